@@ -0,0 +1,89 @@
+package fluent
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backoffConfig describes how long to wait between attempts to reconnect
+// to the server. The interval starts at initial, and is multiplied by
+// multiplier after each attempt, up to max. Each interval is then
+// randomized by up to jitter times its length, so that a fleet of clients
+// that lost their connection to the same server at the same time does
+// not reconnect in lockstep.
+//
+// maxRetries is the number of attempts in a row that may fail before the
+// pending messages are given up on. 0 means that we never give up
+type backoffConfig struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	maxRetries int
+}
+
+func defaultBackoff() backoffConfig {
+	return backoffConfig{
+		initial:    100 * time.Millisecond,
+		max:        5 * time.Second,
+		multiplier: 2,
+	}
+}
+
+func (c *backoffConfig) validate() error {
+	if c.initial <= 0 {
+		return errors.Errorf(`invalid initial backoff interval: %s`, c.initial)
+	}
+	if c.max < c.initial {
+		return errors.Errorf(`max backoff interval %s is shorter than initial interval %s`, c.max, c.initial)
+	}
+	if c.multiplier < 1 {
+		return errors.Errorf(`invalid backoff multiplier: %f`, c.multiplier)
+	}
+	if c.jitter < 0 || c.jitter > 1 {
+		return errors.Errorf(`invalid retry jitter factor: %f`, c.jitter)
+	}
+	if c.maxRetries < 0 {
+		return errors.Errorf(`invalid max retries: %d`, c.maxRetries)
+	}
+	return nil
+}
+
+// interval returns how long to wait after the given number of attempts
+// in a row have failed
+func (c *backoffConfig) interval(failures int) time.Duration {
+	d := float64(c.initial)
+	for i := 1; i < failures && d < float64(c.max); i++ {
+		d *= c.multiplier
+	}
+	if d > float64(c.max) {
+		d = float64(c.max)
+	}
+	if c.jitter > 0 {
+		d *= 1 - c.jitter + 2*c.jitter*rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// exhausted reports whether we should give up after the given number of
+// attempts in a row have failed
+func (c *backoffConfig) exhausted(failures int) bool {
+	return c.maxRetries > 0 && failures > c.maxRetries
+}
+
+// wait waits for the interval after the given number of failures, or
+// until ctx is canceled, in which case its error is returned
+func (c *backoffConfig) wait(ctx context.Context, failures int) error {
+	t := time.NewTimer(c.interval(failures))
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
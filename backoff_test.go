@@ -0,0 +1,101 @@
+package fluent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffInterval(t *testing.T) {
+	c := backoffConfig{
+		initial:    100 * time.Millisecond,
+		max:        time.Second,
+		multiplier: 2,
+	}
+
+	var intervals []time.Duration
+	for failures := 1; failures <= 6; failures++ {
+		intervals = append(intervals, c.interval(failures))
+	}
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	if !assert.Equal(t, expected, intervals, "intervals should grow up to the max") {
+		return
+	}
+
+	c.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := c.interval(10)
+		if !assert.True(t, d >= 500*time.Millisecond && d <= 1500*time.Millisecond, "interval should be randomized within the jitter factor (%s)", d) {
+			return
+		}
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	c := backoffConfig{maxRetries: 2}
+	if !assert.False(t, c.exhausted(2), "backoff should not be exhausted before the max retries") {
+		return
+	}
+	if !assert.True(t, c.exhausted(3), "backoff should be exhausted after the max retries") {
+		return
+	}
+
+	c.maxRetries = 0
+	if !assert.False(t, c.exhausted(1000), "backoff without max retries should never be exhausted") {
+		return
+	}
+}
+
+func TestBackoffErrors(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		option Option
+	}{
+		{name: "initial", option: WithBackoff(0, time.Second, 2, 0, 0)},
+		{name: "max", option: WithBackoff(time.Second, time.Millisecond, 2, 0, 0)},
+		{name: "multiplier", option: WithBackoff(time.Millisecond, time.Second, 0.5, 0, 0)},
+		{name: "jitter", option: WithBackoff(time.Millisecond, time.Second, 2, 1.5, 0)},
+		{name: "max retries", option: WithBackoff(time.Millisecond, time.Second, 2, 0, -1)},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newMinion(tc.option)
+			if !assert.Error(t, err, "newMinion should fail") {
+				return
+			}
+		})
+	}
+}
+
+func TestBackoffRetryJitter(t *testing.T) {
+	// WithRetryJitter is not undone by a WithBackoff that comes after it
+	for _, options := range [][]Option{
+		{WithRetryJitter(0.5), WithBackoff(time.Millisecond, time.Second, 2, 0, 0)},
+		{WithBackoff(time.Millisecond, time.Second, 2, 0.1, 0), WithRetryJitter(0.5)},
+	} {
+		m, err := newMinion(options...)
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return
+		}
+		if !assert.Equal(t, 0.5, m.backoff.jitter, "jitter should be the one of WithRetryJitter") {
+			return
+		}
+		if !assert.Equal(t, time.Millisecond, m.backoff.initial, "initial interval should be the one of WithBackoff") {
+			return
+		}
+	}
+
+	_, err := newMinion(WithBackoff(time.Millisecond, time.Second, 2, 0, 0), WithRetryJitter(1.5))
+	if !assert.Error(t, err, "newMinion should fail") {
+		return
+	}
+}
@@ -0,0 +1,218 @@
+package fluent
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxBatchSize is the number of bytes that a writer claims from the
+// pending buffer at once when there are several connections. A batch
+// always holds at least one message, however large
+const maxBatchSize = 64 * 1024
+
+// With several connections, each writer claims a batch of messages from
+// the head of the pending buffer, and writes it without holding
+// muPending, so that the other writers can claim the following batches
+// in the meantime. The claimed bytes still count against the buffer
+// limit until the batch has been released. Whatever could not be written
+// is put back at the head of the pending buffer, to be claimed again,
+// possibly by another writer. Messages are therefore not guaranteed to
+// reach the server in the order in which they were posted.
+type batch struct {
+	data   []byte
+	frames []pendingFrame
+}
+
+// claimBatch removes a batch from the head of the pending buffer. nil is
+// returned if there is nothing to claim
+func (m *minion) claimBatch() *batch {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	if len(m.pendingFrames) == 0 {
+		return nil
+	}
+
+	// Batches are no larger than a chunk, if chunks are limited, so that
+	// the chunks are spread over the connections. A chunk that is to be
+	// sent again is never split (see encodeChunk)
+	limit := maxBatchSize
+	if m.protocolMode != protocolMessage && m.chunkSizeLimit > 0 && m.chunkSizeLimit < limit {
+		limit = m.chunkSizeLimit
+	}
+	var size, count, chunkEnd int
+	for i, frame := range m.pendingFrames {
+		if count > 0 && size+frame.size > limit && i >= chunkEnd {
+			break
+		}
+		if frame.sentChunk != "" {
+			chunkEnd = i + frame.sentFrames
+		}
+		size += frame.size
+		count++
+	}
+
+	b := &batch{
+		data:   append([]byte(nil), m.pending[:size]...),
+		frames: append([]pendingFrame(nil), m.pendingFrames[:count]...),
+	}
+	m.inflight += size
+	m.batches[b] = struct{}{}
+	m.pending = m.pending[size:]
+	m.pendingFrames = m.pendingFrames[count:]
+	if len(m.pending) == 0 {
+		m.pending = m.buffer[0:0]
+		m.pendingFrames = m.pendingFrames[0:0]
+	}
+	return b
+}
+
+// releaseBatch notifies the callers waiting for the first n frames of b,
+// which have been written, and puts the rest back at the head of the
+// pending buffer
+func (m *minion) releaseBatch(b *batch, n int) {
+	defer m.cond.Broadcast()
+
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	var written int
+	for _, frame := range b.frames[:n] {
+		written += frame.size
+		if _, ok := m.tagBufferLimits[frame.tag]; ok {
+			m.tagPending[frame.tag] -= frame.size
+		}
+		notifyFlush(frame.flushCh, nil)
+	}
+	m.counters.addFlushed(n)
+	m.inflight -= len(b.data)
+	delete(m.batches, b)
+	defer m.spaceCond.Broadcast()
+
+	rest := b.data[written:]
+	if len(rest) == 0 {
+		return
+	}
+	m.logger.Debug("putting back unwritten messages", "bytes", len(rest))
+
+	if len(m.pending) == 0 {
+		m.pendingSince = time.Now()
+	}
+
+	// Make room at the head of the pending buffer. copy handles the
+	// overlap when the pending data moves within the same array
+	total := len(rest) + len(m.pending)
+	if cap(m.buffer) < total {
+		m.buffer = make([]byte, 0, total)
+	}
+	buf := m.buffer[:total]
+	copy(buf[len(rest):], m.pending)
+	copy(buf, rest)
+	m.pending = buf
+
+	m.pendingFrames = append(append([]pendingFrame(nil), b.frames[n:]...), m.pendingFrames...)
+}
+
+// failBatchChunk is failChunk for the chunk of b that starts with its
+// frame at index first, and at offset in its data. If the chunk is to be
+// dropped, it is removed from b, so that it is not put back
+func (m *minion) failBatchChunk(b *batch, first, offset, size, count int, err error) {
+	if m.maxRetries == 0 {
+		return
+	}
+
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	if !m.chunkExhausted(&b.frames[first], err) {
+		return
+	}
+	err = errors.Wrap(err, `chunk dropped after too many failed attempts`)
+	m.dropChunk(b.frames[first:first+count], b.data[offset:offset+size], err)
+	b.frames = append(b.frames[:first], b.frames[first+count:]...)
+	b.data = append(b.data[:offset], b.data[offset+size:]...)
+	m.inflight -= size
+}
+
+// flushBatches claims batches from the pending buffer and writes them to
+// conn, until there is nothing left to claim
+func (m *minion) flushBatches(conn net.Conn, acks chan ackResponse, connClosed <-chan struct{}, target writeTarget) error {
+	for {
+		b := m.claimBatch()
+		if b == nil {
+			return nil
+		}
+
+		if err := m.writeBatch(conn, b, acks, connClosed, target); err != nil {
+			return err
+		}
+
+		if m.isFlushAborted() {
+			return errors.New(`flush aborted`)
+		}
+	}
+}
+
+// writeBatch writes b to conn, and releases it. Like flushPending and
+// flushChunks, only the messages that have been written in their
+// entirety (and acknowledged, if acks are required) are removed
+func (m *minion) writeBatch(conn net.Conn, b *batch, acks chan ackResponse, connClosed <-chan struct{}, target writeTarget) error {
+	var done int // frames that have been written
+	defer func() { m.releaseBatch(b, done) }()
+
+	m.logger.Debug("writing batch", "bytes", len(b.data), "messages", len(b.frames))
+
+	// Messages are written as they are, so the whole batch can be
+	// written at once
+	if m.protocolMode == protocolMessage && !m.requireAck {
+		appended := b.frames[0].appended
+		finish := m.traceWrite(target, "", len(b.frames), len(b.data))
+		setWriteDeadline(conn, m.writeTimeout)
+		n, err := writeAll(conn, b.data)
+		finish(err)
+		var written int
+		for done < len(b.frames) && written+b.frames[done].size <= n {
+			written += b.frames[done].size
+			done++
+		}
+		if err != nil {
+			return errors.Wrap(err, `failed to write data to conn`)
+		}
+		m.counters.observeWrite(time.Since(appended))
+		return nil
+	}
+
+	var offset int
+	for done < len(b.frames) {
+		buf, size, count, chunk, err := m.encodeChunk(b.data[offset:], b.frames[done:])
+		if err != nil {
+			return errors.Wrap(err, `failed to encode chunk`)
+		}
+		appended := b.frames[done].appended
+		finish := m.traceWrite(target, chunk, count, len(buf))
+		setWriteDeadline(conn, m.writeTimeout)
+		if _, err := writeAll(conn, buf); err != nil {
+			finish(err)
+			m.failBatchChunk(b, done, offset, size, count, err)
+			return errors.Wrap(err, `failed to write data to conn`)
+		}
+
+		if m.requireAck {
+			if err := m.waitAck(chunk, acks, connClosed); err != nil {
+				m.logger.Warn("failed to receive ack", "chunk", chunk, "error", err)
+				finish(err)
+				m.reportServerError(err, b.frames[done].tag)
+				m.failBatchChunk(b, done, offset, size, count, err)
+				return err
+			}
+		}
+		finish(nil)
+		m.counters.observeWrite(time.Since(appended))
+
+		offset += size
+		done += count
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package fluent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchRelease(t *testing.T) {
+	m, err := newMinion(WithConnections(2))
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+
+	flushChs := make([]chan error, 3)
+	for i, s := range []string{"aaa", "bb", "c"} {
+		flushChs[i] = make(chan error, 1)
+		m.pending = append(m.pending, s...)
+		m.pendingFrames = append(m.pendingFrames, pendingFrame{size: len(s), flushCh: flushChs[i]})
+	}
+
+	b := m.claimBatch()
+	if !assert.NotNil(t, b, "claimBatch should return a batch") {
+		return
+	}
+	if !assert.Equal(t, "aaabbc", string(b.data), "batch should hold all pending data") {
+		return
+	}
+	if !assert.Empty(t, m.pending, "pending buffer should be empty") {
+		return
+	}
+	if !assert.Equal(t, 6, m.inflight, "claimed bytes should be in flight") {
+		return
+	}
+
+	// Something new comes in while the batch is being written
+	m.pending = append(m.pending, "dd"...)
+	m.pendingFrames = append(m.pendingFrames, pendingFrame{size: 2})
+
+	m.releaseBatch(b, 1)
+	if !assert.NoError(t, <-flushChs[0], "written message should be notified") {
+		return
+	}
+	if !assert.Equal(t, "bbcdd", string(m.pending), "unwritten data should be put back at the head") {
+		return
+	}
+	if !assert.Len(t, m.pendingFrames, 3, "unwritten frames should be put back at the head") {
+		return
+	}
+	if !assert.Equal(t, flushChs[1], m.pendingFrames[0].flushCh, "frames should stay in order") {
+		return
+	}
+	if !assert.Zero(t, m.inflight, "nothing should be in flight") {
+		return
+	}
+}
@@ -0,0 +1,113 @@
+package fluent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker keeps us from piling up messages for a server that has
+// been down for a while. After threshold attempts in a row have failed to
+// reach the server, the circuit opens, and messages are rejected right
+// away. Once cooldown has elapsed, the circuit is half-open: a single
+// message is let through to probe the server. If it makes it, the
+// circuit closes again, otherwise it opens for another cooldown.
+//
+// A nil *circuitBreaker is always closed
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    Logger
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probedAt time.Time
+	state    int
+}
+
+// newCircuitBreaker returns nil if the circuit breaker has not been
+// enabled (see WithCircuitBreaker)
+func newCircuitBreaker(c *circuitBreakerConfig, logger Logger) (*circuitBreaker, error) {
+	if c == nil || c.threshold == 0 {
+		return nil, nil
+	}
+	if c.threshold < 0 {
+		return nil, errors.Errorf(`invalid circuit breaker threshold: %d`, c.threshold)
+	}
+	if c.cooldown <= 0 {
+		return nil, errors.Errorf(`invalid circuit breaker cooldown: %s`, c.cooldown)
+	}
+
+	return &circuitBreaker{
+		threshold: c.threshold,
+		cooldown:  c.cooldown,
+		logger:    logger,
+	}, nil
+}
+
+// allow reports whether a message may be sent to the server
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.logger.Info("circuit breaker half-open, probing server")
+		b.state = circuitHalfOpen
+		b.probedAt = time.Now()
+		return true
+	case circuitHalfOpen:
+		// Only one probe at a time, unless the last one never got to
+		// the server, e.g. because the buffer was full
+		if time.Since(b.probedAt) < b.cooldown {
+			return false
+		}
+		b.probedAt = time.Now()
+		return true
+	}
+	return true
+}
+
+// record records the outcome of an attempt to write to the server, and
+// reports whether it caused the circuit to open
+func (b *circuitBreaker) record(err error) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != circuitClosed {
+			b.logger.Info("circuit breaker closed")
+		}
+		b.failures = 0
+		b.state = circuitClosed
+		return false
+	}
+
+	b.failures++
+	if b.state == circuitHalfOpen || (b.state == circuitClosed && b.failures >= b.threshold) {
+		b.logger.Warn("circuit breaker open", "failures", b.failures, "error", err)
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		return true
+	}
+	return false
+}
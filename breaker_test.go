@@ -0,0 +1,73 @@
+package fluent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	b, err := newCircuitBreaker(&circuitBreakerConfig{threshold: 2, cooldown: 50 * time.Millisecond}, nopLogger{})
+	if !assert.NoError(t, err, "newCircuitBreaker should succeed") {
+		return
+	}
+
+	failure := errors.New("connection refused")
+	if !assert.False(t, b.record(failure), "circuit should stay closed below the threshold") {
+		return
+	}
+	if !assert.True(t, b.allow(), "closed circuit should allow messages") {
+		return
+	}
+	if !assert.True(t, b.record(failure), "circuit should open at the threshold") {
+		return
+	}
+	if !assert.False(t, b.allow(), "open circuit should reject messages") {
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !assert.True(t, b.allow(), "circuit should let a probe through after the cooldown") {
+		return
+	}
+	if !assert.False(t, b.allow(), "circuit should only let one probe through") {
+		return
+	}
+	if !assert.True(t, b.record(failure), "failed probe should open the circuit again") {
+		return
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if !assert.True(t, b.allow(), "circuit should let a probe through after the cooldown") {
+		return
+	}
+	b.record(nil)
+	if !assert.True(t, b.allow(), "successful probe should close the circuit") {
+		return
+	}
+	if !assert.False(t, b.record(failure), "failures should start over once the circuit closes") {
+		return
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b, err := newCircuitBreaker(nil, nopLogger{})
+	if !assert.NoError(t, err, "newCircuitBreaker should succeed") {
+		return
+	}
+	if !assert.Nil(t, b, "circuit breaker should be disabled") {
+		return
+	}
+	if !assert.True(t, b.allow(), "disabled circuit breaker should allow messages") {
+		return
+	}
+
+	for _, c := range []*circuitBreakerConfig{{threshold: -1, cooldown: time.Second}, {threshold: 1}} {
+		_, err := newCircuitBreaker(c, nopLogger{})
+		if !assert.Error(t, err, "newCircuitBreaker should fail with %#v", c) {
+			return
+		}
+	}
+}
@@ -2,69 +2,171 @@ package fluent
 
 import (
 	"context"
+	"io"
 	"time"
 
-	pdebug "github.com/lestrrat/go-pdebug"
 	"github.com/pkg/errors"
 )
 
 // NewBuffered creates a new Buffered client.
 // Options may be one of the following:
 //
+//   * fluent.WithAckTimeout
 //   * fluent.WithAddress
+//   * fluent.WithAddresses
+//   * fluent.WithBackoff
+//   * fluent.WithBuffer
+//   * fluent.WithBufferFile
 //   * fluent.WithBufferLimit
+//   * fluent.WithCircuitBreaker
+//   * fluent.WithClock
+//   * fluent.WithClientCertificate
+//   * fluent.WithCompression
+//   * fluent.WithCompressor
+//   * fluent.WithConn
+//   * fluent.WithConnFactory
+//   * fluent.WithConnections
+//   * fluent.WithConnectHook
+//   * fluent.WithCopyRecords
+//   * fluent.WithDialFunc
 //   * fluent.WithDialTimeout
+//   * fluent.WithDrainOnClose
+//   * fluent.WithErrorHandler
+//   * fluent.WithExpvar
+//   * fluent.WithFallbackInterval
+//   * fluent.WithHeartbeatInterval
+//   * fluent.WithHeartbeatThreshold
+//   * fluent.WithFlushInterval
+//   * fluent.WithInitialBuffer
 //   * fluent.WithJSONMarshaler
+//   * fluent.WithLengthPrefix
+//   * fluent.WithLoadBalancing
+//   * fluent.WithLogger
 //   * fluent.WithMaxConnAttempts
+//   * fluent.WithMaxConnLifetime
 //   * fluent.WithMsgpackMarshaler
 //   * fluent.WithNetwork
+//   * fluent.WithNonBlocking
+//   * fluent.WithOnConnect
+//   * fluent.WithOnDisconnect
+//   * fluent.WithOnDrop
+//   * fluent.WithOnReconnect
+//   * fluent.WithOverflowPolicy
+//   * fluent.WithPassword
+//   * fluent.WithPostTimeout
+//   * fluent.WithProtocolMode
+//   * fluent.WithProxy
+//   * fluent.WithRecordModifier
+//   * fluent.WithRequireAck
+//   * fluent.WithSelfHostname
+//   * fluent.WithSendBufferSize
+//   * fluent.WithServerWeight
+//   * fluent.WithSharedKey
+//   * fluent.WithSRV
+//   * fluent.WithRetryJitter
+//   * fluent.WithRetryPolicy
+//   * fluent.WithTagBufferLimit
 //   * fluent.WithTagPrefix
+//   * fluent.WithTCPKeepAlive
+//   * fluent.WithTCPNoDelay
+//   * fluent.WithTimestampExtractor
+//   * fluent.WithTimestampResolution
+//   * fluent.WithTLSConfig
+//   * fluent.WithUsername
 //   * fluent.WithWriteThreshold
+//   * fluent.WithWriteDeadline
 //   * fluent.WithWriteQueueSize
+//   * fluent.WithWriteTracer
 //
 // Please see their respective documentation for details.
 func NewBuffered(options ...Option) (client *Buffered, err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("fluent.NewBuffered").BindError(&err)
-		defer g.End()
-	}
 	m, err := newMinion(options...)
 	if err != nil {
 		return nil, err
 	}
 
 	var c Buffered
+	var expvarName string
+	c.clock = time.Now
+	c.closing = make(chan struct{})
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var subsecond bool
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeySubSecond:
-			subsecond = opt.Value().(bool)
+			c.resolution = resolutionFromSubsecond(opt.Value().(bool))
+		case optkeyTimestampResolution:
+			c.resolution = opt.Value().(TimestampResolution)
+		case optkeyCopyRecords:
+			c.copyRecords = opt.Value().(bool)
+		case optkeyDrainOnClose:
+			c.drainOnClose = opt.Value().(time.Duration)
+		case optkeyNonBlocking:
+			c.nonBlocking = opt.Value().(bool)
+		case optkeyPostTimeout:
+			c.postTimeout = opt.Value().(time.Duration)
+		case optkeyTimestampExtractor:
+			c.timeExtractor = opt.Value().(func(interface{}) (time.Time, bool))
+		case optkeyClock:
+			c.clock = opt.Value().(func() time.Time)
+		case optkeyExpvar:
+			expvarName = opt.Value().(string)
 		}
 	}
+	c.breaker = m.breaker
+	c.logger = m.logger
+	warnSubsecondFallback(c.logger, c.resolution)
+	c.minionAbort = m.flushCancel
 	c.minionDone = m.done
+	c.minionConnected = m.isConnected
+	c.minionErrors = m.errorCh
+	c.minionLastError = m.getLastError
+	c.minionStats = m.stats
+	c.minionUnflushed = m.unflushed
 	c.minionQueue = m.incoming
 	c.minionCancel = cancel
 	c.pingQueue = m.pingCh
-	c.subsecond = subsecond
+	c.flushQueue = m.flushRequests
+
+	if expvarName != "" {
+		if err := publishExpvar(expvarName, c.Stats); err != nil {
+			cancel()
+			m.closeStore(err)
+			return nil, err
+		}
+	}
 
 	go m.runReader(ctx)
 	go m.runWriter(ctx)
+	if m.heartbeat != nil {
+		go m.heartbeat.run(ctx, m.servers.targets)
+	}
 
 	return &c, nil
 }
 
 // Post posts the given structure after encoding it along with the given tag.
 //
-// An error is returned if the client has already been closed.
+// An error is returned if the client has already been closed. You can
+// check for this using fluent.IsClientClosed. A message that has been
+// accepted by Post before Close() or Shutdown() is called is flushed
+// along with the rest of the pending buffer.
 //
 // If you would like to specify options to `Post()`, you may pass them at the end of
 // the method. Currently you can use the following:
 //
 //   fluent.WithContext: specify context.Context to use
 //   fluent.WithTimestamp: allows you to set arbitrary timestamp values
+//   fluent.WithTimestampResolution: specifies the granularity of the timestamp
 //   fluent.WithSyncAppend: allows you to verify if the append was successful
+//   fluent.WithForwardOption: adds an entry to the message option map
+//   fluent.WithCopyRecords: copies the record before handing it to the writer
+//   fluent.WithNonBlocking: fails with ErrQueueFull instead of waiting for room in the queue
+//   fluent.WithPostTimeout: bounds the time that Post may block
+//
+// If the overflow policy is "block" (see WithOverflowPolicy), Post blocks
+// while the pending buffer is full. Use fluent.WithContext to bound the
+// wait.
 //
 // If fluent.WithSyncAppend is provide and is true, the following errors
 // may be returned:
@@ -74,51 +176,224 @@ func NewBuffered(options ...Option) (client *Buffered, err error) {
 //   2. If the marshaling into msgpack/json failed, it is returned
 //
 func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("fluent.Buffered.Post").BindError(&err)
-		defer g.End()
+	return c.post(tag, v, nil, options...)
+}
+
+// PostWithContext is the same as Post with WithContext(ctx): both handing
+// the message to the background writer and waiting for the result of
+// WithSyncAppend give up once ctx is canceled.
+func (c *Buffered) PostWithContext(ctx context.Context, tag string, v interface{}, options ...Option) (err error) {
+	return c.post(tag, v, nil, append(options[:len(options):len(options)], WithContext(ctx))...)
+}
+
+// PostRaw posts a record that has already been serialized (see
+// RawRecord), skipping the marshaling step. It is the same as Post with
+// RawRecord(raw) and WithTimestamp(t). If t is the zero value, the
+// current time is used. raw is copied, as the message is serialized in
+// the background, so it may be reused once PostRaw returns.
+func (c *Buffered) PostRaw(tag string, t time.Time, raw []byte, options ...Option) (err error) {
+	if len(raw) == 0 {
+		return errors.New(`empty raw record`)
 	}
-	// Do not allow processing at all if we have closed
-	c.muClosed.RLock()
-	defer c.muClosed.RUnlock()
+	return c.post(tag, RawRecord(append([]byte(nil), raw...)), nil, append(options[:len(options):len(options)], WithTimestamp(t))...)
+}
 
-	if c.closed {
-		return errors.New(`client has already been closed`)
+// Writer returns an io.WriteCloser that posts each line that is written
+// to it as a record of the form {"message": line}, using the given tag
+// and options. fluent.WithWriterFields adds fields to every record. The
+// writer can be given to log.SetOutput, for example. Closing it posts the
+// last line, if it was not terminated by a newline, but does not close
+// the client.
+func (c *Buffered) Writer(tag string, options ...Option) io.WriteCloser {
+	return newLineWriter(c, tag, options)
+}
+
+// PostAll posts several messages at once. They are handed to the
+// background writer as a unit, which saves going through the queue and
+// locking the buffer for each of them. The entries whose record cannot be
+// serialized are dropped, and the others are either all appended to the
+// buffer, or none of them is. With WithSyncAppend(true), the entries that
+// were dropped are described by a *BatchError, which maps their indices
+// to their errors. In the forward modes (see WithProtocolMode),
+// consecutive entries with the same tag are sent to the server in a
+// single request.
+//
+// The same options as Post may be specified, except for WithTimestamp,
+// as each entry has its own.
+func (c *Buffered) PostAll(entries []Entry, options ...Option) (err error) {
+	if len(entries) == 0 {
+		return nil
 	}
 
-	var syncAppend bool
-	var subsecond = c.subsecond
-	var t time.Time
-	var ctx = context.Background()
+	cfg, err := c.postConfig(options)
+	if err != nil {
+		return err
+	}
+	if cfg.postTimeout > 0 {
+		var cancel context.CancelFunc
+		cfg.ctx, cancel = context.WithTimeout(cfg.ctx, cfg.postTimeout)
+		defer cancel()
+	}
+
+	now := c.clock()
+	batch := getMessage()
+	if cfg.syncAppend {
+		batch.replyCh = make(chan error, 1)
+	}
+	batch.batch = make([]*Message, len(entries))
+	for i, entry := range entries {
+		v := entry.Record
+		t := entry.Time
+		if f := c.timeExtractor; f != nil {
+			if extracted, ok := f(v); ok {
+				t = extracted
+			}
+		}
+		if t.IsZero() {
+			t = now
+		}
+		if cfg.copyRecords {
+			v = copyRecord(v)
+		}
+
+		msg := makeMessage(entry.Tag, v, t, cfg.resolution, false)
+		if cfg.fwdOptions != nil {
+			// Each message gets its own map, as the chunk ID may be
+			// added to it
+			fwdOptions := make(map[string]interface{}, len(cfg.fwdOptions))
+			for k, v := range cfg.fwdOptions {
+				fwdOptions[k] = v
+			}
+			msg.Option = fwdOptions
+		}
+		batch.batch[i] = msg
+	}
+	return c.enqueue(batch, cfg)
+}
+
+// PostAsync posts the given structure just like Post, but also returns a
+// Result, which can be used to wait for the message to be appended to the
+// buffer, and written to the server, without blocking the caller of
+// PostAsync.
+//
+// The same options as Post may be specified. An error is returned only if
+// the message could not be handed to the background writer.
+func (c *Buffered) PostAsync(tag string, v interface{}, options ...Option) (result *Result, err error) {
+	result = newResult()
+	if err := c.post(tag, v, result, options...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Buffered) post(tag string, v interface{}, result *Result, options ...Option) (err error) {
+	cfg, err := c.postConfig(options)
+	if err != nil {
+		return err
+	}
+	if cfg.postTimeout > 0 {
+		var cancel context.CancelFunc
+		cfg.ctx, cancel = context.WithTimeout(cfg.ctx, cfg.postTimeout)
+		defer cancel()
+	}
+
+	t := cfg.timestamp
+	if f := c.timeExtractor; f != nil {
+		if extracted, ok := f(v); ok {
+			t = extracted
+		}
+	}
+	if t.IsZero() {
+		t = c.clock()
+	}
+
+	if cfg.copyRecords {
+		v = copyRecord(v)
+	}
+
+	msg := makeMessage(tag, v, t, cfg.resolution, cfg.syncAppend && result == nil)
+	if cfg.fwdOptions != nil {
+		msg.Option = cfg.fwdOptions
+	}
+	if result != nil {
+		// The result is notified of both the outcome of appending the
+		// message, and the outcome of writing it
+		msg.replyCh = result.appended
+		msg.flushCh = result.ch
+	}
+	return c.enqueue(msg, cfg)
+}
+
+// postConfig holds the options given to Post, on top of the defaults of
+// the client
+type postConfig struct {
+	copyRecords bool
+	ctx         context.Context
+	fwdOptions  map[string]interface{}
+	nonBlocking bool
+	postTimeout time.Duration
+	resolution  TimestampResolution
+	syncAppend  bool
+	timestamp   time.Time
+}
+
+func (c *Buffered) postConfig(options []Option) (*postConfig, error) {
+	cfg := postConfig{
+		copyRecords: c.copyRecords,
+		ctx:         context.Background(),
+		nonBlocking: c.nonBlocking,
+		postTimeout: c.postTimeout,
+		resolution:  c.resolution,
+	}
 	for _, opt := range options {
 		switch opt.Name() {
+		case optkeyForwardOption:
+			var err error
+			cfg.fwdOptions, err = addForwardOption(cfg.fwdOptions, opt.Value().(*forwardOption))
+			if err != nil {
+				return nil, errors.Wrap(err, `invalid option`)
+			}
 		case optkeyTimestamp:
-			t = opt.Value().(time.Time)
+			cfg.timestamp = opt.Value().(time.Time)
 		case optkeySyncAppend:
-			syncAppend = opt.Value().(bool)
+			cfg.syncAppend = opt.Value().(bool)
 		case optkeySubSecond:
-			subsecond = opt.Value().(bool)
+			cfg.resolution = resolutionFromSubsecond(opt.Value().(bool))
+		case optkeyTimestampResolution:
+			cfg.resolution = opt.Value().(TimestampResolution)
+		case optkeyCopyRecords:
+			cfg.copyRecords = opt.Value().(bool)
+		case optkeyNonBlocking:
+			cfg.nonBlocking = opt.Value().(bool)
+		case optkeyPostTimeout:
+			cfg.postTimeout = opt.Value().(time.Duration)
 		case optkeyContext:
-			if pdebug.Enabled {
-				pdebug.Printf("client: using user-supplied context")
-			}
-			ctx = opt.Value().(context.Context)
+			cfg.ctx = opt.Value().(context.Context)
 		}
 	}
-	if t.IsZero() {
-		t = time.Now()
+	return &cfg, nil
+}
+
+// enqueue hands msg to the background reader, and waits for the outcome
+// of appending it if WithSyncAppend was specified
+func (c *Buffered) enqueue(msg *Message, cfg *postConfig) error {
+	// Do not allow processing at all if we have closed. The read lock is
+	// held until the message has been handed to the minion, so that
+	// close() can't close the queue while we are sending to it
+	c.muClosed.RLock()
+	defer c.muClosed.RUnlock()
+
+	if c.closed {
+		return &clientClosedErrInstance
 	}
 
-	msg := makeMessage(tag, v, t, subsecond, syncAppend)
+	if !c.breaker.allow() {
+		return &circuitOpenErrInstance
+	}
 
 	// This has to be separate from msg.replyCh, b/c msg would be
 	// put back to the pool
 	var replyCh = msg.replyCh
-	if syncAppend {
-		if pdebug.Enabled {
-			pdebug.Printf("client: synchronous append requested. creating channel")
-		}
-	}
 
 	// Because case statements in a select is evaluated in random
 	// order, writing to c.minionQueue in the subsequent select
@@ -126,36 +401,41 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 	//
 	// This extra check ensures that if the context is canceled
 	// well in advance, we never get into the ambiguous situation
+	ctx := cfg.ctx
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-c.minionDone:
-		return errors.New("writer has been closed. Shutdown called?")
-	case c.minionQueue <- msg:
-		if pdebug.Enabled {
-			pdebug.Printf("client: wrote message to queue")
+	if cfg.nonBlocking {
+		select {
+		case c.minionQueue <- msg:
+		default:
+			c.logger.Warn("queue is full, rejecting message", "tag", msg.Tag)
+			return &queueFullErrInstance
+		}
+	} else {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.minionDone:
+			return &clientClosedErrInstance
+		case <-c.closing:
+			// The queue may be full for a while if the overflow policy is
+			// "block", and close() can't proceed until we let go of muClosed
+			return &clientClosedErrInstance
+		case c.minionQueue <- msg:
 		}
 	}
 
-	if syncAppend {
-		if pdebug.Enabled {
-			pdebug.Printf("client: Post is waiting for return status")
-		}
+	if cfg.syncAppend {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-c.minionDone:
-			return errors.New("writer has been closed. Shutdown called?")
+			return &clientClosedErrInstance
 		case e := <-replyCh:
-			if pdebug.Enabled {
-				pdebug.Printf("client: synchronous result received")
-			}
 			return e
 		}
 	}
@@ -163,10 +443,25 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 	return nil
 }
 
-// Close closes the connection, but does not wait for the pending buffers
+// Close closes the connection, and notifies the background worker to
+// flush all existing buffers, but does not wait for the pending buffers
 // to be flushed. If you want to make sure that background minion has properly
 // exited, you should probably use the Shutdown() method
+//
+// If the client was created with the WithDrainOnClose option, Close
+// behaves like Shutdown with the specified timeout.
 func (c *Buffered) Close() error {
+	if c.drainOnClose > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), c.drainOnClose)
+		defer cancel()
+		return c.Shutdown(ctx)
+	}
+	return c.close()
+}
+
+func (c *Buffered) close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+
 	c.muClosed.Lock()
 	c.closed = true
 	if c.minionQueue != nil {
@@ -186,77 +481,182 @@ func (c *Buffered) Close() error {
 // Shutdown closes the connection, and notifies the background worker to
 // flush all existing buffers. This method will block until the
 // background minion exits, or the provided context object is canceled.
+//
+// If the context is canceled before the pending buffers have been flushed,
+// the background worker is told to give up flushing, and any data that
+// has not been written yet is discarded. The error returned in this case
+// is an *UnflushedError, which reports what was discarded.
 func (c *Buffered) Shutdown(ctx context.Context) error {
-	if pdebug.Enabled {
-		pdebug.Printf("client: shutdown requested")
-		defer pdebug.Printf("client: shutdown completed")
-	}
+	c.logger.Debug("shutdown requested")
+	defer c.logger.Debug("shutdown completed")
 
 	if ctx == nil {
 		ctx = context.Background() // no cancel...
 	}
 
-	if err := c.Close(); err != nil {
+	if err := c.close(); err != nil {
 		return errors.Wrap(err, `failed to close`)
 	}
 
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		// The messages are collected before the writer is told to give
+		// up, as it discards them right away
+		leftover := c.minionUnflushed()
+		c.minionAbort()
+		return newUnflushedError(ctx.Err(), leftover)
 	case <-c.minionDone:
 		return nil
 	}
 }
 
+// LastError returns the error from the most recent attempt made by the
+// background writer to connect to or write to the server. If the most
+// recent write succeeded, nil is returned.
+//
+// This is meant to be used for simple health checks that poll the client.
+// Note that a nil value does not mean that all messages have been written.
+func (c *Buffered) LastError() error {
+	return c.minionLastError()
+}
+
+// Stats returns a snapshot of the activity of the client. Queued is the
+// number of messages that are waiting in the queue for the background
+// writer (see WithWriteQueueSize), and PendingBytes is the size of the
+// messages that it holds in memory, including the ones being written,
+// which InflightBytes is the size of.
+//
+// Posted counts the messages that reached the background writer, whether
+// or not they could be appended to the buffer, and Dropped those that
+// never will be written: the ones that could not be serialized or did not
+// fit in the buffer, and the ones that were discarded from the buffer.
+func (c *Buffered) Stats() Stats {
+	return c.minionStats()
+}
+
+// Errors returns a channel that receives the messages that could not be
+// written to the server, along with the reason. These are the same
+// failures that are passed to the error handler (see WithErrorHandler)
+// with a message, such as messages that could not be serialized, or that
+// were dropped from a full buffer, as well as the error replies of the
+// server to the chunks that it rejected (see ServerError), with the tag
+// of the chunk.
+//
+// The channel holds a limited number of errors. When it is full, further
+// errors are dropped rather than blocking the background writer, so the
+// channel should be drained continuously, for example:
+//
+//   go func() {
+//     for perr := range client.Errors() {
+//       log.Printf("dropped message for %s: %s", perr.Tag, perr.Err)
+//     }
+//   }()
+//
+// The channel is closed when the background writer exits, after Close
+// or Shutdown.
+func (c *Buffered) Errors() <-chan PostError {
+	return c.minionErrors
+}
+
+// Flush makes the background writer write all the messages that have been
+// posted so far, without waiting for the write threshold (see
+// WithWriteThreshold) or the flush interval to be reached, and waits until
+// the pending buffer is empty, or the context is canceled. Unlike
+// Shutdown, the client can still be used afterwards.
+//
+// Messages that are posted while Flush is waiting are flushed too, so
+// Flush may not return while messages keep coming in.
+func (c *Buffered) Flush(ctx context.Context) (err error) {
+	ch := make(chan error, 1)
+
+	c.muClosed.RLock()
+	if c.closed {
+		c.muClosed.RUnlock()
+		return &clientClosedErrInstance
+	}
+	select {
+	case <-ctx.Done():
+		c.muClosed.RUnlock()
+		return ctx.Err()
+	case <-c.closing:
+		c.muClosed.RUnlock()
+		return &clientClosedErrInstance
+	case c.flushQueue <- ch:
+	}
+	c.muClosed.RUnlock()
+
+	// The writer notifies us even if it exits before the buffer could
+	// be flushed
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-ch:
+		return err
+	}
+}
+
+// IsConnected reports whether the background writer currently has a
+// connection to the server. The writer only connects when there is
+// something to write, so this is false until the first message has been
+// posted, unless the server is unreachable. For an active check, use Ping.
+//
+// Over http and datagram networks, there is no connection to speak of,
+// and false is always returned. Use LastError instead.
+func (c *Buffered) IsConnected() bool {
+	return c.minionConnected()
+}
+
 // Ping synchronously sends a ping message. This ping bypasses the underlying
 // buffer of pending messages, and establishes a connection to the
-// server entirely for this ping message.
+// server entirely for this ping message. If a shared key has been
+// specified, this includes the handshake, during which the server
+// has to answer our PING.
 func (c *Buffered) Ping(tag string, record interface{}, options ...Option) (err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("Buffered.Ping").BindError(&err)
-		defer g.End()
-	}
-
 	var ctx = context.Background()
-	var subsecond bool
+	var resolution TimestampResolution
 	var t time.Time
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeySubSecond:
-			subsecond = opt.Value().(bool)
+			resolution = resolutionFromSubsecond(opt.Value().(bool))
+		case optkeyTimestampResolution:
+			resolution = opt.Value().(TimestampResolution)
 		case optkeyTimestamp:
 			t = opt.Value().(time.Time)
 		case optkeyContext:
-			if pdebug.Enabled {
-				pdebug.Printf("client: using user-supplied context")
-			}
 			ctx = opt.Value().(context.Context)
 		}
 	}
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock()
 	}
 
-	msg := makeMessage(tag, record, t, subsecond, true)
+	msg := makeMessage(tag, record, t, resolution, true)
 
 	// Do not allow processing at all if we have closed
 	c.muClosed.RLock()
 	if c.closed {
 		c.muClosed.RUnlock()
-		return errors.New(`client has already been closed`)
+		return &clientClosedErrInstance
 	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("Sending to ping queue")
-	}
 	replyCh := msg.replyCh
 
-	c.pingQueue <- msg
-	c.muClosed.RUnlock()
-
-	if pdebug.Enabled {
-		pdebug.Printf("Waiting for synchronous ping response...")
+	// As in enqueue, we must not wait for the reader while holding
+	// muClosed once we are being closed, or close() can't proceed
+	select {
+	case <-ctx.Done():
+		c.muClosed.RUnlock()
+		return ctx.Err()
+	case <-c.minionDone:
+		c.muClosed.RUnlock()
+		return &clientClosedErrInstance
+	case <-c.closing:
+		c.muClosed.RUnlock()
+		return &clientClosedErrInstance
+	case c.pingQueue <- msg:
 	}
+	c.muClosed.RUnlock()
 
 	select {
 	case <-ctx.Done():
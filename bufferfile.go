@@ -0,0 +1,70 @@
+package fluent
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// BufferFile reads the messages that a buffered client left in its
+// buffer file (see WithBufferFile), so that they can be inspected or
+// salvaged, e.g. after a crash.
+type BufferFile struct {
+	spool  *spool
+	offset int64
+}
+
+// OpenBufferFile opens a buffer file for reading. Only the messages that
+// have not been written to the server are read. The file must not be in
+// use by a client at the same time.
+func OpenBufferFile(path string) (*BufferFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to open buffer file`)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, `failed to open buffer file`)
+	}
+
+	// A file that has just been created may not have a header yet
+	s := &spool{file: f, size: fi.Size()}
+	offset := s.size
+	if s.size >= spoolHeaderSize {
+		offset, err = readSpoolHeader(f, s.size)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, `failed to read buffer file %s`, path)
+		}
+	}
+
+	return &BufferFile{
+		spool:  s,
+		offset: offset,
+	}, nil
+}
+
+// Next returns the next message in the file, or io.EOF once all messages
+// have been read. Any other error means that the rest of the file cannot
+// be read, e.g. because the process crashed while writing the last
+// message.
+func (f *BufferFile) Next() (*BufferedMessage, error) {
+	if f.offset >= f.spool.size {
+		return nil, io.EOF
+	}
+
+	msg, n, err := f.spool.readAt(f.offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to read message at offset %d`, f.offset)
+	}
+	f.offset += int64(n)
+	return msg, nil
+}
+
+// Close closes the file.
+func (f *BufferFile) Close() error {
+	return f.spool.file.Close()
+}
@@ -0,0 +1,70 @@
+package fluent
+
+import (
+	"sync"
+)
+
+// callbackQueueSize is the number of callbacks that may be waiting to be
+// run before the next ones are dropped
+const callbackQueueSize = 1024
+
+// callbackQueue runs the callbacks of the application (see
+// WithErrorHandler, WithOnDrop and RetryPolicy) on a goroutine of its
+// own, one at a time, in the order in which they were queued. The client
+// queues them while holding its locks, so running them right away would
+// deadlock a callback that calls back into the client, and a slow callback
+// would hold up the writer. Instead, when the queue is full, the callbacks
+// are dropped
+type callbackQueue struct {
+	ch      chan func()
+	done    chan struct{}
+	mu      sync.Mutex
+	closed  bool
+	dropped func() // called with each callback that is dropped
+}
+
+func newCallbackQueue(size int, dropped func()) *callbackQueue {
+	q := &callbackQueue{
+		ch:      make(chan func(), size),
+		done:    make(chan struct{}),
+		dropped: dropped,
+	}
+	go q.run()
+	return q
+}
+
+func (q *callbackQueue) run() {
+	defer close(q.done)
+	for f := range q.ch {
+		f()
+	}
+}
+
+// push queues f to be run, unless the queue is full or closed, in which
+// case it is dropped. It never blocks
+func (q *callbackQueue) push(f func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.dropped()
+		return
+	}
+	select {
+	case q.ch <- f:
+	default:
+		q.dropped()
+	}
+}
+
+// close stops accepting callbacks, and waits for the ones already queued
+// to be run
+func (q *callbackQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
@@ -0,0 +1,31 @@
+package fluent
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// Compressor compresses the entries that a buffered client sends in the
+// "packed_forward" protocol mode (see WithCompressor). The fluentd server
+// must be able to decompress them: out of the box, it only understands
+// "gzip", which is built in (see WithCompression)
+type Compressor interface {
+	// Name returns the name of the algorithm, which is sent to the server
+	// as the "compressed" option of each request
+	Name() string
+
+	// NewWriter returns a writer that writes to w what is written to it,
+	// once compressed. It is closed once all of the entries of a request
+	// have been written, and must flush them to w then
+	NewWriter(w io.Writer) io.WriteCloser
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return compressionGzip
+}
+
+func (gzipCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
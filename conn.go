@@ -2,21 +2,365 @@ package fluent
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	msgpack "github.com/lestrrat/go-msgpack"
 	"github.com/pkg/errors"
 )
 
-func dial(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+const defaultPort = "24224"
+
+// parseAddress normalizes the address given by the user so that it can
+// be passed to the dialer. For TCP, the following forms are accepted:
+//
+//   host:port, [IPv6]:port -> used as is
+//   host, IPv6, [IPv6]     -> the default fluentd port (24224) is used
+//
+// Addresses for unix domain sockets and named pipes are file paths, and
+// are returned as is
+func parseAddress(network, address string) (string, error) {
+	if isPathNetwork(network) {
+		return address, nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address, nil
+	}
+
+	host := address
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+
+	if len(host) == 0 || strings.ContainsAny(host, "[]") {
+		return "", errors.Errorf(`invalid address: %s`, strconv.Quote(address))
+	}
+
+	return net.JoinHostPort(host, defaultPort), nil
+}
+
+// isPathNetwork reports whether addresses on the network are file paths
+// rather than host names
+func isPathNetwork(network string) bool {
+	switch network {
+	case "unix", "unixgram", "npipe":
+		return true
+	}
+	return false
+}
+
+// dial connects to the server using the given dial function, or
+// net.Dialer (dialPipe for named pipes) if it is nil. The timeout is applied via the context
+// passed to the dial function, and to the TLS handshake if tlsConfig
+// is non-nil
+func dial(ctx context.Context, dialFunc func(context.Context, string, string) (net.Conn, error), tlsConfig *tls.Config, network, address string, timeout time.Duration) (net.Conn, error) {
+	address, err := parseAddress(network, address)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse address`)
+	}
+
 	connCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	var dialer net.Dialer
-	conn, err := dialer.DialContext(connCtx, network, address)
+	if dialFunc == nil {
+		if network == "npipe" {
+			dialFunc = func(ctx context.Context, _, address string) (net.Conn, error) {
+				return dialPipe(ctx, address)
+			}
+		} else {
+			var dialer net.Dialer
+			dialFunc = dialer.DialContext
+		}
+	}
+
+	conn, err := dialFunc(connCtx, network, address)
 	if err != nil {
 		return nil, errors.Wrap(err, `failed to connect to server`)
 	}
 
+	if tlsConfig != nil {
+		tlsConn, err := startTLS(connCtx, conn, tlsConfig, network, address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
 	return conn, nil
 }
+
+// connOnce returns a dial function that returns conn the first time it is
+// called, and fails from then on, as there is nothing to reconnect to
+func connOnce(conn net.Conn) func(context.Context, string, string) (net.Conn, error) {
+	var mu sync.Mutex
+	return func(_ context.Context, _, _ string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if conn == nil {
+			return nil, errors.New(`connection specified via WithConn has already been used`)
+		}
+		c := conn
+		conn = nil
+		return c, nil
+	}
+}
+
+// startTLS performs the TLS handshake over conn. Unless the configuration
+// specifies otherwise, the host part of the address is used as the server
+// name, for both SNI and certificate verification
+func startTLS(ctx context.Context, conn net.Conn, config *tls.Config, network, address string) (net.Conn, error) {
+	if len(config.ServerName) == 0 && !isPathNetwork(network) {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, errors.Wrap(err, `failed to perform TLS handshake`)
+	}
+	return tlsConn, nil
+}
+
+// apply returns a copy of config (or a new configuration, if config is
+// nil) which loads the client certificate from the files every time it
+// is requested by the server. As this only happens during the TLS
+// handshake when connecting, certificates can be rotated by replacing
+// the files, and they are picked up the next time the client connects
+func (c *clientCertificate) apply(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to load client certificate`)
+		}
+		return &cert, nil
+	}
+	return config
+}
+
+// tcpOptions holds the socket options that are applied to each new TCP
+// connection
+type tcpOptions struct {
+	keepAlive      time.Duration
+	noDelay        bool
+	sendBufferSize int
+}
+
+func defaultTCPOptions() tcpOptions {
+	// Go disables Nagle's algorithm by default
+	return tcpOptions{noDelay: true}
+}
+
+// setupConn prepares a freshly established connection for use. If this
+// fails, the caller is responsible for closing the connection
+func setupConn(conn net.Conn, tcp *tcpOptions, hook func(net.Conn) error) error {
+	if err := setTCPOptions(conn, tcp); err != nil {
+		return err
+	}
+
+	if hook != nil {
+		if err := hook(conn); err != nil {
+			return errors.Wrap(err, `connect hook failed`)
+		}
+	}
+	return nil
+}
+
+// setTCPOptions applies the socket options to the connection.
+// Connections that are not TCP connections are left untouched. For TLS
+// connections, the underlying connection is used
+func setTCPOptions(conn net.Conn, tcp *tcpOptions) error {
+	if wrapper, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = wrapper.NetConn()
+	}
+
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if tcp.keepAlive > 0 {
+		if err := tcpconn.SetKeepAlive(true); err != nil {
+			return errors.Wrap(err, `failed to enable keep-alive`)
+		}
+
+		if err := tcpconn.SetKeepAlivePeriod(tcp.keepAlive); err != nil {
+			return errors.Wrap(err, `failed to set keep-alive period`)
+		}
+	}
+
+	if err := tcpconn.SetNoDelay(tcp.noDelay); err != nil {
+		return errors.Wrap(err, `failed to set TCP_NODELAY`)
+	}
+
+	if tcp.sendBufferSize > 0 {
+		if err := tcpconn.SetWriteBuffer(tcp.sendBufferSize); err != nil {
+			return errors.Wrap(err, `failed to set send buffer size`)
+		}
+	}
+	return nil
+}
+
+// setWriteDeadline makes the next write to conn fail if it has not
+// completed within timeout. A timeout of 0 means that writes may block
+// indefinitely
+func setWriteDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// contextTimeout returns timeout, or the time left until the deadline of
+// ctx if it comes first
+func contextTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		// 0 would mean no timeout at all
+		left = time.Nanosecond
+	}
+	if timeout > 0 && timeout < left {
+		return timeout
+	}
+	return left
+}
+
+// writeAll writes buf to w in its entirety, calling Write as many times
+// as necessary. Some connections return short writes without an error
+// when they are under load, in which case the remainder must be written
+// to the same connection before anything else is. The number of bytes
+// written is returned along with the error that stopped the write, if any
+func writeAll(w io.Writer, buf []byte) (int, error) {
+	var written int
+	for written < len(buf) {
+		n, err := w.Write(buf[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// watchConn starts reading from the connection in the background, and
+// returns a channel that is closed when the connection has been closed,
+// by either side.
+//
+// Unless acks have been requested, fluentd does not send anything back
+// to us, so a read only ever returns when the connection is no longer
+// usable. If acks is non-nil, the responses from the server are decoded,
+// and the chunk IDs that they acknowledge are sent to it
+func watchConn(conn net.Conn, acks chan ackResponse, logger Logger) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		if acks == nil {
+			io.Copy(ioutil.Discard, conn)
+			return
+		}
+		readAcks(conn, acks, logger)
+	}()
+	return ch
+}
+
+// ackResponse is a response of the server to a chunk. err is set if the
+// server replied with an error instead of an ack
+type ackResponse struct {
+	chunk string
+	err   error
+}
+
+// readAcks decodes the responses of the server until the connection is
+// closed. Two kinds of responses are recognized: acks ({"ack": "<chunk
+// id>"}), and error replies ({"error": "<message>"}, optionally with the
+// "ack" key naming the chunk). Anything else is logged, and ignored.
+// acks is never blocked on: the writer waits for one response at a time,
+// so anything it is not waiting for could not have matched anyway
+func readAcks(r io.Reader, acks chan ackResponse, logger Logger) {
+	dec := msgpack.NewDecoder(r)
+	for {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			logger.Debug("stopped reading acks", "error", err)
+			return
+		}
+
+		id, ok := ackID(v)
+		var res ackResponse
+		if msg, isErr := errorReply(v); isErr {
+			res = ackResponse{chunk: id, err: &ServerError{Chunk: id, Message: msg}}
+		} else if ok {
+			res = ackResponse{chunk: id}
+		} else {
+			logger.Warn("ignoring invalid ack response")
+			continue
+		}
+
+		select {
+		case acks <- res:
+		default:
+		}
+	}
+}
+
+func ackID(v interface{}) (string, bool) {
+	return stringValue(mapValue(v, "ack"))
+}
+
+// errorReply returns the message of an error reply of the server
+func errorReply(v interface{}) (string, bool) {
+	return stringValue(mapValue(v, "error"))
+}
+
+// mapValue returns the value for key in a decoded msgpack map. Depending
+// on the decoder, maps may come as either map[string]interface{} or
+// map[interface{}]interface{}
+func mapValue(v interface{}, key string) interface{} {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m[key]
+	case map[interface{}]interface{}:
+		return m[key]
+	}
+	return nil
+}
+
+// stringValue returns the contents of a decoded msgpack str or bin value
+func stringValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,49 @@
+package fluent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddress(t *testing.T) {
+	var testcases = []struct {
+		network  string
+		address  string
+		expected string
+		error    bool
+	}{
+		{network: "tcp", address: "127.0.0.1:24224", expected: "127.0.0.1:24224"},
+		{network: "tcp", address: "fluent.example.com:24225", expected: "fluent.example.com:24225"},
+		{network: "tcp", address: "fluent.example.com", expected: "fluent.example.com:24224"},
+		{network: "tcp", address: "127.0.0.1", expected: "127.0.0.1:24224"},
+		{network: "tcp", address: "[2001:db8::1]:24225", expected: "[2001:db8::1]:24225"},
+		{network: "tcp", address: "[2001:db8::1]", expected: "[2001:db8::1]:24224"},
+		{network: "tcp", address: "2001:db8::1", expected: "[2001:db8::1]:24224"},
+		{network: "tcp", address: "", error: true},
+		{network: "tcp", address: "[2001:db8::1", error: true},
+		{network: "unix", address: "/tmp/fluent.sock", expected: "/tmp/fluent.sock"},
+		{network: "unixgram", address: "/tmp/fluent.sock", expected: "/tmp/fluent.sock"},
+		{network: "npipe", address: `\\.\pipe\fluentd`, expected: `\\.\pipe\fluentd`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.network+" "+tc.address, func(t *testing.T) {
+			address, err := parseAddress(tc.network, tc.address)
+			if tc.error {
+				if !assert.Error(t, err, "parseAddress should fail") {
+					return
+				}
+				return
+			}
+
+			if !assert.NoError(t, err, "parseAddress should succeed") {
+				return
+			}
+
+			if !assert.Equal(t, tc.expected, address, "address should match") {
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package fluent
+
+import "reflect"
+
+// copyRecord creates a deep copy of the given record, so that the caller
+// is free to modify the original while we serialize it in the background
+func copyRecord(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return deepCopy(reflect.ValueOf(v)).Interface()
+}
+
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		dst := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			dst.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+		}
+		return dst
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		dst := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			reflect.Copy(dst, v)
+			return dst
+		}
+		for i := 0; i < v.Len(); i++ {
+			dst.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return dst
+	case reflect.Array:
+		dst := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			dst.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return dst
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		dst := reflect.New(v.Type().Elem())
+		dst.Elem().Set(deepCopy(v.Elem()))
+		return dst
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		dst := reflect.New(v.Type()).Elem()
+		dst.Set(deepCopy(v.Elem()))
+		return dst
+	case reflect.Struct:
+		// Unexported fields can't be set via reflection, so they are
+		// copied by value along with the rest of the struct
+		dst := reflect.New(v.Type()).Elem()
+		dst.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := dst.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i)))
+			}
+		}
+		return dst
+	}
+	return v
+}
@@ -0,0 +1,89 @@
+package fluent
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Datagram networks (udp and unixgram) send each record in a datagram of
+// its own, for inputs such as fluentd's in_udp. These inputs parse the datagram as a bare
+// record, and assign the tag and the time themselves, so only the record
+// is serialized. There is no connection to speak of, nor anybody to tell
+// us that a datagram got lost, so a record that cannot be sent is dropped
+// instead of being retried.
+
+// isDatagramNetwork reports whether records are sent as individual
+// datagrams over the given network
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "unixgram":
+		return true
+	}
+	return false
+}
+
+// checkDatagramOptions makes sure that none of the features that require
+// a stream, a response from the server, or the tag of the records have
+// been requested
+func checkDatagramOptions(network string, m marshaler, tlsConfig *tls.Config, hs *handshakeConfig, tagPrefix string) error {
+	if _, ok := m.(recordMarshaler); !ok {
+		return errors.Errorf(`%s network requires either the JSON or the msgpack marshaler`, network)
+	}
+	if tlsConfig != nil {
+		return errors.Errorf(`TLS is not supported over %s`, network)
+	}
+	if hs.enabled() {
+		return errors.Errorf(`handshake is not supported over %s`, network)
+	}
+	if len(tagPrefix) > 0 {
+		return errors.Errorf(`tag prefix is not supported over %s, as records are sent without their tag`, network)
+	}
+	return nil
+}
+
+// writeDatagram sends buf as a single datagram. Datagrams are never
+// written partially, so unlike writeAll, this does not loop
+func writeDatagram(conn net.Conn, buf []byte) error {
+	if _, err := conn.Write(buf); err != nil {
+		return errors.Wrap(err, `failed to write datagram`)
+	}
+	return nil
+}
+
+// flushDatagrams sends the pending records one datagram at a time. Records
+// that could not be sent are dropped, and their callers are notified of
+// the error. The error for the last record that was dropped is returned
+func (m *minion) flushDatagrams(conn net.Conn, address string) error {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	var lastErr error
+	var offset int
+	for i := range m.pendingFrames {
+		frame := &m.pendingFrames[i]
+		done := m.traceWrite(writeTarget{address: address, attempt: 1}, frame.chunk, 1, frame.size)
+		setWriteDeadline(conn, m.writeTimeout)
+		err := writeDatagram(conn, m.pending[offset:offset+frame.size])
+		done(err)
+		if err != nil {
+			lastErr = err
+			// consumePending notifies everybody else of the success
+			notifyFlush(frame.flushCh, err)
+			frame.flushCh = nil
+			frame.dropped = true
+			m.reportDropped(errors.Wrap(err, `record dropped`), *frame, m.pending[offset:offset+frame.size])
+		} else {
+			m.counters.observeWrite(time.Since(frame.appended))
+		}
+		offset += frame.size
+	}
+
+	m.consumePending(len(m.pending))
+	m.pending = m.buffer[0:0]
+	m.pendingFrames = m.pendingFrames[0:0]
+	m.loadStore()
+	return lastErr
+}
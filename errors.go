@@ -1,15 +1,35 @@
 package fluent
 
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
 type bufferFullErr struct{}
 type bufferFuller interface {
 	BufferFull() bool
 }
+type clientClosedErr struct{}
+type clientCloseder interface {
+	ClientClosed() bool
+}
 type causer interface {
 	Cause() error
 }
 
 // Just need one instance
 var bufferFullErrInstance bufferFullErr
+var clientClosedErrInstance clientClosedErr
+
+// ErrBufferFull matches the errors returned when a message does not fit
+// in the buffer, using errors.Is. The errors themselves are of type
+// *BufferFullError, which describes the limit that was hit
+var ErrBufferFull error = &bufferFullErrInstance
+
+// ErrClosed is returned when the client has already been closed via
+// Close() or Shutdown(). It can be matched using errors.Is
+var ErrClosed error = &clientClosedErrInstance
 
 // IsBufferFull returns true if the error is a BufferFull error
 func IsBufferFull(e error) bool {
@@ -20,9 +40,9 @@ func IsBufferFull(e error) bool {
 
 		if cerr, ok := e.(causer); ok {
 			e = cerr.Cause()
+		} else {
+			e = nil
 		}
-
-		e = nil
 	}
 	return false
 }
@@ -34,3 +54,246 @@ func (e *bufferFullErr) BufferFull() bool {
 func (e *bufferFullErr) Error() string {
 	return `buffer full`
 }
+
+// BufferFullError is returned when a message does not fit in the buffer.
+// It matches ErrBufferFull when using errors.Is, and can be inspected
+// using errors.As. All sizes are in bytes
+type BufferFullError struct {
+	Tag         string // set if the limit is the one for this tag (see WithTagBufferLimit)
+	Size        int    // bytes that were already in the buffer
+	Limit       int
+	MessageSize int
+}
+
+func (e *BufferFullError) BufferFull() bool {
+	return true
+}
+
+func (e *BufferFullError) Is(target error) bool {
+	return target == ErrBufferFull
+}
+
+func (e *BufferFullError) Error() string {
+	if e.Tag != "" {
+		return fmt.Sprintf(`buffer full for tag %s (%d bytes of %d used, message is %d bytes)`, e.Tag, e.Size, e.Limit, e.MessageSize)
+	}
+	return fmt.Sprintf(`buffer full (%d bytes of %d used, message is %d bytes)`, e.Size, e.Limit, e.MessageSize)
+}
+
+// IsClientClosed returns true if the error was returned because the
+// client has already been closed via Close() or Shutdown()
+func IsClientClosed(e error) bool {
+	for e != nil {
+		if cerr, ok := e.(clientCloseder); ok {
+			return cerr.ClientClosed()
+		}
+
+		if cerr, ok := e.(causer); ok {
+			e = cerr.Cause()
+		} else {
+			e = nil
+		}
+	}
+	return false
+}
+
+func (e *clientClosedErr) ClientClosed() bool {
+	return true
+}
+
+func (e *clientClosedErr) Error() string {
+	return `client has already been closed`
+}
+
+// UnflushedError is returned by Shutdown when the context is canceled
+// before all pending messages have been written to the server. It holds
+// the messages that were discarded, in their serialized form, and can be
+// inspected using errors.As. errors.Is matches the error of the context.
+//
+// The messages that the client was in the middle of writing are included,
+// although some of them may still have made it to the server. Messages
+// that are left in a custom buffer (see WithBuffer) are not included, as
+// they are not lost.
+type UnflushedError struct {
+	Err      error // the error of the context
+	Messages []*BufferedMessage
+	Bytes    int // total size of Messages
+}
+
+func newUnflushedError(err error, msgs []*BufferedMessage) *UnflushedError {
+	e := &UnflushedError{
+		Err:      err,
+		Messages: msgs,
+	}
+	for _, msg := range msgs {
+		e.Bytes += len(msg.Data)
+	}
+	return e
+}
+
+func (e *UnflushedError) Error() string {
+	return fmt.Sprintf(`%s: %d messages (%d bytes) were not flushed`, e.Err, len(e.Messages), e.Bytes)
+}
+
+func (e *UnflushedError) Cause() error {
+	return e.Err
+}
+
+func (e *UnflushedError) Unwrap() error {
+	return e.Err
+}
+
+type queueFullErr struct{}
+type queueFuller interface {
+	QueueFull() bool
+}
+
+var queueFullErrInstance queueFullErr
+
+// ErrQueueFull is returned by Post when the client does not block (see
+// WithNonBlocking), and the queue of messages is full. It can be matched
+// using errors.Is
+var ErrQueueFull error = &queueFullErrInstance
+
+// IsQueueFull returns true if the error was returned because the queue
+// of messages was full, and the client was not allowed to wait for room
+// in it (see WithNonBlocking)
+func IsQueueFull(e error) bool {
+	for e != nil {
+		if qerr, ok := e.(queueFuller); ok {
+			return qerr.QueueFull()
+		}
+
+		if cerr, ok := e.(causer); ok {
+			e = cerr.Cause()
+		} else {
+			e = nil
+		}
+	}
+	return false
+}
+
+func (e *queueFullErr) QueueFull() bool {
+	return true
+}
+
+func (e *queueFullErr) Error() string {
+	return `queue full`
+}
+
+type circuitOpenErr struct{}
+type circuitOpener interface {
+	CircuitOpen() bool
+}
+
+var circuitOpenErrInstance circuitOpenErr
+
+// ErrCircuitOpen is returned when the circuit breaker is open. It can be
+// matched using errors.Is
+var ErrCircuitOpen error = &circuitOpenErrInstance
+
+// IsCircuitOpen returns true if the error was returned because the
+// circuit breaker (see WithCircuitBreaker) is open, and the message was
+// rejected without trying to send it
+func IsCircuitOpen(e error) bool {
+	for e != nil {
+		if cerr, ok := e.(circuitOpener); ok {
+			return cerr.CircuitOpen()
+		}
+
+		if cerr, ok := e.(causer); ok {
+			e = cerr.Cause()
+		} else {
+			e = nil
+		}
+	}
+	return false
+}
+
+func (e *circuitOpenErr) CircuitOpen() bool {
+	return true
+}
+
+func (e *circuitOpenErr) Error() string {
+	return `circuit breaker is open`
+}
+
+// PostError describes a message that could not be written to the server,
+// as received from the channel returned by Errors(). Record is nil if the
+// message was dropped after it had been serialized, as the record is no
+// longer known at that point
+type PostError struct {
+	Tag    string
+	Time   time.Time
+	Record interface{}
+	Err    error
+}
+
+func (e PostError) Error() string {
+	return fmt.Sprintf(`failed to post message with tag %s: %s`, e.Tag, e.Err)
+}
+
+// Unwrap returns the underlying error, so that it can be matched using
+// errors.Is, for example against ErrBufferFull
+func (e PostError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned by PostAll with WithSyncAppend(true) when some of
+// the entries could not be posted, for example because their record
+// could not be serialized. Errors maps the index of each of those entries
+// to its error; the other entries have been appended to the buffer
+type BatchError struct {
+	Errors map[int]error
+}
+
+// Indices returns the indices of the entries that failed, in order
+func (e *BatchError) Indices() []int {
+	indices := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+func (e *BatchError) Error() string {
+	indices := e.Indices()
+	if len(indices) == 0 {
+		return `failed to post entries`
+	}
+	first := indices[0]
+	if len(indices) == 1 {
+		return fmt.Sprintf(`failed to post entry #%d: %s`, first, e.Errors[first])
+	}
+	return fmt.Sprintf(`failed to post %d entries, first entry #%d: %s`, len(indices), first, e.Errors[first])
+}
+
+// Unwrap returns the errors of the entries, in the order of their
+// indices, so that they can be matched using errors.Is and errors.As
+func (e *BatchError) Unwrap() []error {
+	indices := e.Indices()
+	errs := make([]error, len(indices))
+	for i, index := range indices {
+		errs[i] = e.Errors[index]
+	}
+	return errs
+}
+
+// ServerError is an error reply of the server to a chunk that was sent
+// when acks are required (see WithRequireAck): a map with an "error" key,
+// instead of an ack. It is passed to the error handler (see
+// WithErrorHandler), to the channel returned by Errors(), and to the
+// retry policy (see WithRetryPolicy), which can tell it apart using
+// errors.As
+type ServerError struct {
+	Chunk   string // chunk ID of the rejected chunk, as given by the reply, if any
+	Message string // contents of the "error" key of the reply
+}
+
+func (e *ServerError) Error() string {
+	if e.Chunk == "" {
+		return fmt.Sprintf(`server replied with an error: %s`, e.Message)
+	}
+	return fmt.Sprintf(`server replied with an error to chunk %s: %s`, e.Chunk, e.Message)
+}
@@ -0,0 +1,64 @@
+package fluent
+
+import (
+	"time"
+)
+
+// connEvents holds the callbacks that are told about changes in the state
+// of the connection to the server (see WithOnConnect, WithOnDisconnect
+// and WithOnReconnect). They are passed to run, which the buffered client
+// sets to queue them to its callback goroutine. Otherwise, they are called
+// synchronously from whatever connects or disconnects, so they must not
+// block
+type connEvents struct {
+	onConnect    func(string)
+	onDisconnect func(string, error)
+	onReconnect  func(string, time.Duration)
+	logger       Logger
+	run          func(func())
+}
+
+func (e *connEvents) enabled() bool {
+	return e.onConnect != nil || e.onDisconnect != nil || e.onReconnect != nil
+}
+
+// connected reports that a connection to address has been established.
+// lostAt is the time at which the previous connection was lost because
+// of an error, or the zero time if there was no such connection
+func (e *connEvents) connected(address string, lostAt time.Time) {
+	e.logger.Debug("connected to server", "address", address)
+	if f := e.onConnect; f != nil {
+		e.call(func() { f(address) })
+	}
+	if lostAt.IsZero() {
+		return
+	}
+
+	downtime := time.Since(lostAt)
+	e.logger.Info("reconnected to server", "address", address, "downtime", downtime)
+	if f := e.onReconnect; f != nil {
+		e.call(func() { f(address, downtime) })
+	}
+}
+
+// disconnected reports that the connection to address has been closed.
+// err is the reason why it was lost, or nil if the client closed it of
+// its own accord
+func (e *connEvents) disconnected(address string, err error) {
+	if err != nil {
+		e.logger.Warn("connection lost", "address", address, "error", err)
+	} else {
+		e.logger.Debug("connection closed", "address", address)
+	}
+	if f := e.onDisconnect; f != nil {
+		e.call(func() { f(address, err) })
+	}
+}
+
+func (e *connEvents) call(f func()) {
+	if e.run != nil {
+		e.run(f)
+		return
+	}
+	f()
+}
@@ -0,0 +1,52 @@
+package fluent
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// muExpvar makes checking whether a name is taken and publishing it
+// atomic, as expvar.Publish panics if the name has already been published
+var muExpvar sync.Mutex
+
+// publishExpvar publishes the statistics returned by stats as an expvar
+// named name (see WithExpvar)
+func publishExpvar(name string, stats func() Stats) error {
+	muExpvar.Lock()
+	defer muExpvar.Unlock()
+
+	if expvar.Get(name) != nil {
+		return errors.Errorf(`expvar %s has already been published`, name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return expvarStats(stats())
+	}))
+	return nil
+}
+
+// expvarStats converts s to the value published by WithExpvar, with
+// durations in seconds, and the error as a string
+func expvarStats(s Stats) map[string]interface{} {
+	var lastError interface{}
+	if s.LastError != nil {
+		lastError = s.LastError.Error()
+	}
+	return map[string]interface{}{
+		"queued":              s.Queued,
+		"pending_bytes":       s.PendingBytes,
+		"inflight_bytes":      s.InflightBytes,
+		"posted":              s.Posted,
+		"flushed":             s.Flushed,
+		"dropped":             s.Dropped,
+		"reconnects":          s.Reconnects,
+		"retries":             s.Retries,
+		"dropped_after_retry": s.DroppedAfterRetry,
+		"dropped_callbacks":   s.DroppedCallbacks,
+		"server_disconnects":  s.ServerDisconnects,
+		"writes":              s.WriteLatency.Count,
+		"write_seconds":       s.WriteLatency.Sum.Seconds(),
+		"last_error":          lastError,
+	}
+}
@@ -1,6 +1,8 @@
 // Package fluent implements a client for the fluentd data logging daemon.
 package fluent
 
+import "github.com/pkg/errors"
+
 // New creates a new client. By default a buffered client is created.
 // The `WithBufered` option switches which type of client is created.
 // `WithBuffered(true)` (default) creates a buffered client, and
@@ -9,13 +11,25 @@ package fluent
 // respectively.
 func New(options ...Option) (Client, error) {
 	var buffered = true
+	var resolution TimestampResolution
+	var subsecondStrict bool
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyBuffered:
 			buffered = opt.Value().(bool)
+		case optkeySubSecond:
+			resolution = resolutionFromSubsecond(opt.Value().(bool))
+		case optkeyTimestampResolution:
+			resolution = opt.Value().(TimestampResolution)
+		case optkeySubSecondStrict:
+			subsecondStrict = opt.Value().(bool)
 		}
 	}
 
+	if resolution != TimestampSeconds && subsecondStrict && eventTimeErr != nil {
+		return nil, errors.Wrap(eventTimeErr, `subsecond timestamps are not available`)
+	}
+
 	if buffered {
 		return NewBuffered(options...)
 	}
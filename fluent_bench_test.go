@@ -3,7 +3,9 @@
 package fluent_test
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	official "github.com/fluent/fluent-logger-golang/fluent"
 	k0kubun "github.com/k0kubun/fluent-logger-go"
@@ -58,6 +60,94 @@ func BenchmarkLestrratUnbuffered(b *testing.B) {
 	c.Shutdown(nil)
 }
 
+// These measure the allocations made while filling up the pending
+// buffer of a fresh client, with and without preallocating it
+const postsPerClient = 1000
+
+func benchmarkLestrratInitialBuffer(b *testing.B, n int) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c, _ := lestrrat.New(
+			lestrrat.WithInitialBuffer(n),
+			lestrrat.WithWriteThreshold(8*1024*1024),
+		)
+		for j := 0; j < postsPerClient; j++ {
+			if c.Post(tag, map[string]interface{}{"count": j}, lestrrat.WithSyncAppend(true)) != nil {
+				b.Logf("whoa Post failed")
+			}
+		}
+		c.Shutdown(nil)
+	}
+}
+
+func BenchmarkLestrratInitialBuffer(b *testing.B) {
+	benchmarkLestrratInitialBuffer(b, 1024*1024)
+}
+
+func BenchmarkLestrratNoInitialBuffer(b *testing.B) {
+	benchmarkLestrratInitialBuffer(b, 0)
+}
+
+// These compare the cost of serializing a record that has already
+// been encoded as JSON by the caller against a map
+func BenchmarkLestrratJSONMarshalMap(b *testing.B) {
+	msg := &lestrrat.Message{
+		Tag:    tag,
+		Time:   lestrrat.EventTime{Time: time.Now()},
+		Record: map[string]interface{}{"count": 1},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.MarshalJSON(); err != nil {
+			b.Logf("whoa MarshalJSON failed")
+		}
+	}
+}
+
+func BenchmarkLestrratJSONMarshalRawMessage(b *testing.B) {
+	msg := &lestrrat.Message{
+		Tag:    tag,
+		Time:   lestrrat.EventTime{Time: time.Now()},
+		Record: json.RawMessage(`{"count":1}`),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.MarshalJSON(); err != nil {
+			b.Logf("whoa MarshalJSON failed")
+		}
+	}
+}
+
+// These measure the latency of bursts of Post() calls, which depends on
+// how many messages can be queued before the background reader picks
+// them up
+const postsPerBurst = 256
+
+func benchmarkLestrratWriteQueueSize(b *testing.B, n int) {
+	c, _ := lestrrat.New(lestrrat.WithWriteQueueSize(n))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < postsPerBurst; j++ {
+			if c.Post(tag, map[string]interface{}{"count": j}) != nil {
+				b.Logf("whoa Post failed")
+			}
+		}
+		b.StopTimer()
+		time.Sleep(time.Millisecond) // let the queue drain between bursts
+		b.StartTimer()
+	}
+	b.StopTimer()
+	c.Shutdown(nil)
+}
+
+func BenchmarkLestrratWriteQueueSizeDefault(b *testing.B) {
+	benchmarkLestrratWriteQueueSize(b, 64)
+}
+
+func BenchmarkLestrratWriteQueueSizeBurst(b *testing.B) {
+	benchmarkLestrratWriteQueueSize(b, postsPerBurst)
+}
+
 func BenchmarkOfficial(b *testing.B) {
 	c, _ := official.New(official.Config{})
 	for i := 0; i < b.N; i++ {
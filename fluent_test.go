@@ -1,46 +1,316 @@
 package fluent_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluenttest"
 	msgpack "github.com/lestrrat/go-msgpack"
-	pdebug "github.com/lestrrat/go-pdebug"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
 // to hell with race-conditions. no locking!
+// testClient is implemented by both *fluent.Buffered and *fluent.Unbuffered,
+// so that the tests can use the methods beyond fluent.Client whichever
+// one fluent.New returns
+type testClient interface {
+	fluent.Client
+	fluent.Flusher
+	fluent.StatsProvider
+	PostWithContext(context.Context, string, interface{}, ...fluent.Option) error
+	PostAll([]fluent.Entry, ...fluent.Option) error
+	PostRaw(string, time.Time, []byte, ...fluent.Option) error
+	PostAsync(string, interface{}, ...fluent.Option) (*fluent.Result, error)
+	IsConnected() bool
+	LastError() error
+	Errors() <-chan fluent.PostError
+	Writer(string, ...fluent.Option) io.WriteCloser
+}
+
+var _ testClient = (*fluent.Buffered)(nil)
+var _ testClient = (*fluent.Unbuffered)(nil)
+
+// newClient is fluent.New, for the tests that need the methods of
+// testClient
+func newClient(options ...fluent.Option) (testClient, error) {
+	c, err := fluent.New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return c.(testClient), nil
+}
+
 type server struct {
 	cleanup  func()
 	done     chan struct{}
 	listener net.Listener
 	ready    chan struct{}
 	useJSON  bool
+	t        testing.TB
+	muLog    sync.Mutex
+	closed   bool // once closed, nothing is logged to t
 	Network  string
 	Address  string
 	Payload  []*fluent.Message
+	// if non-zero, the first connection is forcefully closed after
+	// reading this many messages
+	DisconnectAfter int
+	// if non-zero, acks are not sent for this many messages that
+	// requested them
+	SkipAcks int
+	// if true, requests are expected in the forward mode format
+	Forward bool
+	// number of requests received, which may contain several messages
+	// in the forward mode
+	Requests int
+	// if non-empty, clients must perform the handshake using this key
+	SharedKey string
+	// if non-empty, clients must authenticate as this user during the
+	// handshake
+	Username string
+	Password string
+	// common names of the client certificates presented over TLS
+	PeerNames []string
+}
+
+const testServerHostname = "test-server"
+
+func handshakeDigest(salt, hostname, nonce, sharedKey string) string {
+	sum := sha512.Sum512([]byte(salt + hostname + nonce + sharedKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// serverHandshake performs the server side of the handshake, as done by
+// fluentd's in_forward
+func serverHandshake(conn net.Conn, dec *msgpack.Decoder, s *server) error {
+	const nonce = "0123456789abcdef"
+	var authSalt string
+	if s.Username != "" {
+		authSalt = "fedcba9876543210"
+	}
+	helo, err := msgpack.Marshal([]interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": authSalt, "keepalive": true}})
+	if err != nil {
+		return errors.Wrap(err, `failed to encode HELO`)
+	}
+	if _, err := conn.Write(helo); err != nil {
+		return errors.Wrap(err, `failed to write HELO`)
+	}
+
+	var ping []interface{}
+	if err := dec.Decode(&ping); err != nil {
+		return errors.Wrap(err, `failed to read PING`)
+	}
+	if len(ping) != 6 || ping[0] != "PING" {
+		return errors.Errorf(`invalid PING: %#v`, ping)
+	}
+	hostname, _ := ping[1].(string)
+	salt, _ := ping[2].(string)
+
+	var pong []interface{}
+	switch {
+	case ping[3] != handshakeDigest(salt, hostname, nonce, s.SharedKey):
+		pong = []interface{}{"PONG", false, "shared_key mismatch", "", ""}
+	case s.Username != "" && (ping[4] != s.Username || ping[5] != handshakeDigest(authSalt, s.Username, s.Password, "")):
+		pong = []interface{}{"PONG", false, "username/password mismatch", "", ""}
+	default:
+		pong = []interface{}{"PONG", true, "", testServerHostname, handshakeDigest(salt, testServerHostname, nonce, s.SharedKey)}
+	}
+	buf, err := msgpack.Marshal(pong)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode PONG`)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return errors.Wrap(err, `failed to write PONG`)
+	}
+	if !pong[1].(bool) {
+		return errors.New(`authentication failed`)
+	}
+	return nil
+}
+
+// decodeForward decodes a forward mode request, and expands it into
+// individual messages, each carrying the option map of the request
+func decodeForward(d *msgpack.Decoder) ([]*fluent.Message, error) {
+	var length int
+	if err := d.DecodeArrayLength(&length); err != nil {
+		return nil, errors.Wrap(err, `failed to decode request array length`)
+	}
+	if length != 2 && length != 3 {
+		return nil, errors.Errorf(`invalid array length %d (expected 2 or 3)`, length)
+	}
+
+	var tag string
+	if err := d.DecodeString(&tag); err != nil {
+		return nil, errors.Wrap(err, `failed to decode tag`)
+	}
+
+	c, err := d.PeekCode()
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to peek code for entries`)
+	}
+
+	var msgs []*fluent.Message
+	var packed []byte
+	switch c {
+	case msgpack.Bin8, msgpack.Bin16, msgpack.Bin32:
+		// packed forward mode. The entries can only be decoded after the
+		// option, which tells us if they have been compressed
+		if err := d.DecodeBytes(&packed); err != nil {
+			return nil, errors.Wrap(err, `failed to decode packed entries`)
+		}
+	default:
+		var count int
+		if err := d.DecodeArrayLength(&count); err != nil {
+			return nil, errors.Wrap(err, `failed to decode entries array length`)
+		}
+		for i := 0; i < count; i++ {
+			msg, err := decodeEntry(d, tag)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	var option interface{}
+	if length == 3 {
+		if err := d.Decode(&option); err != nil {
+			return nil, errors.Wrap(err, `failed to decode option`)
+		}
+	}
+
+	if packed != nil {
+		var r io.Reader = bytes.NewReader(packed)
+		if optionValue(option, "compressed") == "gzip" {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, errors.Wrap(err, `failed to decompress packed entries`)
+			}
+			r = gr
+		}
+
+		pd := msgpack.NewDecoder(r)
+		for {
+			msg, err := decodeEntry(pd, tag)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	for _, msg := range msgs {
+		msg.Option = option
+	}
+	return msgs, nil
+}
+
+func decodeEntry(d *msgpack.Decoder, tag string) (*fluent.Message, error) {
+	var l int
+	if err := d.DecodeArrayLength(&l); err != nil {
+		return nil, errors.Wrap(err, `failed to decode entry array length`)
+	}
+	if l != 2 {
+		return nil, errors.Errorf(`invalid entry array length %d (expected 2)`, l)
+	}
+
+	msg := &fluent.Message{Tag: tag}
+	c, err := d.PeekCode()
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to peek code for time`)
+	}
+	if msgpack.IsExtFamily(c) {
+		if err := d.DecodeStruct(&msg.Time); err != nil {
+			return nil, errors.Wrap(err, `failed to decode time`)
+		}
+	} else {
+		var t int64
+		if err := d.DecodeInt64(&t); err != nil {
+			return nil, errors.Wrap(err, `failed to decode time`)
+		}
+		msg.Time.Time = time.Unix(t, 0).UTC()
+	}
+	if err := d.Decode(&msg.Record); err != nil {
+		return nil, errors.Wrap(err, `failed to decode record`)
+	}
+	return msg, nil
+}
+
+// optionValue returns the value for key in a message option map
+func optionValue(option interface{}, key string) interface{} {
+	switch options := option.(type) {
+	case map[interface{}]interface{}:
+		return options[key]
+	case map[string]interface{}:
+		return options[key]
+	}
+	return nil
+}
+
+// chunkOption returns the chunk ID that the client requested an ack for
+func chunkOption(msg *fluent.Message) (string, bool) {
+	id, ok := optionValue(msg.Option, "chunk").(string)
+	return id, ok
 }
 
-func newServer(useJSON bool) (*server, error) {
+func newServer(t testing.TB, useJSON bool) (*server, error) {
 	dir, err := ioutil.TempDir("", "sock-")
 	if err != nil {
 		return nil, errors.Wrap(err, `failed to create temporary directory`)
 	}
 
-	file := filepath.Join(dir, "test-server.sock")
+	s, err := newUnixServer(t, useJSON, filepath.Join(dir, "test-server.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	cleanup := s.cleanup
+	s.cleanup = func() {
+		cleanup()
+		os.RemoveAll(dir)
+	}
+	return s, nil
+}
 
+// newUnixServer creates a server that listens to the unix socket at file
+func newUnixServer(t testing.TB, useJSON bool, file string) (*server, error) {
 	l, err := net.Listen("unix", file)
 	if err != nil {
 		return nil, errors.Wrap(err, `failed to listen to unix socket`)
@@ -50,24 +320,132 @@ func newServer(useJSON bool) (*server, error) {
 		Network:  "unix",
 		Address:  file,
 		useJSON:  useJSON,
+		t:        t,
 		done:     make(chan struct{}),
 		ready:    make(chan struct{}),
 		listener: l,
 		cleanup: func() {
 			l.Close()
-			os.RemoveAll(dir)
 		},
 	}
 	return s, nil
 }
 
+// newTCPServer creates a server listening on a TCP port on the loopback
+// interface. Unlike unix domain sockets, writing to a TCP connection that
+// has been closed by the server may appear to succeed
+func newTCPServer(t testing.TB, useJSON bool) (*server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to listen to tcp socket`)
+	}
+
+	s := &server{
+		Network:  "tcp",
+		Address:  l.Addr().String(),
+		useJSON:  useJSON,
+		t:        t,
+		done:     make(chan struct{}),
+		ready:    make(chan struct{}),
+		listener: l,
+		cleanup: func() {
+			l.Close()
+		},
+	}
+	return s, nil
+}
+
+// newTLSServer creates a server listening on a TCP port on the loopback
+// interface, which requires clients to use TLS. The returned pool contains
+// the certificate of the server. If clientCAs is non-nil, clients must
+// present a certificate signed by one of them
+func newTLSServer(t testing.TB, useJSON bool, clientCAs *x509.CertPool) (*server, *x509.CertPool, error) {
+	// httptest comes with a certificate that is valid for 127.0.0.1
+	hs := httptest.NewUnstartedServer(nil)
+	hs.StartTLS()
+	config := hs.TLS
+	pool := x509.NewCertPool()
+	pool.AddCert(hs.Certificate())
+	hs.Close()
+
+	s, err := newTCPServer(t, useJSON)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverConfig := &tls.Config{Certificates: config.Certificates}
+	if clientCAs != nil {
+		serverConfig.ClientCAs = clientCAs
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.listener = tls.NewListener(s.listener, serverConfig)
+	return s, pool, nil
+}
+
+// writeClientCertificate creates a self-signed client certificate with
+// the given common name, and writes it along with its key to dir
+func writeClientCertificate(dir, name string) (string, string, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to generate key`)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to create certificate`)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to parse certificate`)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to marshal key`)
+	}
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to write certificate`)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", nil, errors.Wrap(err, `failed to write key`)
+	}
+	return certFile, keyFile, cert, nil
+}
+
 func (s *server) Close() error {
+	s.muLog.Lock()
+	s.closed = true
+	s.muLog.Unlock()
+
 	if f := s.cleanup; f != nil {
 		f()
 	}
 	return nil
 }
 
+// logf logs through the test that created the server, until the server
+// is closed. The goroutines of the server may outlive the test, which must
+// not be logged to after it has completed
+func (s *server) logf(format string, args ...interface{}) {
+	s.muLog.Lock()
+	defer s.muLog.Unlock()
+	if !s.closed {
+		s.t.Logf(format, args...)
+	}
+}
+
 func (s *server) Ready() <-chan struct{} {
 	return s.ready
 }
@@ -77,43 +455,31 @@ func (s *server) Done() <-chan struct{} {
 }
 
 func (s *server) Run(ctx context.Context) {
-	if pdebug.Enabled {
-		defer pdebug.Printf("bail out of server.Run")
-	}
+	defer s.logf("bail out of server.Run")
 	defer close(s.done)
 
 	go func() {
 		select {
 		case <-ctx.Done():
-			if pdebug.Enabled {
-				pdebug.Printf("context.Context is done, closing listeners")
-			}
+			s.logf("context.Context is done, closing listeners")
 			s.listener.Close()
 		}
 	}()
 
-	if pdebug.Enabled {
-		pdebug.Printf("server started")
-	}
+	s.logf("server started")
 	var once sync.Once
 	for {
-		if pdebug.Enabled {
-			pdebug.Printf("server loop")
-		}
+		s.logf("server loop")
 		select {
 		case <-ctx.Done():
-			if pdebug.Enabled {
-				pdebug.Printf("cancel detected in server.Run")
-			}
+			s.logf("cancel detected in server.Run")
 			return
 		default:
 		}
 
 		readerCh := make(chan *fluent.Message)
 		go func(ch chan *fluent.Message) {
-			if pdebug.Enabled {
-				defer pdebug.Printf("bailing out of server reader")
-			}
+			defer s.logf("bailing out of server reader")
 		ACCEPT:
 			for {
 				select {
@@ -124,61 +490,96 @@ func (s *server) Run(ctx context.Context) {
 				once.Do(func() { close(s.ready) })
 				conn, err := s.listener.Accept()
 				if err != nil {
-					if pdebug.Enabled {
-						pdebug.Printf("Failed to accept: %s", err)
-					}
+					s.logf("Failed to accept: %s", err)
 					return
 				}
 
-				if pdebug.Enabled {
-					pdebug.Printf("Accepted new connection")
+				s.logf("Accepted new connection")
+
+				// Complete the TLS handshake now, as a failure would
+				// otherwise be reported on every attempt to decode
+				if tc, ok := conn.(*tls.Conn); ok {
+					if err := tc.Handshake(); err != nil {
+						s.logf("test server: TLS handshake failed: %s", err)
+						conn.Close()
+						continue ACCEPT
+					}
+					if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+						s.PeerNames = append(s.PeerNames, certs[0].Subject.CommonName)
+					}
 				}
 
 				var dec func(interface{}) error
+				var mdec *msgpack.Decoder
 				if s.useJSON {
 					dec = json.NewDecoder(conn).Decode
 				} else {
-					dec = msgpack.NewDecoder(conn).Decode
+					mdec = msgpack.NewDecoder(conn)
+					dec = mdec.Decode
 				}
 
-				for {
-					if pdebug.Enabled {
-						pdebug.Printf("waiting for next message...")
+				if s.SharedKey != "" {
+					if err := serverHandshake(conn, mdec, s); err != nil {
+						s.logf("test server: handshake failed: %s", err)
+						conn.Close()
+						continue ACCEPT
+					}
+				}
+
+				for count := 0; ; count++ {
+					if s.DisconnectAfter > 0 && count == s.DisconnectAfter {
+						s.logf("test server: forcefully disconnecting after %d messages", count)
+						s.DisconnectAfter = 0
+						conn.Close()
+						continue ACCEPT
 					}
+
+					s.logf("waiting for next message...")
 					// conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-					var v fluent.Message
-					if err := dec(&v); err != nil {
+					var msgs []*fluent.Message
+					var err error
+					if s.Forward {
+						msgs, err = decodeForward(mdec)
+					} else {
+						var v fluent.Message
+						err = dec(&v)
+						msgs = []*fluent.Message{&v}
+					}
+					if err != nil {
 						var decName string
 						if s.useJSON {
 							decName = "json"
 						} else {
 							decName = "msgpack"
 						}
-						if pdebug.Enabled {
-							pdebug.Printf("test server: failed to decode %s: %s", decName, err)
-						}
+						s.logf("test server: failed to decode %s: %s", decName, err)
 						if errors.Cause(err) == io.EOF {
-							if pdebug.Enabled {
-								pdebug.Printf("test server: EOF detected")
-							}
+							s.logf("test server: EOF detected")
 							conn.Close()
 							continue ACCEPT
 						}
 						continue
 					}
 
-					if pdebug.Enabled {
-						pdebug.Printf("Read new fluet.Message")
-					}
-					select {
-					case <-ctx.Done():
-						if pdebug.Enabled {
-							pdebug.Printf("bailing out of read loop")
+					s.logf("Read %d new fluet.Message(s)", len(msgs))
+					s.Requests++
+					if chunk, ok := chunkOption(msgs[0]); ok && !s.useJSON {
+						if s.SkipAcks > 0 {
+							s.SkipAcks--
+						} else {
+							ack, err := msgpack.Marshal(map[string]interface{}{"ack": chunk})
+							if err == nil {
+								conn.Write(ack)
+							}
 						}
-						return
-					case ch <- &v:
-						if pdebug.Enabled {
-							pdebug.Printf("Sent new message to read channel")
+					}
+					for _, v := range msgs {
+						select {
+						case <-ctx.Done():
+							s.logf("bailing out of read loop")
+							return
+						case ch <- v:
+							s.logf("Sent new message to read channel")
 						}
 					}
 				}
@@ -189,14 +590,10 @@ func (s *server) Run(ctx context.Context) {
 			var v *fluent.Message
 			select {
 			case <-ctx.Done():
-				if pdebug.Enabled {
-					pdebug.Printf("bailout")
-				}
+				s.logf("bailout")
 				return
 			case v = <-readerCh:
-				if pdebug.Enabled {
-					pdebug.Printf("new payload: %#v", v)
-				}
+				s.logf("new payload: %#v", v)
 			}
 
 			// This is some silly stuff, but msgpack would return
@@ -244,7 +641,7 @@ func TestConnectOnStart(t *testing.T) {
 		})
 	}
 
-	s, err := newServer(false)
+	s, err := newServer(t, false)
 	if !assert.NoError(t, err, "newServer should succeed") {
 		return
 	}
@@ -306,7 +703,7 @@ func TestWithContext(t *testing.T) {
 }
 
 func TestTagPrefix(t *testing.T) {
-	s, err := newServer(false)
+	s, err := newServer(t, false)
 	if !assert.NoError(t, err, "newServer should succeed") {
 		return
 	}
@@ -320,83 +717,34 @@ func TestTagPrefix(t *testing.T) {
 
 	<-s.Ready()
 
-	client, err := fluent.New(
-		fluent.WithNetwork(s.Network),
-		fluent.WithAddress(s.Address),
-		fluent.WithTagPrefix("test"),
-	)
-	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
-		return
-	}
-
-	client.Shutdown(nil)
-
-	for _, p := range s.Payload {
-		if !assert.Equal(t, "test.tag_name", p.Tag, "tag should have prefix") {
+	for _, buffered := range []bool{true, false} {
+		client, err := newClient(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithBuffered(buffered),
+			fluent.WithTagPrefix("test"),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
 			return
 		}
-	}
-}
-
-func TestBufferFull(t *testing.T) {
-	s, err := newServer(false)
-	if !assert.NoError(t, err, "newServer should succeed") {
-		return
-	}
-	defer s.Close()
-
-	client, err := fluent.New(
-		fluent.WithNetwork(s.Network),
-		fluent.WithAddress(s.Address),
-		fluent.WithBufferLimit(256),
-		fluent.WithWriteThreshold(1),
-	)
 
-	count := 1
-	// Write until buffer is full.
-	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 0}, fluent.WithSyncAppend(true)), "Post should succeed") {
-		return
-	}
-	for i := 1; ; i++ {
-		err := client.Post("tag_name", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
-		if fluent.IsBufferFull(err) {
-			if pdebug.Enabled {
-				pdebug.Printf("Detected full buffer. Stopping Post() loop")
-			}
-			break
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+			return
 		}
-		count++
-	}
-
-	sctx, scancel := context.WithCancel(context.Background())
-	defer scancel()
-
-	// Start the server, which should start the writer process
-	go s.Run(sctx)
-
-	<-s.Ready()
 
-	// write one more message
-	var wroteOneMore bool
-	for i := 1; i < 10; i++ {
-		if pdebug.Enabled {
-			pdebug.Printf("Writing one more message...")
-		}
-		err := client.Post("tag_name", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
-		if err == nil {
-			count++
-			wroteOneMore = true
-			break
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = client.Flush(ctx)
+		cancel()
+		if !assert.NoError(t, err, "Flush should succeed") {
+			return
 		}
-		time.Sleep(500 * time.Millisecond)
-	}
-	if !assert.True(t, wroteOneMore, "expected to be able to write one more message") {
-		return
+		// The server reads one connection at a time
+		client.Close()
 	}
 
-	// wait for the server to process all of our messages
+	// wait for the server to process both messages
 	{
-		timeout := time.NewTimer(10 * time.Second)
+		timeout := time.NewTimer(5 * time.Second)
 		defer timeout.Stop()
 		tick := time.NewTicker(10 * time.Millisecond)
 		defer tick.Stop()
@@ -404,57 +752,342 @@ func TestBufferFull(t *testing.T) {
 			select {
 			case <-timeout.C:
 				t.Errorf("timed out while waiting for the server to process requests")
-				return // Don't forget to return
+				return
 			case <-tick.C:
-				if len(s.Payload) == count {
-					t.Logf("Got expected %d messages in the server", len(s.Payload))
+				if len(s.Payload) == 2 {
 					loop = false
 				}
 			}
 		}
 	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("Writing one more after draining")
-	}
-	// See if we can still write after the buffer has been drained
-	s.Payload = s.Payload[0:0]
-	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}, fluent.WithSyncAppend(true)), "writing after the buffer has been drained should succeed") {
-		return
-	}
-
-	// wait for the server to process all of our messages
-	{
-		timeout := time.NewTimer(10 * time.Second)
-		defer timeout.Stop()
-		tick := time.NewTicker(10 * time.Millisecond)
-		defer tick.Stop()
-		for loop := true; loop; {
-			select {
-			case <-timeout.C:
-				t.Errorf("timed out while waiting for the server to process requests")
-			case <-tick.C:
-				if len(s.Payload) == 1 {
-					t.Logf("Got expected %d messages in the server", len(s.Payload))
-					loop = false
-				}
-			}
+	for _, p := range s.Payload {
+		if !assert.Equal(t, "test.tag_name", p.Tag, "tag should have prefix") {
+			return
 		}
 	}
-
-	client.Close()
 }
 
-type badmsgpack struct{}
+func TestErrors(t *testing.T) {
+	client, err := fluent.New(
+		fluent.WithAddress("127.0.0.1:1"),
+		fluent.WithBufferLimit(64),
+		fluent.WithTagBufferLimit("small_tag", 16),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
 
-func (msg *badmsgpack) EncodeMsgpack(_ *msgpack.Encoder) error {
-	return errors.New(`badmsgpack`)
+	t.Run("buffer full", func(t *testing.T) {
+		err := client.Post("tag_name", map[string]interface{}{"foo": strings.Repeat("x", 64)}, fluent.WithSyncAppend(true))
+		if !assert.True(t, errors.Is(err, fluent.ErrBufferFull), "error should match ErrBufferFull") {
+			return
+		}
+		var bferr *fluent.BufferFullError
+		if !assert.True(t, errors.As(err, &bferr), "error should be a BufferFullError") {
+			return
+		}
+		if !assert.Equal(t, 64, bferr.Limit, "limit should be reported") {
+			return
+		}
+		if !assert.True(t, bferr.MessageSize > 64, "message size should be reported") {
+			return
+		}
+		if !assert.True(t, fluent.IsBufferFull(errors.Wrap(err, `wrapped`)), "IsBufferFull should see through wrapped errors") {
+			return
+		}
+	})
+	t.Run("tag buffer full", func(t *testing.T) {
+		err := client.Post("small_tag", map[string]interface{}{"foo": strings.Repeat("x", 16)}, fluent.WithSyncAppend(true))
+		var bferr *fluent.BufferFullError
+		if !assert.True(t, errors.As(err, &bferr), "error should be a BufferFullError") {
+			return
+		}
+		if !assert.Equal(t, "small_tag", bferr.Tag, "tag should be reported") {
+			return
+		}
+		if !assert.Equal(t, 16, bferr.Limit, "limit of the tag should be reported") {
+			return
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		client.Close()
+		err := client.Post("tag_name", map[string]interface{}{"foo": 1})
+		if !assert.True(t, errors.Is(err, fluent.ErrClosed), "error should match ErrClosed") {
+			return
+		}
+		if !assert.True(t, fluent.IsClientClosed(err), "IsClientClosed should return true") {
+			return
+		}
+	})
+}
+
+func TestPostWithContext(t *testing.T) {
+	// Nothing is listening on this address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	t.Run("buffered", func(t *testing.T) {
+		// The background reader gets stuck once the buffer is full,
+		// after which Post blocks
+		client, err := newClient(
+			fluent.WithAddress(dead),
+			fluent.WithBufferLimit(64),
+			fluent.WithOverflowPolicy("block"),
+			fluent.WithWriteQueueSize(1),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		for i := 0; i < 100; i++ {
+			err := client.PostWithContext(ctx, "tag_name", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
+			if err == nil {
+				continue
+			}
+			if !assert.Equal(t, context.DeadlineExceeded, err, "PostWithContext should time out") {
+				return
+			}
+			return
+		}
+		t.Errorf("PostWithContext should time out once the buffer is full")
+	})
+	t.Run("unbuffered", func(t *testing.T) {
+		client, err := newClient(
+			fluent.WithAddress(dead),
+			fluent.WithBuffered(false),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = client.PostWithContext(ctx, "tag_name", map[string]interface{}{"foo": 1})
+		if !assert.Equal(t, context.Canceled, err, "PostWithContext should fail once canceled") {
+			return
+		}
+	})
+}
+
+func TestPostTimeout(t *testing.T) {
+	for _, perCall := range []bool{true, false} {
+		t.Run(fmt.Sprintf("per call=%t", perCall), func(t *testing.T) {
+			// Nothing is listening on this address
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if !assert.NoError(t, err, "net.Listen should succeed") {
+				return
+			}
+			dead := l.Addr().String()
+			l.Close()
+
+			// The background reader gets stuck once the buffer is full,
+			// after which Post blocks
+			options := []fluent.Option{
+				fluent.WithAddress(dead),
+				fluent.WithBufferLimit(64),
+				fluent.WithOverflowPolicy("block"),
+				fluent.WithWriteQueueSize(1),
+			}
+			var postOptions []fluent.Option
+			if perCall {
+				postOptions = append(postOptions, fluent.WithPostTimeout(200*time.Millisecond))
+			} else {
+				options = append(options, fluent.WithPostTimeout(200*time.Millisecond))
+			}
+			client, err := fluent.New(options...)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			for i := 0; i < 100; i++ {
+				start := time.Now()
+				err := client.Post("tag_name", map[string]interface{}{"foo": i}, postOptions...)
+				if err == nil {
+					continue
+				}
+				if !assert.Equal(t, context.DeadlineExceeded, err, "Post should time out") {
+					return
+				}
+				if !assert.True(t, time.Since(start) < 2*time.Second, "Post should respect the timeout") {
+					return
+				}
+				return
+			}
+			t.Errorf("Post should time out once the buffer is full")
+		})
+	}
+}
+
+func TestNonBlocking(t *testing.T) {
+	for _, perCall := range []bool{true, false} {
+		t.Run(fmt.Sprintf("per call=%t", perCall), func(t *testing.T) {
+			// Nothing is listening on this address
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if !assert.NoError(t, err, "net.Listen should succeed") {
+				return
+			}
+			dead := l.Addr().String()
+			l.Close()
+
+			// The background reader gets stuck once the buffer is full,
+			// after which the queue fills up
+			options := []fluent.Option{
+				fluent.WithAddress(dead),
+				fluent.WithBufferLimit(64),
+				fluent.WithOverflowPolicy("block"),
+				fluent.WithWriteQueueSize(1),
+			}
+			var postOptions []fluent.Option
+			if perCall {
+				postOptions = append(postOptions, fluent.WithNonBlocking(true))
+			} else {
+				options = append(options, fluent.WithNonBlocking(true))
+			}
+			client, err := fluent.New(options...)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			for i := 0; i < 100; i++ {
+				err := client.Post("tag_name", map[string]interface{}{"foo": i}, postOptions...)
+				if err == nil {
+					continue
+				}
+				if !assert.True(t, errors.Is(err, fluent.ErrQueueFull), "error should match ErrQueueFull") {
+					return
+				}
+				if !assert.True(t, fluent.IsQueueFull(err), "IsQueueFull should return true") {
+					return
+				}
+				return
+			}
+			t.Errorf("Post should fail once the queue is full")
+		})
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithBufferLimit(256),
+		fluent.WithWriteThreshold(1),
+	)
+
+	count := 1
+	// Write until buffer is full.
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 0}, fluent.WithSyncAppend(true)), "Post should succeed") {
+		return
+	}
+	for i := 1; ; i++ {
+		err := client.Post("tag_name", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
+		if fluent.IsBufferFull(err) {
+			t.Logf("Detected full buffer. Stopping Post() loop")
+			break
+		}
+		count++
+	}
+
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	// Start the server, which should start the writer process
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	// write one more message
+	var wroteOneMore bool
+	for i := 1; i < 10; i++ {
+		t.Logf("Writing one more message...")
+		err := client.Post("tag_name", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
+		if err == nil {
+			count++
+			wroteOneMore = true
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if !assert.True(t, wroteOneMore, "expected to be able to write one more message") {
+		return
+	}
+
+	// wait for the server to process all of our messages
+	{
+		timeout := time.NewTimer(10 * time.Second)
+		defer timeout.Stop()
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for loop := true; loop; {
+			select {
+			case <-timeout.C:
+				t.Errorf("timed out while waiting for the server to process requests")
+				return // Don't forget to return
+			case <-tick.C:
+				if len(s.Payload) == count {
+					t.Logf("Got expected %d messages in the server", len(s.Payload))
+					loop = false
+				}
+			}
+		}
+	}
+
+	t.Logf("Writing one more after draining")
+	// See if we can still write after the buffer has been drained
+	s.Payload = s.Payload[0:0]
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}, fluent.WithSyncAppend(true)), "writing after the buffer has been drained should succeed") {
+		return
+	}
+
+	// wait for the server to process all of our messages
+	{
+		timeout := time.NewTimer(10 * time.Second)
+		defer timeout.Stop()
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for loop := true; loop; {
+			select {
+			case <-timeout.C:
+				t.Errorf("timed out while waiting for the server to process requests")
+			case <-tick.C:
+				if len(s.Payload) == 1 {
+					t.Logf("Got expected %d messages in the server", len(s.Payload))
+					loop = false
+				}
+			}
+		}
+	}
+
+	client.Close()
+}
+
+type badmsgpack struct{}
+
+func (msg *badmsgpack) EncodeMsgpack(_ *msgpack.Encoder) error {
+	return errors.New(`badmsgpack`)
 }
 
 func TestPostSync(t *testing.T) {
 	for _, syncAppend := range []bool{true, false} {
 		t.Run("sync="+strconv.FormatBool(syncAppend), func(t *testing.T) {
-			s, err := newServer(false)
+			s, err := newServer(t, false)
 			if !assert.NoError(t, err, "newServer should succeed") {
 				return
 			}
@@ -547,7 +1180,7 @@ func TestPostRoundtrip(t *testing.T) {
 					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 					defer cancel()
 
-					s, err := newServer(useJSON)
+					s, err := newServer(t, useJSON)
 					if !assert.NoError(t, err, "newServer should succeed") {
 						return
 					}
@@ -580,9 +1213,7 @@ func TestPostRoundtrip(t *testing.T) {
 
 					time.Sleep(time.Second)
 					scancel()
-					if pdebug.Enabled {
-						pdebug.Printf("canceled server context")
-					}
+					t.Logf("canceled server context")
 
 					select {
 					case <-ctx.Done():
@@ -665,7 +1296,7 @@ func TestPing(t *testing.T) {
 			})
 
 			t.Run("Ping with active server", func(t *testing.T) {
-				s, err := newServer(false)
+				s, err := newServer(t, false)
 				if !assert.NoError(t, err, "newServer should succeed") {
 					return
 				}
@@ -705,3 +1336,5101 @@ func TestPing(t *testing.T) {
 		})
 	}
 }
+
+func TestPingDuringClose(t *testing.T) {
+	// Nothing is listening on this address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	// The background reader gets stuck once the buffer is full, so that
+	// it never picks up the ping
+	client, err := fluent.New(
+		fluent.WithAddress(dead),
+		fluent.WithBufferLimit(64),
+		fluent.WithOverflowPolicy("block"),
+		fluent.WithWriteQueueSize(1),
+		fluent.WithPostTimeout(100*time.Millisecond),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		if client.Post("tag_name", map[string]interface{}{"foo": i}) != nil {
+			break
+		}
+	}
+
+	pinged := make(chan error, 1)
+	go func() {
+		pinged <- client.Ping("ping", map[string]interface{}{"host": "localhost"})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Close should not wait for a pending Ping")
+		return
+	}
+	select {
+	case err := <-pinged:
+		if !assert.True(t, fluent.IsClientClosed(err), "Ping should fail as the client is closed") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Ping should return once the client is closed")
+	}
+}
+
+func TestForwardOption(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.Error(t, client.Post("tag_name", map[string]interface{}{"foo": 1}, fluent.WithForwardOption("chunk", "foo")), "Post with reserved option key should fail") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}, fluent.WithForwardOption("custom", "value")), "Post should succeed") {
+				return
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+				return
+			}
+
+			option, ok := s.Payload[0].Option.(map[interface{}]interface{})
+			if !assert.True(t, ok, "option should be a map") {
+				return
+			}
+
+			if !assert.Equal(t, "value", option["custom"], "custom option should be present") {
+				return
+			}
+		})
+	}
+}
+
+func TestPostOrdering(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.DisconnectAfter = 10
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithWriteThreshold(1),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+			return
+		}
+		// give the writer a chance to write in between, so that
+		// the disconnect happens in the middle of the stream
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.True(t, len(s.Payload) > 10, "expected messages after reconnect") {
+		return
+	}
+
+	var prev int64 = -1
+	for _, p := range s.Payload {
+		// the exact integer type depends on the decoder, so go through
+		// its string representation
+		v, err := strconv.ParseInt(fmt.Sprintf("%v", p.Record.(map[string]interface{})["seq"]), 10, 64)
+		if !assert.NoError(t, err, "seq should be an integer") {
+			return
+		}
+		if !assert.True(t, v > prev, "sequence numbers should be strictly increasing (%d -> %d)", prev, v) {
+			return
+		}
+		prev = v
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err, "net.Listen should succeed") {
+			return
+		}
+		defer l.Close()
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go io.Copy(ioutil.Discard, conn)
+			}
+		}()
+
+		for _, buffered := range []bool{true, false} {
+			t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+				client, err := fluent.New(
+					fluent.WithAddress(l.Addr().String()),
+					fluent.WithBuffered(buffered),
+					fluent.WithTCPKeepAlive(30*time.Second),
+					fluent.WithTCPNoDelay(false),
+					fluent.WithSendBufferSize(64*1024),
+				)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+					return
+				}
+			})
+		}
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		for _, buffered := range []bool{true, false} {
+			t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+				s, err := newServer(t, false)
+				if !assert.NoError(t, err, "newServer should succeed") {
+					return
+				}
+				defer s.Close()
+
+				// This is just to stop the server
+				sctx, scancel := context.WithCancel(context.Background())
+				defer scancel()
+
+				go s.Run(sctx)
+
+				<-s.Ready()
+
+				client, err := fluent.New(
+					fluent.WithNetwork(s.Network),
+					fluent.WithAddress(s.Address),
+					fluent.WithBuffered(buffered),
+					fluent.WithTCPKeepAlive(30*time.Second),
+					fluent.WithTCPNoDelay(false),
+					fluent.WithSendBufferSize(64*1024),
+				)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+					return
+				}
+
+				client.Shutdown(nil)
+
+				// timing sensitive :/ we need to give the server enough time to receive
+				// the message before canceling it via scancel
+				time.Sleep(100 * time.Millisecond)
+				scancel()
+				<-s.Done()
+
+				if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+					return
+				}
+			})
+		}
+	})
+}
+
+func TestPostAsync(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithWriteThreshold(1),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Shutdown(nil)
+
+			var results []*fluent.Result
+			for i := 0; i < 10; i++ {
+				result, err := client.PostAsync("tag_name", map[string]interface{}{"seq": i})
+				if !assert.NoError(t, err, "PostAsync should succeed") {
+					return
+				}
+				results = append(results, result)
+			}
+
+			badResult, err := client.PostAsync("tag_name", &badmsgpack{})
+			if !assert.NoError(t, err, "PostAsync should succeed") {
+				return
+			}
+
+			timeout := time.NewTimer(5 * time.Second)
+			defer timeout.Stop()
+			for i, result := range results {
+				select {
+				case <-timeout.C:
+					t.Errorf("timed out waiting for result #%d to be appended", i)
+					return
+				case err := <-result.Appended():
+					if !assert.NoError(t, err, "result #%d should be appended", i) {
+						return
+					}
+				}
+			}
+			for i, result := range results[:5] {
+				select {
+				case <-timeout.C:
+					t.Errorf("timed out waiting for result #%d", i)
+					return
+				case err := <-result.Done():
+					if !assert.NoError(t, err, "result #%d should be successful", i) {
+						return
+					}
+				}
+			}
+			for i, result := range results[5:] {
+				if !assert.NoError(t, result.Err(), "result #%d should be successful", i+5) {
+					return
+				}
+				if !assert.NoError(t, result.Err(), "Err should return the same outcome again") {
+					return
+				}
+			}
+
+			select {
+			case <-timeout.C:
+				t.Errorf("timed out waiting for result")
+				return
+			case err := <-badResult.Appended():
+				if !assert.Error(t, err, "result should report marshal error when appending") {
+					return
+				}
+			}
+			if !assert.Error(t, badResult.Err(), "result should report marshal error") {
+				return
+			}
+		})
+	}
+}
+
+func TestCopyRecords(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithCopyRecords(true),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	record := map[string]interface{}{
+		"foo":  "bar",
+		"list": []interface{}{"a", "b"},
+	}
+	if !assert.NoError(t, client.Post("tag_name", record), "Post should succeed") {
+		return
+	}
+
+	// modify the record immediately. the client should not notice
+	record["foo"] = "baz"
+	record["list"].([]interface{})[0] = "z"
+	delete(record, "list")
+
+	client.Shutdown(nil)
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+		return
+	}
+
+	if !assert.Equal(t, map[string]interface{}{"foo": "bar", "list": []interface{}{"a", "b"}}, s.Payload[0].Record, "server should receive the original record") {
+		return
+	}
+}
+
+func TestInitialBuffer(t *testing.T) {
+	for _, size := range []int{0, 16, 1024 * 1024} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithInitialBuffer(size),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			const count = 100
+			for i := 0; i < count; i++ {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}, fluent.WithSyncAppend(true)), "Post should succeed") {
+					return
+				}
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, count, "expected all messages") {
+				return
+			}
+
+			for _, p := range s.Payload {
+				if !assert.Equal(t, map[string]interface{}{"foo": "bar"}, p.Record, "records should be delivered intact") {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestConnectHook(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			var mu sync.Mutex
+			var connects int
+			hook := func(conn net.Conn) error {
+				mu.Lock()
+				defer mu.Unlock()
+				connects++
+				// fail the first attempt, so that we reconnect
+				if connects == 1 {
+					return errors.New(`connect hook failure`)
+				}
+				return nil
+			}
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithConnectHook(hook),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+				return
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !assert.Equal(t, 2, connects, "hook should be called for each connection") {
+				return
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("flush pending buffer", func(t *testing.T) {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		// The write threshold is never reached, so nothing is written
+		// until we call Shutdown
+		client, err := fluent.New(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithWriteThreshold(1024*1024),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		for i := 0; i < 10; i++ {
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}, fluent.WithSyncAppend(true)), "Post should succeed") {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+			return
+		}
+
+		// timing sensitive :/ we need to give the server enough time to receive
+		// the message before canceling it via scancel
+		time.Sleep(100 * time.Millisecond)
+		scancel()
+		<-s.Done()
+
+		if !assert.Len(t, s.Payload, 10, "expected all messages to be flushed") {
+			return
+		}
+	})
+
+	t.Run("abort flush", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sock-")
+		if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		// Nobody is listening on this address, so the flush can't complete
+		client, err := newClient(
+			fluent.WithNetwork("unix"),
+			fluent.WithAddress(filepath.Join(dir, "nonexistent.sock")),
+			fluent.WithMaxConnAttempts(0),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		result, err := client.PostAsync("tag_name", map[string]interface{}{"foo": 1})
+		if !assert.NoError(t, err, "PostAsync should succeed") {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = client.Shutdown(ctx)
+		if !assert.True(t, errors.Is(err, context.DeadlineExceeded), "Shutdown should time out") {
+			return
+		}
+		var uerr *fluent.UnflushedError
+		if !assert.True(t, errors.As(err, &uerr), "error should be an UnflushedError") {
+			return
+		}
+		if !assert.Len(t, uerr.Messages, 1, "the pending message should be reported") {
+			return
+		}
+		if !assert.Equal(t, "tag_name", uerr.Messages[0].Tag, "tag should be reported") {
+			return
+		}
+		if !assert.Equal(t, len(uerr.Messages[0].Data), uerr.Bytes, "size should be reported") {
+			return
+		}
+
+		// Once the flush is aborted, the pending message should be discarded
+		select {
+		case <-time.After(5 * time.Second):
+			t.Errorf("timed out waiting for the flush to be aborted")
+		case err := <-result.Done():
+			if !assert.Error(t, err, "message should not have been written") {
+				return
+			}
+		}
+	})
+}
+
+func TestRecordModifier(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			modifier := func(tag string, record interface{}) interface{} {
+				m, ok := record.(map[string]interface{})
+				if !ok {
+					return record
+				}
+
+				modified := map[string]interface{}{
+					"hostname": "localhost",
+					"service":  tag,
+				}
+				for k, v := range m {
+					modified[k] = v
+				}
+				return modified
+			}
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithRecordModifier(modifier),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+				return
+			}
+
+			expected := map[string]interface{}{
+				"foo":      "bar",
+				"hostname": "localhost",
+				"service":  "tag_name",
+			}
+			if !assert.Equal(t, expected, s.Payload[0].Record, "record should contain injected fields") {
+				return
+			}
+		})
+	}
+}
+
+func TestPostRaw(t *testing.T) {
+	record := map[string]interface{}{"foo": "bar"}
+	ts := time.Unix(1482493046, 0).UTC()
+	for _, useJSON := range []bool{true, false} {
+		for _, buffered := range []bool{true, false} {
+			t.Run(fmt.Sprintf("json=%t, buffered=%t", useJSON, buffered), func(t *testing.T) {
+				s, err := newServer(t, useJSON)
+				if !assert.NoError(t, err, "newServer should succeed") {
+					return
+				}
+				defer s.Close()
+
+				// This is just to stop the server
+				sctx, scancel := context.WithCancel(context.Background())
+				defer scancel()
+
+				go s.Run(sctx)
+
+				<-s.Ready()
+
+				options := []fluent.Option{
+					fluent.WithNetwork(s.Network),
+					fluent.WithAddress(s.Address),
+					fluent.WithBuffered(buffered),
+				}
+				var raw []byte
+				if useJSON {
+					options = append(options, fluent.WithJSONMarshaler())
+					raw, err = json.Marshal(record)
+				} else {
+					raw, err = msgpack.Marshal(record)
+				}
+				if !assert.NoError(t, err, "marshaling the record should succeed") {
+					return
+				}
+
+				client, err := newClient(options...)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				if !assert.Error(t, client.PostRaw("tag_name", ts, nil), "PostRaw should fail with an empty record") {
+					return
+				}
+				if !assert.NoError(t, client.PostRaw("tag_name", ts, raw), "PostRaw should succeed") {
+					return
+				}
+				// The client keeps a copy, so the buffer can be reused
+				// right away
+				copy(raw, bytes.Repeat([]byte{'x'}, len(raw)))
+
+				client.Shutdown(nil)
+
+				// timing sensitive :/ we need to give the server enough time to receive
+				// the message before canceling it via scancel
+				time.Sleep(100 * time.Millisecond)
+				scancel()
+				<-s.Done()
+
+				if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+					return
+				}
+				if !assert.Equal(t, record, s.Payload[0].Record, "record should arrive unchanged") {
+					return
+				}
+				if !assert.Equal(t, ts.Unix(), s.Payload[0].Time.Unix(), "timestamp should match") {
+					return
+				}
+			})
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			w := client.Writer("tag_name")
+			for _, chunk := range []string{"first line\nsec", "ond line\r\n\n", "last line"} {
+				if _, err := io.WriteString(w, chunk); !assert.NoError(t, err, "Write should succeed") {
+					return
+				}
+			}
+			if !assert.NoError(t, w.Close(), "Close should succeed") {
+				return
+			}
+			if _, err := io.WriteString(w, "more\n"); !assert.Error(t, err, "Write should fail after Close") {
+				return
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 3, "expected 3 messages") {
+				return
+			}
+			for i, line := range []string{"first line", "second line", "last line"} {
+				if !assert.Equal(t, "tag_name", s.Payload[i].Tag, "tag should match") {
+					return
+				}
+				if !assert.Equal(t, map[string]interface{}{"message": line}, s.Payload[i].Record, "line should match") {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestWriterStdLog(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	fields := map[string]interface{}{"source": "stdlib"}
+	logger := log.New(client.Writer("tag_name", fluent.WithWriterFields(fields)), "", 0)
+	logger.Printf("hello %s", "world")
+
+	client.Shutdown(nil)
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+		return
+	}
+	expected := map[string]interface{}{
+		"message": "hello world",
+		"source":  "stdlib",
+	}
+	if !assert.Equal(t, expected, s.Payload[0].Record, "record should include the fields") {
+		return
+	}
+}
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1482493046, 0).UTC()
+	clock := func() time.Time { return now }
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithClock(clock),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+				return
+			}
+			if !assert.Equal(t, now.Unix(), s.Payload[0].Time.Unix(), "timestamp should come from the clock") {
+				return
+			}
+		})
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	var mu sync.Mutex
+	var errs []error
+	var tags []string
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithBufferLimit(64),
+		fluent.WithErrorHandler(func(err error, msg *fluent.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+			if msg != nil {
+				tags = append(tags, msg.Tag)
+			}
+		}),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, client.Post("small", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+		return
+	}
+	if !assert.NoError(t, client.Post("large", map[string]interface{}{"foo": strings.Repeat("x", 100)}), "Post should succeed") {
+		return
+	}
+	if !assert.NoError(t, client.Post("invalid", make(chan int)), "Post should succeed") {
+		return
+	}
+	// Errors reported to the caller are not passed to the handler
+	if !assert.Error(t, client.Post("large", map[string]interface{}{"foo": strings.Repeat("x", 100)}, fluent.WithSyncAppend(true)), "Post should fail") {
+		return
+	}
+	client.Shutdown(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Len(t, errs, 2, "expected 2 errors") {
+		return
+	}
+	if !assert.True(t, fluent.IsBufferFull(errs[0]), "first error should be buffer full") {
+		return
+	}
+	if !assert.Equal(t, []string{"large", "invalid"}, tags, "messages should be passed to the handler") {
+		return
+	}
+}
+
+func TestCallbacksCallClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing is listening, so the messages pile up, and the oldest ones
+	// are evicted with the buffer locked
+	var client *fluent.Buffered
+	called := make(chan fluent.Stats, 100)
+	onCall := func() {
+		select {
+		case called <- client.Stats():
+		default:
+		}
+	}
+	client, err = fluent.NewBuffered(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(filepath.Join(dir, "fluent.sock")),
+		fluent.WithBufferLimit(64),
+		fluent.WithOverflowPolicy("drop_oldest"),
+		fluent.WithErrorHandler(func(error, *fluent.Message) { onCall() }),
+		fluent.WithOnDrop(func(error, *fluent.BufferedMessage) { onCall() }),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	for i := 0; i < 10; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"count": i}), "Post should succeed") {
+			return
+		}
+	}
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Errorf("callbacks should be able to call the client")
+	}
+}
+
+func TestCallbacksSlowHandler(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	const count = 5000
+	var mu sync.Mutex
+	var calls int
+	goroutines := runtime.NumGoroutine()
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithErrorHandler(func(error, *fluent.Message) {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+		}),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	// Each of these fails to serialize in the background, and is passed
+	// to the handler, which cannot keep up
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", make(chan int)), "Post should succeed") {
+			return
+		}
+	}
+	if !assert.True(t, runtime.NumGoroutine() < goroutines+10, "callbacks should not spawn goroutines") {
+		return
+	}
+	client.Shutdown(nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	stats := client.Stats()
+	if !assert.NotZero(t, stats.DroppedCallbacks, "callbacks should be dropped") {
+		return
+	}
+	if !assert.Equal(t, count, calls+int(stats.DroppedCallbacks), "every error should be passed or dropped") {
+		return
+	}
+}
+
+func TestErrorChannel(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithBufferLimit(64),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	var perrs []fluent.PostError
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for perr := range client.Errors() {
+			perrs = append(perrs, perr)
+		}
+	}()
+
+	large := map[string]interface{}{"foo": strings.Repeat("x", 100)}
+	if !assert.NoError(t, client.Post("small", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+		return
+	}
+	if !assert.NoError(t, client.Post("large", large), "Post should succeed") {
+		return
+	}
+	client.Shutdown(nil)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the error channel should be closed")
+		return
+	}
+
+	if !assert.Len(t, perrs, 1, "expected 1 error") {
+		return
+	}
+	if !assert.Equal(t, "large", perrs[0].Tag, "tag should match") {
+		return
+	}
+	if !assert.Equal(t, large, perrs[0].Record, "record should match") {
+		return
+	}
+	if !assert.True(t, errors.Is(perrs[0], fluent.ErrBufferFull), "error should match ErrBufferFull") {
+		return
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			for _, v := range []interface{}{
+				map[string]interface{}{"foo": "bar"},
+				make(chan int),
+				map[string]interface{}{"foo": "baz"},
+			} {
+				client.Post("tag_name", v)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+				return
+			}
+
+			stats := client.Stats()
+			if !assert.Equal(t, uint64(3), stats.Posted, "posted messages should be counted") {
+				return
+			}
+			if !assert.Equal(t, uint64(2), stats.Flushed, "flushed messages should be counted") {
+				return
+			}
+			if !assert.Equal(t, uint64(1), stats.Dropped, "dropped messages should be counted") {
+				return
+			}
+			if !assert.Zero(t, stats.PendingBytes, "nothing should be pending") {
+				return
+			}
+			if !assert.NotZero(t, stats.WriteLatency.Count, "writes should be observed") {
+				return
+			}
+		})
+	}
+}
+
+func TestWriteLatency(t *testing.T) {
+	// Each message waits in the buffer while the ones before it wait for
+	// their ack, which is part of the latency of its write
+	const delay = 100 * time.Millisecond
+	s, err := fluenttest.NewServer("unix")
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.SetAckDelay(delay)
+	s.Start()
+
+	client, err := fluent.NewBuffered(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithRequireAck(true),
+	)
+	if !assert.NoError(t, err, "fluent.NewBuffered should succeed") {
+		return
+	}
+	defer client.Close()
+
+	const count = 3
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+		return
+	}
+
+	latency := client.Stats().WriteLatency
+	if !assert.Equal(t, uint64(count), latency.Count, "each write should be observed") {
+		return
+	}
+	if !assert.True(t, latency.Sum/time.Duration(latency.Count) >= delay, "average latency (%s) should include the ack delay", latency.Sum/time.Duration(latency.Count)) {
+		return
+	}
+	// The writes take about 1, 2 and 3 times the delay from the time the
+	// messages were posted, against 3 times the delay in all when only the
+	// writes themselves are measured
+	if !assert.True(t, latency.Sum >= 5*delay, "total latency (%s) should include the time spent in the buffer", latency.Sum) {
+		return
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			name := fmt.Sprintf("fluent_test_expvar_%t", buffered)
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithExpvar(name),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+				return
+			}
+
+			v := expvar.Get(name)
+			if !assert.NotNil(t, v, "expvar should be published") {
+				return
+			}
+			var stats map[string]interface{}
+			if !assert.NoError(t, json.Unmarshal([]byte(v.String()), &stats), "expvar should be valid JSON") {
+				return
+			}
+			if !assert.Equal(t, float64(1), stats["posted"], "posted messages should be published") {
+				return
+			}
+			if !assert.Contains(t, stats, "last_error", "last error should be published") {
+				return
+			}
+
+			_, err = fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithExpvar(name),
+			)
+			if !assert.Error(t, err, "fluent.New should fail when the name is taken") {
+				return
+			}
+		})
+	}
+}
+
+type logEntry struct {
+	level string
+	msg   string
+	args  []interface{}
+}
+
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) log(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, args: args})
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.log("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.log("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.log("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.log("error", msg, args) }
+
+// find returns the first entry with the given message
+func (l *recordingLogger) find(msg string) (logEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestLogger(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	logger := &recordingLogger{}
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithLogger(logger),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	for _, v := range []interface{}{
+		map[string]interface{}{"foo": "bar"},
+		make(chan int),
+	} {
+		client.Post("tag_name", v)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+		return
+	}
+
+	e, ok := logger.find("connected to server")
+	if !assert.True(t, ok, "connection should be logged") {
+		return
+	}
+	if !assert.Equal(t, []interface{}{"address", s.Address}, e.args, "address should be logged") {
+		return
+	}
+
+	e, ok = logger.find("failed to serialize message")
+	if !assert.True(t, ok, "serialization failure should be logged") {
+		return
+	}
+	if !assert.Equal(t, "warn", e.level, "serialization failure should be logged as a warning") {
+		return
+	}
+	if !assert.Equal(t, []interface{}{"tag", "tag_name"}, e.args[:2], "tag should be logged") {
+		return
+	}
+}
+
+type writeTracer struct {
+	mu     sync.Mutex
+	writes []fluent.WriteInfo
+	errs   []error
+}
+
+func (t *writeTracer) StartWrite(info fluent.WriteInfo) func(error) {
+	return func(err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.writes = append(t.writes, info)
+		t.errs = append(t.errs, err)
+	}
+}
+
+func TestWriteTracer(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	tracer := &writeTracer{}
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithWriteTracer(tracer),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	for _, v := range []string{"foo", "bar"} {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"v": v}), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+		return
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	if !assert.NotEmpty(t, tracer.writes, "writes should be traced") {
+		return
+	}
+	var messages int
+	for i, info := range tracer.writes {
+		if !assert.NoError(t, tracer.errs[i], "writes should succeed") {
+			return
+		}
+		if !assert.Equal(t, s.Network, info.Network, "network should match") {
+			return
+		}
+		if !assert.Equal(t, s.Address, info.Address, "address should match") {
+			return
+		}
+		if !assert.Equal(t, 1, info.Attempt, "attempt should match") {
+			return
+		}
+		if !assert.NotZero(t, info.Bytes, "bytes should be counted") {
+			return
+		}
+		messages += info.Messages
+	}
+	if !assert.Equal(t, 2, messages, "all messages should be traced") {
+		return
+	}
+}
+
+func TestJSONRawMessage(t *testing.T) {
+	s, err := newServer(t, true)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithJSONMarshaler(),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, client.Post("tag_name", json.RawMessage(`{"foo":"bar","list":[1,2]}`)), "Post should succeed") {
+		return
+	}
+
+	client.Shutdown(nil)
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 1, "expected 1 message") {
+		return
+	}
+
+	expected := map[string]interface{}{
+		"foo":  "bar",
+		"list": []interface{}{float64(1), float64(2)},
+	}
+	if !assert.Equal(t, expected, s.Payload[0].Record, "record should arrive unchanged") {
+		return
+	}
+}
+
+func TestDrainOnClose(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		client, err := newClient(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithDrainOnClose(5*time.Second),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		var results []*fluent.Result
+		for i := 0; i < 10; i++ {
+			result, err := client.PostAsync("tag_name", map[string]interface{}{"seq": i})
+			if !assert.NoError(t, err, "PostAsync should succeed") {
+				return
+			}
+			results = append(results, result)
+		}
+
+		if !assert.NoError(t, client.Close(), "Close should succeed") {
+			return
+		}
+
+		// By the time Close returns, everything should have been written
+		for i, result := range results {
+			select {
+			case err := <-result.Done():
+				if !assert.NoError(t, err, "result #%d should be successful", i) {
+					return
+				}
+			default:
+				t.Errorf("result #%d should be available after Close", i)
+				return
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sock-")
+		if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		// Nobody is listening on this address, so the flush can't complete
+		client, err := fluent.New(
+			fluent.WithNetwork("unix"),
+			fluent.WithAddress(filepath.Join(dir, "nonexistent.sock")),
+			fluent.WithMaxConnAttempts(0),
+			fluent.WithDrainOnClose(100*time.Millisecond),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+			return
+		}
+
+		if !assert.Error(t, client.Close(), "Close should time out") {
+			return
+		}
+	})
+}
+
+func TestTagBufferLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Nobody is listening on this address, so everything stays in the buffer
+	client, err := fluent.New(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(filepath.Join(dir, "nonexistent.sock")),
+		fluent.WithTagBufferLimit("noisy", 256),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	var saturated bool
+	for i := 0; i < 100; i++ {
+		err := client.Post("noisy", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true))
+		if fluent.IsBufferFull(err) {
+			saturated = true
+			break
+		}
+		if !assert.NoError(t, err, "Post should succeed until the tag buffer is full") {
+			return
+		}
+	}
+
+	if !assert.True(t, saturated, "buffer for noisy tag should become full") {
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		if !assert.NoError(t, client.Post("critical", map[string]interface{}{"foo": i}, fluent.WithSyncAppend(true)), "Post for other tags should succeed") {
+			return
+		}
+	}
+}
+
+func TestLastError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Nobody is listening on this socket yet
+	file := filepath.Join(dir, "test-server.sock")
+
+	client, err := newClient(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(file),
+		fluent.WithDialTimeout(100*time.Millisecond),
+		fluent.WithWriteThreshold(1),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Shutdown(nil)
+
+	if !assert.NoError(t, client.LastError(), "LastError should be nil before anything is written") {
+		return
+	}
+
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+		return
+	}
+
+	waitFor := func(cond func() bool) bool {
+		timeout := time.After(5 * time.Second)
+		for !cond() {
+			select {
+			case <-timeout:
+				return false
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		return true
+	}
+
+	if !assert.True(t, waitFor(func() bool { return client.LastError() != nil }), "LastError should be non-nil while the server is down") {
+		return
+	}
+
+	l, err := net.Listen("unix", file)
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	if !assert.True(t, waitFor(func() bool { return client.LastError() == nil }), "LastError should be cleared after a successful write") {
+		return
+	}
+}
+
+// extValue is encoded as a 4 byte msgpack extension
+type extValue struct {
+	v uint32
+}
+
+func (v extValue) EncodeMsgpack(e *msgpack.Encoder) error {
+	return e.Writer().WriteUint32(v.v)
+}
+
+func (v *extValue) DecodeMsgpack(d *msgpack.Decoder) error {
+	n, err := d.Reader().ReadUint32()
+	if err != nil {
+		return err
+	}
+	v.v = n
+	return nil
+}
+
+func TestMsgpackExt(t *testing.T) {
+	const extType = 42
+	if !assert.NoError(t, msgpack.RegisterExt(extType, extValue{}), "msgpack.RegisterExt should succeed") {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test-server.sock")
+	l, err := net.Listen("unix", file)
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	defer l.Close()
+
+	// Read the raw bytes, as we want to look at the wire format
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer conn.Close()
+		var buf bytes.Buffer
+		io.Copy(&buf, conn)
+		received <- buf.Bytes()
+	}()
+
+	client, err := fluent.New(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(file),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"value": extValue{v: 0xdeadbeef}}), "Post should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	var buf []byte
+	select {
+	case buf = <-received:
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for payload")
+		return
+	}
+
+	// fixext 4, followed by the type, followed by the payload
+	expected := []byte{0xd6, extType, 0xde, 0xad, 0xbe, 0xef}
+	if !assert.True(t, bytes.Contains(buf, expected), "payload should contain the extension (%x)", buf) {
+		return
+	}
+}
+
+func TestPostDuringShutdown(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	const posters = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var accepted int
+	var unexpected []error
+	start := make(chan struct{})
+	for i := 0; i < posters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for {
+				err := client.Post("tag_name", map[string]interface{}{"foo": "bar"})
+				mu.Lock()
+				switch {
+				case err == nil:
+					accepted++
+				case !fluent.IsClientClosed(err):
+					unexpected = append(unexpected, err)
+				}
+				mu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	close(start)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// All posters must return once the client is closed
+	wg.Wait()
+
+	if !assert.Empty(t, unexpected, "Post should either succeed or fail because the client is closed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(500 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, accepted, "every accepted message should be flushed") {
+		return
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			received := make(chan *fluent.Message, 1)
+			var dialed []string
+			dialFunc := func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialed = append(dialed, network+" "+address)
+				client, server := net.Pipe()
+				go func() {
+					defer server.Close()
+					var msg fluent.Message
+					if err := msgpack.NewDecoder(server).Decode(&msg); err != nil {
+						return
+					}
+					received <- &msg
+				}()
+				return client, nil
+			}
+
+			client, err := fluent.New(
+				fluent.WithBuffered(buffered),
+				fluent.WithAddress("fluent.example.com"),
+				fluent.WithDialFunc(dialFunc),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			var msg *fluent.Message
+			select {
+			case msg = <-received:
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out waiting for message")
+				return
+			}
+
+			if !assert.Equal(t, []string{"tcp fluent.example.com:24224"}, dialed, "dial func should be called with the normalized address") {
+				return
+			}
+			if !assert.Equal(t, "tag_name", msg.Tag, "tag should match") {
+				return
+			}
+		})
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s, err := newTCPServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.DisconnectAfter = 5
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	var mu sync.Mutex
+	var connections int
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithWriteThreshold(1),
+		fluent.WithConnectHook(func(_ net.Conn) error {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+			return nil
+		}),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+			return
+		}
+		// give the writer a chance to write each message separately,
+		// and the server to close the connection while the writer is idle
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Equal(t, 2, connections, "client should reconnect exactly once") {
+		return
+	}
+	if !assert.Equal(t, uint64(1), client.(fluent.StatsProvider).Stats().ServerDisconnects, "the disconnect should be counted") {
+		return
+	}
+	if !assert.Len(t, s.Payload, count, "no message should be lost") {
+		return
+	}
+}
+
+func TestTimestampExtractor(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			extractor := func(record interface{}) (time.Time, bool) {
+				m, ok := record.(map[string]interface{})
+				if !ok {
+					return time.Time{}, false
+				}
+				sec, ok := m["time"].(int64)
+				if !ok {
+					return time.Time{}, false
+				}
+				return time.Unix(sec, 0).UTC(), true
+			}
+
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithTimestampExtractor(extractor),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			eventTime := time.Unix(1482493046, 0).UTC()
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"time": eventTime.Unix()}), "Post should succeed") {
+				return
+			}
+
+			// without the field, the timestamp given via WithTimestamp is used
+			fallback := time.Unix(1482493047, 0).UTC()
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}, fluent.WithTimestamp(fallback)), "Post should succeed") {
+				return
+			}
+
+			// The same goes for the time of the entries of PostAll
+			entries := []fluent.Entry{
+				{Tag: "tag_name", Time: fallback, Record: map[string]interface{}{"time": eventTime.Unix()}},
+				{Tag: "tag_name", Time: fallback, Record: map[string]interface{}{"foo": "bar"}},
+			}
+			if !assert.NoError(t, client.PostAll(entries), "PostAll should succeed") {
+				return
+			}
+
+			client.Shutdown(nil)
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 4, "expected 4 messages") {
+				return
+			}
+
+			for i := 0; i < 4; i += 2 {
+				if !assert.Equal(t, eventTime, s.Payload[i].Time.Time, "time should be extracted from the record") {
+					return
+				}
+				if !assert.Equal(t, fallback, s.Payload[i+1].Time.Time, "time should fall back to the given one") {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			var mu sync.Mutex
+			var connections int
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithWriteThreshold(1),
+				fluent.WithMaxConnLifetime(50*time.Millisecond),
+				fluent.WithConnectHook(func(_ net.Conn) error {
+					mu.Lock()
+					connections++
+					mu.Unlock()
+					return nil
+				}),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			// The first two messages are written within the lifetime of
+			// the first connection, the last one after it has expired
+			for _, wait := range []time.Duration{0, 10 * time.Millisecond, 100 * time.Millisecond} {
+				time.Sleep(wait)
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !assert.Equal(t, 2, connections, "client should reconnect once after the lifetime elapsed") {
+				return
+			}
+			if !assert.Len(t, s.Payload, 3, "expected 3 messages") {
+				return
+			}
+		})
+	}
+}
+
+func TestShutdownAll(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	var clients []fluent.Client
+	for i := 0; i < 2; i++ {
+		client, err := fluent.New(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		clients = append(clients, client)
+	}
+
+	// This client can never flush its pending buffer
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	stuck, err := fluent.New(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(filepath.Join(dir, "nobody-is-listening.sock")),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	clients = append(clients, stuck)
+
+	for _, client := range clients {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = fluent.ShutdownAll(ctx, clients...)
+	if !assert.Error(t, err, "ShutdownAll should fail") {
+		return
+	}
+	if !assert.True(t, time.Since(start) < 2*time.Second, "ShutdownAll should respect the deadline") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "failed to shutdown 1 client(s)", "only one client should fail") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), context.DeadlineExceeded.Error(), "error should be the deadline") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 2, "the other clients should have flushed") {
+		return
+	}
+}
+
+func TestLengthPrefix(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sock-")
+			if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "test-server.sock")
+			l, err := net.Listen("unix", file)
+			if !assert.NoError(t, err, "net.Listen should succeed") {
+				return
+			}
+			defer l.Close()
+
+			// Read the raw bytes, as fluentd would not understand them
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					close(received)
+					return
+				}
+				defer conn.Close()
+				var buf bytes.Buffer
+				io.Copy(&buf, conn)
+				received <- buf.Bytes()
+			}()
+
+			client, err := fluent.New(
+				fluent.WithNetwork("unix"),
+				fluent.WithAddress(file),
+				fluent.WithBuffered(buffered),
+				fluent.WithLengthPrefix(true),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			const count = 3
+			for i := 0; i < count; i++ {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"count": i}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			var buf []byte
+			select {
+			case buf = <-received:
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out waiting for payload")
+				return
+			}
+
+			for i := 0; i < count; i++ {
+				if !assert.True(t, len(buf) >= 4, "expected length prefix") {
+					return
+				}
+				size := int(binary.BigEndian.Uint32(buf))
+				buf = buf[4:]
+				if !assert.True(t, len(buf) >= size, "expected %d bytes to follow the prefix", size) {
+					return
+				}
+
+				var msg fluent.Message
+				if !assert.NoError(t, msgpack.Unmarshal(buf[:size], &msg), "frame should be a complete message") {
+					return
+				}
+				if !assert.Equal(t, "tag_name", msg.Tag, "tag should match") {
+					return
+				}
+				buf = buf[size:]
+			}
+			if !assert.Empty(t, buf, "there should be no trailing data") {
+				return
+			}
+		})
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithFlushInterval(100*time.Millisecond),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Shutdown(nil)
+
+	// A single message is well below the default write threshold
+	start := time.Now()
+	result, err := client.PostAsync("tag_name", map[string]interface{}{"foo": "bar"})
+	if !assert.NoError(t, err, "PostAsync should succeed") {
+		return
+	}
+
+	select {
+	case err := <-result.Done():
+		if !assert.NoError(t, err, "message should be written") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for the message to be flushed")
+		return
+	}
+
+	if !assert.True(t, time.Since(start) >= 100*time.Millisecond, "message should be held until the flush interval elapses") {
+		return
+	}
+}
+
+func TestRequireAck(t *testing.T) {
+	for _, skip := range []int{0, 2} {
+		t.Run(fmt.Sprintf("skip acks=%d", skip), func(t *testing.T) {
+			s, err := newTCPServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.SkipAcks = skip
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithRequireAck(true),
+				fluent.WithAckTimeout(100*time.Millisecond),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			const count = 5
+			for i := 0; i < count; i++ {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			// messages that were not acked are sent again
+			if !assert.Len(t, s.Payload, count+skip, "server should receive unacked messages twice") {
+				return
+			}
+
+			seen := make(map[string]struct{})
+			for _, msg := range s.Payload {
+				chunk, ok := chunkOption(msg)
+				if !assert.True(t, ok, "message should have a chunk option") {
+					return
+				}
+				seen[chunk] = struct{}{}
+			}
+			if !assert.Len(t, seen, count, "each message should have a distinct chunk ID") {
+				return
+			}
+		})
+	}
+}
+
+func TestInflightChunks(t *testing.T) {
+	// A writer waits for the ack of each chunk before it writes the next
+	// one, so there are never more unacked chunks than connections, however
+	// slow the server is to ack them
+	for _, connections := range []int{1, 3} {
+		t.Run(fmt.Sprintf("connections=%d", connections), func(t *testing.T) {
+			s, err := fluenttest.NewServer("unix")
+			if !assert.NoError(t, err, "NewServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.SetAckDelay(20 * time.Millisecond)
+			s.Start()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithProtocolMode("forward"),
+				fluent.WithRequireAck(true),
+				fluent.WithConnections(connections),
+				// One message per chunk, so that the chunks are spread
+				// over the connections
+				fluent.WithChunkSizeLimit(1),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			const count = 20
+			for i := 0; i < count; i++ {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			if !assert.Len(t, s.Events(), count, "server should receive all messages") {
+				return
+			}
+			if !assert.True(t, s.MaxUnacked() <= connections, "unacked chunks (%d) should not outnumber the connections", s.MaxUnacked()) {
+				return
+			}
+		})
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	for _, connections := range []int{1, 2} {
+		t.Run(fmt.Sprintf("connections=%d", connections), func(t *testing.T) {
+			s, err := fluenttest.NewServer("unix")
+			if !assert.NoError(t, err, "NewServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.RejectTag("rejected")
+			s.Start()
+
+			var mu sync.Mutex
+			var dropped []string
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithRequireAck(true),
+				fluent.WithAckTimeout(50*time.Millisecond),
+				fluent.WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1, 0, 0),
+				fluent.WithConnections(connections),
+				fluent.WithMaxRetries(3),
+				fluent.WithOnDrop(func(_ error, msg *fluent.BufferedMessage) {
+					mu.Lock()
+					defer mu.Unlock()
+					dropped = append(dropped, msg.Tag)
+				}),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			// The chunk that is never acked comes first, and would hold up
+			// the others forever
+			if !assert.NoError(t, client.Post("rejected", map[string]interface{}{"seq": 0}), "Post should succeed") {
+				return
+			}
+			const count = 3
+			for i := 0; i < count; i++ {
+				if !assert.NoError(t, client.Post("accepted", map[string]interface{}{"seq": i}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			var accepted, rejected int
+			for _, e := range s.Events() {
+				switch e.Tag {
+				case "accepted":
+					accepted++
+				case "rejected":
+					rejected++
+				}
+			}
+			if !assert.True(t, accepted >= count, "later chunks should be written") {
+				return
+			}
+			if !assert.Equal(t, 3, rejected, "rejected chunk should be sent until it is dropped") {
+				return
+			}
+			if !assert.Equal(t, uint64(1), client.Stats().DroppedAfterRetry, "rejected chunk should be counted") {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !assert.Equal(t, []string{"rejected"}, dropped, "rejected chunk should be passed to the drop hook") {
+				return
+			}
+		})
+	}
+}
+
+func TestServerErrorReply(t *testing.T) {
+	for _, connections := range []int{1, 2} {
+		t.Run(fmt.Sprintf("connections=%d", connections), func(t *testing.T) {
+			s, err := fluenttest.NewServer("unix")
+			if !assert.NoError(t, err, "NewServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.ReplyWithErrors("malformed record")
+			s.Start()
+
+			var mu sync.Mutex
+			var handled []error
+			client, err := fluent.NewBuffered(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithRequireAck(true),
+				// Much longer than the test is given to complete, so that
+				// the error reply can't be mistaken for a missing ack
+				fluent.WithAckTimeout(time.Minute),
+				fluent.WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1, 0, 0),
+				fluent.WithConnections(connections),
+				fluent.WithErrorHandler(func(err error, _ *fluent.Message) {
+					mu.Lock()
+					defer mu.Unlock()
+					handled = append(handled, err)
+				}),
+			)
+			if !assert.NoError(t, err, "fluent.NewBuffered should succeed") {
+				return
+			}
+			defer client.Close()
+
+			// The first message gets the error reply, and is sent again
+			// along with the second one, which gets a normal ack
+			for i := 0; i < 2; i++ {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+				return
+			}
+
+			seqs := map[interface{}]bool{}
+			for _, e := range s.Events() {
+				seqs[e.Record.(map[string]interface{})["seq"]] = true
+			}
+			if !assert.Len(t, seqs, 2, "both messages should be delivered") {
+				return
+			}
+
+			select {
+			case perr := <-client.Errors():
+				if !assert.Equal(t, "tag_name", perr.Tag, "tag of the rejected chunk should be reported") {
+					return
+				}
+				var serr *fluent.ServerError
+				if !assert.True(t, errors.As(perr.Err, &serr), "error should be a ServerError") {
+					return
+				}
+				if !assert.Equal(t, "malformed record", serr.Message, "message of the reply should be reported") {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("error reply should be sent to the error channel")
+				return
+			}
+
+			// The error handler has been called once the client is closed
+			client.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			var serverErrors int
+			for _, err := range handled {
+				var serr *fluent.ServerError
+				if errors.As(err, &serr) {
+					serverErrors++
+				}
+			}
+			if !assert.Equal(t, 1, serverErrors, "error reply should be passed to the error handler") {
+				return
+			}
+		})
+	}
+}
+
+func TestProtocolModeForward(t *testing.T) {
+	for _, mode := range []string{"forward", "packed_forward"} {
+		for _, requireAck := range []bool{false, true} {
+			testProtocolModeForward(t, mode, requireAck)
+		}
+	}
+}
+
+func testProtocolModeForward(t *testing.T, mode string, requireAck bool) {
+	t.Run(fmt.Sprintf("mode=%s, require ack=%t", mode, requireAck), func(t *testing.T) {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+		s.Forward = true
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		client, err := fluent.New(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithProtocolMode(mode),
+			fluent.WithRequireAck(requireAck),
+			fluent.WithTagPrefix("prefix"),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		tags := []string{"foo", "foo", "foo", "bar", "bar", "foo"}
+		for i, tag := range tags {
+			if !assert.NoError(t, client.Post(tag, map[string]interface{}{"seq": int64(i)}), "Post should succeed") {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+			return
+		}
+
+		// timing sensitive :/ we need to give the server enough time to receive
+		// the message before canceling it via scancel
+		time.Sleep(100 * time.Millisecond)
+		scancel()
+		<-s.Done()
+
+		if !assert.Equal(t, 3, s.Requests, "consecutive messages with the same tag should be sent together") {
+			return
+		}
+		if !assert.Len(t, s.Payload, len(tags), "server should receive all messages") {
+			return
+		}
+		for i, msg := range s.Payload {
+			if !assert.Equal(t, "prefix."+tags[i], msg.Tag, "tag should match") {
+				return
+			}
+			if !assert.Equal(t, map[string]interface{}{"seq": int64(i)}, msg.Record, "record should match") {
+				return
+			}
+			_, ok := chunkOption(msg)
+			if !assert.Equal(t, requireAck, ok, "chunk option should be present if acks are required") {
+				return
+			}
+		}
+	})
+}
+
+func TestPostAll(t *testing.T) {
+	tags := []string{"foo", "foo", "foo", "bar", "bar", "foo"}
+	entries := make([]fluent.Entry, len(tags))
+	for i, tag := range tags {
+		entries[i] = fluent.Entry{Tag: tag, Record: map[string]interface{}{"seq": int64(i)}}
+	}
+
+	for _, mode := range []string{"message", "forward", "unbuffered"} {
+		t.Run(fmt.Sprintf("mode=%s", mode), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.Forward = mode == "forward"
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			options := []fluent.Option{
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+			}
+			switch mode {
+			case "unbuffered":
+				options = append(options, fluent.WithBuffered(false))
+			default:
+				options = append(options, fluent.WithProtocolMode(mode))
+			}
+			client, err := newClient(options...)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.PostAll(entries, fluent.WithSyncAppend(true)), "PostAll should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if mode == "forward" {
+				if !assert.Equal(t, 3, s.Requests, "consecutive entries with the same tag should be sent together") {
+					return
+				}
+			}
+			if !assert.Len(t, s.Payload, len(tags), "server should receive all entries") {
+				return
+			}
+			for i, msg := range s.Payload {
+				if !assert.Equal(t, tags[i], msg.Tag, "tag should match") {
+					return
+				}
+				if !assert.Equal(t, map[string]interface{}{"seq": int64(i)}, msg.Record, "record should match") {
+					return
+				}
+			}
+		})
+	}
+
+	for _, mode := range []string{"message", "forward", "unbuffered"} {
+		t.Run(fmt.Sprintf("marshal failure mode=%s", mode), func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.Forward = mode == "forward"
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			options := []fluent.Option{
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+			}
+			switch mode {
+			case "unbuffered":
+				options = append(options, fluent.WithBuffered(false))
+			default:
+				options = append(options, fluent.WithProtocolMode(mode))
+			}
+			client, err := newClient(options...)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			const bad = 3
+			batch := make([]fluent.Entry, len(entries))
+			copy(batch, entries)
+			batch[bad].Record = map[string]interface{}{"seq": make(chan int)}
+
+			err = client.PostAll(batch, fluent.WithSyncAppend(true))
+			var batchErr *fluent.BatchError
+			if !assert.True(t, errors.As(err, &batchErr), "error should be a BatchError") {
+				return
+			}
+			if !assert.Equal(t, []int{bad}, batchErr.Indices(), "only the bad entry should fail") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, len(tags)-1, "server should receive the other entries") {
+				return
+			}
+			for i, msg := range s.Payload {
+				seq := i
+				if i >= bad {
+					seq++
+				}
+				if !assert.Equal(t, tags[seq], msg.Tag, "tag should match") {
+					return
+				}
+				if !assert.Equal(t, map[string]interface{}{"seq": int64(seq)}, msg.Record, "record should match") {
+					return
+				}
+			}
+		})
+	}
+
+	t.Run("buffer full", func(t *testing.T) {
+		client, err := newClient(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithBufferLimit(64),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		// The first few entries would fit, but they are rejected along
+		// with the rest
+		err = client.PostAll(entries, fluent.WithSyncAppend(true))
+		var bferr *fluent.BufferFullError
+		if !assert.True(t, errors.As(err, &bferr), "error should be a BufferFullError") {
+			return
+		}
+		if !assert.Equal(t, 0, bferr.Size, "no entry should have been appended") {
+			return
+		}
+
+		err = client.Post("foo", map[string]interface{}{"seq": 0}, fluent.WithSyncAppend(true))
+		if !assert.NoError(t, err, "Post should succeed, as the buffer is still empty") {
+			return
+		}
+	})
+}
+
+func TestChunkSizeLimit(t *testing.T) {
+	s, err := fluenttest.NewServer("unix")
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.Start()
+
+	client, err := newClient(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithProtocolMode("packed_forward"),
+		fluent.WithRequireAck(true),
+		fluent.WithChunkSizeLimit(64),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	const count = 20
+	entries := make([]fluent.Entry, count)
+	for i := range entries {
+		entries[i] = fluent.Entry{Tag: "tag_name", Record: map[string]interface{}{"seq": i}}
+	}
+	if !assert.NoError(t, client.PostAll(entries, fluent.WithSyncAppend(true)), "PostAll should succeed") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	if !assert.True(t, s.Requests() > 1, "entries should be split into several chunks") {
+		return
+	}
+	events := s.Events()
+	if !assert.Len(t, events, count, "server should receive all entries") {
+		return
+	}
+	for i, e := range events {
+		if !assert.Equal(t, map[string]interface{}{"seq": int64(i)}, e.Record, "entries should be received in order") {
+			return
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	t.Run("invalid", func(t *testing.T) {
+		_, err := fluent.New(fluent.WithCompression("lz4"))
+		if !assert.Error(t, err, "fluent.New with unknown compression should fail") {
+			return
+		}
+		_, err = fluent.New(fluent.WithCompression("gzip"), fluent.WithProtocolMode("forward"))
+		if !assert.Error(t, err, "fluent.New with compression in forward mode should fail") {
+			return
+		}
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+		s.Forward = true
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		client, err := fluent.New(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithCompression("gzip"),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		const count = 100
+		for i := 0; i < count; i++ {
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": int64(i)}), "Post should succeed") {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+			return
+		}
+
+		// timing sensitive :/ we need to give the server enough time to receive
+		// the message before canceling it via scancel
+		time.Sleep(100 * time.Millisecond)
+		scancel()
+		<-s.Done()
+
+		if !assert.Len(t, s.Payload, count, "server should receive all messages") {
+			return
+		}
+		for i, msg := range s.Payload {
+			if !assert.Equal(t, "gzip", optionValue(msg.Option, "compressed"), "compressed option should be set") {
+				return
+			}
+			if !assert.Equal(t, map[string]interface{}{"seq": int64(i)}, msg.Record, "record should match") {
+				return
+			}
+		}
+	})
+
+	t.Run("custom compressor", func(t *testing.T) {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+		s.Forward = true
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		client, err := fluent.New(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithCompressor(nopCompressor{}),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		const count = 10
+		for i := 0; i < count; i++ {
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": int64(i)}), "Post should succeed") {
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		scancel()
+		<-s.Done()
+
+		if !assert.Len(t, s.Payload, count, "server should receive all messages") {
+			return
+		}
+		for i, msg := range s.Payload {
+			if !assert.Equal(t, "none", optionValue(msg.Option, "compressed"), "compressed option should be the name of the compressor") {
+				return
+			}
+			if !assert.Equal(t, map[string]interface{}{"seq": int64(i)}, msg.Record, "record should match") {
+				return
+			}
+		}
+	})
+}
+
+type nopCompressor struct{}
+
+func (nopCompressor) Name() string {
+	return "none"
+}
+
+func (nopCompressor) NewWriter(w io.Writer) io.WriteCloser {
+	return nopWriteCloser{w}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestSharedKey(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		for _, key := range []string{"secret", "wrong"} {
+			t.Run(fmt.Sprintf("buffered=%t, key=%s", buffered, key), func(t *testing.T) {
+				s, err := newServer(t, false)
+				if !assert.NoError(t, err, "newServer should succeed") {
+					return
+				}
+				defer s.Close()
+				s.SharedKey = "secret"
+
+				// This is just to stop the server
+				sctx, scancel := context.WithCancel(context.Background())
+				defer scancel()
+
+				go s.Run(sctx)
+
+				<-s.Ready()
+
+				client, err := newClient(
+					fluent.WithNetwork(s.Network),
+					fluent.WithAddress(s.Address),
+					fluent.WithBuffered(buffered),
+					fluent.WithSharedKey(key),
+					fluent.WithSelfHostname("test-client"),
+					fluent.WithDialTimeout(500*time.Millisecond),
+				)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				err = client.Post("tag_name", map[string]interface{}{"foo": "bar"})
+				if !buffered && key != "secret" {
+					client.Close()
+					if !assert.Error(t, err, "Post should fail") {
+						return
+					}
+					if !assert.Contains(t, err.Error(), "shared_key mismatch", "error should contain the reason") {
+						return
+					}
+					return
+				}
+				if !assert.NoError(t, err, "Post should succeed") {
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				err = client.Shutdown(ctx)
+				if key != "secret" {
+					if !assert.Error(t, err, "Shutdown should fail, as the message can not be written") {
+						return
+					}
+					if !assert.Contains(t, client.LastError().Error(), "shared_key mismatch", "error should contain the reason") {
+						return
+					}
+					return
+				}
+				if !assert.NoError(t, err, "Shutdown should succeed") {
+					return
+				}
+
+				// timing sensitive :/ we need to give the server enough time to receive
+				// the message before canceling it via scancel
+				time.Sleep(100 * time.Millisecond)
+				scancel()
+				<-s.Done()
+
+				if !assert.Len(t, s.Payload, 1, "server should receive the message") {
+					return
+				}
+			})
+		}
+	}
+}
+
+func TestUserAuth(t *testing.T) {
+	var testcases = []struct {
+		name     string
+		username string
+		password string
+		success  bool
+	}{
+		{name: "valid credentials", username: "alice", password: "s3cret", success: true},
+		{name: "wrong password", username: "alice", password: "wrong"},
+		{name: "no credentials"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+			s.SharedKey = "secret"
+			s.Username = "alice"
+			s.Password = "s3cret"
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := fluent.New(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(false),
+				fluent.WithMaxConnAttempts(1),
+				fluent.WithSharedKey("secret"),
+				fluent.WithUsername(tc.username),
+				fluent.WithPassword(tc.password),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			err = client.Post("tag_name", map[string]interface{}{"foo": "bar"})
+			if !tc.success {
+				if !assert.Error(t, err, "Post should fail") {
+					return
+				}
+				return
+			}
+			if !assert.NoError(t, err, "Post should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "server should receive the message") {
+				return
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, pool, err := newTLSServer(t, false, nil)
+			if !assert.NoError(t, err, "newTLSServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			// Without the root CA, the server certificate can not be verified
+			_, err = fluent.New(
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithConnectOnStart(true),
+				fluent.WithTLSConfig(&tls.Config{}),
+			)
+			if !assert.Error(t, err, "fluent.New should fail without the root CA") {
+				return
+			}
+
+			client, err := fluent.New(
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithTLSConfig(&tls.Config{RootCAs: pool}),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the message before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 1, "server should receive the message") {
+				return
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-client-cert-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Both certificates are created upfront, so that the server trusts
+	// them both. The client starts out with the first one
+	clientCAs := x509.NewCertPool()
+	var certFiles, keyFiles []string
+	for _, name := range []string{"first", "second"} {
+		certDir := filepath.Join(dir, name)
+		if !assert.NoError(t, os.Mkdir(certDir, 0700), "os.Mkdir should succeed") {
+			return
+		}
+		certFile, keyFile, cert, err := writeClientCertificate(certDir, name)
+		if !assert.NoError(t, err, "writeClientCertificate should succeed") {
+			return
+		}
+		clientCAs.AddCert(cert)
+		certFiles = append(certFiles, certFile)
+		keyFiles = append(keyFiles, keyFile)
+	}
+
+	s, pool, err := newTLSServer(t, false, clientCAs)
+	if !assert.NoError(t, err, "newTLSServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithAddress(s.Address),
+		fluent.WithBuffered(false),
+		fluent.WithClientCertificate(certFiles[0], keyFiles[0]),
+		fluent.WithTLSConfig(&tls.Config{RootCAs: pool}),
+		fluent.WithMaxConnLifetime(time.Nanosecond),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": 1}), "Post should succeed") {
+		return
+	}
+
+	// Rotate the certificate. As the connection lifetime is very short,
+	// the next message is sent over a new connection
+	if !assert.NoError(t, os.Rename(certFiles[1], certFiles[0]), "os.Rename should succeed") {
+		return
+	}
+	if !assert.NoError(t, os.Rename(keyFiles[1], keyFiles[0]), "os.Rename should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": 2}), "Post should succeed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 2, "server should receive all messages") {
+		return
+	}
+	if !assert.Equal(t, []string{"first", "second"}, s.PeerNames, "client should present the rotated certificate") {
+		return
+	}
+}
+
+func TestHTTPNetwork(t *testing.T) {
+	type request struct {
+		path        string
+		time        string
+		contentType string
+		body        []byte
+	}
+
+	for _, buffered := range []bool{true, false} {
+		for _, useJSON := range []bool{true, false} {
+			t.Run(fmt.Sprintf("buffered=%t, json=%t", buffered, useJSON), func(t *testing.T) {
+				var mu sync.Mutex
+				var requests []request
+				closed := make(chan struct{}, 1)
+				hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := ioutil.ReadAll(r.Body)
+					mu.Lock()
+					requests = append(requests, request{
+						path:        r.URL.Path,
+						time:        r.URL.Query().Get("time"),
+						contentType: r.Header.Get("Content-Type"),
+						body:        body,
+					})
+					mu.Unlock()
+				}))
+				hs.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+					if state == http.StateClosed {
+						select {
+						case closed <- struct{}{}:
+						default:
+						}
+					}
+				}
+				hs.Start()
+				defer hs.Close()
+
+				options := []fluent.Option{
+					fluent.WithNetwork("http"),
+					fluent.WithAddress(hs.URL + "/prefix"),
+					fluent.WithBuffered(buffered),
+					fluent.WithTagPrefix("app"),
+				}
+				if useJSON {
+					options = append(options, fluent.WithJSONMarshaler())
+				}
+				client, err := fluent.New(options...)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				ts := time.Unix(1482493046, 0)
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}, fluent.WithTimestamp(ts)), "Post should succeed") {
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+					return
+				}
+
+				select {
+				case <-closed:
+				case <-time.After(5 * time.Second):
+					t.Errorf("connection should be closed along with the client")
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if !assert.Len(t, requests, 1, "server should receive one request") {
+					return
+				}
+
+				req := requests[0]
+				if !assert.Equal(t, "/prefix/app.tag_name", req.path, "path should contain the prefixed tag") {
+					return
+				}
+				if !assert.Equal(t, "1482493046", req.time, "time should match") {
+					return
+				}
+
+				var record map[string]interface{}
+				if useJSON {
+					if !assert.Equal(t, "application/json", req.contentType, "content type should match") {
+						return
+					}
+					err = json.Unmarshal(req.body, &record)
+				} else {
+					if !assert.Equal(t, "application/msgpack", req.contentType, "content type should match") {
+						return
+					}
+					err = msgpack.Unmarshal(req.body, &record)
+				}
+				if !assert.NoError(t, err, "body should be decoded") {
+					return
+				}
+				if !assert.Equal(t, map[string]interface{}{"foo": "bar"}, record, "record should match") {
+					return
+				}
+			})
+		}
+	}
+
+	t.Run("invalid address", func(t *testing.T) {
+		_, err := fluent.New(fluent.WithNetwork("http"), fluent.WithAddress("127.0.0.1:9880"))
+		if !assert.Error(t, err, "fluent.New should fail without a URL") {
+			return
+		}
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		for _, buffered := range []bool{true, false} {
+			_, err := fluent.New(
+				fluent.WithNetwork("http"),
+				fluent.WithAddress("http://127.0.0.1:9880"),
+				fluent.WithBuffered(buffered),
+				fluent.WithSharedKey("secret"),
+			)
+			if !assert.Error(t, err, "fluent.New should fail with a shared key (buffered=%t)", buffered) {
+				return
+			}
+		}
+	})
+}
+
+func TestUDPNetwork(t *testing.T) {
+	testDatagramNetwork(t, "udp", func() string { return "127.0.0.1:0" })
+}
+
+func TestUnixgramNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-unixgram-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var count int
+	testDatagramNetwork(t, "unixgram", func() string {
+		count++
+		return filepath.Join(dir, fmt.Sprintf("sock%d", count))
+	})
+}
+
+// testDatagramNetwork runs the tests for a datagram network. address is
+// called for each server that is started
+func testDatagramNetwork(t *testing.T, network string, address func() string) {
+	for _, buffered := range []bool{true, false} {
+		for _, useJSON := range []bool{true, false} {
+			t.Run(fmt.Sprintf("buffered=%t, json=%t", buffered, useJSON), func(t *testing.T) {
+				pc, err := net.ListenPacket(network, address())
+				if !assert.NoError(t, err, "ListenPacket should succeed") {
+					return
+				}
+				defer pc.Close()
+
+				options := []fluent.Option{
+					fluent.WithNetwork(network),
+					fluent.WithAddress(pc.LocalAddr().String()),
+					fluent.WithBuffered(buffered),
+				}
+				if useJSON {
+					options = append(options, fluent.WithJSONMarshaler())
+				}
+				client, err := fluent.New(options...)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				const count = 3
+				for i := 0; i < count; i++ {
+					if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"count": i}), "Post should succeed") {
+						return
+					}
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+					return
+				}
+
+				buf := make([]byte, 64*1024)
+				for i := 0; i < count; i++ {
+					pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+					n, _, err := pc.ReadFrom(buf)
+					if !assert.NoError(t, err, "ReadFrom should succeed") {
+						return
+					}
+
+					var record map[string]interface{}
+					if useJSON {
+						err = json.Unmarshal(buf[:n], &record)
+					} else {
+						err = msgpack.Unmarshal(buf[:n], &record)
+					}
+					if !assert.NoError(t, err, "datagram should contain a single record") {
+						return
+					}
+					if !assert.EqualValues(t, i, record["count"], "records should arrive in order") {
+						return
+					}
+				}
+			})
+		}
+	}
+
+	t.Run("unsupported options", func(t *testing.T) {
+		for _, opt := range []fluent.Option{
+			fluent.WithTLSConfig(&tls.Config{}),
+			fluent.WithSharedKey("secret"),
+			fluent.WithProtocolMode("forward"),
+			fluent.WithRequireAck(true),
+			fluent.WithTagPrefix("app"),
+		} {
+			_, err := fluent.New(fluent.WithNetwork(network), opt)
+			if !assert.Error(t, err, "fluent.New should fail with %s", opt.Name()) {
+				return
+			}
+		}
+	})
+}
+
+func TestNamedPipeNetwork(t *testing.T) {
+	_, err := fluent.New(fluent.WithNetwork("npipe"), fluent.WithAddress(`\\.\pipe\fluentd`), fluent.WithRequireAck(true))
+	if !assert.Error(t, err, "fluent.New should fail when acks are required") {
+		return
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	for _, buffered := range []bool{true, false} {
+		_, err := fluent.New(
+			fluent.WithNetwork("npipe"),
+			fluent.WithAddress(`\\.\pipe\fluentd`),
+			fluent.WithBuffered(buffered),
+			fluent.WithConnectOnStart(true),
+		)
+		if !assert.Error(t, err, "fluent.New should fail to connect outside of Windows") {
+			return
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	// readMessages decodes messages from the server side of the pipe,
+	// until it is closed
+	readMessages := func(conn net.Conn) <-chan []string {
+		ch := make(chan []string, 1)
+		go func() {
+			var tags []string
+			dec := msgpack.NewDecoder(conn)
+			for {
+				var msg fluent.Message
+				if err := dec.Decode(&msg); err != nil {
+					break
+				}
+				tags = append(tags, msg.Tag)
+			}
+			ch <- tags
+		}()
+		return ch
+	}
+
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("WithConn, buffered=%t", buffered), func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer serverConn.Close()
+			tagsCh := readMessages(serverConn)
+
+			client, err := fluent.New(fluent.WithConn(clientConn), fluent.WithBuffered(buffered))
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			for _, tag := range []string{"foo", "bar"} {
+				if !assert.NoError(t, client.Post(tag, map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// The client closes the connection that it was given, which
+			// ends the reader
+			select {
+			case tags := <-tagsCh:
+				if !assert.Equal(t, []string{"foo", "bar"}, tags, "messages should be received") {
+					return
+				}
+			case <-ctx.Done():
+				t.Errorf("connection was not closed by the client")
+			}
+		})
+	}
+
+	t.Run("WithConn cannot reconnect", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer serverConn.Close()
+		readMessages(serverConn)
+
+		client, err := fluent.NewUnbuffered(fluent.WithConn(clientConn), fluent.WithMaxConnAttempts(2))
+		if !assert.NoError(t, err, "fluent.NewUnbuffered should succeed") {
+			return
+		}
+
+		if !assert.NoError(t, client.Post("foo", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+			return
+		}
+
+		// Once the connection is gone, there is nothing to connect to
+		client.Close()
+		err = client.Post("foo", map[string]interface{}{"foo": "bar"})
+		if !assert.Error(t, err, "Post should fail") {
+			return
+		}
+		if !assert.Contains(t, err.Error(), "already been used", "error should explain why") {
+			return
+		}
+	})
+
+	t.Run("WithConnFactory", func(t *testing.T) {
+		var mu sync.Mutex
+		var calls int
+		var readers []<-chan []string
+		factory := func(ctx context.Context) (net.Conn, error) {
+			clientConn, serverConn := net.Pipe()
+			mu.Lock()
+			calls++
+			readers = append(readers, readMessages(serverConn))
+			mu.Unlock()
+			return clientConn, nil
+		}
+
+		client, err := fluent.NewUnbuffered(fluent.WithConnFactory(factory), fluent.WithMaxConnLifetime(time.Nanosecond))
+		if !assert.NoError(t, err, "fluent.NewUnbuffered should succeed") {
+			return
+		}
+
+		for _, tag := range []string{"foo", "bar"} {
+			if !assert.NoError(t, client.Post(tag, map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		client.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !assert.Equal(t, 2, calls, "factory should be called for each connection") {
+			return
+		}
+		for i, tag := range []string{"foo", "bar"} {
+			if !assert.Equal(t, []string{tag}, <-readers[i], "each connection should carry one message") {
+				return
+			}
+		}
+	})
+}
+
+const (
+	testProxyUser     = "proxy-user"
+	testProxyPassword = "proxy-password"
+)
+
+// runProxy accepts connections on a random port, and relays them to the
+// test server. The addresses that the clients asked for, as returned by
+// negotiate, are sent to requested
+func runProxy(ctx context.Context, s *server, negotiate func(net.Conn) (string, error), requested chan<- string) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", errors.Wrap(err, `failed to listen`)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				address, err := negotiate(conn)
+				if err != nil {
+					return
+				}
+				requested <- address
+
+				upstream, err := net.Dial(s.Network, s.Address)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}(conn)
+		}
+	}()
+	return l.Addr().String(), nil
+}
+
+// negotiateSOCKS5 is the server side of a SOCKS5 CONNECT request, which
+// requires username/password authentication
+func negotiateSOCKS5(conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if !bytes.Contains(methods, []byte{0x02}) {
+		conn.Write([]byte{0x05, 0xff})
+		return "", errors.New(`client does not support authentication`)
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	readString := func() (string, error) {
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		buf := make([]byte, l[0])
+		_, err := io.ReadFull(conn, buf)
+		return string(buf), err
+	}
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return "", err
+	}
+	user, err := readString()
+	if err != nil {
+		return "", err
+	}
+	password, err := readString()
+	if err != nil {
+		return "", err
+	}
+	if user != testProxyUser || password != testProxyPassword {
+		conn.Write([]byte{0x01, 0x01})
+		return "", errors.New(`authentication failed`)
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make(net.IP, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 0x03:
+		if host, err = readString(); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.Errorf(`unsupported address type %d`, req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// negotiateHTTPConnect is the server side of an HTTP CONNECT request,
+// which requires basic authentication
+func negotiateHTTPConnect(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(testProxyUser+":"+testProxyPassword))
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != expected {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", errors.New(`authentication failed`)
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, nil
+}
+
+func TestProxy(t *testing.T) {
+	proxies := []struct {
+		scheme    string
+		negotiate func(net.Conn) (string, error)
+	}{
+		{scheme: "socks5", negotiate: negotiateSOCKS5},
+		{scheme: "http", negotiate: negotiateHTTPConnect},
+	}
+
+	for _, proxy := range proxies {
+		for _, buffered := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s, buffered=%t", proxy.scheme, buffered), func(t *testing.T) {
+				s, err := newServer(t, false)
+				if !assert.NoError(t, err, "newServer should succeed") {
+					return
+				}
+				defer s.Close()
+
+				// This is just to stop the server
+				sctx, scancel := context.WithCancel(context.Background())
+				defer scancel()
+
+				go s.Run(sctx)
+
+				<-s.Ready()
+
+				requested := make(chan string, 1)
+				proxyAddress, err := runProxy(sctx, s, proxy.negotiate, requested)
+				if !assert.NoError(t, err, "runProxy should succeed") {
+					return
+				}
+
+				// The address is resolved by the proxy, which relays
+				// everything to the test server
+				const address = "fluent.example.com:24224"
+
+				_, err = fluent.New(
+					fluent.WithAddress(address),
+					fluent.WithBuffered(buffered),
+					fluent.WithConnectOnStart(true),
+					fluent.WithProxy(fmt.Sprintf("%s://%s:wrong@%s", proxy.scheme, testProxyUser, proxyAddress)),
+				)
+				if !assert.Error(t, err, "fluent.New should fail with wrong credentials") {
+					return
+				}
+
+				client, err := fluent.New(
+					fluent.WithAddress(address),
+					fluent.WithBuffered(buffered),
+					fluent.WithProxy(fmt.Sprintf("%s://%s:%s@%s", proxy.scheme, testProxyUser, testProxyPassword, proxyAddress)),
+				)
+				if !assert.NoError(t, err, "fluent.New should succeed") {
+					return
+				}
+
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+					return
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+					return
+				}
+
+				// timing sensitive :/ we need to give the server enough time to receive
+				// the message before canceling it via scancel
+				time.Sleep(100 * time.Millisecond)
+				scancel()
+				<-s.Done()
+
+				if !assert.Len(t, s.Payload, 1, "server should receive the message") {
+					return
+				}
+				if !assert.Equal(t, address, <-requested, "proxy should be asked for the server address") {
+					return
+				}
+			})
+		}
+	}
+
+	t.Run("invalid proxy", func(t *testing.T) {
+		for _, options := range [][]fluent.Option{
+			{fluent.WithProxy("ftp://proxy.example.com")},
+			{fluent.WithProxy("socks5://proxy.example.com"), fluent.WithNetwork("unix")},
+		} {
+			_, err := fluent.New(options...)
+			if !assert.Error(t, err, "fluent.New should fail") {
+				return
+			}
+		}
+	})
+}
+
+func TestFailover(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sock-")
+			if !assert.NoError(t, err, "TempDir should succeed") {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			// Nothing is listening on the primary address to begin with
+			primaryAddress := filepath.Join(dir, "primary.sock")
+
+			standby, err := newServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer standby.Close()
+
+			// This is just to stop the servers
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go standby.Run(sctx)
+			<-standby.Ready()
+
+			const fallbackInterval = 200 * time.Millisecond
+			client, err := newClient(
+				fluent.WithNetwork("unix"),
+				fluent.WithAddresses(primaryAddress, standby.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithFallbackInterval(fallbackInterval),
+				fluent.WithDialTimeout(100*time.Millisecond),
+				fluent.WithWriteThreshold(1),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			result, err := client.PostAsync("standby", map[string]interface{}{"foo": "bar"})
+			if !assert.NoError(t, err, "PostAsync should succeed") {
+				return
+			}
+			if !assert.NoError(t, <-result.Done(), "message should be written") {
+				return
+			}
+
+			// Once the primary is back, it is used again after the
+			// fallback interval
+			primary, err := newUnixServer(t, false, primaryAddress)
+			if !assert.NoError(t, err, "newUnixServer should succeed") {
+				return
+			}
+			defer primary.Close()
+
+			go primary.Run(sctx)
+			<-primary.Ready()
+
+			time.Sleep(fallbackInterval)
+
+			if !assert.NoError(t, client.Post("primary", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the servers enough time to receive
+			// the messages before canceling them via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-standby.Done()
+			<-primary.Done()
+
+			for _, tc := range []struct {
+				server *server
+				tag    string
+			}{
+				{server: standby, tag: "standby"},
+				{server: primary, tag: "primary"},
+			} {
+				if !assert.Len(t, tc.server.Payload, 1, "%s should receive one message", tc.tag) {
+					return
+				}
+				if !assert.Equal(t, tc.tag, tc.server.Payload[0].Tag, "%s should receive its message", tc.tag) {
+					return
+				}
+			}
+		})
+	}
+
+	t.Run("no addresses", func(t *testing.T) {
+		_, err := fluent.New(fluent.WithAddresses())
+		if !assert.Error(t, err, "fluent.New should fail") {
+			return
+		}
+	})
+}
+
+func TestLoadBalancing(t *testing.T) {
+	// This is just to stop the servers
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	var servers []*server
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		s, err := newServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+
+		go s.Run(sctx)
+		<-s.Ready()
+
+		servers = append(servers, s)
+		addresses = append(addresses, s.Address)
+	}
+
+	client, err := newClient(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddresses(addresses...),
+		fluent.WithLoadBalancing("round_robin"),
+		fluent.WithWriteThreshold(1),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	// Each message is written separately, so that they are spread
+	// across the servers
+	for i := 0; i < 4; i++ {
+		result, err := client.PostAsync("tag_name", map[string]interface{}{"seq": i})
+		if !assert.NoError(t, err, "PostAsync should succeed") {
+			return
+		}
+		if !assert.NoError(t, <-result.Done(), "message should be written") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the servers enough time to receive
+	// the messages before canceling them via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	for i, s := range servers {
+		<-s.Done()
+		if !assert.Len(t, s.Payload, 2, "server %d should receive half of the messages", i) {
+			return
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing is listening on this address
+	client, err := newClient(
+		fluent.WithNetwork("unix"),
+		fluent.WithAddress(filepath.Join(dir, "fluent.sock")),
+		fluent.WithBackoff(10*time.Millisecond, 50*time.Millisecond, 2, 0.5, 3),
+		fluent.WithWriteThreshold(1),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	defer client.Close()
+
+	result, err := client.PostAsync("test", map[string]interface{}{"foo": "bar"})
+	if !assert.NoError(t, err, "PostAsync should succeed") {
+		return
+	}
+
+	select {
+	case err := <-result.Done():
+		if !assert.Error(t, err, "message should be discarded after the max retries") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("message should be discarded after the max retries")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sock-")
+	if !assert.NoError(t, err, "TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing is listening on this address to begin with
+	address := filepath.Join(dir, "fluent.sock")
+	newPolicyClient := func(policy fluent.RetryPolicy, options ...fluent.Option) (testClient, error) {
+		return newClient(append([]fluent.Option{
+			fluent.WithNetwork("unix"),
+			fluent.WithAddress(address),
+			fluent.WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1, 0, 0),
+			fluent.WithRetryPolicy(policy),
+			fluent.WithWriteThreshold(1),
+		}, options...)...)
+	}
+
+	t.Run("dead letter", func(t *testing.T) {
+		var mu sync.Mutex
+		var deadLetters []*fluent.BufferedMessage
+		var attempts int
+		client, err := newPolicyClient(fluent.RetryPolicy{
+			MaxAttempts: 10,
+			Retryable: func(err error) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				return false
+			},
+			Exhausted: "dead_letter",
+			DeadLetter: func(_ error, msg *fluent.BufferedMessage) {
+				mu.Lock()
+				defer mu.Unlock()
+				deadLetters = append(deadLetters, msg)
+			},
+		})
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		result, err := client.PostAsync("test", map[string]interface{}{"foo": "bar"})
+		if !assert.NoError(t, err, "PostAsync should succeed") {
+			return
+		}
+		if !assert.Error(t, <-result.Done(), "message should not be written") {
+			return
+		}
+		// DeadLetter is called in the background, before the client is done
+		client.Shutdown(nil)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !assert.Equal(t, 1, attempts, "errors that are not retryable should not be retried") {
+			return
+		}
+		if !assert.Len(t, deadLetters, 1, "message should be passed to DeadLetter") {
+			return
+		}
+		if !assert.Equal(t, "test", deadLetters[0].Tag, "tag should match") {
+			return
+		}
+	})
+	t.Run("drop", func(t *testing.T) {
+		client, err := newPolicyClient(fluent.RetryPolicy{MaxAttempts: 2})
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		result, err := client.PostAsync("test", map[string]interface{}{"foo": "bar"})
+		if !assert.NoError(t, err, "PostAsync should succeed") {
+			return
+		}
+		select {
+		case err := <-result.Done():
+			if !assert.Error(t, err, "message should be discarded after the max attempts") {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("message should be discarded after the max attempts")
+		}
+	})
+	t.Run("block", func(t *testing.T) {
+		client, err := newPolicyClient(
+			fluent.RetryPolicy{MaxAttempts: 2, Exhausted: "block"},
+			fluent.WithWriteQueueSize(1),
+			fluent.WithPostTimeout(100*time.Millisecond),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		if !assert.NoError(t, client.Post("test", map[string]interface{}{"count": 1}), "Post should succeed") {
+			return
+		}
+		// Give the client time to exhaust its attempts
+		time.Sleep(200 * time.Millisecond)
+
+		// The reader holds on to the next message, and the queue to the
+		// one after that. Anything more blocks
+		var posted int
+		for i := 2; i <= 4; i++ {
+			if client.Post("test", map[string]interface{}{"count": i}) != nil {
+				break
+			}
+			posted++
+		}
+		if !assert.Equal(t, 2, posted, "Post should block once the retries are exhausted") {
+			return
+		}
+
+		s, err := newUnixServer(t, false, address)
+		if !assert.NoError(t, err, "newUnixServer should succeed") {
+			return
+		}
+		defer s.Close()
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+		<-s.Ready()
+
+		if !assert.NoError(t, client.Post("test", map[string]interface{}{"count": 4}), "Post should succeed once the server is back") {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+			return
+		}
+
+		// timing sensitive :/ we need to give the server enough time to receive
+		// the messages before canceling it via scancel
+		time.Sleep(100 * time.Millisecond)
+		scancel()
+		<-s.Done()
+
+		if !assert.Len(t, s.Payload, 4, "all messages should be written") {
+			return
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newPolicyClient(fluent.RetryPolicy{Exhausted: "dead_letter"})
+		if !assert.Error(t, err, "fluent.New should fail without DeadLetter") {
+			return
+		}
+		_, err = newPolicyClient(fluent.RetryPolicy{Exhausted: "retry_forever"})
+		if !assert.Error(t, err, "fluent.New should fail with an invalid policy") {
+			return
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sock-")
+			if !assert.NoError(t, err, "TempDir should succeed") {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			// Nothing is listening on this address to begin with
+			address := filepath.Join(dir, "fluent.sock")
+
+			const cooldown = 200 * time.Millisecond
+			client, err := newClient(
+				fluent.WithNetwork("unix"),
+				fluent.WithAddress(address),
+				fluent.WithBuffered(buffered),
+				fluent.WithCircuitBreaker(2, cooldown),
+				fluent.WithBackoff(10*time.Millisecond, 10*time.Millisecond, 1, 0, 0),
+				fluent.WithMaxConnAttempts(1),
+				fluent.WithWriteThreshold(1),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+			defer client.Close()
+
+			// The unbuffered client fails once for each message, while the
+			// buffered client keeps trying to write the first one
+			for i := 0; i < 2; i++ {
+				result, err := client.PostAsync("test", map[string]interface{}{"foo": "bar"})
+				if !assert.NoError(t, err, "PostAsync should succeed") {
+					return
+				}
+				if !assert.Error(t, <-result.Done(), "message should not be written") {
+					return
+				}
+				if buffered {
+					break
+				}
+			}
+
+			err = client.Post("test", map[string]interface{}{"foo": "bar"})
+			if !assert.True(t, fluent.IsCircuitOpen(err), "Post should fail while the circuit is open (%v)", err) {
+				return
+			}
+
+			s, err := newUnixServer(t, false, address)
+			if !assert.NoError(t, err, "newUnixServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+			<-s.Ready()
+
+			time.Sleep(cooldown)
+
+			result, err := client.PostAsync("probe", map[string]interface{}{"foo": "bar"})
+			if !assert.NoError(t, err, "PostAsync should succeed once the cooldown has elapsed") {
+				return
+			}
+			if !assert.NoError(t, <-result.Done(), "probe should be written") {
+				return
+			}
+			if !assert.NoError(t, client.Post("test", map[string]interface{}{"foo": "bar"}), "Post should succeed once the circuit has closed") {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			// timing sensitive :/ we need to give the server enough time to receive
+			// the messages before canceling it via scancel
+			time.Sleep(100 * time.Millisecond)
+			scancel()
+			<-s.Done()
+
+			if !assert.Len(t, s.Payload, 2, "server should receive the probe and the next message") {
+				return
+			}
+			if !assert.Equal(t, "probe", s.Payload[0].Tag, "server should receive the probe first") {
+				return
+			}
+		})
+	}
+}
+
+func TestConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	defer l.Close()
+
+	// Unlike the test server, this reads from all connections at once
+	var mu sync.Mutex
+	var accepted int
+	received := make(map[string]int)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				dec := msgpack.NewDecoder(conn)
+				for {
+					var v fluent.Message
+					if err := dec.Decode(&v); err != nil {
+						return
+					}
+					mu.Lock()
+					received[v.Tag]++
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+
+	// The messages are large enough to be split into several batches,
+	// and are only written once they have all been posted, so that all
+	// connections take part
+	const connections = 3
+	const count = 500
+	payload := strings.Repeat("x", 1024)
+	client, err := fluent.New(
+		fluent.WithAddress(l.Addr().String()),
+		fluent.WithConnections(connections),
+		fluent.WithWriteThreshold(count*len(payload)),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post(fmt.Sprintf("tag%d", i), map[string]interface{}{"payload": payload}), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the messages
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !assert.Equal(t, connections, accepted, "client should open all connections") {
+		return
+	}
+	if !assert.Len(t, received, count, "server should receive all messages") {
+		return
+	}
+	for tag, n := range received {
+		if !assert.Equal(t, 1, n, "server should receive %s exactly once", tag) {
+			return
+		}
+	}
+
+	t.Run("unsupported network", func(t *testing.T) {
+		_, err := fluent.New(
+			fluent.WithNetwork("udp"),
+			fluent.WithConnections(connections),
+		)
+		if !assert.Error(t, err, "fluent.New should fail") {
+			return
+		}
+	})
+}
+
+func TestWriteDeadline(t *testing.T) {
+	// This server accepts connections, but never reads from them
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	defer l.Close()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+
+	// Large enough to fill up the socket buffers
+	payload := strings.Repeat("x", 32*1024*1024)
+
+	t.Run("buffered=false", func(t *testing.T) {
+		client, err := fluent.New(
+			fluent.WithAddress(l.Addr().String()),
+			fluent.WithBuffered(false),
+			fluent.WithWriteDeadline(100*time.Millisecond),
+			fluent.WithMaxConnAttempts(1),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		start := time.Now()
+		if !assert.Error(t, client.Post("test", map[string]interface{}{"payload": payload}), "Post should fail") {
+			return
+		}
+		if !assert.True(t, time.Since(start) < 5*time.Second, "Post should not block") {
+			return
+		}
+	})
+
+	t.Run("buffered=true", func(t *testing.T) {
+		client, err := newClient(
+			fluent.WithAddress(l.Addr().String()),
+			fluent.WithWriteDeadline(100*time.Millisecond),
+			fluent.WithBufferLimit(64*1024*1024),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+
+		if !assert.NoError(t, client.Post("test", map[string]interface{}{"payload": payload}), "Post should succeed") {
+			return
+		}
+
+		timeout := time.After(5 * time.Second)
+		for client.LastError() == nil {
+			select {
+			case <-timeout:
+				t.Errorf("write should time out")
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		// The writer is not stuck, so Shutdown can give up on it
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		client.Shutdown(ctx)
+	})
+}
+
+func TestConnectionEvents(t *testing.T) {
+	s, err := newTCPServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.DisconnectAfter = 1
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithWriteThreshold(1),
+		fluent.WithOnConnect(func(address string) {
+			record("connect " + address)
+		}),
+		fluent.WithOnDisconnect(func(address string, err error) {
+			record(fmt.Sprintf("disconnect %s (lost=%t)", address, err != nil))
+		}),
+		fluent.WithOnReconnect(func(address string, downtime time.Duration) {
+			record("reconnect " + address)
+		}),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+			return
+		}
+		// give the server a chance to close the connection while the
+		// writer is idle
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{
+		"connect " + s.Address,
+		"disconnect " + s.Address + " (lost=true)",
+		"connect " + s.Address,
+		"reconnect " + s.Address,
+		"disconnect " + s.Address + " (lost=false)",
+	}
+	if !assert.Equal(t, expected, events, "events should be reported in order") {
+		return
+	}
+
+	t.Run("unsupported network", func(t *testing.T) {
+		for _, network := range []string{"udp", "http"} {
+			_, err := fluent.New(
+				fluent.WithNetwork(network),
+				fluent.WithOnConnect(func(string) {}),
+			)
+			if !assert.Error(t, err, "fluent.New should fail over %s", network) {
+				return
+			}
+		}
+	})
+}
+
+func TestIsConnected(t *testing.T) {
+	for _, buffered := range []bool{true, false} {
+		t.Run(fmt.Sprintf("buffered=%t", buffered), func(t *testing.T) {
+			s, err := newTCPServer(t, false)
+			if !assert.NoError(t, err, "newServer should succeed") {
+				return
+			}
+			defer s.Close()
+
+			// This is just to stop the server
+			sctx, scancel := context.WithCancel(context.Background())
+			defer scancel()
+
+			go s.Run(sctx)
+
+			<-s.Ready()
+
+			client, err := newClient(
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+				fluent.WithBuffered(buffered),
+				fluent.WithWriteThreshold(1),
+			)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			if !assert.False(t, client.IsConnected(), "client should not be connected before posting") {
+				return
+			}
+
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			if !assert.True(t, client.IsConnected(), "client should be connected after posting") {
+				return
+			}
+
+			client.Shutdown(nil)
+			if !assert.False(t, client.IsConnected(), "client should not be connected after Shutdown") {
+				return
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	t.Run("flushes pending messages", func(t *testing.T) {
+		s, err := newTCPServer(t, false)
+		if !assert.NoError(t, err, "newServer should succeed") {
+			return
+		}
+		defer s.Close()
+
+		// This is just to stop the server
+		sctx, scancel := context.WithCancel(context.Background())
+		defer scancel()
+
+		go s.Run(sctx)
+
+		<-s.Ready()
+
+		// Nothing would be written for an hour without Flush
+		client, err := newClient(
+			fluent.WithNetwork(s.Network),
+			fluent.WithAddress(s.Address),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithFlushInterval(time.Hour),
+		)
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Shutdown(nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Flush(ctx), "Flush should succeed with nothing to flush") {
+			return
+		}
+
+		for i := 0; i < 3; i++ {
+			if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": i}), "Post should succeed") {
+				return
+			}
+		}
+		if !assert.NoError(t, client.Flush(ctx), "Flush should succeed") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		if !assert.Len(t, s.Payload, 3, "all messages should have been written") {
+			return
+		}
+	})
+	t.Run("times out", func(t *testing.T) {
+		// Nothing is listening on this address
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err, "net.Listen should succeed") {
+			return
+		}
+		dead := l.Addr().String()
+		l.Close()
+
+		client, err := newClient(fluent.WithAddress(dead))
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		defer client.Close()
+
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"foo": 1}), "Post should succeed") {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if !assert.Equal(t, context.DeadlineExceeded, client.Flush(ctx), "Flush should time out") {
+			return
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		client, err := newClient()
+		if !assert.NoError(t, err, "fluent.New should succeed") {
+			return
+		}
+		client.Close()
+
+		if !assert.True(t, errors.Is(client.Flush(context.Background()), fluent.ErrClosed), "Flush should fail after Close") {
+			return
+		}
+	})
+}
+
+func TestBufferFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+
+	// Nothing is listening on this address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, "net.Listen should succeed") {
+		return
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	const count = 20
+	client, err := fluent.New(
+		fluent.WithAddress(dead),
+		fluent.WithBufferFile(path, 0),
+		// Only a few messages fit in memory, the rest go to the file
+		fluent.WithBufferLimit(64),
+		fluent.WithMaxConnAttempts(1),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}, fluent.WithSyncAppend(true)), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	client.Shutdown(ctx)
+
+	messages := readBufferFile(t, path)
+	if !assert.Len(t, messages, count, "all messages should be left in the buffer file") {
+		return
+	}
+	for _, msg := range messages {
+		if !assert.Equal(t, "tag_name", msg.Tag, "tag should be read from the buffer file") {
+			return
+		}
+	}
+
+	s, err := newTCPServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	// The new client sends what the previous one left behind, before
+	// its own messages
+	client, err = fluent.New(
+		fluent.WithAddress(s.Address),
+		fluent.WithBufferFile(path, 0),
+		fluent.WithBufferLimit(64),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+	if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": count}), "Post should succeed") {
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, count+1, "all messages should be received") {
+		return
+	}
+	for i, msg := range s.Payload {
+		record, ok := msg.Record.(map[string]interface{})
+		if !assert.True(t, ok, "record should be a map") {
+			return
+		}
+		if !assert.EqualValues(t, i, record["seq"], "messages should be received in order") {
+			return
+		}
+	}
+
+	if !assert.Empty(t, readBufferFile(t, path), "buffer file should be empty once everything has been sent") {
+		return
+	}
+}
+
+func readBufferFile(t *testing.T, path string) []*fluent.BufferedMessage {
+	f, err := fluent.OpenBufferFile(path)
+	if !assert.NoError(t, err, "fluent.OpenBufferFile should succeed") {
+		return nil
+	}
+	defer f.Close()
+
+	var messages []*fluent.BufferedMessage
+	for {
+		msg, err := f.Next()
+		if err == io.EOF {
+			return messages
+		}
+		if !assert.NoError(t, err, "Next should succeed") {
+			return nil
+		}
+		messages = append(messages, msg)
+	}
+}
+
+// sliceBuffer is a fluent.Buffer that keeps the messages in memory, and
+// records how it is used
+type sliceBuffer struct {
+	mu        sync.Mutex
+	messages  []*fluent.BufferedMessage
+	read      int
+	truncated int
+	closed    bool
+}
+
+func (b *sliceBuffer) Write(msg *fluent.BufferedMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	copied := *msg
+	copied.Data = append([]byte(nil), msg.Data...)
+	b.messages = append(b.messages, &copied)
+	return nil
+}
+
+func (b *sliceBuffer) Read() (*fluent.BufferedMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.read == len(b.messages) {
+		return nil, io.EOF
+	}
+	b.read++
+	return b.messages[b.read-1], nil
+}
+
+func (b *sliceBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.messages)
+}
+
+func (b *sliceBuffer) Truncate(n int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages = b.messages[n:]
+	b.read -= n
+	b.truncated += n
+	return nil
+}
+
+func (b *sliceBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func TestCustomBuffer(t *testing.T) {
+	s, err := newServer(t, false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	var b sliceBuffer
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithBuffer(&b),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"seq": i}), "Post should succeed") {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, count, "all messages should be received") {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !assert.Equal(t, count, b.truncated, "all messages should be truncated from the buffer") {
+		return
+	}
+	if !assert.Empty(t, b.messages, "buffer should be empty") {
+		return
+	}
+	if !assert.True(t, b.closed, "buffer should be closed") {
+		return
+	}
+}
@@ -0,0 +1,108 @@
+// Package fluentlogrus provides a logrus.Hook that posts log entries to
+// fluentd using a fluent.Client.
+package fluentlogrus
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook is a logrus.Hook that posts each entry to fluentd as a record of
+// the form
+//
+//	{"level": "info", "message": "...", <fields>...}
+//
+// The caller is added as "caller" if the logger reports it. Fields whose
+// values are errors, times, or durations are converted to strings. The
+// timestamp of the message is the time of the entry.
+type Hook struct {
+	client   fluent.Client
+	fallback func(*logrus.Entry, error)
+	levels   []logrus.Level
+	options  []fluent.Option
+	tag      string
+}
+
+// NewHook creates a Hook that posts entries of all levels with the given
+// tag using client. The options are passed to client.Post for every
+// entry.
+//
+// So that logging does not stall when fluentd cannot keep up, entries
+// are posted with fluent.WithNonBlocking(true), unless the options say
+// otherwise. See SetFallback for what happens to the entries that are
+// rejected.
+func NewHook(client fluent.Client, tag string, options ...fluent.Option) *Hook {
+	return &Hook{
+		client:  client,
+		levels:  logrus.AllLevels,
+		options: append([]fluent.Option{fluent.WithNonBlocking(true)}, options...),
+		tag:     tag,
+	}
+}
+
+// SetLevels specifies the levels of the entries that are posted
+func (h *Hook) SetLevels(levels ...logrus.Level) {
+	h.levels = levels
+}
+
+// SetFallback specifies a function that is called with the entries that
+// were rejected because the client is saturated, i.e. its buffer or its
+// queue is full, or its circuit breaker is open. The function may, for
+// example, write the entry to a local file. The error is not returned to
+// logrus then.
+//
+// Without a fallback, or for other errors, the error is returned to
+// logrus, which reports it on stderr.
+func (h *Hook) SetFallback(f func(entry *logrus.Entry, err error)) {
+	h.fallback = f
+}
+
+// Levels returns the levels of the entries that are posted
+func (h *Hook) Levels() []logrus.Level {
+	return h.levels
+}
+
+// Fire posts entry
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	record := make(map[string]interface{}, len(entry.Data)+3)
+	for k, v := range entry.Data {
+		record[k] = fieldValue(v)
+	}
+	record["level"] = entry.Level.String()
+	record["message"] = entry.Message
+	if entry.HasCaller() {
+		record["caller"] = fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line)
+	}
+
+	options := append(h.options[:len(h.options):len(h.options)], fluent.WithTimestamp(entry.Time))
+	err := h.client.Post(h.tag, record, options...)
+	if err != nil && h.fallback != nil && isSaturated(err) {
+		h.fallback(entry, err)
+		return nil
+	}
+	return err
+}
+
+// isSaturated reports whether err was returned because the client could
+// not take any more messages for now
+func isSaturated(err error) bool {
+	return errors.Is(err, fluent.ErrBufferFull) || errors.Is(err, fluent.ErrQueueFull) || errors.Is(err, fluent.ErrCircuitOpen)
+}
+
+// fieldValue converts v to a value that both of the client's marshalers
+// can serialize
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	}
+	return v
+}
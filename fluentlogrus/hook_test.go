@@ -0,0 +1,114 @@
+package fluentlogrus_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluentlogrus"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type message struct {
+	tag    string
+	record interface{}
+}
+
+// client records the messages that are posted, instead of sending them.
+// If err is set, it is returned instead
+type client struct {
+	err      error
+	messages []message
+}
+
+func (c *client) Post(tag string, v interface{}, _ ...fluent.Option) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.messages = append(c.messages, message{tag: tag, record: v})
+	return nil
+}
+
+func (c *client) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return c.Post(tag, v, options...)
+}
+
+func (c *client) Close() error {
+	return nil
+}
+
+func (c *client) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func newLogger(hook logrus.Hook) *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.Level = logrus.DebugLevel
+	logger.AddHook(hook)
+	return logger
+}
+
+func TestHook(t *testing.T) {
+	c := &client{}
+	hook := fluentlogrus.NewHook(c, "app")
+	hook.SetLevels(logrus.InfoLevel, logrus.WarnLevel)
+	logger := newLogger(hook)
+
+	logger.Debug("not posted")
+	logger.WithFields(logrus.Fields{
+		"port":    8080,
+		"elapsed": 2 * time.Second,
+	}).WithError(errors.New("timeout")).Warn("slow start")
+
+	if !assert.Len(t, c.messages, 1, "expected 1 message") {
+		return
+	}
+	if !assert.Equal(t, "app", c.messages[0].tag, "tag should match") {
+		return
+	}
+	expected := map[string]interface{}{
+		"level":   "warning",
+		"message": "slow start",
+		"port":    8080,
+		"elapsed": "2s",
+		"error":   "timeout",
+	}
+	if !assert.Equal(t, expected, c.messages[0].record, "record should match") {
+		return
+	}
+}
+
+func TestHookFallback(t *testing.T) {
+	c := &client{err: &fluent.BufferFullError{Limit: 1}}
+	hook := fluentlogrus.NewHook(c, "app")
+
+	// Without a fallback, the error goes back to logrus
+	if !assert.Error(t, hook.Fire(logrus.NewEntry(newLogger(hook))), "Fire should fail") {
+		return
+	}
+
+	var fallback []error
+	hook.SetFallback(func(_ *logrus.Entry, err error) {
+		fallback = append(fallback, err)
+	})
+	if !assert.NoError(t, hook.Fire(logrus.NewEntry(newLogger(hook))), "Fire should succeed with a fallback") {
+		return
+	}
+	if !assert.Len(t, fallback, 1, "the fallback should be called") {
+		return
+	}
+
+	// Other errors are not handled by the fallback
+	c.err = errors.New("marshal failed")
+	if !assert.Error(t, hook.Fire(logrus.NewEntry(newLogger(hook))), "Fire should fail") {
+		return
+	}
+	if !assert.Len(t, fallback, 1, "the fallback should not be called") {
+		return
+	}
+}
@@ -0,0 +1,114 @@
+// Package fluentotel provides a fluent.WriteTracer that records the writes
+// of a buffered client as OpenTelemetry spans and metrics, so that stalls
+// in the shipping of logs can be correlated with the traces of a service.
+package fluentotel
+
+import (
+	"context"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/lestrrat/go-fluent-client/fluentotel"
+
+// WriteTracer starts a span for each write to the server, named
+// "fluent.write", with the following attributes:
+//
+//	server.address    address of the server being written to
+//	fluent.network    network of the server
+//	fluent.chunk_id   chunk ID of the messages, if any
+//	fluent.messages   number of messages being written
+//	fluent.bytes      number of bytes being written
+//	fluent.attempt    1, plus the number of attempts that failed in a row before this one
+//
+// It also records the following metrics, with the attributes
+// server.address, fluent.network and fluent.failed:
+//
+//	fluent.client.write.duration   time taken by the writes, in seconds
+//	fluent.client.write.size       number of bytes written
+type WriteTracer struct {
+	tracer   trace.Tracer
+	duration metric.Float64Histogram
+	size     metric.Int64Counter
+}
+
+// NewWriteTracer creates a WriteTracer that uses the given providers. If
+// either is nil, the global one is used (see otel.GetTracerProvider and
+// otel.GetMeterProvider).
+func NewWriteTracer(tp trace.TracerProvider, mp metric.MeterProvider) (*WriteTracer, error) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+
+	meter := mp.Meter(instrumentationName)
+	duration, err := meter.Float64Histogram(
+		"fluent.client.write.duration",
+		metric.WithDescription("Time taken by the writes to the server."),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create duration histogram`)
+	}
+	size, err := meter.Int64Counter(
+		"fluent.client.write.size",
+		metric.WithDescription("Number of bytes written to the server."),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create size counter`)
+	}
+
+	return &WriteTracer{
+		tracer:   tp.Tracer(instrumentationName),
+		duration: duration,
+		size:     size,
+	}, nil
+}
+
+// StartWrite starts the span for the write described by info, and
+// returns the function that ends it.
+func (t *WriteTracer) StartWrite(info fluent.WriteInfo) func(error) {
+	attrs := []attribute.KeyValue{
+		attribute.String("server.address", info.Address),
+		attribute.String("fluent.network", info.Network),
+		attribute.Int("fluent.messages", info.Messages),
+		attribute.Int("fluent.bytes", info.Bytes),
+		attribute.Int("fluent.attempt", info.Attempt),
+	}
+	if info.Chunk != "" {
+		attrs = append(attrs, attribute.String("fluent.chunk_id", info.Chunk))
+	}
+
+	start := time.Now()
+	ctx, span := t.tracer.Start(context.Background(), "fluent.write",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
+		measured := metric.WithAttributes(
+			attribute.String("server.address", info.Address),
+			attribute.String("fluent.network", info.Network),
+			attribute.Bool("fluent.failed", err != nil),
+		)
+		t.duration.Record(ctx, time.Since(start).Seconds(), measured)
+		if err == nil {
+			t.size.Add(ctx, int64(info.Bytes), measured)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package fluentotel_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluentotel"
+	"github.com/lestrrat/go-fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWriteTracer(t *testing.T) {
+	s, err := fluenttest.NewServer("unix")
+	if !assert.NoError(t, err, "NewServer should succeed") {
+		return
+	}
+	defer s.Close()
+	s.Start()
+
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	tracer, err := fluentotel.NewWriteTracer(tp, mp)
+	if !assert.NoError(t, err, "NewWriteTracer should succeed") {
+		return
+	}
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithProtocolMode("forward"),
+		fluent.WithRequireAck(true),
+		fluent.WithWriteTracer(tracer),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	for _, v := range []string{"foo", "bar", "baz"} {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"v": v}), "Post should succeed") {
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+		return
+	}
+
+	// The messages may be written in more than one chunk
+	var messages int64
+	for _, span := range spans.Ended() {
+		if !assert.Equal(t, "fluent.write", span.Name(), "span name should match") {
+			return
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if !assert.Equal(t, s.Address, attrs["server.address"].AsString(), "address should be recorded") {
+			return
+		}
+		if !assert.Equal(t, int64(1), attrs["fluent.attempt"].AsInt64(), "attempt should be recorded") {
+			return
+		}
+		if !assert.NotEmpty(t, attrs["fluent.chunk_id"].AsString(), "chunk ID should be recorded") {
+			return
+		}
+		messages += attrs["fluent.messages"].AsInt64()
+	}
+	if !assert.Equal(t, int64(3), messages, "all messages should be traced") {
+		return
+	}
+
+	var rm metricdata.ResourceMetrics
+	if !assert.NoError(t, reader.Collect(context.Background(), &rm), "Collect should succeed") {
+		return
+	}
+	var names []string
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			names = append(names, m.Name)
+		}
+	}
+	if !assert.ElementsMatch(t, []string{"fluent.client.write.duration", "fluent.client.write.size"}, names, "metrics should be recorded") {
+		return
+	}
+}
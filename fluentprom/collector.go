@@ -0,0 +1,149 @@
+// Package fluentprom provides a prometheus.Collector that exposes the
+// statistics of a fluent.Client (see fluent.Stats).
+package fluentprom
+
+import (
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultNamespace = "fluent_client"
+
+// Collector is a prometheus.Collector that takes a snapshot of the
+// statistics of a client each time it is collected. The metrics are, in
+// the default namespace:
+//
+//	fluent_client_queued_messages          messages waiting in the queue
+//	fluent_client_pending_bytes            bytes waiting in the buffer
+//	fluent_client_inflight_bytes           bytes being written, or waiting for their ack
+//	fluent_client_posted_messages_total    messages accepted by the client
+//	fluent_client_flushed_messages_total   messages written to the server
+//	fluent_client_dropped_messages_total   messages that will never be written
+//	fluent_client_dropped_after_retry_messages_total
+//	                                       messages dropped as their chunk failed too many times
+//	fluent_client_reconnects_total         connections established again after an error
+//	fluent_client_server_disconnects_total connections closed by the server while in use
+//	fluent_client_retries_total            failed attempts that were tried again
+//	fluent_client_dropped_callbacks_total  calls to the callbacks that were dropped
+//	fluent_client_write_duration_seconds   time from the buffer to the server for the writes that succeeded
+//	fluent_client_up                       1 if the last attempt to write succeeded
+//
+// To collect the statistics of several clients in the same registry, give
+// each collector its own labels (see WithConstLabels) or namespace (see
+// WithNamespace), or register them using prometheus.WrapRegistererWith.
+type Collector struct {
+	client        fluent.StatsProvider
+	constLabels   prometheus.Labels
+	namespace     string
+	queued        *prometheus.Desc
+	pending       *prometheus.Desc
+	inflight      *prometheus.Desc
+	posted        *prometheus.Desc
+	flushed       *prometheus.Desc
+	dropped       *prometheus.Desc
+	retryDrops    *prometheus.Desc
+	reconnects    *prometheus.Desc
+	disconnects   *prometheus.Desc
+	retries       *prometheus.Desc
+	callbacks     *prometheus.Desc
+	writeDuration *prometheus.Desc
+	up            *prometheus.Desc
+}
+
+// Option configures a Collector (see NewCollector)
+type Option func(*Collector)
+
+// WithNamespace specifies the prefix of the names of the metrics, instead
+// of "fluent_client"
+func WithNamespace(namespace string) Option {
+	return func(c *Collector) {
+		c.namespace = namespace
+	}
+}
+
+// WithConstLabels specifies labels that are added to all of the metrics,
+// e.g. to tell apart the clients of the same program. The collectors that
+// share a registry and a namespace must all have the same label names
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(c *Collector) {
+		c.constLabels = labels
+	}
+}
+
+// NewCollector creates a Collector for client. Both *fluent.Buffered and
+// *fluent.Unbuffered can be given, as well as the fluent.Client returned by
+// fluent.New, once asserted to a fluent.StatsProvider.
+func NewCollector(client fluent.StatsProvider, options ...Option) *Collector {
+	c := &Collector{
+		client:    client,
+		namespace: defaultNamespace,
+	}
+	for _, option := range options {
+		option(c)
+	}
+
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(c.namespace, "", name), help, nil, c.constLabels)
+	}
+	c.queued = desc("queued_messages", "Number of messages waiting in the queue for the background writer.")
+	c.pending = desc("pending_bytes", "Number of bytes in the buffer that have not been written yet.")
+	c.inflight = desc("inflight_bytes", "Number of bytes in the buffer that are being written, or waiting for their ack.")
+	c.posted = desc("posted_messages_total", "Total number of messages accepted by the client.")
+	c.flushed = desc("flushed_messages_total", "Total number of messages written to the server.")
+	c.dropped = desc("dropped_messages_total", "Total number of messages that were accepted, but will never be written.")
+	c.retryDrops = desc("dropped_after_retry_messages_total", "Total number of messages that were dropped because their chunk failed too many times.")
+	c.reconnects = desc("reconnects_total", "Total number of times a connection was established again after it was lost to an error.")
+	c.disconnects = desc("server_disconnects_total", "Total number of connections that the server closed while the client was using them.")
+	c.retries = desc("retries_total", "Total number of attempts to connect or write to the server that failed, and were tried again.")
+	c.callbacks = desc("dropped_callbacks_total", "Total number of calls to the callbacks of the client that were dropped, because too many were waiting.")
+	c.writeDuration = desc("write_duration_seconds", "Time from the handoff of the messages to the buffer until their write to the server succeeded.")
+	c.up = desc("up", "Whether the last attempt to connect or write to the server succeeded.")
+	return c
+}
+
+// Describe sends the descriptors of the metrics to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queued
+	ch <- c.pending
+	ch <- c.inflight
+	ch <- c.posted
+	ch <- c.flushed
+	ch <- c.dropped
+	ch <- c.retryDrops
+	ch <- c.reconnects
+	ch <- c.disconnects
+	ch <- c.retries
+	ch <- c.callbacks
+	ch <- c.writeDuration
+	ch <- c.up
+}
+
+// Collect sends the current values of the metrics to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(stats.PendingBytes))
+	ch <- prometheus.MustNewConstMetric(c.inflight, prometheus.GaugeValue, float64(stats.InflightBytes))
+	ch <- prometheus.MustNewConstMetric(c.posted, prometheus.CounterValue, float64(stats.Posted))
+	ch <- prometheus.MustNewConstMetric(c.flushed, prometheus.CounterValue, float64(stats.Flushed))
+	ch <- prometheus.MustNewConstMetric(c.dropped, prometheus.CounterValue, float64(stats.Dropped))
+	ch <- prometheus.MustNewConstMetric(c.retryDrops, prometheus.CounterValue, float64(stats.DroppedAfterRetry))
+	ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(stats.Reconnects))
+	ch <- prometheus.MustNewConstMetric(c.disconnects, prometheus.CounterValue, float64(stats.ServerDisconnects))
+	ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(stats.Retries))
+	ch <- prometheus.MustNewConstMetric(c.callbacks, prometheus.CounterValue, float64(stats.DroppedCallbacks))
+
+	latency := stats.WriteLatency
+	buckets := make(map[float64]uint64, len(latency.Buckets))
+	for i, b := range latency.Buckets {
+		buckets[b.Seconds()] = latency.Counts[i]
+	}
+	ch <- prometheus.MustNewConstHistogram(c.writeDuration, latency.Count, latency.Sum.Seconds(), buckets)
+
+	var up float64
+	if stats.LastError == nil {
+		up = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, up)
+}
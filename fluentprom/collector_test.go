@@ -0,0 +1,91 @@
+package fluentprom_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat/go-fluent-client/fluentprom"
+	"github.com/lestrrat/go-fluent-client/fluenttest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	client := &fluenttest.Recorder{}
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"i": i}), "Post should succeed") {
+			return
+		}
+	}
+
+	c := fluentprom.NewCollector(client)
+	registry := prometheus.NewPedanticRegistry()
+	if !assert.NoError(t, registry.Register(c), "Register should succeed") {
+		return
+	}
+	if !assert.Equal(t, 13, testutil.CollectAndCount(c), "all metrics should be collected") {
+		return
+	}
+
+	expected := `
+# HELP fluent_client_flushed_messages_total Total number of messages written to the server.
+# TYPE fluent_client_flushed_messages_total counter
+fluent_client_flushed_messages_total 2
+# HELP fluent_client_posted_messages_total Total number of messages accepted by the client.
+# TYPE fluent_client_posted_messages_total counter
+fluent_client_posted_messages_total 2
+# HELP fluent_client_up Whether the last attempt to connect or write to the server succeeded.
+# TYPE fluent_client_up gauge
+fluent_client_up 1
+`
+	if !assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fluent_client_posted_messages_total", "fluent_client_flushed_messages_total", "fluent_client_up"), "metrics should match") {
+		return
+	}
+
+	client.SetError(errors.New("connection refused"))
+	expected = `
+# HELP fluent_client_up Whether the last attempt to connect or write to the server succeeded.
+# TYPE fluent_client_up gauge
+fluent_client_up 0
+`
+	if !assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fluent_client_up"), "metrics should match") {
+		return
+	}
+}
+
+func TestCollectorsInSameRegistry(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	if !assert.NoError(t, registry.Register(fluentprom.NewCollector(&fluenttest.Recorder{})), "Register should succeed") {
+		return
+	}
+	if !assert.Error(t, registry.Register(fluentprom.NewCollector(&fluenttest.Recorder{})), "Register should fail for the same metrics") {
+		return
+	}
+
+	registry = prometheus.NewPedanticRegistry()
+	for _, name := range []string{"a", "b"} {
+		c := fluentprom.NewCollector(&fluenttest.Recorder{}, fluentprom.WithConstLabels(prometheus.Labels{"client": name}))
+		if !assert.NoError(t, registry.Register(c), "Register should succeed with other labels") {
+			return
+		}
+	}
+	c := fluentprom.NewCollector(&fluenttest.Recorder{}, fluentprom.WithNamespace("other_client"))
+	if !assert.NoError(t, registry.Register(c), "Register should succeed in another namespace") {
+		return
+	}
+
+	expected := `
+# HELP fluent_client_up Whether the last attempt to connect or write to the server succeeded.
+# TYPE fluent_client_up gauge
+fluent_client_up{client="a"} 1
+fluent_client_up{client="b"} 1
+# HELP other_client_up Whether the last attempt to connect or write to the server succeeded.
+# TYPE other_client_up gauge
+other_client_up 1
+`
+	if !assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "fluent_client_up", "other_client_up"), "metrics should match") {
+		return
+	}
+}
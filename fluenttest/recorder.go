@@ -0,0 +1,229 @@
+// Package fluenttest provides helpers for testing code that uses the
+// fluent package: a Recorder, which implements fluent.Client by keeping
+// the messages that are posted in memory, and a Server, which speaks the
+// forward protocol.
+package fluenttest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/pkg/errors"
+)
+
+// timestampKey is the name of the options created by fluent.WithTimestamp
+var timestampKey = fluent.WithTimestamp(time.Time{}).Name()
+
+// Message is a message that was posted to a Recorder
+type Message struct {
+	Tag     string
+	Time    time.Time // given by fluent.WithTimestamp, or the time of the call
+	Record  interface{}
+	Options []fluent.Option
+}
+
+// Recorder is a fluent.Client that records the messages that are posted
+// to it, instead of sending them. It is safe for concurrent use, and the
+// zero value is ready to use.
+//
+// Messages posted with a timestamp, using PostAll or PostRaw, have a
+// fluent.WithTimestamp option at the end of their Options.
+type Recorder struct {
+	closed   bool
+	err      error
+	messages []Message
+	mu       sync.Mutex
+}
+
+var _ fluent.Client = (*Recorder)(nil)
+var _ fluent.Flusher = (*Recorder)(nil)
+var _ fluent.StatsProvider = (*Recorder)(nil)
+
+// SetError makes the methods that post messages return err, without
+// recording the messages, until it is called again with nil. This can be
+// used to test how the code under test handles errors such as
+// fluent.ErrBufferFull
+func (r *Recorder) SetError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Messages returns the messages that have been posted so far, in order
+func (r *Recorder) Messages() []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Message(nil), r.messages...)
+}
+
+// ByTag returns the messages that have been posted with the given tag so
+// far, in order
+func (r *Recorder) ByTag(tag string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var msgs []Message
+	for _, msg := range r.messages {
+		if msg.Tag == tag {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// Len returns the number of messages that have been posted so far
+func (r *Recorder) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.messages)
+}
+
+// Reset forgets the messages that have been posted so far
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = nil
+}
+
+// Post records the message
+func (r *Recorder) Post(tag string, v interface{}, options ...fluent.Option) error {
+	return r.post([]Message{newMessage(tag, v, options)})
+}
+
+// PostWithContext records the message, unless ctx has been canceled
+func (r *Recorder) PostWithContext(ctx context.Context, tag string, v interface{}, options ...fluent.Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.Post(tag, v, options...)
+}
+
+// PostAll records all of the entries, or none of them if there is an
+// error
+func (r *Recorder) PostAll(entries []fluent.Entry, options ...fluent.Option) error {
+	msgs := make([]Message, len(entries))
+	for i, e := range entries {
+		msgs[i] = newMessage(e.Tag, e.Record, withTimestamp(options, e.Time))
+	}
+	return r.post(msgs)
+}
+
+// PostRaw records the message, with raw as a fluent.RawRecord
+func (r *Recorder) PostRaw(tag string, t time.Time, raw []byte, options ...fluent.Option) error {
+	if len(raw) == 0 {
+		return errors.New(`empty raw record`)
+	}
+	return r.Post(tag, fluent.RawRecord(raw), withTimestamp(options, t)...)
+}
+
+// PostAsync records the message, and returns a Result that has already
+// completed
+func (r *Recorder) PostAsync(tag string, v interface{}, options ...fluent.Option) (*fluent.Result, error) {
+	if err := r.Post(tag, v, options...); err != nil {
+		return nil, err
+	}
+	return fluent.NewCompletedResult(nil), nil
+}
+
+// Ping records the message, like Post
+func (r *Recorder) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return r.Post(tag, v, options...)
+}
+
+// Flush returns nil right away, as there is nothing to flush
+func (r *Recorder) Flush(_ context.Context) error {
+	return nil
+}
+
+// IsConnected returns true until the client is closed
+func (r *Recorder) IsConnected() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closed
+}
+
+// LastError returns the error given to SetError
+func (r *Recorder) LastError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Stats returns the number of messages that have been recorded as both
+// posted and flushed, along with the error given to SetError
+func (r *Recorder) Stats() fluent.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fluent.Stats{
+		Posted:    uint64(len(r.messages)),
+		Flushed:   uint64(len(r.messages)),
+		LastError: r.err,
+	}
+}
+
+// Errors returns a closed channel, as the Recorder returns the error
+// given to SetError from the methods that post messages
+func (r *Recorder) Errors() <-chan fluent.PostError {
+	ch := make(chan fluent.PostError)
+	close(ch)
+	return ch
+}
+
+// Close closes the client. Messages that are posted afterwards are
+// rejected with fluent.ErrClosed
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// Shutdown closes the client, like Close
+func (r *Recorder) Shutdown(_ context.Context) error {
+	return r.Close()
+}
+
+// Writer returns an io.WriteCloser that posts lines to r, like the one
+// returned by the clients in the fluent package
+func (r *Recorder) Writer(tag string, options ...fluent.Option) io.WriteCloser {
+	return fluent.NewWriter(r, tag, options...)
+}
+
+func (r *Recorder) post(msgs []Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return fluent.ErrClosed
+	}
+	if r.err != nil {
+		return r.err
+	}
+	r.messages = append(r.messages, msgs...)
+	return nil
+}
+
+func newMessage(tag string, v interface{}, options []fluent.Option) Message {
+	msg := Message{
+		Tag:     tag,
+		Time:    time.Now(),
+		Record:  v,
+		Options: options,
+	}
+	for _, opt := range options {
+		if opt.Name() == timestampKey {
+			msg.Time = opt.Value().(time.Time)
+		}
+	}
+	return msg
+}
+
+func withTimestamp(options []fluent.Option, t time.Time) []fluent.Option {
+	if t.IsZero() {
+		return options
+	}
+	return append(options[:len(options):len(options)], fluent.WithTimestamp(t))
+}
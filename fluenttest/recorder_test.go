@@ -0,0 +1,83 @@
+package fluenttest_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	c := &fluenttest.Recorder{}
+	var client fluent.Client = c
+
+	if !assert.NoError(t, client.Post("tag1", map[string]interface{}{"foo": "bar"}), "Post should succeed") {
+		return
+	}
+	result, err := c.PostAsync("tag2", "baz")
+	if !assert.NoError(t, err, "PostAsync should succeed") {
+		return
+	}
+	if !assert.NoError(t, result.Err(), "result should be successful") {
+		return
+	}
+	w := c.Writer("tag3")
+	if _, err := io.WriteString(w, "line\n"); !assert.NoError(t, err, "Write should succeed") {
+		return
+	}
+
+	msgs := c.Messages()
+	if !assert.Len(t, msgs, 3, "expected 3 messages") {
+		return
+	}
+	for i, tag := range []string{"tag1", "tag2", "tag3"} {
+		if !assert.Equal(t, tag, msgs[i].Tag, "tag should match") {
+			return
+		}
+	}
+	if !assert.Equal(t, map[string]interface{}{"message": "line"}, msgs[2].Record, "line should be recorded") {
+		return
+	}
+
+	ts := time.Unix(1482493046, 0)
+	if !assert.NoError(t, client.Post("tag1", "qux", fluent.WithTimestamp(ts)), "Post should succeed") {
+		return
+	}
+	if !assert.Equal(t, 4, c.Len(), "expected 4 messages") {
+		return
+	}
+	byTag := c.ByTag("tag1")
+	if !assert.Len(t, byTag, 2, "expected 2 messages for tag1") {
+		return
+	}
+	if !assert.Equal(t, "qux", byTag[1].Record, "record should match") {
+		return
+	}
+	if !assert.True(t, ts.Equal(byTag[1].Time), "time should match") {
+		return
+	}
+
+	c.Reset()
+	c.SetError(fluent.ErrBufferFull)
+	if !assert.True(t, errors.Is(client.Post("tag", "foo"), fluent.ErrBufferFull), "Post should return the error") {
+		return
+	}
+	c.SetError(nil)
+	if !assert.NoError(t, client.Post("tag", "foo"), "Post should succeed") {
+		return
+	}
+
+	if !assert.NoError(t, client.Close(), "Close should succeed") {
+		return
+	}
+	if !assert.True(t, errors.Is(client.Post("tag", "foo"), fluent.ErrClosed), "Post should fail after Close") {
+		return
+	}
+	if !assert.Len(t, c.Messages(), 1, "expected 1 message") {
+		return
+	}
+}
@@ -0,0 +1,614 @@
+package fluenttest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	msgpack "github.com/lestrrat/go-msgpack"
+	"github.com/pkg/errors"
+)
+
+const defaultHostname = "fluenttest"
+
+// Event is a message that was received by a Server
+type Event struct {
+	Tag    string
+	Time   time.Time
+	Record interface{} // maps are map[string]interface{}
+	Option map[string]interface{}
+}
+
+// Server is an in-process fluentd server, which speaks the forward
+// protocol in all of its modes (message, forward, packed forward, and
+// compressed packed forward), acks the requests that ask for it, and
+// performs the handshake if SharedKey is set. It records the events that
+// it receives, and can be told to misbehave, to test how clients cope
+// with a server that is slow or drops connections.
+//
+// The exported fields must be set before calling Start.
+type Server struct {
+	Network  string // "tcp" or "unix"
+	Address  string
+	Hostname string // sent in the handshake, "fluenttest" if empty
+	Password string
+	// SharedKey enables the handshake. Username and Password are only
+	// checked if Username is set
+	SharedKey string
+	Username  string
+
+	ackDelay        time.Duration
+	changed         chan struct{}
+	closed          bool
+	conns           map[net.Conn]struct{}
+	dir             string
+	disconnectAfter int
+	errorReplies    []string
+	events          []Event
+	listener        net.Listener
+	maxUnacked      int
+	mu              sync.Mutex
+	readDelay       time.Duration
+	rejectedTags    map[string]bool
+	requests        int
+	skipAcks        int
+	unacked         int
+	wg              sync.WaitGroup
+}
+
+// NewServer creates a server that listens on an available port of the
+// loopback interface if network is "tcp", or on a unix domain socket in
+// a temporary directory if network is "unix". Clients can connect to it
+// using fluent.WithNetwork(s.Network) and fluent.WithAddress(s.Address)
+// once Start has been called.
+func NewServer(network string) (*Server, error) {
+	s := &Server{
+		Network: network,
+		changed: make(chan struct{}),
+		conns:   make(map[net.Conn]struct{}),
+	}
+
+	var err error
+	switch network {
+	case "tcp":
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	case "unix":
+		s.dir, err = ioutil.TempDir("", "fluenttest-")
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to create temporary directory`)
+		}
+		s.listener, err = net.Listen("unix", filepath.Join(s.dir, "fluentd.sock"))
+		if err != nil {
+			os.RemoveAll(s.dir)
+		}
+	default:
+		return nil, errors.Errorf(`unsupported network: %s`, network)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to listen`)
+	}
+	s.Address = s.listener.Addr().String()
+	return s, nil
+}
+
+// Start starts accepting connections
+func (s *Server) Start() {
+	s.wg.Add(1)
+	go s.accept()
+}
+
+// Close stops the server, and closes all connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+	return err
+}
+
+// Events returns the events that have been received so far, in order
+func (s *Server) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Requests returns the number of requests that have been received. A
+// request holds several events in the forward modes
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// WaitEvents waits until at least n events have been received, and
+// returns them. If ctx is canceled first, the events received so far are
+// returned along with the error of the context
+func (s *Server) WaitEvents(ctx context.Context, n int) ([]Event, error) {
+	for {
+		s.mu.Lock()
+		events := append([]Event(nil), s.events...)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(events) >= n {
+			return events, nil
+		}
+		select {
+		case <-ctx.Done():
+			return events, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// SetReadDelay makes the server wait for d before reading each request,
+// as a server under load would
+func (s *Server) SetReadDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readDelay = d
+}
+
+// SetAckDelay makes the server wait for d before acking each request,
+// while it goes on reading the next ones, as a server that is slow to
+// process them would
+func (s *Server) SetAckDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ackDelay = d
+}
+
+// MaxUnacked returns the largest number of requests that were waiting
+// for their ack at the same time, over all connections
+func (s *Server) MaxUnacked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxUnacked
+}
+
+// DisconnectAfter makes the server close the connection on which the
+// n-th request from now is received, without reading it
+func (s *Server) DisconnectAfter(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnectAfter = n
+}
+
+// SkipAcks makes the server not ack the next n requests that ask for it
+func (s *Server) SkipAcks(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipAcks = n
+}
+
+// RejectTag makes the server never ack the requests for tag, as if it
+// kept failing to process them
+func (s *Server) RejectTag(tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejectedTags == nil {
+		s.rejectedTags = make(map[string]bool)
+	}
+	s.rejectedTags[tag] = true
+}
+
+// ReplyWithErrors makes the server reply to the next requests that ask
+// for an ack with an error instead, one for each of the given messages
+// ({"ack": "<chunk id>", "error": "<message>"}). The requests are still
+// recorded as events
+func (s *Server) ReplyWithErrors(messages ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorReplies = append(s.errorReplies, messages...)
+}
+
+// Disconnect closes all connections. Clients may connect again
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	dec := msgpack.NewDecoder(conn)
+	if s.SharedKey != "" {
+		if err := s.handshake(conn, dec); err != nil {
+			return
+		}
+	}
+
+	// The acks may be written by several goroutines (see SetAckDelay)
+	var muWrite sync.Mutex
+
+	for {
+		if !s.beforeRead() {
+			return
+		}
+
+		events, err := decodeRequest(dec)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.requests++
+		s.events = append(s.events, events...)
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mu.Unlock()
+
+		if chunk, ok := events[0].Option["chunk"].(string); ok && s.shouldAck(events[0].Tag) {
+			reply := map[string]interface{}{"ack": chunk}
+			if message, ok := s.nextErrorReply(); ok {
+				reply["error"] = message
+			}
+			ack, err := msgpack.Marshal(reply)
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			delay := s.ackDelay
+			s.unacked++
+			if s.unacked > s.maxUnacked {
+				s.maxUnacked = s.unacked
+			}
+			s.mu.Unlock()
+
+			if delay == 0 {
+				if err := s.writeAck(conn, &muWrite, ack); err != nil {
+					return
+				}
+				continue
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				time.Sleep(delay)
+				s.writeAck(conn, &muWrite, ack)
+			}()
+		}
+	}
+}
+
+// writeAck records that a request is no longer waiting for its ack, and
+// writes the ack to conn. The request stops counting first, as the client
+// may send the next one as soon as it receives the ack
+func (s *Server) writeAck(conn net.Conn, muWrite *sync.Mutex, ack []byte) error {
+	s.mu.Lock()
+	s.unacked--
+	s.mu.Unlock()
+
+	muWrite.Lock()
+	defer muWrite.Unlock()
+	_, err := conn.Write(ack)
+	return err
+}
+
+// beforeRead applies the read delay, and reports whether the next
+// request should be read (see DisconnectAfter)
+func (s *Server) beforeRead() bool {
+	s.mu.Lock()
+	delay := s.readDelay
+	s.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnectAfter > 0 {
+		s.disconnectAfter--
+		if s.disconnectAfter == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// nextErrorReply returns the message of the next error reply, if any
+// (see ReplyWithErrors)
+func (s *Server) nextErrorReply() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.errorReplies) == 0 {
+		return "", false
+	}
+	message := s.errorReplies[0]
+	s.errorReplies = s.errorReplies[1:]
+	return message, true
+}
+
+func (s *Server) shouldAck(tag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejectedTags[tag] {
+		return false
+	}
+	if s.skipAcks > 0 {
+		s.skipAcks--
+		return false
+	}
+	return true
+}
+
+// handshake performs the server side of the handshake, as fluentd's
+// in_forward does
+func (s *Server) handshake(conn net.Conn, dec *msgpack.Decoder) error {
+	const nonce = "0123456789abcdef"
+	var authSalt string
+	if s.Username != "" {
+		authSalt = "fedcba9876543210"
+	}
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = defaultHostname
+	}
+
+	helo, err := msgpack.Marshal([]interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": authSalt, "keepalive": true}})
+	if err != nil {
+		return errors.Wrap(err, `failed to encode HELO`)
+	}
+	if _, err := conn.Write(helo); err != nil {
+		return errors.Wrap(err, `failed to write HELO`)
+	}
+
+	var ping []interface{}
+	if err := dec.Decode(&ping); err != nil {
+		return errors.Wrap(err, `failed to read PING`)
+	}
+	if len(ping) != 6 || ping[0] != "PING" {
+		return errors.Errorf(`invalid PING: %#v`, ping)
+	}
+	clientHostname, _ := ping[1].(string)
+	salt, _ := ping[2].(string)
+
+	var pong []interface{}
+	switch {
+	case ping[3] != digest(salt, clientHostname, nonce, s.SharedKey):
+		pong = []interface{}{"PONG", false, "shared_key mismatch", "", ""}
+	case s.Username != "" && (ping[4] != s.Username || ping[5] != digest(authSalt, s.Username, s.Password, "")):
+		pong = []interface{}{"PONG", false, "username/password mismatch", "", ""}
+	default:
+		pong = []interface{}{"PONG", true, "", hostname, digest(salt, hostname, nonce, s.SharedKey)}
+	}
+	buf, err := msgpack.Marshal(pong)
+	if err != nil {
+		return errors.Wrap(err, `failed to encode PONG`)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return errors.Wrap(err, `failed to write PONG`)
+	}
+	if !pong[1].(bool) {
+		return errors.New(`authentication failed`)
+	}
+	return nil
+}
+
+func digest(salt, hostname, nonce, sharedKey string) string {
+	sum := sha512.Sum512([]byte(salt + hostname + nonce + sharedKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeRequest decodes a request in any of the modes, and expands it
+// into individual events, each carrying the option map of the request
+func decodeRequest(d *msgpack.Decoder) ([]Event, error) {
+	var length int
+	if err := d.DecodeArrayLength(&length); err != nil {
+		return nil, errors.Wrap(err, `failed to decode request array length`)
+	}
+	if length < 2 || length > 4 {
+		return nil, errors.Errorf(`invalid request array length %d`, length)
+	}
+
+	var tag string
+	if err := d.DecodeString(&tag); err != nil {
+		return nil, errors.Wrap(err, `failed to decode tag`)
+	}
+
+	c, err := d.PeekCode()
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to peek code`)
+	}
+
+	var events []Event
+	var packed []byte
+	var optionIndex int
+	switch {
+	case isArray(c):
+		// forward mode
+		var count int
+		if err := d.DecodeArrayLength(&count); err != nil {
+			return nil, errors.Wrap(err, `failed to decode entries array length`)
+		}
+		for i := 0; i < count; i++ {
+			event, err := decodeEntry(d, tag)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+		optionIndex = 2
+	case c == msgpack.Bin8 || c == msgpack.Bin16 || c == msgpack.Bin32:
+		// packed forward mode. The entries can only be decoded after the
+		// option, which tells us if they have been compressed
+		if err := d.DecodeBytes(&packed); err != nil {
+			return nil, errors.Wrap(err, `failed to decode packed entries`)
+		}
+		optionIndex = 2
+	default:
+		// message mode
+		event := Event{Tag: tag}
+		if event.Time, err = decodeTime(d); err != nil {
+			return nil, err
+		}
+		if err := d.Decode(&event.Record); err != nil {
+			return nil, errors.Wrap(err, `failed to decode record`)
+		}
+		event.Record = normalize(event.Record)
+		events = append(events, event)
+		optionIndex = 3
+	}
+
+	var option map[string]interface{}
+	switch {
+	case length == optionIndex+1:
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, errors.Wrap(err, `failed to decode option`)
+		}
+		option, _ = normalize(v).(map[string]interface{})
+	case length != optionIndex:
+		return nil, errors.Errorf(`invalid request array length %d`, length)
+	}
+
+	if packed != nil {
+		var r io.Reader = bytes.NewReader(packed)
+		if option["compressed"] == "gzip" {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, errors.Wrap(err, `failed to decompress packed entries`)
+			}
+			r = gr
+		}
+
+		pd := msgpack.NewDecoder(r)
+		for {
+			event, err := decodeEntry(pd, tag)
+			if err != nil {
+				if errors.Cause(err) == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New(`request has no entries`)
+	}
+
+	for i := range events {
+		events[i].Option = option
+	}
+	return events, nil
+}
+
+func decodeEntry(d *msgpack.Decoder, tag string) (Event, error) {
+	var l int
+	if err := d.DecodeArrayLength(&l); err != nil {
+		return Event{}, errors.Wrap(err, `failed to decode entry array length`)
+	}
+	if l != 2 {
+		return Event{}, errors.Errorf(`invalid entry array length %d (expected 2)`, l)
+	}
+
+	event := Event{Tag: tag}
+	var err error
+	if event.Time, err = decodeTime(d); err != nil {
+		return Event{}, err
+	}
+	if err := d.Decode(&event.Record); err != nil {
+		return Event{}, errors.Wrap(err, `failed to decode record`)
+	}
+	event.Record = normalize(event.Record)
+	return event, nil
+}
+
+// decodeTime decodes either an EventTime, or an integer timestamp
+func decodeTime(d *msgpack.Decoder) (time.Time, error) {
+	c, err := d.PeekCode()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, `failed to peek code for time`)
+	}
+	if msgpack.IsExtFamily(c) {
+		var t fluent.EventTime
+		if err := d.DecodeStruct(&t); err != nil {
+			return time.Time{}, errors.Wrap(err, `failed to decode time`)
+		}
+		return t.Time, nil
+	}
+
+	var t int64
+	if err := d.DecodeInt64(&t); err != nil {
+		return time.Time{}, errors.Wrap(err, `failed to decode time`)
+	}
+	return time.Unix(t, 0).UTC(), nil
+}
+
+func isArray(c msgpack.Code) bool {
+	return (c >= 0x90 && c <= 0x9f) || c == msgpack.Array16 || c == msgpack.Array32
+}
+
+// normalize turns the map[interface{}]interface{} values that the
+// decoder returns into map[string]interface{}, so that they are easier
+// to compare in tests
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = normalize(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalize(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,177 @@
+package fluenttest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		network  string
+		options  []fluent.Option
+		setup    func(*fluenttest.Server)
+		requests int // expected number of requests, if not one per message
+	}{
+		{name: "message", network: "unix"},
+		{name: "message over tcp", network: "tcp"},
+		{
+			name:     "forward",
+			network:  "unix",
+			options:  []fluent.Option{fluent.WithProtocolMode("forward")},
+			requests: 1,
+		},
+		{
+			name:     "packed forward",
+			network:  "unix",
+			options:  []fluent.Option{fluent.WithProtocolMode("packed_forward")},
+			requests: 1,
+		},
+		{
+			name:     "compressed packed forward",
+			network:  "unix",
+			options:  []fluent.Option{fluent.WithCompression("gzip")},
+			requests: 1,
+		},
+		{
+			name:    "require ack",
+			network: "unix",
+			options: []fluent.Option{fluent.WithRequireAck(true)},
+		},
+		{
+			name:    "skip ack",
+			network: "unix",
+			options: []fluent.Option{
+				fluent.WithRequireAck(true),
+				fluent.WithAckTimeout(100 * time.Millisecond),
+			},
+			setup: func(s *fluenttest.Server) {
+				s.SkipAcks(1)
+			},
+			requests: 4, // the first message is sent again
+		},
+		{
+			name:    "skip ack in forward mode",
+			network: "unix",
+			options: []fluent.Option{
+				fluent.WithProtocolMode("forward"),
+				fluent.WithRequireAck(true),
+				fluent.WithAckTimeout(100 * time.Millisecond),
+			},
+			setup: func(s *fluenttest.Server) {
+				s.SkipAcks(1)
+			},
+			requests: 2, // the chunk is sent again
+		},
+		{
+			name:    "slow reads",
+			network: "unix",
+			setup: func(s *fluenttest.Server) {
+				s.SetReadDelay(50 * time.Millisecond)
+			},
+		},
+		{
+			name:    "handshake",
+			network: "tcp",
+			options: []fluent.Option{
+				fluent.WithSharedKey("secret"),
+				fluent.WithUsername("user"),
+				fluent.WithPassword("password"),
+			},
+			setup: func(s *fluenttest.Server) {
+				s.SharedKey = "secret"
+				s.Username = "user"
+				s.Password = "password"
+			},
+		},
+		{
+			// Without acks, the messages that were written to the dropped
+			// connection would be lost
+			name:    "disconnect",
+			network: "unix",
+			options: []fluent.Option{fluent.WithRequireAck(true)},
+			setup: func(s *fluenttest.Server) {
+				s.DisconnectAfter(2)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := fluenttest.NewServer(test.network)
+			if !assert.NoError(t, err, "NewServer should succeed") {
+				return
+			}
+			defer s.Close()
+			if test.setup != nil {
+				test.setup(s)
+			}
+			s.Start()
+
+			options := append([]fluent.Option{
+				fluent.WithNetwork(s.Network),
+				fluent.WithAddress(s.Address),
+			}, test.options...)
+			client, err := fluent.New(options...)
+			if !assert.NoError(t, err, "fluent.New should succeed") {
+				return
+			}
+
+			ts := time.Unix(1482493046, 0).UTC()
+			for _, v := range []string{"foo", "bar", "baz"} {
+				if !assert.NoError(t, client.Post("tag_name", map[string]interface{}{"v": v}, fluent.WithTimestamp(ts)), "Post should succeed") {
+					return
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if !assert.NoError(t, client.Shutdown(ctx), "Shutdown should succeed") {
+				return
+			}
+
+			received, err := s.WaitEvents(ctx, 3)
+			if !assert.NoError(t, err, "WaitEvents should succeed") {
+				return
+			}
+
+			// Messages that are sent again have the same chunk ID
+			var events []fluenttest.Event
+			seen := make(map[string]bool)
+			for _, e := range received {
+				if chunk := e.Option["chunk"]; chunk != nil {
+					key := fmt.Sprint(chunk, e.Record)
+					if seen[key] {
+						continue
+					}
+					seen[key] = true
+				}
+				events = append(events, e)
+			}
+			if !assert.Len(t, events, 3, "expected 3 events") {
+				return
+			}
+			for i, v := range []string{"foo", "bar", "baz"} {
+				if !assert.Equal(t, "tag_name", events[i].Tag, "tag should match") {
+					return
+				}
+				if !assert.Equal(t, map[string]interface{}{"v": v}, events[i].Record, "record should match") {
+					return
+				}
+				if !assert.Equal(t, ts.Unix(), events[i].Time.Unix(), "time should match") {
+					return
+				}
+			}
+			if test.requests > 0 {
+				if !assert.Equal(t, test.requests, s.Requests(), "requests should match") {
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Package fluentzap provides a zapcore.Core that posts log entries to
+// fluentd using a fluent.Client, so that zap loggers can send structured
+// logs to fluentd without encoding them as JSON first.
+package fluentzap
+
+import (
+	"context"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"go.uber.org/zap/zapcore"
+)
+
+// Core is a zapcore.Core that posts each entry to fluentd as a record of
+// the form
+//
+//	{"level": "info", "message": "...", <fields>...}
+//
+// The caller and the stack trace are added as "caller" and "stacktrace",
+// if the logger records them. Fields are added to the record as they
+// are, except for times and durations, which are converted to strings.
+// The timestamp of the message is the time of the entry.
+type Core struct {
+	zapcore.LevelEnabler
+	client      fluent.Client
+	fields      []zapcore.Field
+	options     []fluent.Option
+	syncTimeout time.Duration
+	tag         string
+}
+
+// DefaultSyncTimeout is how long Sync waits for the messages to be
+// written, unless specified otherwise by SetSyncTimeout
+const DefaultSyncTimeout = 5 * time.Second
+
+// NewCore creates a Core that posts the entries that enab enables using
+// client. The tag of the messages is tag, followed by the name of the
+// logger, if any, e.g. "app.db" for a logger named "db". The options are
+// passed to client.Post for every entry.
+func NewCore(client fluent.Client, tag string, enab zapcore.LevelEnabler, options ...fluent.Option) *Core {
+	return &Core{
+		LevelEnabler: enab,
+		client:       client,
+		options:      options,
+		syncTimeout:  DefaultSyncTimeout,
+		tag:          tag,
+	}
+}
+
+// SetSyncTimeout specifies how long Sync waits for the messages to be
+// written to the server, so that a logger that is synced on exit does
+// not hang when fluentd is down. A zero or negative value makes Sync
+// return right away, without flushing anything
+func (c *Core) SetSyncTimeout(d time.Duration) {
+	c.syncTimeout = d
+}
+
+// With returns a Core that adds fields to every entry
+func (c *Core) With(fields []zapcore.Field) zapcore.Core {
+	c2 := *c
+	c2.fields = append(c.fields[:len(c.fields):len(c.fields)], fields...)
+	return &c2
+}
+
+// Check adds c to ce if the level of ent is enabled
+func (c *Core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// Write posts ent along with fields. The error from the client is
+// returned as it is
+func (c *Core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := &encoder{zapcore.NewMapObjectEncoder()}
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	record := enc.Fields
+	record["level"] = ent.Level.String()
+	record["message"] = ent.Message
+	if ent.Caller.Defined {
+		record["caller"] = ent.Caller.TrimmedPath()
+	}
+	if ent.Stack != "" {
+		record["stacktrace"] = ent.Stack
+	}
+
+	tag := c.tag
+	if ent.LoggerName != "" {
+		tag += "." + ent.LoggerName
+	}
+
+	options := append(c.options[:len(c.options):len(c.options)], fluent.WithTimestamp(ent.Time))
+	return c.client.Post(tag, record, options...)
+}
+
+// Sync waits until the messages that have been posted so far have been
+// written to the server (see fluent.Flusher), for up to the sync timeout
+// (see SetSyncTimeout). If they could not all be written by then, the
+// error of the flush is returned, and they stay in the buffer of the
+// client. Sync does nothing if the client is not a fluent.Flusher
+func (c *Core) Sync() error {
+	flusher, ok := c.client.(fluent.Flusher)
+	if !ok || c.syncTimeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.syncTimeout)
+	defer cancel()
+	return flusher.Flush(ctx)
+}
+
+// encoder stores times and durations as strings, so that the records
+// can be serialized by both of the client's marshalers
+type encoder struct {
+	*zapcore.MapObjectEncoder
+}
+
+func (e *encoder) AddDuration(key string, d time.Duration) {
+	e.AddString(key, d.String())
+}
+
+func (e *encoder) AddTime(key string, t time.Time) {
+	e.AddString(key, t.Format(time.RFC3339Nano))
+}
@@ -0,0 +1,132 @@
+package fluentzap_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluentzap"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type message struct {
+	tag    string
+	record interface{}
+}
+
+// client records the messages that are posted, instead of sending them
+type client struct {
+	flushed    bool
+	flushBlock bool // Flush waits for its context to be done
+	messages   []message
+}
+
+func (c *client) Post(tag string, v interface{}, _ ...fluent.Option) error {
+	c.messages = append(c.messages, message{tag: tag, record: v})
+	return nil
+}
+
+func (c *client) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return c.Post(tag, v, options...)
+}
+
+func (c *client) Close() error {
+	return nil
+}
+
+func (c *client) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func (c *client) Flush(ctx context.Context) error {
+	c.flushed = true
+	if c.flushBlock {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestCore(t *testing.T) {
+	c := &client{}
+	logger := zap.New(fluentzap.NewCore(c, "app", zapcore.InfoLevel))
+
+	logger.Debug("not posted")
+	logger.Info("started", zap.Int("port", 8080))
+	logger.Named("db").With(zap.String("table", "users")).Warn("slow query",
+		zap.Duration("elapsed", 2*time.Second),
+		zap.Namespace("stats"),
+		zap.Int("rows", 10),
+		zap.Error(errors.New("timeout")),
+	)
+	if !assert.NoError(t, logger.Sync(), "Sync should succeed") {
+		return
+	}
+	if !assert.True(t, c.flushed, "Sync should flush the client") {
+		return
+	}
+
+	if !assert.Len(t, c.messages, 2, "expected 2 messages") {
+		return
+	}
+
+	if !assert.Equal(t, "app", c.messages[0].tag, "tag should match") {
+		return
+	}
+	expected := map[string]interface{}{
+		"level":   "info",
+		"message": "started",
+		"port":    int64(8080),
+	}
+	if !assert.Equal(t, expected, c.messages[0].record, "record should match") {
+		return
+	}
+
+	if !assert.Equal(t, "app.db", c.messages[1].tag, "tag should include the logger name") {
+		return
+	}
+	expected = map[string]interface{}{
+		"level":   "warn",
+		"message": "slow query",
+		"table":   "users",
+		"elapsed": "2s",
+		"stats": map[string]interface{}{
+			"rows":  int64(10),
+			"error": "timeout",
+		},
+	}
+	if !assert.Equal(t, expected, c.messages[1].record, "record should match") {
+		return
+	}
+}
+
+func TestCoreSyncTimeout(t *testing.T) {
+	c := &client{flushBlock: true}
+	core := fluentzap.NewCore(c, "app", zapcore.InfoLevel)
+	core.SetSyncTimeout(10 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- zap.New(core).Sync() }()
+	select {
+	case err := <-done:
+		if !assert.Equal(t, context.DeadlineExceeded, err, "Sync should give up once the timeout expires") {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Sync should not block forever")
+		return
+	}
+
+	c.flushed = false
+	core.SetSyncTimeout(0)
+	if !assert.NoError(t, zap.New(core).Sync(), "Sync should succeed") {
+		return
+	}
+	if !assert.False(t, c.flushed, "Sync should not flush without a timeout") {
+		return
+	}
+}
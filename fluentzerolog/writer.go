@@ -0,0 +1,118 @@
+// Package fluentzerolog provides an io.Writer that takes the output of a
+// zerolog logger, and posts each event to fluentd using a fluent.Client.
+package fluentzerolog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/pkg/errors"
+)
+
+const defaultTimeKey = "time"
+
+// Writer is an io.Writer that parses the JSON events written by zerolog,
+// and posts each of them as a record with the fields of the event. The
+// timestamp of the message is taken from the time field of the event
+// (see SetTimeKey), which is then removed from the record.
+//
+// It can be given to zerolog.New, or to zerolog.MultiLevelWriter to send
+// the events both to fluentd and to the console, for example.
+type Writer struct {
+	client  fluent.Client
+	options []fluent.Option
+	tag     string
+	timeKey string
+}
+
+// NewWriter creates a Writer that posts events with the given tag using
+// client. The options are passed to client.Post for every event.
+func NewWriter(client fluent.Client, tag string, options ...fluent.Option) *Writer {
+	return &Writer{
+		client:  client,
+		options: options,
+		tag:     tag,
+		timeKey: defaultTimeKey,
+	}
+}
+
+// SetTimeKey specifies the field that holds the time of the event, which
+// must match zerolog.TimestampFieldName. The default is "time". Times
+// formatted as RFC 3339 (zerolog's default), and as Unix times in seconds
+// (zerolog.TimeFormatUnix) are understood. If the time field is missing
+// or cannot be parsed, the field is kept, and the time at which the event
+// was posted is used.
+func (w *Writer) SetTimeKey(key string) {
+	w.timeKey = key
+}
+
+// Write posts the events in p. zerolog writes one event at a time, but
+// several events in a row are accepted as well
+func (w *Writer) Write(p []byte) (int, error) {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	for {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return len(p), nil
+			}
+			return 0, errors.Wrap(err, `failed to parse event`)
+		}
+
+		for k, v := range record {
+			record[k] = convertNumbers(v)
+		}
+
+		options := w.options
+		if t, ok := parseTime(record[w.timeKey]); ok {
+			delete(record, w.timeKey)
+			options = append(options[:len(options):len(options)], fluent.WithTimestamp(t))
+		}
+		if err := w.client.Post(w.tag, record, options...); err != nil {
+			return 0, errors.Wrap(err, `failed to post event`)
+		}
+	}
+}
+
+// parseTime parses the time field of an event
+func parseTime(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case int64:
+		return time.Unix(v, 0), true
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// convertNumbers replaces the json.Numbers in v with int64s, or float64s
+// for numbers that are not integers, so that they are serialized as
+// numbers by both of the client's marshalers
+func convertNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = convertNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = convertNumbers(e)
+		}
+	}
+	return v
+}
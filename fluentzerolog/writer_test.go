@@ -0,0 +1,93 @@
+package fluentzerolog_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/lestrrat/go-fluent-client/fluentzerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type message struct {
+	tag       string
+	record    interface{}
+	timestamp time.Time
+}
+
+// client records the messages that are posted, instead of sending them
+type client struct {
+	messages []message
+}
+
+func (c *client) Post(tag string, v interface{}, options ...fluent.Option) error {
+	msg := message{tag: tag, record: v}
+	for _, opt := range options {
+		if opt.Name() == "timestamp" {
+			msg.timestamp = opt.Value().(time.Time)
+		}
+	}
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+func (c *client) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return c.Post(tag, v, options...)
+}
+
+func (c *client) Close() error {
+	return nil
+}
+
+func (c *client) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	c := &client{}
+	w := fluentzerolog.NewWriter(c, "app")
+
+	events := `{"level":"info","port":8080,"ratio":0.5,"time":"2016-12-23T11:37:26Z","message":"started"}
+{"level":"warn","stats":{"rows":10},"message":"no time"}
+`
+	if _, err := io.WriteString(w, events); !assert.NoError(t, err, "Write should succeed") {
+		return
+	}
+	if _, err := io.WriteString(w, `{"level":`); !assert.Error(t, err, "Write should fail with invalid JSON") {
+		return
+	}
+
+	if !assert.Len(t, c.messages, 2, "expected 2 messages") {
+		return
+	}
+
+	expected := map[string]interface{}{
+		"level":   "info",
+		"message": "started",
+		"port":    int64(8080),
+		"ratio":   0.5,
+	}
+	if !assert.Equal(t, "app", c.messages[0].tag, "tag should match") {
+		return
+	}
+	if !assert.Equal(t, expected, c.messages[0].record, "record should match") {
+		return
+	}
+	if !assert.Equal(t, int64(1482493046), c.messages[0].timestamp.Unix(), "timestamp should match") {
+		return
+	}
+
+	expected = map[string]interface{}{
+		"level":   "warn",
+		"message": "no time",
+		"stats":   map[string]interface{}{"rows": int64(10)},
+	}
+	if !assert.Equal(t, expected, c.messages[1].record, "record should match") {
+		return
+	}
+	if !assert.True(t, c.messages[1].timestamp.IsZero(), "timestamp should not be set") {
+		return
+	}
+}
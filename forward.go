@@ -0,0 +1,102 @@
+package fluent
+
+import (
+	"bytes"
+
+	msgpack "github.com/lestrrat/go-msgpack"
+	"github.com/pkg/errors"
+)
+
+// Protocol modes. See WithProtocolMode
+const (
+	protocolMessage       = "message"
+	protocolForward       = "forward"
+	protocolPackedForward = "packed_forward"
+)
+
+// Compression algorithms. See WithCompression
+const (
+	compressionGzip = "gzip"
+)
+
+// marshalEntry serializes a message as a [time, record] entry. In the
+// forward modes, this is what gets stored in the pending buffer, and
+// entries with the same tag are bundled together by the writer
+func marshalEntry(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msg.encodeEntry(msgpack.NewEncoder(&buf)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeForward creates a single request from count serialized entries.
+// In the forward mode, the entries are sent as an array:
+//
+//	[tag, [entry, entry, ...], option]
+//
+// In the packed forward mode, the entries are concatenated, and sent as
+// a single msgpack bin object:
+//
+//	[tag, bin(entry entry ...), option]
+//
+// If a compressor is specified, the concatenated entries are compressed
+// before being sent in the packed forward mode.
+//
+// The option map always contains the number of entries, as well as the
+// chunk ID if an ack is requested
+func encodeForward(mode string, compressor Compressor, tag string, entries []byte, count int, chunk string) ([]byte, error) {
+	var buf bytes.Buffer
+	e := msgpack.NewEncoder(&buf)
+	if err := e.EncodeArrayHeader(3); err != nil {
+		return nil, errors.Wrap(err, `failed to encode array header`)
+	}
+	if err := e.EncodeString(tag); err != nil {
+		return nil, errors.Wrap(err, `failed to encode tag`)
+	}
+
+	switch mode {
+	case protocolPackedForward:
+		if compressor != nil {
+			compressed, err := compressEntries(compressor, entries)
+			if err != nil {
+				return nil, err
+			}
+			entries = compressed
+		}
+		if err := e.EncodeBytes(entries); err != nil {
+			return nil, errors.Wrap(err, `failed to encode entries`)
+		}
+	default:
+		if err := e.EncodeArrayHeader(count); err != nil {
+			return nil, errors.Wrap(err, `failed to encode entries header`)
+		}
+		if _, err := e.Writer().Write(entries); err != nil {
+			return nil, errors.Wrap(err, `failed to encode entries`)
+		}
+	}
+
+	options := map[string]interface{}{"size": count}
+	if chunk != "" {
+		options["chunk"] = chunk
+	}
+	if compressor != nil {
+		options["compressed"] = compressor.Name()
+	}
+	if err := e.Encode(options); err != nil {
+		return nil, errors.Wrap(err, `failed to encode option`)
+	}
+	return buf.Bytes(), nil
+}
+
+func compressEntries(compressor Compressor, entries []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := compressor.NewWriter(&buf)
+	if _, err := w.Write(entries); err != nil {
+		return nil, errors.Wrap(err, `failed to compress entries`)
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, `failed to compress entries`)
+	}
+	return buf.Bytes(), nil
+}
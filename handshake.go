@@ -0,0 +1,158 @@
+package fluent
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	msgpack "github.com/lestrrat/go-msgpack"
+	"github.com/pkg/errors"
+)
+
+// handshakeConfig holds the credentials used for the handshake that
+// fluentd's in_forward expects when it is configured with a <security>
+// section. The handshake is only performed if a shared key is given
+type handshakeConfig struct {
+	password     string
+	selfHostname string
+	sharedKey    string
+	username     string
+}
+
+func (h *handshakeConfig) enabled() bool {
+	return len(h.sharedKey) > 0
+}
+
+// setDefaults fills in the hostname of the machine if the handshake is
+// enabled, and the user did not specify one
+func (h *handshakeConfig) setDefaults() error {
+	if !h.enabled() || len(h.selfHostname) > 0 {
+		return nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return errors.Wrap(err, `failed to get hostname`)
+	}
+	h.selfHostname = hostname
+	return nil
+}
+
+// handshake authenticates the connection with the server. The exchange
+// looks like this:
+//
+//	server: ["HELO", {"nonce": nonce, "auth": auth_salt, "keepalive": bool}]
+//	client: ["PING", self_hostname, shared_key_salt, shared_key_digest, username, password_digest]
+//	server: ["PONG", auth_result, reason, server_hostname, shared_key_digest]
+//
+// The username and password digest are only sent if the server asks for
+// user authentication by sending a non-empty auth salt.
+//
+// The digest in PONG is computed by the server using its own hostname,
+// which proves to us that it knows the shared key as well
+func handshake(conn net.Conn, cfg *handshakeConfig, timeout time.Duration) (err error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	dec := msgpack.NewDecoder(conn)
+
+	helo, err := readHandshakeMessage(dec, "HELO", 2)
+	if err != nil {
+		return err
+	}
+	nonce, ok := stringValue(mapValue(helo[1], "nonce"))
+	if !ok {
+		return errors.New(`invalid HELO message: missing nonce`)
+	}
+	// A non-empty auth salt means that the server requires user
+	// authentication
+	authSalt, _ := stringValue(mapValue(helo[1], "auth"))
+	if len(authSalt) > 0 && len(cfg.username) == 0 {
+		return errors.New(`server requires username and password`)
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+
+	var username, passwordDigest string
+	if len(authSalt) > 0 {
+		username = cfg.username
+		passwordDigest = digest(authSalt, cfg.username, cfg.password)
+	}
+
+	ping, err := msgpack.Marshal([]interface{}{
+		"PING",
+		cfg.selfHostname,
+		salt,
+		digest(salt, cfg.selfHostname, nonce, cfg.sharedKey),
+		username,
+		passwordDigest,
+	})
+	if err != nil {
+		return errors.Wrap(err, `failed to encode PING message`)
+	}
+	if _, err := writeAll(conn, ping); err != nil {
+		return errors.Wrap(err, `failed to write PING message`)
+	}
+
+	pong, err := readHandshakeMessage(dec, "PONG", 5)
+	if err != nil {
+		return err
+	}
+	if result, _ := pong[1].(bool); !result {
+		reason, _ := stringValue(pong[2])
+		return errors.Errorf(`authentication failed: %s`, strconv.Quote(reason))
+	}
+
+	serverHostname, _ := stringValue(pong[3])
+	sharedKeyDigest, _ := stringValue(pong[4])
+	if sharedKeyDigest != digest(salt, serverHostname, nonce, cfg.sharedKey) {
+		return errors.New(`shared key mismatch in PONG message`)
+	}
+	return nil
+}
+
+// readHandshakeMessage reads a handshake message, and makes sure that
+// it is of the expected type, and has at least n elements
+func readHandshakeMessage(dec *msgpack.Decoder, typ string, n int) ([]interface{}, error) {
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.Wrapf(err, `failed to read %s message`, typ)
+	}
+
+	l, ok := v.([]interface{})
+	if !ok || len(l) < n {
+		return nil, errors.Errorf(`invalid %s message`, typ)
+	}
+	if s, _ := stringValue(l[0]); s != typ {
+		return nil, errors.Errorf(`expected %s message, got %s`, typ, strconv.Quote(s))
+	}
+	return l, nil
+}
+
+func newSalt() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, `failed to generate salt`)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// digest computes the hex encoded SHA-512 digest of the concatenation of
+// the given values, which is how both the shared key and the password
+// are sent during the handshake
+func digest(values ...string) string {
+	h := sha512.New()
+	for _, v := range values {
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,126 @@
+package fluent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// heartbeat implements the UDP heartbeat of fluentd's out_forward. Every
+// interval, a single null byte is sent over UDP to the port that each
+// server listens on, and in_forward responds in kind. A server that has
+// missed threshold heartbeats in a row is considered dead until it
+// responds again, so that we can fail over before writing to it fails.
+//
+// Servers that have not been probed yet are considered alive
+type heartbeat struct {
+	interval  time.Duration
+	threshold int
+	logger    Logger
+
+	mu     sync.Mutex
+	missed map[string]int
+}
+
+func newHeartbeat(interval time.Duration, threshold int, logger Logger) *heartbeat {
+	return &heartbeat{
+		interval:  interval,
+		threshold: threshold,
+		logger:    logger,
+		missed:    make(map[string]int),
+	}
+}
+
+// run sends heartbeats to the servers returned by addresses until ctx is
+// canceled. addresses is called for each round, as the servers may change
+func (h *heartbeat) run(ctx context.Context, addresses func() []string) {
+	h.logger.Debug("heartbeat started")
+	defer h.logger.Debug("heartbeat exited")
+
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+
+	for {
+		h.beat(ctx, addresses())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// beat sends a heartbeat to each server concurrently, and waits for all
+// of them to respond or to time out
+func (h *heartbeat) beat(ctx context.Context, addresses []string) {
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			err := sendHeartbeat(ctx, address, h.interval)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			if err == nil {
+				if h.missed[address] >= h.threshold {
+					h.logger.Info("server is alive again", "address", address)
+				}
+				h.missed[address] = 0
+				return
+			}
+
+			h.missed[address]++
+			if h.missed[address] == h.threshold {
+				h.logger.Warn("server missed too many heartbeats", "address", address, "error", err)
+			}
+		}(address)
+	}
+	wg.Wait()
+}
+
+// alive reports whether the server at address has responded recently
+func (h *heartbeat) alive(address string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.missed[address] < h.threshold
+}
+
+// sendHeartbeat sends a heartbeat to address, and waits for the response
+// until timeout has elapsed. The heartbeat does not go through the dial
+// function, as it may not be capable of UDP. As with the connections to
+// the server, the default port is used if address has none
+func sendHeartbeat(ctx context.Context, address string, timeout time.Duration) error {
+	address, err := parseAddress("udp", address)
+	if err != nil {
+		return errors.Wrap(err, `failed to parse address`)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return errors.Wrap(err, `failed to dial`)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte{0x00}); err != nil {
+		return errors.Wrap(err, `failed to send heartbeat`)
+	}
+
+	var buf [1]byte
+	if _, err := conn.Read(buf[:]); err != nil {
+		return errors.Wrap(err, `failed to receive heartbeat`)
+	}
+	return nil
+}
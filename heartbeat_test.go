@@ -0,0 +1,134 @@
+package fluent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runHeartbeatResponder responds to heartbeats on address like in_forward
+// does
+func runHeartbeatResponder(t *testing.T, address string) (string, func()) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+
+	go func() {
+		var buf [1]byte
+		for {
+			_, addr, err := conn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte{0x00}, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// deadAddress returns an address that nothing is listening on
+func deadAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket failed: %s", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestHeartbeat(t *testing.T) {
+	live, stop := runHeartbeatResponder(t, "127.0.0.1:0")
+	defer stop()
+	dead := deadAddress(t)
+
+	h := newHeartbeat(100*time.Millisecond, 2, nopLogger{})
+	h.beat(context.Background(), []string{live, dead})
+	if !assert.True(t, h.alive(dead), "server should be alive until the threshold is reached") {
+		return
+	}
+
+	h.beat(context.Background(), []string{live, dead})
+	if !assert.True(t, h.alive(live), "responding server should be alive") {
+		return
+	}
+	if !assert.False(t, h.alive(dead), "server should be dead after missing heartbeats") {
+		return
+	}
+
+	t.Run("server list", func(t *testing.T) {
+		l, err := newServerList([]string{dead, live}, nil, "", time.Minute, nopLogger{})
+		if !assert.NoError(t, err, "newServerList should succeed") {
+			return
+		}
+		l.heartbeat = h
+
+		if !assert.Equal(t, []int{1, 0}, l.order(0), "dead servers should be tried last") {
+			return
+		}
+		if !assert.True(t, l.rotate(), "client should move away from a dead server") {
+			return
+		}
+
+		l.connected(1)
+		if !assert.False(t, l.rotate(), "client should stay on a live server") {
+			return
+		}
+	})
+
+	t.Run("load balancing", func(t *testing.T) {
+		l, err := newServerList([]string{dead, live}, nil, loadBalanceRoundRobin, 0, nopLogger{})
+		if !assert.NoError(t, err, "newServerList should succeed") {
+			return
+		}
+		l.heartbeat = h
+
+		for i := 0; i < 4; i++ {
+			l.rotate()
+			if !assert.Equal(t, 1, l.next(), "dead servers should not be picked") {
+				return
+			}
+		}
+	})
+}
+
+func TestHeartbeatDefaultPort(t *testing.T) {
+	// The address of the server may be given without the port, like
+	// when connecting to it
+	if conn, err := net.ListenPacket("udp", "127.0.0.1:"+defaultPort); err != nil {
+		t.Skipf("default port is not available: %s", err)
+	} else {
+		conn.Close()
+	}
+	_, stop := runHeartbeatResponder(t, "127.0.0.1:"+defaultPort)
+	defer stop()
+
+	h := newHeartbeat(100*time.Millisecond, 1, nopLogger{})
+	h.beat(context.Background(), []string{"127.0.0.1"})
+	if !assert.True(t, h.alive("127.0.0.1"), "server should be alive") {
+		return
+	}
+}
+
+func TestHeartbeatErrors(t *testing.T) {
+	var testcases = []struct {
+		name    string
+		options []Option
+	}{
+		{name: "unix", options: []Option{WithNetwork("unix"), WithAddress("/tmp/fluent.sock")}},
+		{name: "proxy", options: []Option{WithProxy("socks5://127.0.0.1:1080")}},
+		{name: "threshold", options: []Option{WithHeartbeatThreshold(0)}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newMinion(append(tc.options, WithHeartbeatInterval(time.Second))...)
+			if !assert.Error(t, err, "newMinion should fail") {
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package fluent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpTransport posts records to fluentd's in_http input. Unlike the
+// forward protocol, each record is sent in a separate request, with the
+// tag in the path and the time in the query string:
+//
+//	POST /<tag>?time=<unix time>
+type httpTransport struct {
+	client    *http.Client
+	marshaler recordMarshaler
+	url       *url.URL
+}
+
+func newHTTPTransport(address string, m marshaler, dialFunc func(context.Context, string, string) (net.Conn, error), tlsConfig *tls.Config, dialTimeout, writeTimeout time.Duration) (*httpTransport, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse address as URL`)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, errors.Errorf(`invalid URL for http network: %s`, strconv.Quote(address))
+	}
+
+	rm, ok := m.(recordMarshaler)
+	if !ok {
+		return nil, errors.New(`http network requires either the JSON or the msgpack marshaler`)
+	}
+
+	if dialFunc == nil {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		dialFunc = dialer.DialContext
+	}
+
+	return &httpTransport{
+		client: &http.Client{
+			Timeout: writeTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialFunc,
+				TLSClientConfig:     tlsConfig,
+				TLSHandshakeTimeout: dialTimeout,
+			},
+		},
+		marshaler: rm,
+		url:       u,
+	}, nil
+}
+
+// post sends a single record that has been serialized via MarshalRecord
+func (t *httpTransport) post(ctx context.Context, tag string, ts time.Time, subsecond bool, body []byte) error {
+	u := *t.url
+	u.Path = u.Path + "/" + tag
+	u.RawQuery = url.Values{"time": {formatHTTPTime(ts, subsecond)}}.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, `failed to create request`)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", t.marshaler.ContentType())
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, `failed to post record`)
+	}
+	// Drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.Errorf(`unexpected response from server: %s`, res.Status)
+	}
+	return nil
+}
+
+// close closes the connections that are kept alive between requests
+func (t *httpTransport) close() {
+	t.client.CloseIdleConnections()
+}
+
+func formatHTTPTime(t time.Time, subsecond bool) string {
+	if subsecond {
+		return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	}
+	return strconv.FormatInt(t.Unix(), 10)
+}
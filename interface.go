@@ -2,29 +2,92 @@ package fluent
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"sync"
 	"time"
 )
 
 const (
-	optkeyAddress         = "address"
-	optkeyBuffered        = "buffered"
-	optkeyBufferLimit     = "buffer_limit"
-	optkeyContext         = "context"
-	optkeyConnectOnStart  = "connect_on_start"
-	optkeyDialTimeout     = "dial_timeout"
-	optkeyMarshaler       = "marshaler"
-	optkeyMaxConnAttempts = "max_conn_attempts"
-	optkeyNetwork         = "network"
-	optkeyPingInterval    = "ping_interval"
-	optkeyPingResultChan  = "ping_result_chan"
-	optkeySubSecond       = "subsecond"
-	optkeySyncAppend      = "sync_append"
-	optkeyTagPrefix       = "tag_prefix"
-	optkeyTimestamp       = "timestamp"
-	optkeyWriteQueueSize  = "write_queue_size"
-	optkeyWriteThreshold  = "write_threshold"
+	optkeyAckTimeout          = "ack_timeout"
+	optkeyAddress             = "address"
+	optkeyAddresses           = "addresses"
+	optkeyBackoff             = "backoff"
+	optkeyBuffered            = "buffered"
+	optkeyBuffer              = "buffer"
+	optkeyBufferFile          = "buffer_file"
+	optkeyBufferLimit         = "buffer_limit"
+	optkeyContext             = "context"
+	optkeyCopyRecords         = "copy_records"
+	optkeyCompression         = "compression"
+	optkeyCompressor          = "compressor"
+	optkeyChunkSizeLimit      = "chunk_size_limit"
+	optkeyCircuitBreaker      = "circuit_breaker"
+	optkeyClock               = "clock"
+	optkeyClientCertificate   = "client_certificate"
+	optkeyConnections         = "connections"
+	optkeyConnectHook         = "connect_hook"
+	optkeyConnectOnStart      = "connect_on_start"
+	optkeyDialFunc            = "dial_func"
+	optkeyDialTimeout         = "dial_timeout"
+	optkeyDrainOnClose        = "drain_on_close"
+	optkeyErrorHandler        = "error_handler"
+	optkeyExpvar              = "expvar"
+	optkeyFallbackInterval    = "fallback_interval"
+	optkeyFlushInterval       = "flush_interval"
+	optkeyForwardOption       = "forward_option"
+	optkeyHeartbeatInterval   = "heartbeat_interval"
+	optkeyHeartbeatThreshold  = "heartbeat_threshold"
+	optkeyInitialBuffer       = "initial_buffer"
+	optkeyLengthPrefix        = "length_prefix"
+	optkeyLoadBalancing       = "load_balancing"
+	optkeyLogger              = "logger"
+	optkeyMarshaler           = "marshaler"
+	optkeyMaxConnAttempts     = "max_conn_attempts"
+	optkeyMaxConnLifetime     = "max_conn_lifetime"
+	optkeyMaxRetries          = "max_retries"
+	optkeyNetwork             = "network"
+	optkeyNonBlocking         = "non_blocking"
+	optkeyOnConnect           = "on_connect"
+	optkeyOnDisconnect        = "on_disconnect"
+	optkeyOnDrop              = "on_drop"
+	optkeyOnReconnect         = "on_reconnect"
+	optkeyOverflowPolicy      = "overflow_policy"
+	optkeyPingInterval        = "ping_interval"
+	optkeyPingResultChan      = "ping_result_chan"
+	optkeyPassword            = "password"
+	optkeyPostTimeout         = "post_timeout"
+	optkeyProtocolMode        = "protocol_mode"
+	optkeyProxy               = "proxy"
+	optkeyRecordModifier      = "record_modifier"
+	optkeyRequireAck          = "require_ack"
+	optkeySendBufferSize      = "send_buffer_size"
+	optkeySelfHostname        = "self_hostname"
+	optkeyServerWeight        = "server_weight"
+	optkeySharedKey           = "shared_key"
+	optkeyRetryJitter         = "retry_jitter"
+	optkeyRetryPolicy         = "retry_policy"
+	optkeySRV                 = "srv"
+	optkeySlogLevel           = "slog_level"
+	optkeySlogNameKey         = "slog_name_key"
+	optkeySlogTag             = "slog_tag"
+	optkeySubSecond           = "subsecond"
+	optkeySubSecondStrict     = "subsecond_strict"
+	optkeySyncAppend          = "sync_append"
+	optkeyTagBufferLimit      = "tag_buffer_limit"
+	optkeyTagPrefix           = "tag_prefix"
+	optkeyTCPKeepAlive        = "tcp_keep_alive"
+	optkeyTCPNoDelay          = "tcp_no_delay"
+	optkeyTimestamp           = "timestamp"
+	optkeyTimestampExtractor  = "timestamp_extractor"
+	optkeyTimestampResolution = "timestamp_resolution"
+	optkeyTLSConfig           = "tls_config"
+	optkeyUsername            = "username"
+	optkeyWriteDeadline       = "write_deadline"
+	optkeyWriterFields        = "writer_fields"
+	optkeyWriteQueueSize      = "write_queue_size"
+	optkeyWriteThreshold      = "write_threshold"
+	optkeyWriteTracer         = "write_tracer"
 )
 
 type marshaler interface {
@@ -34,6 +97,12 @@ type marshaler interface {
 // Client represents a fluentd client. The client receives data as we go,
 // and proxies it to a background minion. The background minion attempts to
 // write to the server as soon as possible
+//
+// Both *Buffered and *Unbuffered implement Client, and New returns one or
+// the other. Code that accepts a Client rather than either type can be
+// given a fake in tests, such as the one in the fluenttest package. The
+// other methods of the clients are available from the concrete types, or
+// through Flusher and StatsProvider.
 type Client interface {
 	Post(string, interface{}, ...Option) error
 	Ping(string, interface{}, ...Option) error
@@ -41,30 +110,132 @@ type Client interface {
 	Shutdown(context.Context) error
 }
 
+// Flusher is implemented by the clients that can wait for the messages
+// that have been posted so far to be written to the server, such as
+// *Buffered and *Unbuffered. Code that is given a Client can check for it
+// with a type assertion
+type Flusher interface {
+	Flush(context.Context) error
+}
+
+// StatsProvider is implemented by the clients that keep statistics, such
+// as *Buffered and *Unbuffered (see Stats). Code that is given a Client
+// can check for it with a type assertion
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// Buffer stores the messages that the buffered client has not written to
+// the server yet (see WithBuffer). Messages are written to the buffer as
+// they are posted, and read back in the same order whenever the client
+// has room for them in memory. Once they have been written to the server,
+// or given up on, they are removed from the buffer with Truncate.
+//
+// The methods are never called concurrently.
+type Buffer interface {
+	// Write appends a message to the buffer. If there is no room for
+	// it, an error for which IsBufferFull returns true should be
+	// returned. msg.Data must be copied if it is kept after Write
+	// returns.
+	Write(msg *BufferedMessage) error
+
+	// Read returns the oldest message that has not been read yet, or
+	// io.EOF if there is none.
+	Read() (*BufferedMessage, error)
+
+	// Len returns the number of messages in the buffer, including the
+	// ones that have been read, but not truncated yet.
+	Len() int
+
+	// Truncate removes the n oldest messages, all of which have been
+	// read, from the buffer.
+	Truncate(n int) error
+
+	// Close is called when the client is done with the buffer. The
+	// messages that are still in it have not been written.
+	Close() error
+}
+
+// BufferedMessage is a message held in a Buffer.
+//
+// Data holds the message serialized exactly as the client sends it,
+// which depends on the options that the client was created with: a
+// complete message in the message protocol mode, an entry (time and
+// record) in the forward modes, or just the record over http and
+// datagram networks. It is encoded with the marshaler of the client,
+// and includes the length prefix if WithLengthPrefix was specified.
+type BufferedMessage struct {
+	Tag       string // as posted, without the prefix from WithTagPrefix
+	Time      time.Time
+	Subsecond bool   // only used over http
+	Chunk     string // chunk ID embedded in Data, if acks are required in the message mode
+	Data      []byte
+}
+
 // Buffered is a Client that buffers incoming messages, and sends them
 // asynchrnously when it can.
 type Buffered struct {
-	closed       bool
-	minionCancel func()
-	minionDone   chan struct{}
-	minionQueue  chan *Message
-	muClosed     sync.RWMutex
-	pingQueue    chan *Message
-	subsecond    bool
+	breaker         *circuitBreaker
+	clock           func() time.Time
+	closeOnce       sync.Once
+	closed          bool
+	closing         chan struct{} // closed as soon as close() is called
+	copyRecords     bool
+	drainOnClose    time.Duration
+	flushQueue      chan chan error
+	logger          Logger
+	minionAbort     func()
+	minionCancel    func()
+	minionConnected func() bool
+	minionDone      chan struct{}
+	minionErrors    <-chan PostError
+	minionLastError func() error
+	minionStats     func() Stats
+	minionUnflushed func() []*BufferedMessage
+	minionQueue     chan *Message
+	muClosed        sync.RWMutex
+	nonBlocking     bool
+	pingQueue       chan *Message
+	postTimeout     time.Duration
+	resolution      TimestampResolution
+	timeExtractor   func(interface{}) (time.Time, bool)
 }
 
 // Unbuffered is a Client that synchronously sends messages.
 type Unbuffered struct {
-	address         string
-	conn            net.Conn
-	dialTimeout     time.Duration
-	marshaler       marshaler
-	maxConnAttempts uint64
-	mu              sync.RWMutex
-	network         string
-	subsecond       bool
-	tagPrefix       string
-	writeTimeout    time.Duration
+	address          string
+	breaker          *circuitBreaker
+	clock            func() time.Time
+	conn             net.Conn
+	counters         *counters // see Stats
+	connectedAt      time.Time
+	connectHook      func(net.Conn) error
+	dialFunc         func(context.Context, string, string) (net.Conn, error)
+	dialTimeout      time.Duration
+	events           connEvents
+	fallbackInterval time.Duration
+	handshake        handshakeConfig
+	http             *httpTransport
+	lastAddress      string
+	lastError        error
+	lostAt           time.Time
+	lengthPrefix     bool
+	logger           Logger
+	marshaler        marshaler
+	maxConnAttempts  uint64
+	maxConnLifetime  time.Duration
+	mu               sync.RWMutex
+	muLastError      sync.RWMutex
+	network          string
+	postTimeout      time.Duration
+	recordModifier   func(string, interface{}) interface{}
+	resolution       TimestampResolution
+	servers          *serverList
+	tagPrefix        string
+	tcp              tcpOptions
+	timeExtractor    func(interface{}) (time.Time, bool)
+	tlsConfig        *tls.Config
+	writeTimeout     time.Duration
 }
 
 // Option is an interface used for providing options to the
@@ -83,6 +254,62 @@ type Message struct {
 	Option    interface{} `msgpack:"option"`
 	subsecond bool        // true if we should include subsecond resolution time
 	replyCh   chan error  // non-nil if caller expects notification for successfully appending to buffer
+	flushCh   chan error  // non-nil if caller expects notification for writing to the server
+	batch     []*Message  // non-nil if the messages were posted together via PostAll
+}
+
+// Entry is a single message posted via PostAll. If Time is the zero
+// value, the current time is used. As with WithTimestamp, the time that
+// is extracted from Record takes precedence, if the client has a
+// timestamp extractor (see WithTimestampExtractor)
+type Entry struct {
+	Tag    string
+	Time   time.Time
+	Record interface{}
+}
+
+// Result represents the outcome of a message posted via PostAsync
+type Result struct {
+	appended chan error
+	ch       chan error
+	err      error
+	once     sync.Once
+}
+
+// forwardOption is a single user-specified entry in the message option map
+type forwardOption struct {
+	key   string
+	value interface{}
+}
+
+// clientCertificate specifies the files from which the client certificate
+// used for TLS connections is loaded
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+}
+
+// tagBufferLimit is the maximum number of pending bytes for a single tag
+type tagBufferLimit struct {
+	tag   string
+	limit int
+}
+
+// bufferFileConfig describes the file in which the pending messages are
+// persisted (see WithBufferFile)
+type bufferFileConfig struct {
+	path  string
+	limit int
+}
+
+type circuitBreakerConfig struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+type serverWeight struct {
+	address string
+	weight  int
 }
 
 // EventTime is used to represent the time in a msgpack Message
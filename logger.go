@@ -0,0 +1,21 @@
+package fluent
+
+// Logger receives the diagnostics of a client, such as connections and
+// reconnections, buffer pressure and dropped messages (see WithLogger).
+// Each method takes a message, followed by alternating keys and values,
+// as in log/slog, so that a *slog.Logger can be used as is. The methods
+// are called synchronously from the client, so they must not block
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger is used when no logger has been specified
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -1,13 +1,48 @@
 package fluent
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+
 	msgpack "github.com/lestrrat/go-msgpack"
+	"github.com/pkg/errors"
 )
 
-type marshalFunc func(*Message) ([]byte, error)
+// recordMarshaler is implemented by marshalers that can serialize a bare
+// record, which is required by transports that send the tag and the time
+// separately from the record, such as HTTP
+type recordMarshaler interface {
+	MarshalRecord(interface{}) ([]byte, error)
+	ContentType() string
+}
+
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(msg *Message) ([]byte, error) {
+	return jsonMarshal(msg)
+}
 
-func (f marshalFunc) Marshal(msg *Message) ([]byte, error) {
-	return f(msg)
+func (jsonMarshaler) MarshalRecord(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaler) ContentType() string {
+	return "application/json"
+}
+
+type msgpackMarshaler struct{}
+
+func (msgpackMarshaler) Marshal(msg *Message) ([]byte, error) {
+	return msgpackMarshal(msg)
+}
+
+func (msgpackMarshaler) MarshalRecord(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackMarshaler) ContentType() string {
+	return "application/msgpack"
 }
 
 func msgpackMarshal(m *Message) ([]byte, error) {
@@ -17,3 +52,16 @@ func msgpackMarshal(m *Message) ([]byte, error) {
 func jsonMarshal(m *Message) ([]byte, error) {
 	return m.MarshalJSON()
 }
+
+// addLengthPrefix prepends the length of the serialized message as a
+// 4 byte big-endian unsigned integer
+func addLengthPrefix(buf []byte) ([]byte, error) {
+	if uint64(len(buf)) > math.MaxUint32 {
+		return nil, errors.Errorf(`message too large for length prefix (%d bytes)`, len(buf))
+	}
+
+	prefixed := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(prefixed, uint32(len(buf)))
+	copy(prefixed[4:], buf)
+	return prefixed, nil
+}
@@ -2,41 +2,119 @@ package fluent
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"strconv"
 	"time"
 
 	msgpack "github.com/lestrrat/go-msgpack"
-	pdebug "github.com/lestrrat/go-pdebug"
 	"github.com/pkg/errors"
 )
 
-func makeMessage(tag string, record interface{}, t time.Time, useSubsecond, needReply bool) *Message {
+// RawRecord is a record that has already been serialized in the format
+// of the marshaler of the client: msgpack by default, or JSON (see
+// WithJSONMarshaler). It is written as is, without being validated, so
+// it must contain a single valid value. See also PostRaw.
+//
+// Like any record given to Post, a RawRecord is serialized in the
+// background by a buffered client, so it must not be modified after it
+// has been posted, unless WithCopyRecords is given. PostRaw copies it.
+type RawRecord []byte
+
+// EncodeMsgpack writes the record as is
+func (r RawRecord) EncodeMsgpack(e *msgpack.Encoder) error {
+	if len(r) == 0 {
+		return errors.New(`empty raw record`)
+	}
+	if _, err := e.Writer().Write(r); err != nil {
+		return errors.Wrap(err, `failed to write raw record`)
+	}
+	return nil
+}
+
+// MarshalJSON returns the record as is
+func (r RawRecord) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return nil, errors.New(`empty raw record`)
+	}
+	return r, nil
+}
+
+func makeMessage(tag string, record interface{}, t time.Time, resolution TimestampResolution, needReply bool) *Message {
 	msg := getMessage()
 	msg.Tag = tag
-	msg.Time.Time = t
 	msg.Record = record
-	msg.subsecond = useSubsecond
+	switch resolution {
+	case TimestampMilliseconds:
+		msg.Time.Time = t.Truncate(time.Millisecond)
+		msg.subsecond = true
+	case TimestampNanoseconds:
+		msg.Time.Time = t
+		msg.subsecond = true
+	default:
+		msg.Time.Time = t
+		msg.subsecond = false
+	}
 	if needReply {
 		msg.replyCh = make(chan error, 1)
 	}
 	return msg
 }
 
-func (m *Message) clear() {
-	if pdebug.Enabled {
-		g := pdebug.Marker("Message.clear")
-		defer g.End()
+// These keys in the message option map are managed by this library,
+// and may not be specified via WithForwardOption
+var reservedForwardOptions = map[string]struct{}{
+	"chunk":      {},
+	"compressed": {},
+	"size":       {},
+}
+
+// addForwardOption adds a user-specified entry to the message option map.
+// The map is allocated on demand, so that messages without any options
+// keep sending nil in their option field
+func addForwardOption(options map[string]interface{}, fo *forwardOption) (map[string]interface{}, error) {
+	if _, ok := reservedForwardOptions[fo.key]; ok {
+		return nil, errors.Errorf(`forward option %s is reserved`, strconv.Quote(fo.key))
 	}
 
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	options[fo.key] = fo.value
+	return options, nil
+}
+
+// newChunkID generates a random ID to be used as the "chunk" option
+func newChunkID() (string, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", errors.Wrap(err, `failed to generate chunk id`)
+	}
+	return base64.StdEncoding.EncodeToString(buf[:]), nil
+}
+
+// setChunkOption adds the chunk ID to the message option map, which tells
+// the server to send us an ack for this message
+func (m *Message) setChunkOption(id string) {
+	options, ok := m.Option.(map[string]interface{})
+	if !ok || options == nil {
+		options = make(map[string]interface{})
+		m.Option = options
+	}
+	options["chunk"] = id
+}
+
+func (m *Message) clear() {
 	m.Tag = ""
 	m.Time = EventTime{}
 	m.Record = nil
 	m.Option = nil
+	// flushCh is owned by the writer once the message has been appended
+	// to the pending buffer, so we only let go of our reference
+	m.flushCh = nil
+	m.batch = nil
 	if m.replyCh != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("Closing reply channel")
-		}
 		close(m.replyCh)
 		m.replyCh = nil
 	}
@@ -100,10 +178,19 @@ func (m *Message) MarshalJSON() ([]byte, error) {
 
 	buf.WriteByte(',')
 
-	if err := enc.Encode(m.Record); err != nil {
-		return nil, errors.Wrap(err, `failed to encode record`)
+	if raw, ok := m.Record.(json.RawMessage); ok && len(raw) > 0 {
+		// The record has already been serialized by the caller. Going
+		// through the encoder would validate and compact it, which
+		// costs us allocations, so we trust the caller and copy as is
+		buf.Write(raw)
+	} else if raw, ok := m.Record.(RawRecord); ok && len(raw) > 0 {
+		buf.Write(raw)
+	} else {
+		if err := enc.Encode(m.Record); err != nil {
+			return nil, errors.Wrap(err, `failed to encode record`)
+		}
+		buf.Truncate(buf.Len() - 1)
 	}
-	buf.Truncate(buf.Len() - 1)
 
 	buf.WriteByte(',')
 
@@ -114,10 +201,6 @@ func (m *Message) MarshalJSON() ([]byte, error) {
 
 	buf.WriteByte(']')
 
-	if pdebug.Enabled {
-		pdebug.Printf("message marshaled to: %s", strconv.Quote(buf.String()))
-	}
-
 	return buf.Bytes(), nil
 }
 
@@ -129,8 +212,35 @@ func (m *Message) EncodeMsgpack(e *msgpack.Encoder) error {
 	if err := e.EncodeString(m.Tag); err != nil {
 		return errors.Wrap(err, `failed to encode tag`)
 	}
+	if err := m.encodeTime(e); err != nil {
+		return err
+	}
+	if err := e.Encode(m.Record); err != nil {
+		return errors.Wrap(err, `failed to encode record`)
+	}
+	if err := e.Encode(m.Option); err != nil {
+		return errors.Wrap(err, `failed to encode option`)
+	}
+	return nil
+}
+
+// encodeEntry serializes a Message as a single [time, record] entry,
+// which is what the forward modes send for each message
+func (m *Message) encodeEntry(e *msgpack.Encoder) error {
+	if err := e.EncodeArrayHeader(2); err != nil {
+		return errors.Wrap(err, `failed to encode array header`)
+	}
+	if err := m.encodeTime(e); err != nil {
+		return err
+	}
+	if err := e.Encode(m.Record); err != nil {
+		return errors.Wrap(err, `failed to encode record`)
+	}
+	return nil
+}
 
-	if m.subsecond {
+func (m *Message) encodeTime(e *msgpack.Encoder) error {
+	if m.subsecond && subsecondAvailable() {
 		if err := e.EncodeStruct(m.Time); err != nil {
 			return errors.Wrap(err, `failed to encode time`)
 		}
@@ -139,13 +249,6 @@ func (m *Message) EncodeMsgpack(e *msgpack.Encoder) error {
 			return errors.Wrap(err, `failed to encode msgpack: time`)
 		}
 	}
-
-	if err := e.Encode(m.Record); err != nil {
-		return errors.Wrap(err, `failed to encode record`)
-	}
-	if err := e.Encode(m.Option); err != nil {
-		return errors.Wrap(err, `failed to encode option`)
-	}
 	return nil
 }
 
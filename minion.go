@@ -2,12 +2,12 @@ package fluent
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net"
 	"sync"
 	"time"
 
-	backoff "github.com/lestrrat/go-backoff"
-	pdebug "github.com/lestrrat/go-pdebug"
 	"github.com/pkg/errors"
 )
 
@@ -48,120 +48,621 @@ import (
 // Once connected, the writer tries to write everything it can, for as long
 // as it can. If the buffer is empty, or the connection is dropped, we
 // start over the write process (without waiting for the wake-up call)
+//
+// The connection is also watched by a separate goroutine that reads from
+// it, so that a connection closed by the server while the writer was idle
+// is replaced before anything else is written to it.
+//
+// Messages are always written in the order that they were accepted by
+// Post(). The writer keeps track of the boundaries of each serialized
+// message in the pending buffer, and only discards messages that have been
+// written in their entirety. If the connection is dropped in the middle of
+// a message, that message stays at the head of the buffer, and is sent
+// again on the next connection before any newer data.
+//
+// In the forward modes (forward and packed_forward), the pending buffer
+// holds [time, record] entries instead of complete messages, and the writer
+// bundles consecutive entries with the same tag into a single request.
+// Each request is treated as a unit: it is either written in its entirety,
+// or sent again.
+
+const (
+	overflowReject     = "reject"
+	overflowDropOldest = "drop_oldest"
+	overflowBlock      = "block"
+)
+
+// errorChSize is the number of errors that the error channel holds (see
+// Buffered.Errors) before further errors are dropped
+const errorChSize = 128
+
+// pendingFrame describes a single serialized message in the pending buffer
+type pendingFrame struct {
+	chunk     string // chunk ID that the server acknowledges, if acks are required
+	size      int
+	tag       string     // tag as specified by the user, without the prefix
+	time      time.Time  // only used by the HTTP transport, which sends the time separately
+	subsecond bool       // only used by the HTTP transport
+	flushCh   chan error // non-nil if the caller expects notification for writing to the server
+	stored    bool       // true if the message is held in m.store (see loadStore)
+	dropped   bool       // true if the message could not be sent over a datagram network
+	appended  time.Time  // when the message was appended to the pending buffer, see observeWrite
+
+	// In the forward modes, the chunk ID with which this message and the
+	// ones after it were sent, if they are waiting for an ack. They are
+	// sent again as the same chunk (see encodeChunk)
+	sentChunk  string
+	sentFrames int
+	attempts   int // failed attempts to write the chunk that starts here, see failChunk
+}
 
 type minion struct {
-	address         string
-	backoffPolicy   backoff.Policy
-	buffer          []byte
-	bufferLimit     int
-	cond            *sync.Cond
-	dialTimeout     time.Duration
-	done            chan struct{}
-	incoming        chan *Message
-	marshaler       marshaler
-	maxConnAttempts uint64
-	muPending       sync.RWMutex
-	network         string
-	pending         []byte
-	pingCh          chan *Message
-	readerDone      chan struct{}
-	tagPrefix       string
-	writeThreshold  int
-	writeTimeout    time.Duration
+	ackTimeout       time.Duration
+	address          string
+	backoff          backoffConfig
+	batches          map[*batch]struct{} // claimed by the writers, see claimBatch
+	buffer           []byte
+	breaker          *circuitBreaker
+	bufferLimit      int
+	callbacks        *callbackQueue // runs the callbacks of the application, see queueCallback
+	chunkSizeLimit   int            // max bytes of messages in a chunk, see encodeChunk
+	closing          bool           // see waitSpace
+	compressor       Compressor
+	cond             *sync.Cond
+	connections      int
+	counters         *counters // see stats
+	connectHook      func(net.Conn) error
+	dialFunc         func(context.Context, string, string) (net.Conn, error)
+	dialTimeout      time.Duration
+	done             chan struct{}
+	errorCh          chan PostError // see Buffered.Errors
+	errorChClosed    bool
+	errorHandler     func(error, *Message)
+	events           connEvents
+	fallbackInterval time.Duration
+	flushCancel      func()
+	flushCtx         context.Context
+	flushInterval    time.Duration
+	flushRequests    chan chan error // see requestFlush
+	flushWaiters     []chan error
+	handshake        handshakeConfig
+	heartbeat        *heartbeat
+	http             *httpTransport
+	incoming         chan *Message
+	inflight         int // bytes claimed by the writers, see claimBatch
+	lastError        error
+	lengthPrefix     bool
+	logger           Logger
+	marshaler        marshaler
+	maxConnAttempts  uint64
+	maxConnLifetime  time.Duration
+	maxRetries       int // failures before a chunk is dropped, see failChunk
+	muConns          sync.Mutex
+	muErrorCh        sync.Mutex
+	muLastError      sync.RWMutex
+	muPending        sync.RWMutex
+	network          string
+	onDrop           func(error, *BufferedMessage)
+	openConns        map[net.Conn]<-chan struct{} // see isConnected
+	overflowPolicy   string
+	pending          []byte
+	pendingFrames    []pendingFrame
+	pendingSince     time.Time
+	pingCh           chan *Message
+	protocolMode     string
+	readerDone       chan struct{}
+	recordModifier   func(string, interface{}) interface{}
+	requireAck       bool
+	retryBlocked     bool // see waitRetry
+	retryPolicy      RetryPolicy
+	servers          *serverList
+	spaceCond        *sync.Cond // signaled when room is made in the pending buffer, see waitSpace
+	store            Buffer
+	storeNext        *BufferedMessage // read from store, but not loaded yet
+	storeWaiters     []chan error     // flushCh of the messages in store that have not been loaded
+	tagBufferLimits  map[string]int
+	tagPending       map[string]int
+	tagPrefix        string
+	tcp              tcpOptions
+	tlsConfig        *tls.Config
+	writeThreshold   int
+	writeTimeout     time.Duration
+	writeTracer      WriteTracer
+	writing          int // bytes at the head of the pending buffer being written without holding muPending
 }
 
 func newMinion(options ...Option) (*minion, error) {
 	m := &minion{
-		address:         "127.0.0.1:24224",
-		backoffPolicy:   backoff.NewExponential(),
-		bufferLimit:     8 * 1024 * 1024,
-		cond:            sync.NewCond(&sync.Mutex{}),
-		dialTimeout:     3 * time.Second,
-		done:            make(chan struct{}),
-		maxConnAttempts: 64,
-		marshaler:       marshalFunc(msgpackMarshal),
-		network:         "tcp",
-		pingCh:          make(chan *Message),
-		readerDone:      make(chan struct{}),
-		writeThreshold:  8 * 1028,
-		writeTimeout:    3 * time.Second,
+		ackTimeout:       10 * time.Second,
+		address:          "127.0.0.1:24224",
+		backoff:          defaultBackoff(),
+		batches:          make(map[*batch]struct{}),
+		bufferLimit:      8 * 1024 * 1024,
+		cond:             sync.NewCond(&sync.Mutex{}),
+		connections:      1,
+		logger:           nopLogger{},
+		openConns:        make(map[net.Conn]<-chan struct{}),
+		overflowPolicy:   overflowReject,
+		tcp:              defaultTCPOptions(),
+		dialTimeout:      3 * time.Second,
+		fallbackInterval: time.Minute,
+		counters:         &counters{},
+		done:             make(chan struct{}),
+		errorCh:          make(chan PostError, errorChSize),
+		maxConnAttempts:  64,
+		marshaler:        msgpackMarshaler{},
+		network:          "tcp",
+		pingCh:           make(chan *Message),
+		protocolMode:     protocolMessage,
+		readerDone:       make(chan struct{}),
+		flushInterval:    time.Second,
+		flushRequests:    make(chan chan error),
+		writeThreshold:   8 * 1024,
+		writeTimeout:     3 * time.Second,
 	}
+	m.spaceCond = sync.NewCond(&m.muPending)
 
 	var writeQueueSize = 64
+	var initialBuffer = -1
 	var connectOnStart bool
+	var protocolModeSet bool
+	var clientCert *clientCertificate
+	var proxyURL string
+	var addresses []string
+	var srvName string
+	var loadBalancing string
+	var serverWeights map[string]int
+	var heartbeatInterval time.Duration
+	var heartbeatThreshold = 3
+	var breakerConfig *circuitBreakerConfig
+	var bufferFile *bufferFileConfig
+	var store Buffer
+	var retryJitter *float64
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyNetwork:
 			v := opt.Value().(string)
 			switch v {
-			case "tcp", "unix":
+			case "tcp", "unix", "http", "udp", "unixgram", "npipe":
 			default:
 				return nil, errors.Errorf(`invalid network type: %s`, v)
 			}
 			m.network = v
 		case optkeyAddress:
 			m.address = opt.Value().(string)
+			addresses = nil
+			srvName = ""
+		case optkeyAddresses:
+			addresses = opt.Value().([]string)
+			srvName = ""
+		case optkeySRV:
+			srvName = opt.Value().(string)
+		case optkeyFallbackInterval:
+			m.fallbackInterval = opt.Value().(time.Duration)
+		case optkeyOverflowPolicy:
+			v := opt.Value().(string)
+			switch v {
+			case overflowReject, overflowDropOldest, overflowBlock:
+			default:
+				return nil, errors.Errorf(`invalid overflow policy: %s`, v)
+			}
+			m.overflowPolicy = v
+		case optkeyLoadBalancing:
+			v := opt.Value().(string)
+			switch v {
+			case "", loadBalanceRoundRobin, loadBalanceRandom:
+			default:
+				return nil, errors.Errorf(`invalid load balancing strategy: %s`, v)
+			}
+			loadBalancing = v
+		case optkeyServerWeight:
+			v := opt.Value().(*serverWeight)
+			if serverWeights == nil {
+				serverWeights = make(map[string]int)
+			}
+			serverWeights[v.address] = v.weight
+		case optkeyHeartbeatInterval:
+			heartbeatInterval = opt.Value().(time.Duration)
+		case optkeyHeartbeatThreshold:
+			heartbeatThreshold = opt.Value().(int)
+		case optkeyAckTimeout:
+			m.ackTimeout = opt.Value().(time.Duration)
+		case optkeyBuffer:
+			store = opt.Value().(Buffer)
+			bufferFile = nil
+		case optkeyBufferFile:
+			bufferFile = opt.Value().(*bufferFileConfig)
+			store = nil
 		case optkeyBufferLimit:
 			m.bufferLimit = opt.Value().(int)
+		case optkeyCompression:
+			v := opt.Value().(string)
+			switch v {
+			case "":
+				m.compressor = nil
+			case compressionGzip:
+				m.compressor = gzipCompressor{}
+			default:
+				return nil, errors.Errorf(`invalid compression: %s`, v)
+			}
+		case optkeyCompressor:
+			// A nil compressor disables compression
+			m.compressor, _ = opt.Value().(Compressor)
+		case optkeyCircuitBreaker:
+			breakerConfig = opt.Value().(*circuitBreakerConfig)
+		case optkeyClientCertificate:
+			clientCert = opt.Value().(*clientCertificate)
+		case optkeyConnections:
+			m.connections = opt.Value().(int)
+		case optkeyConnectHook:
+			m.connectHook = opt.Value().(func(net.Conn) error)
+		case optkeyErrorHandler:
+			m.errorHandler = opt.Value().(func(error, *Message))
+		case optkeyOnDrop:
+			m.onDrop = opt.Value().(func(error, *BufferedMessage))
+		case optkeyOnConnect:
+			m.events.onConnect = opt.Value().(func(string))
+		case optkeyOnDisconnect:
+			m.events.onDisconnect = opt.Value().(func(string, error))
+		case optkeyOnReconnect:
+			m.events.onReconnect = opt.Value().(func(string, time.Duration))
+		case optkeyDialFunc:
+			m.dialFunc = opt.Value().(func(context.Context, string, string) (net.Conn, error))
 		case optkeyDialTimeout:
 			m.dialTimeout = opt.Value().(time.Duration)
+		case optkeyWriteDeadline:
+			m.writeTimeout = opt.Value().(time.Duration)
+		case optkeyFlushInterval:
+			m.flushInterval = opt.Value().(time.Duration)
+		case optkeyInitialBuffer:
+			initialBuffer = opt.Value().(int)
+		case optkeyLengthPrefix:
+			m.lengthPrefix = opt.Value().(bool)
+		case optkeyLogger:
+			m.logger = opt.Value().(Logger)
 		case optkeyMarshaler:
 			m.marshaler = opt.Value().(marshaler)
 		case optkeyMaxConnAttempts:
 			m.maxConnAttempts = opt.Value().(uint64)
+		case optkeyMaxConnLifetime:
+			m.maxConnLifetime = opt.Value().(time.Duration)
+		case optkeyChunkSizeLimit:
+			v := opt.Value().(int)
+			if v < 0 {
+				return nil, errors.Errorf(`invalid chunk size limit: %d`, v)
+			}
+			m.chunkSizeLimit = v
+		case optkeyMaxRetries:
+			v := opt.Value().(int)
+			if v < 0 {
+				return nil, errors.Errorf(`invalid max retries: %d`, v)
+			}
+			m.maxRetries = v
+		case optkeyProtocolMode:
+			v := opt.Value().(string)
+			switch v {
+			case protocolMessage, protocolForward, protocolPackedForward:
+			default:
+				return nil, errors.Errorf(`invalid protocol mode: %s`, v)
+			}
+			m.protocolMode = v
+			protocolModeSet = true
+		case optkeyRetryPolicy:
+			m.retryPolicy = opt.Value().(RetryPolicy)
+		case optkeyRetryJitter:
+			v := opt.Value().(float64)
+			retryJitter = &v
+		case optkeyBackoff:
+			m.backoff = *(opt.Value().(*backoffConfig))
+		case optkeyTagBufferLimit:
+			v := opt.Value().(*tagBufferLimit)
+			if m.tagBufferLimits == nil {
+				m.tagBufferLimits = make(map[string]int)
+				m.tagPending = make(map[string]int)
+			}
+			m.tagBufferLimits[v.tag] = v.limit
+		case optkeyRecordModifier:
+			m.recordModifier = opt.Value().(func(string, interface{}) interface{})
+		case optkeyRequireAck:
+			m.requireAck = opt.Value().(bool)
+		case optkeyPassword:
+			m.handshake.password = opt.Value().(string)
+		case optkeySelfHostname:
+			m.handshake.selfHostname = opt.Value().(string)
+		case optkeySharedKey:
+			m.handshake.sharedKey = opt.Value().(string)
+		case optkeyUsername:
+			m.handshake.username = opt.Value().(string)
 		case optkeyTagPrefix:
 			m.tagPrefix = opt.Value().(string)
+		case optkeyTCPKeepAlive:
+			m.tcp.keepAlive = opt.Value().(time.Duration)
+		case optkeyTCPNoDelay:
+			m.tcp.noDelay = opt.Value().(bool)
+		case optkeySendBufferSize:
+			m.tcp.sendBufferSize = opt.Value().(int)
+		case optkeyTLSConfig:
+			m.tlsConfig = opt.Value().(*tls.Config)
 		case optkeyWriteQueueSize:
 			writeQueueSize = opt.Value().(int)
 		case optkeyWriteThreshold:
 			m.writeThreshold = opt.Value().(int)
+		case optkeyWriteTracer:
+			m.writeTracer = opt.Value().(WriteTracer)
 		case optkeyConnectOnStart:
 			connectOnStart = opt.Value().(bool)
+		case optkeyProxy:
+			proxyURL = opt.Value().(string)
+		}
+	}
+
+	// This is done after all options have been processed, so that it
+	// does not matter whether WithTLSConfig comes before or after
+	if clientCert != nil {
+		m.tlsConfig = clientCert.apply(m.tlsConfig)
+	}
+
+	if err := m.handshake.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	// WithRetryJitter applies whether it comes before or after WithBackoff
+	if retryJitter != nil {
+		m.backoff.jitter = *retryJitter
+	}
+	if err := m.backoff.validate(); err != nil {
+		return nil, err
+	}
+	if err := m.retryPolicy.validate(); err != nil {
+		return nil, err
+	}
+
+	if m.connections < 1 {
+		return nil, errors.Errorf(`invalid number of connections: %d`, m.connections)
+	}
+	if m.connections > 1 && m.network != "tcp" && m.network != "unix" {
+		return nil, errors.Errorf(`multiple connections are not supported over %s`, m.network)
+	}
+
+	m.events.logger = m.logger
+
+	breaker, err := newCircuitBreaker(breakerConfig, m.logger)
+	if err != nil {
+		return nil, err
+	}
+	m.breaker = breaker
+
+	// The proxy dialer wraps whatever dial function has been specified,
+	// so this is also done after all options have been processed
+	if len(proxyURL) > 0 {
+		if m.network != "tcp" && m.network != "http" {
+			return nil, errors.Errorf(`network %s can not be used through a proxy`, m.network)
+		}
+		d, err := newProxyDialer(proxyURL, m.dialFunc)
+		if err != nil {
+			return nil, err
+		}
+		m.dialFunc = d.dial
+	}
+
+	// Compression is only defined for the packed forward mode
+	if m.compressor != nil {
+		if !protocolModeSet {
+			m.protocolMode = protocolPackedForward
+		} else if m.protocolMode != protocolPackedForward {
+			return nil, errors.Errorf(`compression is not supported in protocol mode %s`, m.protocolMode)
+		}
+	}
+
+	if len(srvName) > 0 {
+		if len(loadBalancing) > 0 || serverWeights != nil {
+			return nil, errors.New(`load balancing is not supported with SRV records`)
+		}
+		m.servers = newSRVServerList(srvName, m.logger)
+	} else {
+		if addresses == nil {
+			addresses = []string{m.address}
+		} else if len(addresses) > 0 {
+			m.address = addresses[0]
+		}
+		m.servers, err = newServerList(addresses, serverWeights, loadBalancing, m.fallbackInterval, m.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if heartbeatInterval > 0 {
+		if m.network != "tcp" {
+			return nil, errors.Errorf(`heartbeat is not supported over %s`, m.network)
+		}
+		if len(proxyURL) > 0 {
+			return nil, errors.New(`heartbeat is not supported through a proxy`)
+		}
+		if heartbeatThreshold <= 0 {
+			return nil, errors.Errorf(`invalid heartbeat threshold: %d`, heartbeatThreshold)
+		}
+		m.heartbeat = newHeartbeat(heartbeatInterval, heartbeatThreshold, m.logger)
+		m.servers.heartbeat = m.heartbeat
+	}
+
+	if m.network == "http" {
+		if len(addresses) > 1 || len(srvName) > 0 {
+			return nil, errors.New(`multiple addresses are not supported over http`)
+		}
+
+		if m.protocolMode != protocolMessage {
+			return nil, errors.Errorf(`protocol mode %s is not supported over http`, m.protocolMode)
+		}
+		if m.handshake.enabled() {
+			return nil, errors.New(`handshake is not supported over http`)
+		}
+
+		m.http, err = newHTTPTransport(m.address, m.marshaler, m.dialFunc, m.tlsConfig, m.dialTimeout, m.writeTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// There is no connection whose state could be reported over http,
+	// or over datagram networks
+	if m.events.enabled() && (m.network == "http" || isDatagramNetwork(m.network)) {
+		return nil, errors.Errorf(`connection callbacks are not supported over %s`, m.network)
+	}
+
+	// Named pipes are opened as synchronous handles, on which a pending
+	// read blocks any write. We cannot have watchConn read in the
+	// background, so there is no way to receive acks
+	if m.network == "npipe" && m.requireAck {
+		return nil, errors.New(`acks are not supported over npipe`)
+	}
+
+	if isDatagramNetwork(m.network) {
+		if m.protocolMode != protocolMessage {
+			return nil, errors.Errorf(`protocol mode %s is not supported over %s`, m.protocolMode, m.network)
+		}
+		if m.requireAck {
+			return nil, errors.Errorf(`acks are not supported over %s`, m.network)
+		}
+		if err := checkDatagramOptions(m.network, m.marshaler, m.tlsConfig, &m.handshake, m.tagPrefix); err != nil {
+			return nil, err
 		}
 	}
 
-	// if requested, connect to the server
-	if connectOnStart {
-		conn, err := dial(context.Background(), m.network, m.address, m.dialTimeout)
+	// if requested, connect to the server. There is no connection to
+	// establish upfront for HTTP
+	if connectOnStart && m.http == nil {
+		conn, err := m.servers.dial(context.Background(), func(ctx context.Context, address string) (net.Conn, error) {
+			return dial(ctx, m.dialFunc, m.tlsConfig, m.network, address, m.dialTimeout)
+		})
 		if err != nil {
 			return nil, errors.Wrap(err, `failed to connect on start`)
 		}
 		defer conn.Close()
 	}
 
-	m.buffer = make([]byte, 0, m.bufferLimit)
+	if m.errorHandler != nil || m.onDrop != nil || m.retryPolicy.DeadLetter != nil || m.events.enabled() {
+		m.callbacks = newCallbackQueue(callbackQueueSize, func() {
+			m.counters.addDroppedCallback()
+			m.logger.Warn("callback queue is full, dropping callback")
+		})
+		m.events.run = m.queueCallback
+	}
+
+	if initialBuffer < 0 || initialBuffer > m.bufferLimit {
+		initialBuffer = m.bufferLimit
+	}
+	m.buffer = make([]byte, 0, initialBuffer)
 	m.pending = m.buffer
-	if pdebug.Enabled {
-		pdebug.Printf("m.pending cap %d", cap(m.pending))
-		pdebug.Printf("m.pending len %d", len(m.pending))
+	// The buffer file is opened last, as there is nobody to close it if
+	// we fail. Messages that were left in the buffer by a previous
+	// process are loaded before any new message is accepted
+	if store != nil || bufferFile != nil {
+		if m.connections > 1 {
+			return nil, errors.New(`custom buffers are not supported with several connections`)
+		}
+		if m.overflowPolicy != overflowReject {
+			return nil, errors.Errorf(`overflow policy %s is not supported with custom buffers`, m.overflowPolicy)
+		}
+		if bufferFile != nil {
+			store, err = NewFileBuffer(bufferFile.path, bufferFile.limit)
+			if err != nil {
+				m.closeCallbacks()
+				return nil, err
+			}
+		}
+		m.store = store
+		m.storeWaiters = make([]chan error, store.Len())
+		if n := len(m.storeWaiters); n > 0 {
+			m.logger.Info("recovered messages from buffer", "messages", n)
+		}
+		m.loadStore()
 	}
 
 	m.incoming = make(chan *Message, writeQueueSize)
 
+	// flushCtx is only canceled when the user gives up on waiting for
+	// the pending buffer to be flushed during Shutdown()
+	m.flushCtx, m.flushCancel = context.WithCancel(context.Background())
+
 	return m, nil
 }
 
+// requestFlush makes the writer write everything that has been posted so
+// far, regardless of the write threshold, and notifies ch once the pending
+// buffer is empty (see Buffered.Flush)
+func (m *minion) requestFlush(ch chan error) {
+	// The messages that were posted before Flush was called may still be
+	// waiting in the queue
+	for n := len(m.incoming); n > 0; n-- {
+		msg, ok := <-m.incoming
+		if !ok {
+			break
+		}
+		m.appendMessage(msg)
+	}
+
+	m.logger.Debug("flush requested")
+	m.muPending.Lock()
+	m.flushWaiters = append(m.flushWaiters, ch)
+	m.notifyFlushed()
+	m.muPending.Unlock()
+
+	// Wake up the writer, so that it ignores the write threshold
+	m.cond.Broadcast()
+}
+
+// notifyFlushed notifies the callers waiting for the pending buffer to be
+// flushed, if there is nothing left to write. The caller must be holding
+// muPending
+func (m *minion) notifyFlushed() {
+	if len(m.flushWaiters) == 0 || len(m.pending) > 0 || m.inflight > 0 || m.storeNext != nil || len(m.storeWaiters) > 0 {
+		return
+	}
+	for _, ch := range m.flushWaiters {
+		ch <- nil
+	}
+	m.flushWaiters = nil
+}
+
+// flushRequested reports whether Flush is waiting for the pending data to
+// be written, after notifying it if there is nothing left to write
+func (m *minion) flushRequested() bool {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	m.notifyFlushed()
+	return len(m.flushWaiters) > 0 && len(m.pending) > 0
+}
+
 // This is the reader loop. The only thing we're responsible for
 // is to accept incoming messages from the client as soon as possible
 func (m *minion) runReader(ctx context.Context) {
-	if pdebug.Enabled {
-		pdebug.Printf("background reader: starting")
-		defer pdebug.Printf("background reader: exiting")
-	}
+	m.logger.Debug("background reader started")
+	defer m.logger.Debug("background reader exited")
 
 	defer close(m.readerDone)
 	// Wake up the writer goroutine so that it can detect
 	// cancelation.
 	defer m.cond.Broadcast()
 
+	// The reader may be waiting for room in the pending buffer when we
+	// are asked to close, and the writer may not be able to make any
+	if m.overflowPolicy == overflowBlock || m.retryPolicy.Exhausted == retryBlock {
+		go func() {
+			<-ctx.Done()
+			m.muPending.Lock()
+			m.closing = true
+			m.muPending.Unlock()
+			m.spaceCond.Broadcast()
+		}()
+	}
+
 	// This goroutine receives the incoming data as fast as
 	// possible, so that the caller to enqueue does not block
 	for loop := true; loop; {
 		select {
 		case <-ctx.Done():
-			if pdebug.Enabled {
-				pdebug.Printf("background reader: cancel detected")
-			}
+			m.logger.Debug("background reader canceled")
 			loop = false
 		case msg, ok := <-m.incoming:
 			// m.incoming could have been closed already, so we should
@@ -179,21 +680,17 @@ func (m *minion) runReader(ctx context.Context) {
 			if !ok {
 				loop = false
 			}
+		case ch := <-m.flushRequests:
+			m.requestFlush(ch)
 		}
 	}
 
 	// if we have more messages in the channel, we should try to flush them
 	for len(m.pingCh) > 0 {
-		if pdebug.Enabled {
-			pdebug.Printf("background reader: flushing incoming pings (%d left)", len(m.pingCh))
-		}
 		m.ping(<-m.pingCh)
 	}
 
 	for len(m.incoming) > 0 {
-		if pdebug.Enabled {
-			pdebug.Printf("background reader: flushing incoming buffer (%d left)", len(m.incoming))
-		}
 		m.appendMessage(<-m.incoming)
 	}
 
@@ -202,19 +699,12 @@ func (m *minion) runReader(ctx context.Context) {
 // ping is a one-shot deal. we connect, we send, we bail out.
 // if anything fails, oh well...
 func (m *minion) ping(msg *Message) (err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("minion.ping").BindError(&err)
-		defer g.End()
-	}
 	defer releaseMessage(msg)
 	defer func() {
 		if err == nil {
 			return
 		}
 
-		if pdebug.Enabled {
-			pdebug.Printf("Replying back with an error message (%s)", err)
-		}
 		msg.replyCh <- err
 	}()
 
@@ -223,25 +713,37 @@ func (m *minion) ping(msg *Message) (err error) {
 		return nil
 	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("Connecting to server for ping...")
+	if m.http != nil {
+		buf, err := m.serializeRecord(msg)
+		if err != nil {
+			return errors.Wrap(err, `failed to serialize ping message`)
+		}
+		if err := m.http.post(context.Background(), m.prefixTag(msg.Tag), msg.Time.Time, msg.subsecond, buf); err != nil {
+			return errors.Wrap(err, `failed to post ping message`)
+		}
+		return nil
 	}
-	conn, err := dial(context.Background(), m.network, m.address, m.dialTimeout)
+
+	conn, _, err := m.dial(context.Background())
 	if err != nil {
 		return errors.Wrap(err, `failed to connect server for ping`)
 	}
+	defer conn.Close()
+	setWriteDeadline(conn, m.writeTimeout)
 
-	if pdebug.Enabled {
-		pdebug.Printf("Serializing ping message...")
+	if isDatagramNetwork(m.network) {
+		buf, err := m.serializeRecord(msg)
+		if err != nil {
+			return errors.Wrap(err, `failed to serialize ping message`)
+		}
+		return writeDatagram(conn, buf)
 	}
+
 	buf, err := m.serialize(msg)
 	if err != nil {
 		return errors.Wrap(err, `failed to serialize ping message`)
 	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("Writing ping message...")
-	}
 	for len(buf) > 0 {
 		n, err := conn.Write(buf)
 		if err != nil {
@@ -255,31 +757,74 @@ func (m *minion) ping(msg *Message) (err error) {
 }
 
 func (m *minion) serialize(msg *Message) ([]byte, error) {
-	if p := m.tagPrefix; len(p) > 0 {
-		msg.Tag = p + "." + msg.Tag
+	if f := m.recordModifier; f != nil {
+		msg.Record = f(msg.Tag, msg.Record)
+	}
+
+	msg.Tag = m.prefixTag(msg.Tag)
+
+	buf, err := m.marshaler.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.lengthPrefix {
+		return addLengthPrefix(buf)
+	}
+	return buf, nil
+}
+
+// serializeEntry is the equivalent of serialize for the forward modes.
+// Only the time and record are serialized, as the tag is sent once for
+// each batch of entries
+func (m *minion) serializeEntry(msg *Message) ([]byte, error) {
+	if f := m.recordModifier; f != nil {
+		msg.Record = f(msg.Tag, msg.Record)
 	}
+	return marshalEntry(msg)
+}
+
+// serializeRecord is the equivalent of serialize for the HTTP transport
+// and the datagram networks, which only send the record. The marshaler
+// has been verified to be a recordMarshaler when the minion was created
+func (m *minion) serializeRecord(msg *Message) ([]byte, error) {
+	if f := m.recordModifier; f != nil {
+		msg.Record = f(msg.Tag, msg.Record)
+	}
+	return m.marshaler.(recordMarshaler).MarshalRecord(msg.Record)
+}
 
-	return m.marshaler.Marshal(msg)
+func (m *minion) prefixTag(tag string) string {
+	if p := m.tagPrefix; len(p) > 0 {
+		return p + "." + tag
+	}
+	return tag
 }
 
 // appends a message to the pending buffer
 func (m *minion) appendMessage(msg *Message) {
+	if msg.batch != nil {
+		m.appendBatch(msg)
+		return
+	}
 	defer releaseMessage(msg)
+	m.counters.addPosted(1)
 
-	if pdebug.Enabled {
-		if msg.replyCh != nil {
-			pdebug.Printf("background reader: message expects reply")
-		}
-	}
+	// serialize adds the prefix to msg.Tag, so remember the original
+	tag := msg.Tag
 
-	buf, err := m.serialize(msg)
+	buf, chunk, err := m.serializeMessage(msg)
 	if err != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("background reader: failed to marshal message: %s", err)
-		}
+		m.logger.Warn("failed to serialize message", "tag", msg.Tag, "error", err)
+		err = errors.Wrap(err, `failed to marshal payload`)
+		m.counters.addDropped(1)
 		if msg.replyCh != nil {
-			msg.replyCh <- errors.Wrap(err, `failed to marshal payload`)
+			msg.replyCh <- err
+		} else {
+			msg.Tag = tag
+			m.reportError(err, msg)
 		}
+		notifyFlush(msg.flushCh, err)
 		return
 	}
 
@@ -296,139 +841,773 @@ func (m *minion) appendMessage(msg *Message) {
 
 	m.muPending.Lock()
 	defer m.muPending.Unlock()
-	isFull := len(m.pending)+len(buf) > m.bufferLimit
+	m.waitRetry()
+	frame := pendingFrame{
+		chunk:     chunk,
+		size:      len(buf),
+		tag:       tag,
+		time:      msg.Time.Time,
+		subsecond: msg.subsecond,
+		flushCh:   msg.flushCh,
+	}
+
+	if m.overflowPolicy == overflowBlock {
+		m.waitSpace(len(buf))
+	}
 
-	if isFull {
-		if pdebug.Enabled {
-			pdebug.Printf("background reader: buffer is full")
+	isFull := len(m.pending)+m.inflight+len(buf) > m.bufferLimit
+	if limit, ok := m.tagBufferLimits[tag]; ok && m.tagPending[tag]+len(buf) > limit {
+		m.logger.Warn("buffer for tag is full", "tag", tag)
+		err = &BufferFullError{
+			Tag:         tag,
+			Size:        m.tagPending[tag],
+			Limit:       limit,
+			MessageSize: len(buf),
+		}
+	} else if m.store != nil {
+		// The message goes through the custom buffer, from which it is
+		// loaded right away if there is room for it
+		err = m.store.Write(&BufferedMessage{
+			Tag:       frame.tag,
+			Time:      frame.time,
+			Subsecond: frame.subsecond,
+			Chunk:     frame.chunk,
+			Data:      buf,
+		})
+		if err == nil {
+			m.storeWaiters = append(m.storeWaiters, frame.flushCh)
+			m.loadStore()
+			return
 		}
+	} else if isFull && !m.closing && (m.overflowPolicy != overflowDropOldest || !m.evictPending(len(buf))) {
+		err = &BufferFullError{
+			Size:        len(m.pending) + m.inflight,
+			Limit:       m.bufferLimit,
+			MessageSize: len(buf),
+		}
+	}
+
+	if err != nil {
+		m.logger.Warn("failed to append message", "tag", tag, "error", err)
+		m.counters.addDropped(1)
 		if msg.replyCh != nil {
-			if pdebug.Enabled {
-				pdebug.Printf("background reader: replying error to client")
-			}
-			msg.replyCh <- &bufferFullErrInstance
+			msg.replyCh <- err
+		} else {
+			msg.Tag = tag
+			m.reportError(err, msg)
+			m.notifyDrop(err, frame, buf)
 		}
+		notifyFlush(msg.flushCh, err)
 		return
 	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("background reader: received %d more bytes, appending", len(buf))
-	}
-	m.pending = append(m.pending, buf...)
+	m.pushPending(frame, buf)
 }
 
-func (m *minion) isReaderDone() bool {
-	select {
-	case <-m.readerDone:
-		return true
-	default:
+// serializeMessage serializes msg in the form in which it is stored in
+// the pending buffer, which depends on the transport and the protocol
+// mode. The chunk ID that the server acknowledges is returned as well, if
+// one was assigned
+func (m *minion) serializeMessage(msg *Message) (buf []byte, chunk string, err error) {
+	if m.http != nil || isDatagramNetwork(m.network) {
+		buf, err = m.serializeRecord(msg)
+	} else if m.protocolMode == protocolMessage {
+		// In the forward modes, chunk IDs are assigned to each batch
+		// by the writer instead
+		if m.requireAck {
+			chunk, err = newChunkID()
+			if err == nil {
+				msg.setChunkOption(chunk)
+			}
+		}
+		if err == nil {
+			buf, err = m.serialize(msg)
+		}
+	} else {
+		buf, err = m.serializeEntry(msg)
 	}
-	return false
+	return buf, chunk, err
 }
 
-// This goroutine waits for the receiver goroutine to wake
-// it up. When it's awake, we know that there's at least one
-// piece of data to send to the fluentd server.
-func (m *minion) runWriter(ctx context.Context) {
-	if pdebug.Enabled {
-		defer pdebug.Printf("background writer: exiting")
-	}
-	defer close(m.done)
+// appendBatch appends the messages posted together via PostAll. The
+// messages that fail to serialize are reported one by one (as a
+// *BatchError if the caller waits for the reply), and the others are
+// appended. Either all of those are appended, or none, in which case the
+// error is reported once for the whole batch. In the forward modes,
+// consecutive messages with the same tag end up in the same request
+func (m *minion) appendBatch(batch *Message) {
+	defer releaseMessage(batch)
+	defer func() {
+		for _, msg := range batch.batch {
+			releaseMessage(msg)
+		}
+	}()
+	m.counters.addPosted(len(batch.batch))
 
-	var conn net.Conn
-	defer func(conn net.Conn) {
-		// Make sure that this connection is closed.
-		if conn != nil {
-			if pdebug.Enabled {
-				pdebug.Printf("background writer: closing connection (in cleanup)")
+	var err error
+	var total int
+	var batchErr *BatchError
+	msgs := make([]*Message, 0, len(batch.batch))
+	frames := make([]pendingFrame, 0, len(batch.batch))
+	bufs := make([][]byte, 0, len(batch.batch))
+	for i, msg := range batch.batch {
+		frame := pendingFrame{
+			tag:       msg.Tag,
+			time:      msg.Time.Time,
+			subsecond: msg.subsecond,
+		}
+		buf, chunk, serr := m.serializeMessage(msg)
+		msg.Tag = frame.tag
+		if serr != nil {
+			m.logger.Warn("failed to serialize message", "tag", msg.Tag, "error", serr)
+			if batchErr == nil {
+				batchErr = &BatchError{Errors: make(map[int]error)}
 			}
-			conn.Close()
+			batchErr.Errors[i] = errors.Wrap(serr, `failed to marshal payload`)
+			continue
 		}
-	}(conn)
-
-	for {
-		// Wait for the reader to notify us
-		if err := m.waitPending(ctx); err != nil {
+		frame.chunk = chunk
+		frame.size = len(buf)
+		total += frame.size
+		msgs = append(msgs, msg)
+		frames = append(frames, frame)
+		bufs = append(bufs, buf)
+	}
+	if batchErr != nil {
+		m.counters.addDropped(len(batchErr.Errors))
+		if batch.replyCh == nil {
+			for i, err := range batchErr.Errors {
+				m.reportError(err, batch.batch[i])
+			}
+		}
+		if len(msgs) == 0 {
+			if batch.replyCh != nil {
+				batch.replyCh <- batchErr
+			}
 			return
 		}
+	}
 
-		// if we're not connected, we should do that now.
-		// there are two cases where we can get to this point.
-		// 1. reader got something, want us to write
-		// 2. reader got notified of cancel, want us to exit
-		// case 1 is simple. in case 2, we need to at least attempt to
-		// flush the remaining buffer, without checking the context cancelation
-		// status, otherwise we exit immediately
+	defer m.cond.Broadcast()
 
-		var connAttempts uint64
-		for conn == nil {
-			if pdebug.Enabled {
-				if m.isReaderDone() {
-					pdebug.Printf("background writer: attempting to connect in flush mode")
-				} else {
-					pdebug.Printf("background writer: attempting to connect")
-				}
-			}
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
 
-			parentCtx := ctx
-			if m.isReaderDone() {
-				// In flush mode, we don't let a parent context to cancel us.
-				// we connect, or we die trying
-				parentCtx = context.Background()
-			}
+	m.waitRetry()
+	if m.overflowPolicy == overflowBlock {
+		m.waitSpace(total)
+	}
 
-			conn = m.connect(parentCtx)
-			if pdebug.Enabled {
-				if conn == nil {
-					pdebug.Printf("background writer: failed to connect to %s:%s", m.network, m.address)
-				} else {
-					pdebug.Printf("background writer: connected to %s:%s", m.network, m.address)
-				}
+	tagSizes := make(map[string]int)
+	for _, frame := range frames {
+		if _, ok := m.tagBufferLimits[frame.tag]; ok {
+			tagSizes[frame.tag] += frame.size
+		}
+	}
+	for tag, size := range tagSizes {
+		if limit := m.tagBufferLimits[tag]; m.tagPending[tag]+size > limit {
+			err = &BufferFullError{
+				Tag:         tag,
+				Size:        m.tagPending[tag],
+				Limit:       limit,
+				MessageSize: size,
 			}
+			break
+		}
+	}
 
-			if conn != nil {
+	isFull := len(m.pending)+m.inflight+total > m.bufferLimit
+	switch {
+	case err != nil:
+		// One of the tags is over its limit
+	case m.store != nil:
+		// A failure leaves the messages that were written before it in
+		// the custom buffer, so they are sent anyway
+		for i, frame := range frames {
+			err = m.store.Write(&BufferedMessage{
+				Tag:       frame.tag,
+				Time:      frame.time,
+				Subsecond: frame.subsecond,
+				Chunk:     frame.chunk,
+				Data:      bufs[i],
+			})
+			if err != nil {
 				break
 			}
-
-			if m.isReaderDone() {
-				connAttempts++
-				if m.maxConnAttempts > 0 && connAttempts > m.maxConnAttempts {
-					if pdebug.Enabled {
-						pdebug.Printf("background writer: bailing out after failed to connect to %s:%s (%d attempts) under flush mode", m.network, m.address, connAttempts)
-					}
-					return
-				}
-			}
+			m.storeWaiters = append(m.storeWaiters, nil)
 		}
-
-		if m.isReaderDone() {
-			if pdebug.Enabled {
-				pdebug.Printf("background writer: in flush mode, no deadline set")
-			}
-			conn.SetWriteDeadline(time.Time{})
-		} else {
-			conn.SetWriteDeadline(time.Now().Add(m.writeTimeout))
+		m.loadStore()
+	case isFull && !m.closing && (m.overflowPolicy != overflowDropOldest || !m.evictPending(total)):
+		err = &BufferFullError{
+			Size:        len(m.pending) + m.inflight,
+			Limit:       m.bufferLimit,
+			MessageSize: total,
 		}
-
-		if err := m.flushPending(conn); err != nil {
-			conn.Close()
-			conn = nil
+	default:
+		m.logger.Debug("appending batch", "messages", len(frames), "bytes", total)
+		for i, frame := range frames {
+			m.pushPending(frame, bufs[i])
 		}
+	}
 
-		if m.isReaderDone() {
-			if !m.pendingAvailable(0) {
-				if pdebug.Enabled {
-					pdebug.Printf("background writer: pending buffer is empty, bailing out")
-				}
-				return
+	if err != nil {
+		m.logger.Warn("failed to append batch", "messages", len(msgs), "error", err)
+		m.rejectBatch(batch, msgs, frames, bufs, err, batchErr)
+		return
+	}
+	if batchErr != nil && batch.replyCh != nil {
+		batch.replyCh <- batchErr
+	}
+}
+
+// rejectBatch reports that the messages msgs of batch could not be
+// appended. frames and bufs describe them once serialized. batchErr holds
+// the errors of the messages of the batch that could not be serialized,
+// if any, in which case the caller receives it, with err added for each
+// of msgs
+func (m *minion) rejectBatch(batch *Message, msgs []*Message, frames []pendingFrame, bufs [][]byte, err error, batchErr *BatchError) {
+	m.counters.addDropped(len(msgs))
+	if batch.replyCh != nil {
+		if batchErr == nil {
+			batch.replyCh <- err
+			return
+		}
+		for i := range batch.batch {
+			if _, ok := batchErr.Errors[i]; !ok {
+				batchErr.Errors[i] = err
 			}
 		}
+		batch.replyCh <- batchErr
+		return
+	}
+	for _, msg := range msgs {
+		m.reportError(err, msg)
+	}
+	for i, frame := range frames {
+		m.notifyDrop(err, frame, bufs[i])
 	}
 }
 
-func (m *minion) waitPending(ctx context.Context) error {
-	// We need to check for ctx.Done() here before getting into
-	// the cond loop, because otherwise we might never be woken
+// pushPending appends a message to the pending buffer. The caller must
+// be holding muPending
+func (m *minion) pushPending(frame pendingFrame, buf []byte) {
+	frame.appended = time.Now()
+	if len(m.pending) == 0 {
+		m.pendingSince = frame.appended
+	}
+	prevCap := cap(m.pending)
+	m.pending = append(m.pending, buf...)
+	if cap(m.pending) != prevCap {
+		// The pending buffer has been reallocated. Make sure that we
+		// keep reusing the larger backing array after it's been drained
+		m.buffer = m.pending[0:0]
+	}
+	m.pendingFrames = append(m.pendingFrames, frame)
+	if _, ok := m.tagBufferLimits[frame.tag]; ok {
+		m.tagPending[frame.tag] += frame.size
+	}
+}
+
+// loadStore moves messages from the custom buffer to the pending buffer,
+// for as long as they fit. A message is always loaded into an empty
+// pending buffer, however large. The caller must be holding muPending
+func (m *minion) loadStore() {
+	if m.store == nil {
+		return
+	}
+
+	for {
+		if m.storeNext == nil {
+			msg, err := m.store.Read()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				m.logger.Error("failed to read from buffer", "error", err)
+				m.setLastError(errors.Wrap(err, `failed to read from buffer`))
+				return
+			}
+			m.storeNext = msg
+		}
+
+		msg := m.storeNext
+		if len(m.pending) > 0 && len(m.pending)+m.inflight+len(msg.Data) > m.bufferLimit {
+			return
+		}
+		m.storeNext = nil
+
+		var flushCh chan error
+		if len(m.storeWaiters) > 0 {
+			flushCh = m.storeWaiters[0]
+			m.storeWaiters = m.storeWaiters[1:]
+		}
+		m.pushPending(pendingFrame{
+			chunk:     msg.Chunk,
+			size:      len(msg.Data),
+			tag:       msg.Tag,
+			time:      msg.Time,
+			subsecond: msg.Subsecond,
+			flushCh:   flushCh,
+			stored:    true,
+		}, msg.Data)
+	}
+}
+
+// closeStore closes the custom buffer, if any. The messages that are
+// still in it are left for the next process to send, but the callers
+// waiting for them are notified of err, as they would otherwise wait
+// forever
+func (m *minion) closeStore(err error) {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	if m.store == nil {
+		return
+	}
+	for _, ch := range m.storeWaiters {
+		notifyFlush(ch, err)
+	}
+	m.storeWaiters = nil
+	if err := m.store.Close(); err != nil {
+		m.logger.Error("failed to close buffer", "error", err)
+	}
+	m.store = nil
+}
+
+func (m *minion) isReaderDone() bool {
+	select {
+	case <-m.readerDone:
+		return true
+	default:
+	}
+	return false
+}
+
+// This goroutine waits for the receiver goroutine to wake
+// it up. When it's awake, we know that there's at least one
+// piece of data to send to the fluentd server.
+func (m *minion) runWriter(ctx context.Context) {
+	defer m.logger.Debug("background writer exited")
+	defer close(m.done)
+	// Whatever was reported below is passed to the callbacks before the
+	// client is done
+	defer m.closeCallbacks()
+	defer m.closeErrorCh()
+	defer m.flushCancel()
+	// Whatever is left at this point will never be written, by us anyway
+	defer m.discardPending(errors.New(`writer exited before message was written`))
+	defer m.closeStore(errors.New(`writer exited before message was written`))
+
+	if m.http != nil {
+		defer m.http.close()
+		m.runHTTPWriter(ctx)
+		return
+	}
+	if isDatagramNetwork(m.network) {
+		m.runDatagramWriter(ctx)
+		return
+	}
+
+	if m.connections > 1 {
+		var wg sync.WaitGroup
+		for i := 0; i < m.connections; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.runConnWriter(ctx)
+			}()
+		}
+		wg.Wait()
+		return
+	}
+	m.runConnWriter(ctx)
+}
+
+// runConnWriter is the main loop of runWriter for the stream networks.
+// It maintains a single connection, and writes the pending messages to
+// it. With more than one connection (see WithConnections), one of these
+// runs for each connection, and they take turns claiming batches of the
+// pending messages
+func (m *minion) runConnWriter(ctx context.Context) {
+	var conn net.Conn
+	var connClosed <-chan struct{}
+	var connectedAt time.Time
+	var acks chan ackResponse
+	var failures int      // attempts to connect that failed in a row
+	var writeFailures int // attempts to write that failed in a row
+	var address string
+	var lostAt time.Time // when the last connection was lost to an error
+
+	// closeConn closes the current connection. err is the reason why it
+	// is being closed, or nil if we are simply done with it
+	closeConn := func(err error) {
+		m.untrackConn(conn)
+		conn.Close()
+		conn = nil
+		m.events.disconnected(address, err)
+		if err != nil {
+			lostAt = time.Now()
+		}
+	}
+	defer func() {
+		// Make sure that this connection is closed. conn must not be
+		// bound when the defer statement is evaluated, as it would
+		// always be nil at that point
+		if conn != nil {
+			m.logger.Debug("closing connection", "address", address)
+			closeConn(nil)
+		}
+	}()
+
+	for {
+		// Wait for the reader to notify us
+		if err := m.waitPending(ctx); err != nil {
+			return
+		}
+
+		// if we're not connected, we should do that now.
+		// there are two cases where we can get to this point.
+		// 1. reader got something, want us to write
+		// 2. reader got notified of cancel, want us to exit
+		// case 1 is simple. in case 2, we need to at least attempt to
+		// flush the remaining buffer, without checking the context cancelation
+		// status, otherwise we exit immediately
+
+		// If the server has closed the connection while we were waiting,
+		// writing to it might appear to succeed while the data is lost.
+		// Start over with a new connection instead
+		if conn != nil {
+			select {
+			case <-connClosed:
+				m.logger.Warn("connection closed by server", "address", address)
+				closeConn(errors.New(`connection closed by server`))
+			default:
+			}
+		}
+
+		// Connections that have been open for too long are replaced. As
+		// everything written so far has been written in its entirety,
+		// nothing is lost by closing the connection at this point
+		if conn != nil && m.maxConnLifetime > 0 && time.Since(connectedAt) > m.maxConnLifetime {
+			m.logger.Debug("connection exceeded max lifetime, reconnecting", "address", address)
+			closeConn(nil)
+		}
+
+		// Likewise, the connection is replaced when the data is to be
+		// written to a different server, because of load balancing, or
+		// because it is time to try the primary server again
+		if m.servers.rotate() && conn != nil {
+			m.logger.Debug("switching servers, reconnecting", "address", address)
+			closeConn(nil)
+		}
+
+		var connAttempts uint64
+		for conn == nil {
+			m.logger.Debug("connecting to server", "flushing", m.isReaderDone())
+
+			parentCtx := ctx
+			if m.isReaderDone() {
+				// In flush mode, we don't let a parent context to cancel us.
+				// we connect, or we die trying (unless Shutdown() gives up
+				// waiting for us)
+				parentCtx = m.flushCtx
+			}
+
+			var err error
+			conn, address, err = m.dial(parentCtx)
+			if conn != nil {
+				if m.requireAck {
+					acks = make(chan ackResponse, 1)
+				}
+				// Named pipes are not watched, as a pending read would
+				// block our writes (see newMinion). connClosed stays nil,
+				// so the pipe is only replaced once writing to it fails
+				if m.network != "npipe" {
+					connClosed = watchConn(conn, acks, m.logger)
+				}
+				connectedAt = time.Now()
+				failures = 0
+				m.setRetryBlocked(false)
+				m.trackConn(conn, connClosed)
+				if connClosed != nil {
+					go m.countServerDisconnect(conn, connClosed)
+				}
+				if !lostAt.IsZero() {
+					m.counters.addReconnect()
+				}
+				m.events.connected(address, lostAt)
+				lostAt = time.Time{}
+				break
+			}
+			// An attempt that was cut short because we are being closed
+			// says nothing about the server
+			if parentCtx.Err() == nil {
+				m.setLastError(err)
+			}
+
+			if m.isFlushAborted() {
+				m.logger.Warn("flush aborted, giving up on pending messages")
+				return
+			}
+
+			// The attempt was cut short because we are being closed. The
+			// reader is about to hand the last messages over, after which
+			// we try again in flush mode
+			if !m.isReaderDone() && parentCtx.Err() != nil {
+				select {
+				case <-m.readerDone:
+				case <-m.flushCtx.Done():
+				}
+				continue
+			}
+			failures++
+			m.counters.addRetry()
+
+			if m.isReaderDone() {
+				connAttempts++
+				if m.maxConnAttempts > 0 && connAttempts > m.maxConnAttempts {
+					m.logger.Error("giving up connecting to server while flushing", "network", m.network, "address", m.address, "attempts", connAttempts)
+					return
+				}
+			} else if m.breaker.record(err) {
+				// New messages are rejected until the circuit closes
+				// again, and the ones we have are given up on
+				m.discardPending(errors.Wrap(err, `circuit breaker opened`))
+				break
+			} else if m.backoff.exhausted(failures) || m.retryPolicy.exhausted(err, failures) {
+				// Give up on what we have, so that the buffer does not
+				// stay full until the server comes back
+				m.giveUp(errors.Wrap(err, `gave up connecting to server`))
+				failures = 0
+				break
+			}
+
+			m.logger.Debug("backing off", "failures", failures)
+			m.backoff.wait(parentCtx, failures)
+		}
+		if conn == nil {
+			continue
+		}
+
+		var err error
+		target := writeTarget{address: address, attempt: writeFailures + 1}
+		if m.connections > 1 {
+			err = m.flushBatches(conn, acks, connClosed, target)
+		} else if m.requireAck || m.protocolMode != protocolMessage {
+			err = m.flushChunks(conn, acks, connClosed, target)
+		} else {
+			err = m.flushPending(conn, target)
+		}
+		m.setLastError(err)
+		if err != nil {
+			closeConn(err)
+			writeFailures++
+			m.counters.addRetry()
+		} else {
+			writeFailures = 0
+		}
+		if m.breaker.record(err) && !m.isReaderDone() {
+			m.discardPending(errors.Wrap(err, `circuit breaker opened`))
+		} else if err != nil && !m.isReaderDone() && m.retryPolicy.exhausted(err, writeFailures) {
+			m.giveUp(errors.Wrap(err, `gave up writing to server`))
+			writeFailures = 0
+		}
+
+		if m.isFlushAborted() {
+			m.logger.Warn("flush aborted, giving up on pending messages")
+			return
+		}
+
+		if m.isReaderDone() {
+			if !m.pendingAvailable(0) {
+				m.logger.Debug("pending buffer is empty, exiting")
+				return
+			}
+		}
+	}
+}
+
+// runHTTPWriter is the equivalent of the main loop of runWriter for the
+// HTTP transport. There is no connection to maintain, so all we do is
+// post the pending records, and retry if that fails
+func (m *minion) runHTTPWriter(ctx context.Context) {
+	var attempts uint64
+	var failures int // attempts to post that failed in a row
+	for {
+		if err := m.waitPending(ctx); err != nil {
+			return
+		}
+
+		err := m.flushHTTP(ctx)
+		m.setLastError(err)
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+			m.setRetryBlocked(false)
+		}
+		if m.breaker.record(err) && !m.isReaderDone() {
+			m.discardPending(errors.Wrap(err, `circuit breaker opened`))
+		} else if err != nil && !m.isReaderDone() && m.retryPolicy.exhausted(err, failures) {
+			m.giveUp(errors.Wrap(err, `gave up posting to server`))
+			failures = 0
+		}
+
+		if m.isFlushAborted() {
+			m.logger.Warn("flush aborted, giving up on pending messages")
+			return
+		}
+
+		if err == nil {
+			attempts = 0
+		} else if m.isReaderDone() {
+			attempts++
+			if m.maxConnAttempts > 0 && attempts > m.maxConnAttempts {
+				m.logger.Error("giving up posting to server while flushing", "address", m.address, "attempts", attempts)
+				return
+			}
+		}
+
+		if m.isReaderDone() {
+			if !m.pendingAvailable(0) {
+				m.logger.Debug("pending buffer is empty, exiting")
+				return
+			}
+		}
+	}
+}
+
+// runDatagramWriter is the equivalent of the main loop of runWriter for
+// the datagram networks. Nothing is ever retried: if we cannot send the
+// pending records, they are dropped, so that the buffer does not fill up
+func (m *minion) runDatagramWriter(ctx context.Context) {
+	var conn net.Conn
+	var address string
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		if err := m.waitPending(ctx); err != nil {
+			return
+		}
+
+		if m.servers.rotate() && conn != nil {
+			conn.Close()
+			conn = nil
+		}
+
+		if conn == nil {
+			// Opening the socket does not involve the server, so there is
+			// nothing to wait for. It is done regardless of ctx, which may
+			// already have been canceled while records are still pending
+			var err error
+			conn, address, err = m.dial(m.flushCtx)
+			if err != nil {
+				m.logger.Error("failed to open socket, dropping pending messages", "network", m.network, "address", m.address, "error", err)
+				m.setLastError(err)
+				m.discardPending(errors.Wrap(err, `record dropped`))
+			}
+		}
+
+		if conn != nil {
+			m.setLastError(m.flushDatagrams(conn, address))
+		}
+
+		if m.isFlushAborted() {
+			m.logger.Warn("flush aborted, giving up on pending messages")
+			return
+		}
+
+		if m.isReaderDone() {
+			if !m.pendingAvailable(0) {
+				m.logger.Debug("pending buffer is empty, exiting")
+				return
+			}
+		}
+	}
+}
+
+// flushHTTP posts the pending records one at a time. Each record is
+// removed from the pending buffer once the server has accepted it
+func (m *minion) flushHTTP(ctx context.Context) error {
+	defer m.clearWriting()
+	for {
+		m.muPending.Lock()
+		if len(m.pendingFrames) == 0 {
+			m.muPending.Unlock()
+			return nil
+		}
+		frame := m.pendingFrames[0]
+		// Only the writer discards data from the pending buffer, and
+		// appending never modifies the data that is already there, so
+		// it is safe to use without holding the lock during the request
+		body := m.pending[:frame.size]
+		m.writing = frame.size
+		m.muPending.Unlock()
+
+		if err := m.postWithRetry(ctx, frame, body); err != nil {
+			return err
+		}
+
+		m.muPending.Lock()
+		m.writing = 0
+		consumed := m.consumePending(frame.size)
+		m.pending = m.pending[consumed:]
+		if len(m.pending) == 0 {
+			m.pending = m.buffer[0:0]
+			m.pendingFrames = m.pendingFrames[0:0]
+		}
+		m.loadStore()
+		m.muPending.Unlock()
+	}
+}
+
+// postWithRetry posts a single record until it succeeds, or the backoff
+// gives up, or the dial timeout has elapsed
+func (m *minion) postWithRetry(ctx context.Context, frame pendingFrame, body []byte) error {
+	// In flush mode, we don't let a parent context to cancel us
+	if m.isReaderDone() {
+		ctx = m.flushCtx
+	}
+
+	retryCtx, cancel := context.WithTimeout(ctx, m.dialTimeout)
+	defer cancel()
+
+	for failures := 1; ; failures++ {
+		done := m.traceWrite(writeTarget{address: m.address, attempt: failures}, frame.chunk, 1, len(body))
+		err := m.http.post(m.flushCtx, m.prefixTag(frame.tag), frame.time, frame.subsecond, body)
+		done(err)
+		if err == nil {
+			m.counters.observeWrite(time.Since(frame.appended))
+			return nil
+		}
+		if m.backoff.exhausted(failures) {
+			return err
+		}
+		m.counters.addRetry()
+
+		m.logger.Warn("failed to post record, backing off", "address", m.address, "attempt", failures, "error", err)
+		if m.backoff.wait(retryCtx, failures) != nil {
+			return err
+		}
+	}
+}
+
+func (m *minion) isFlushAborted() bool {
+	select {
+	case <-m.flushCtx.Done():
+		return true
+	default:
+	}
+	return false
+}
+
+func (m *minion) waitPending(ctx context.Context) error {
+	// We need to check for ctx.Done() here before getting into
+	// the cond loop, because otherwise we might never be woken
 	// up again
 	select {
 	case <-ctx.Done():
@@ -436,47 +1615,74 @@ func (m *minion) waitPending(ctx context.Context) error {
 	default:
 	}
 
+	// pendingAvailable checks for strictly more bytes than the threshold,
+	// whereas we want to start writing once we have reached it
+	threshold := m.writeThreshold - 1
+	if threshold < 0 {
+		threshold = 0
+	}
+
 	m.cond.L.Lock()
 	defer m.cond.L.Unlock()
 
 	for {
-		if m.pendingAvailable(m.writeThreshold) {
+		if m.pendingAvailable(threshold) || m.flushRequested() {
 			break
 		}
 
 		select {
 		case <-ctx.Done():
-			if pdebug.Enabled {
-				pdebug.Printf("background writer: cancel detected")
-			}
+			m.logger.Debug("background writer canceled")
 			return nil
 		default:
 		}
 
+		// Data that does not reach the threshold is written anyway once
+		// it has been pending for longer than the flush interval, so that
+		// it does not get stuck waiting for more data that may never come
+		var timer *time.Timer
+		if wait, ok := m.flushWait(); ok {
+			if wait <= 0 {
+				m.logger.Debug("flush interval elapsed")
+				break
+			}
+			timer = time.AfterFunc(wait, func() {
+				m.cond.L.Lock()
+				m.cond.Broadcast()
+				m.cond.L.Unlock()
+			})
+		}
+
 		m.cond.Wait()
+
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 	return nil
 }
 
-func (m *minion) flushPending(conn net.Conn) error {
-	var writeiters int
-	var wrotebytes int
-	if pdebug.Enabled {
-		defer func() {
-			pdebug.Printf("background writer: wrote %d bytes in %d iterations", wrotebytes, writeiters)
-		}()
+// flushWait returns the amount of time until the pending data should be
+// written regardless of the write threshold. false is returned if there
+// is no pending data, or if the flush interval is disabled
+func (m *minion) flushWait() (time.Duration, bool) {
+	m.muPending.RLock()
+	defer m.muPending.RUnlock()
+
+	if len(m.pending) == 0 || m.flushInterval <= 0 {
+		return 0, false
 	}
+	return m.flushInterval - time.Since(m.pendingSince), true
+}
+
+func (m *minion) flushPending(conn net.Conn, target writeTarget) error {
 	for {
-		if pdebug.Enabled {
-			writeiters++
-		}
-		n, err := m.writePending(conn)
-		if pdebug.Enabled {
-			wrotebytes += n
+		if _, err := m.writePending(conn, target); err != nil {
+			return err
 		}
 
-		if err != nil {
-			return err
+		if m.isFlushAborted() {
+			return errors.New(`flush aborted`)
 		}
 
 		if !m.pendingAvailable(0) {
@@ -486,69 +1692,661 @@ func (m *minion) flushPending(conn net.Conn) error {
 	return nil
 }
 
-func (m *minion) writePending(conn net.Conn) (int, error) {
+func (m *minion) writePending(conn net.Conn, target writeTarget) (int, error) {
 	m.muPending.Lock()
 	defer m.muPending.Unlock()
-	if pdebug.Enabled {
-		pdebug.Printf("background writer: attempting to write %d bytes", len(m.pending))
+	m.logger.Debug("writing pending messages", "bytes", len(m.pending), "messages", len(m.pendingFrames))
+
+	var appended time.Time
+	if len(m.pendingFrames) > 0 {
+		appended = m.pendingFrames[0].appended
+	}
+	done := m.traceWrite(target, "", len(m.pendingFrames), len(m.pending))
+	setWriteDeadline(conn, m.writeTimeout)
+	n, err := writeAll(conn, m.pending)
+	done(err)
+
+	// Only discard messages that were written in their entirety. The
+	// remainder of a partially written message is meaningless on a new
+	// connection, so it needs to be sent again from its beginning.
+	// Note that this only happens on error: writeAll keeps writing to
+	// the same connection on short writes, as anything else would
+	// corrupt the stream
+	consumed := m.consumePending(n)
+	m.pending = m.pending[consumed:]
+	if len(m.pending) == 0 {
+		m.pending = m.buffer[0:0]
+		m.pendingFrames = m.pendingFrames[0:0]
 	}
+	m.loadStore()
 
-	n, err := conn.Write(m.pending)
 	if err != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("background writer: error while writing: %s", err)
+		m.logger.Warn("failed to write to server", "written", n, "consumed", consumed, "error", err)
+		return consumed, errors.Wrap(err, `failed to write data to conn`)
+	}
+	if !appended.IsZero() {
+		m.counters.observeWrite(time.Since(appended))
+	}
+
+	return n, nil
+}
+
+// flushChunks writes the pending messages one chunk at a time. In the
+// message mode a chunk is a single message, and in the forward modes it
+// is a batch of consecutive messages with the same tag.
+//
+// If acks are required, the writer waits for the server to acknowledge
+// each chunk before it is removed from the pending buffer. If the ack
+// does not arrive, the chunk is left at the head of the buffer, to be
+// sent again on a new connection
+func (m *minion) flushChunks(conn net.Conn, acks chan ackResponse, connClosed <-chan struct{}, target writeTarget) error {
+	defer m.clearWriting()
+	for {
+		m.muPending.Lock()
+		if len(m.pendingFrames) == 0 {
+			m.muPending.Unlock()
+			return nil
+		}
+		buf, size, count, chunk, err := m.encodeChunk(m.pending, m.pendingFrames)
+		if err != nil {
+			m.muPending.Unlock()
+			return errors.Wrap(err, `failed to encode chunk`)
+		}
+		m.logger.Debug("writing chunk", "chunk", chunk, "bytes", len(buf), "messages", count)
+		appended := m.pendingFrames[0].appended
+		tag := m.pendingFrames[0].tag
+		done := m.traceWrite(target, chunk, count, len(buf))
+		setWriteDeadline(conn, m.writeTimeout)
+		_, err = writeAll(conn, buf)
+		m.writing = size
+		m.muPending.Unlock()
+
+		if err != nil {
+			done(err)
+			m.failChunk(size, count, err)
+			return errors.Wrap(err, `failed to write data to conn`)
+		}
+
+		// Do not hold the lock while waiting, so that new messages can
+		// still be appended to the pending buffer
+		if m.requireAck {
+			if err := m.waitAck(chunk, acks, connClosed); err != nil {
+				m.logger.Warn("failed to receive ack", "chunk", chunk, "error", err)
+				done(err)
+				m.reportServerError(err, tag)
+				m.failChunk(size, count, err)
+				return err
+			}
+		}
+		done(nil)
+		m.counters.observeWrite(time.Since(appended))
+
+		if m.isFlushAborted() {
+			return errors.New(`flush aborted`)
 		}
-		return 0, errors.Wrap(err, `failed to write data to conn`)
+
+		m.muPending.Lock()
+		m.writing = 0
+		consumed := m.consumePending(size)
+		m.pending = m.pending[consumed:]
+		if len(m.pending) == 0 {
+			m.pending = m.buffer[0:0]
+			m.pendingFrames = m.pendingFrames[0:0]
+		}
+		m.loadStore()
+		m.muPending.Unlock()
+	}
+}
+
+// failChunk records that the chunk made of the first count messages of
+// the pending buffer, which take size bytes, could not be written, or was
+// not acknowledged, because of err. Once it has failed as many times as
+// allowed (see WithMaxRetries), it is dropped, so that it does not hold
+// up the messages after it forever
+func (m *minion) failChunk(size, count int, err error) {
+	if m.maxRetries == 0 {
+		return
+	}
+
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	if !m.chunkExhausted(&m.pendingFrames[0], err) {
+		return
 	}
-	m.pending = m.pending[n:]
+	err = errors.Wrap(err, `chunk dropped after too many failed attempts`)
+	stored := m.dropChunk(m.pendingFrames[:count], m.pending[:size], err)
+	m.writing = 0
+	m.pending = m.pending[size:]
+	m.pendingFrames = m.pendingFrames[count:]
 	if len(m.pending) == 0 {
 		m.pending = m.buffer[0:0]
+		m.pendingFrames = m.pendingFrames[0:0]
 	}
+	m.truncateStore(stored)
+	m.loadStore()
+	m.spaceCond.Broadcast()
+}
 
-	if pdebug.Enabled {
-		pdebug.Printf("m.pending cap %d", cap(m.pending))
-		pdebug.Printf("m.pending len %d", len(m.pending))
+// chunkExhausted counts a failed attempt to write the chunk that starts
+// with head, and reports whether it should be dropped. The caller must be
+// holding muPending
+func (m *minion) chunkExhausted(head *pendingFrame, err error) bool {
+	head.attempts++
+	if head.attempts < m.maxRetries {
+		return false
 	}
-	return n, nil
+	m.logger.Warn("dropping chunk after too many failed attempts", "chunk", head.sentChunk, "attempts", head.attempts, "error", err)
+	return true
 }
 
-func (m *minion) pendingAvailable(threshold int) bool {
+// dropChunk drops the messages of a chunk that failed too many times,
+// described by frames and serialized as data, and returns how many of
+// them are held in the custom buffer. The caller must be holding
+// muPending, and remove them from wherever they are
+func (m *minion) dropChunk(frames []pendingFrame, data []byte, err error) int {
+	var offset, stored int
+	for _, frame := range frames {
+		if _, ok := m.tagBufferLimits[frame.tag]; ok {
+			m.tagPending[frame.tag] -= frame.size
+		}
+		notifyFlush(frame.flushCh, err)
+		m.reportDropped(err, frame, data[offset:offset+frame.size])
+		offset += frame.size
+		if frame.stored {
+			stored++
+		}
+	}
+	m.counters.addDroppedAfterRetry(len(frames))
+	return stored
+}
+
+// nextChunk returns the serialized chunk at the head of the pending
+// buffer, the number of bytes in the pending buffer that it covers, and
+// its chunk ID. The caller must be holding muPending
+func (m *minion) nextChunk() ([]byte, int, string, error) {
+	buf, size, _, chunk, err := m.encodeChunk(m.pending, m.pendingFrames)
+	return buf, size, chunk, err
+}
+
+// encodeChunk returns the serialized chunk at the head of data, which
+// holds the given frames, along with the number of bytes and frames that
+// it covers, and its chunk ID
+func (m *minion) encodeChunk(data []byte, frames []pendingFrame) ([]byte, int, int, string, error) {
+	if m.protocolMode == protocolMessage {
+		frame := frames[0]
+		return data[:frame.size], frame.size, 1, frame.chunk, nil
+	}
+
+	// A chunk that is sent again must hold the same messages under the
+	// same ID, so that the server can tell that it is a duplicate of the
+	// one whose ack we missed, even if more messages with the same tag
+	// have been posted since. Those were within the size limit when the
+	// chunk was first sent
+	head := &frames[0]
+	tag := head.tag
+	chunk := head.sentChunk
+	var size, count int
+	for _, frame := range frames {
+		if frame.tag != tag || (chunk != "" && count == head.sentFrames) || (count > 0 && frame.sentChunk != "") {
+			break
+		}
+		if chunk == "" && count > 0 && m.chunkSizeLimit > 0 && size+frame.size > m.chunkSizeLimit {
+			break
+		}
+		size += frame.size
+		count++
+	}
+
+	if m.requireAck && chunk == "" {
+		var err error
+		if chunk, err = newChunkID(); err != nil {
+			return nil, 0, 0, "", err
+		}
+		head.sentChunk = chunk
+		head.sentFrames = count
+	}
+
+	buf, err := encodeForward(m.protocolMode, m.compressor, m.prefixTag(tag), data[:size], count, chunk)
+	if err != nil {
+		return nil, 0, 0, "", err
+	}
+
+	if m.lengthPrefix {
+		if buf, err = addLengthPrefix(buf); err != nil {
+			return nil, 0, 0, "", err
+		}
+	}
+	return buf, size, count, chunk, nil
+}
+
+func (m *minion) waitAck(chunk string, acks chan ackResponse, connClosed <-chan struct{}) error {
+	timer := time.NewTimer(m.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-acks:
+		// An error reply need not name the chunk, as there is only ever
+		// one chunk waiting for a response on a connection
+		if res.err != nil && res.chunk == "" {
+			return res.err
+		}
+		if res.chunk != chunk {
+			return errors.Errorf(`received ack for unexpected chunk %s (expected %s)`, res.chunk, chunk)
+		}
+		return res.err
+	case <-connClosed:
+		return errors.Errorf(`connection closed before receiving ack for chunk %s`, chunk)
+	case <-timer.C:
+		return errors.Errorf(`timed out waiting for ack for chunk %s`, chunk)
+	case <-m.flushCtx.Done():
+		return errors.New(`flush aborted`)
+	}
+}
+
+// consumePending removes the messages that fit in the first n bytes of
+// the pending buffer, and returns the number of bytes that they occupy.
+// Callers waiting for these messages to be written are notified.
+// The caller must be holding muPending
+func (m *minion) consumePending(n int) int {
+	var consumed, stored, flushed, i int
+	for ; i < len(m.pendingFrames); i++ {
+		frame := m.pendingFrames[i]
+		if consumed+frame.size > n {
+			break
+		}
+		consumed += frame.size
+		if frame.stored {
+			stored++
+		}
+		if _, ok := m.tagBufferLimits[frame.tag]; ok {
+			m.tagPending[frame.tag] -= frame.size
+		}
+		notifyFlush(frame.flushCh, nil)
+		if !frame.dropped {
+			flushed++
+		}
+	}
+	m.counters.addFlushed(flushed)
+	m.pendingFrames = m.pendingFrames[i:]
+	m.truncateStore(stored)
+	if consumed > 0 {
+		m.spaceCond.Broadcast()
+	}
+	return consumed
+}
+
+// truncateStore removes the n oldest messages from the custom buffer.
+// The caller must be holding muPending
+func (m *minion) truncateStore(n int) {
+	if m.store == nil || n == 0 {
+		return
+	}
+	if err := m.store.Truncate(n); err != nil {
+		m.logger.Error("failed to truncate buffer", "error", err)
+		m.setLastError(errors.Wrap(err, `failed to truncate buffer`))
+	}
+}
+
+// evictPending makes room for n more bytes in the pending buffer by
+// discarding the oldest messages, except for the ones that the writer is
+// in the middle of writing. It reports whether enough room could be made,
+// in which case the callers waiting for the evicted messages are
+// notified. Otherwise, nothing is discarded. The caller must be holding
+// muPending
+func (m *minion) evictPending(n int) bool {
+	excess := len(m.pending) + m.inflight + n - m.bufferLimit
+
+	var offset, first int
+	for first < len(m.pendingFrames) && offset < m.writing {
+		offset += m.pendingFrames[first].size
+		first++
+	}
+
+	// A chunk that is waiting for an ack is evicted as a whole, as it must
+	// be sent again with the same messages, if at all (see encodeChunk)
+	var evicted, chunkEnd int
+	last := first
+	for ; last < len(m.pendingFrames) && (evicted < excess || last < chunkEnd); last++ {
+		frame := m.pendingFrames[last]
+		if frame.sentChunk != "" {
+			chunkEnd = last + frame.sentFrames
+		}
+		evicted += frame.size
+	}
+	if evicted < excess {
+		return false
+	}
+
+	m.logger.Warn("buffer is full, evicting oldest messages", "messages", last-first, "bytes", evicted)
+	err := errors.New(`message evicted from the buffer`)
+	dropped := offset
+	for _, frame := range m.pendingFrames[first:last] {
+		if _, ok := m.tagBufferLimits[frame.tag]; ok {
+			m.tagPending[frame.tag] -= frame.size
+		}
+		notifyFlush(frame.flushCh, err)
+		m.reportDropped(err, frame, m.pending[dropped:dropped+frame.size])
+		dropped += frame.size
+	}
+	copy(m.pending[offset:], m.pending[offset+evicted:])
+	m.pending = m.pending[:len(m.pending)-evicted]
+	m.pendingFrames = append(m.pendingFrames[:first], m.pendingFrames[last:]...)
+	return true
+}
+
+// waitSpace waits until there is room for n more bytes in the pending
+// buffer. Messages that could never fit are not waited for, and neither
+// is anything once the client is closing, in which case the message is
+// accepted regardless of the limit, so that it gets flushed along with
+// the rest. The caller must be holding muPending
+func (m *minion) waitSpace(n int) {
+	if n > m.bufferLimit {
+		return
+	}
+	if !m.closing && len(m.pending)+m.inflight+n > m.bufferLimit {
+		m.logger.Warn("buffer is full, waiting for room", "bytes", n)
+	}
+	for !m.closing && len(m.pending)+m.inflight+n > m.bufferLimit {
+		m.spaceCond.Wait()
+	}
+}
+
+// clearWriting records that the writer is no longer in the middle of
+// writing the head of the pending buffer
+func (m *minion) clearWriting() {
+	m.muPending.Lock()
+	m.writing = 0
+	m.muPending.Unlock()
+}
+
+// discardPending notifies all callers still waiting for their messages
+// to be written that it is never going to happen
+func (m *minion) discardPending(err error) {
+	m.discardPendingTo(err, nil)
+}
+
+// discardPendingTo is discardPending, which also passes the discarded
+// messages to deadLetter, unless it is nil (see RetryPolicy)
+func (m *minion) discardPendingTo(err error, deadLetter func(error, *BufferedMessage)) {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	var stored, offset int
+	for _, frame := range m.pendingFrames {
+		data := m.pending[offset : offset+frame.size]
+		notifyFlush(frame.flushCh, err)
+		m.reportDropped(err, frame, data)
+		if deadLetter != nil {
+			dropped := newBufferedMessage(frame, data)
+			m.queueCallback(func() { deadLetter(err, dropped) })
+		}
+		offset += frame.size
+		if frame.stored {
+			stored++
+		}
+	}
+	for tag := range m.tagPending {
+		m.tagPending[tag] = 0
+	}
+	for _, ch := range m.flushWaiters {
+		ch <- err
+	}
+	m.flushWaiters = nil
+	m.pendingFrames = m.pendingFrames[0:0]
+	m.pending = m.buffer[0:0]
+	m.truncateStore(stored)
+	m.loadStore()
+	m.spaceCond.Broadcast()
+}
+
+// unflushed returns a copy of the messages that have not been written to
+// the server yet, including the ones that are being written, as there is
+// no telling whether they are going to make it (see UnflushedError)
+func (m *minion) unflushed() []*BufferedMessage {
 	m.muPending.RLock()
 	defer m.muPending.RUnlock()
 
-	if l := len(m.pending); l > threshold {
-		if pdebug.Enabled {
-			pdebug.Printf("background writer: %d bytes to write", l)
+	var msgs []*BufferedMessage
+	appendFrames := func(data []byte, frames []pendingFrame) {
+		var offset int
+		for _, frame := range frames {
+			msgs = append(msgs, newBufferedMessage(frame, data[offset:offset+frame.size]))
+			offset += frame.size
 		}
+	}
+	for b := range m.batches {
+		appendFrames(b.data, b.frames)
+	}
+	appendFrames(m.pending, m.pendingFrames)
+	return msgs
+}
+
+// pendingAvailable reports whether there is pending data to write, and
+// whether it exceeds the threshold along with the data that the other
+// writers have claimed, if any (see claimBatch)
+func (m *minion) pendingAvailable(threshold int) bool {
+	m.muPending.RLock()
+	defer m.muPending.RUnlock()
+
+	if l := len(m.pending); l > 0 && l+m.inflight > threshold {
 		return true
 	}
 	return false
 }
 
-func (m *minion) connect(ctx context.Context) net.Conn {
-	retryCtx, cancel := context.WithTimeout(ctx, m.dialTimeout)
-	defer cancel()
+// dial connects to the first server that can be reached
+func (m *minion) dial(ctx context.Context) (net.Conn, string, error) {
+	var address string
+	conn, err := m.servers.dial(ctx, func(ctx context.Context, a string) (net.Conn, error) {
+		address = a
+		return m.dialServer(ctx, a)
+	})
+	return conn, address, err
+}
 
-	b, backoffCancel := m.backoffPolicy.Start(retryCtx)
-	defer backoffCancel()
+// dialServer connects to the server at address, and prepares the
+// connection for writing
+func (m *minion) dialServer(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := dial(ctx, m.dialFunc, m.tlsConfig, m.network, address, m.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		conn, err := dial(ctx, m.network, m.address, m.dialTimeout)
-		if err == nil {
-			if pdebug.Enabled {
-				pdebug.Printf("connected to server!")
-			}
-			return conn
-		}
+	if err := setupConn(conn, &m.tcp, m.connectHook); err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-		if pdebug.Enabled {
-			pdebug.Printf("failed to connect to server, backing off...")
+	if m.handshake.enabled() {
+		if err := handshake(conn, &m.handshake, m.dialTimeout); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, `handshake failed`)
 		}
+	}
+	return conn, nil
+}
+
+// trackConn records that a writer has opened conn. closed is closed
+// when the server closes the connection, and may be nil if we cannot
+// tell (see watchConn)
+func (m *minion) trackConn(conn net.Conn, closed <-chan struct{}) {
+	m.muConns.Lock()
+	m.openConns[conn] = closed
+	m.muConns.Unlock()
+}
+
+func (m *minion) untrackConn(conn net.Conn) {
+	m.muConns.Lock()
+	delete(m.openConns, conn)
+	m.muConns.Unlock()
+}
+
+// countServerDisconnect waits for conn to be closed, and counts it as
+// closed by the server if it was still in use by then. The writers stop
+// tracking a connection before closing it themselves
+func (m *minion) countServerDisconnect(conn net.Conn, closed <-chan struct{}) {
+	<-closed
+	m.muConns.Lock()
+	_, ok := m.openConns[conn]
+	m.muConns.Unlock()
+	if ok {
+		m.counters.addServerDisconnect()
+	}
+}
+
+// isConnected reports whether any of the writers has a connection to the
+// server that has not been closed by the server in the meantime
+func (m *minion) isConnected() bool {
+	m.muConns.Lock()
+	defer m.muConns.Unlock()
+
+	for _, closed := range m.openConns {
 		select {
-		case <-b.Done():
-			return nil
-		case <-b.Next():
+		case <-closed:
+		default:
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+// setLastError records the outcome of the latest attempt to connect to
+// or write to the server. A nil error means that it succeeded
+func (m *minion) setLastError(err error) {
+	m.muLastError.Lock()
+	m.lastError = err
+	m.muLastError.Unlock()
+	m.reportError(err, nil)
+}
+
+// reportError passes err to the error handler (see WithErrorHandler), if
+// any. msg is the message that err concerns, or nil if it concerns the
+// connection rather than a specific message. Errors about a message are
+// also sent to the error channel (see Buffered.Errors)
+func (m *minion) reportError(err error, msg *Message) {
+	if err == nil {
+		return
+	}
+	if f := m.errorHandler; f != nil {
+		// msg goes back to the pool once we return, so the handler gets
+		// a copy of it
+		var failed *Message
+		if msg != nil {
+			failed = &Message{
+				Tag:       msg.Tag,
+				Time:      msg.Time,
+				Record:    msg.Record,
+				Option:    msg.Option,
+				subsecond: msg.subsecond,
+			}
+		}
+		m.queueCallback(func() { f(err, failed) })
+	}
+	if msg != nil {
+		m.sendError(PostError{
+			Tag:    msg.Tag,
+			Time:   msg.Time.Time,
+			Record: msg.Record,
+			Err:    err,
+		})
+	}
+}
+
+// reportServerError sends err to the error channel if it is an error
+// reply of the server to a chunk with the given tag (see ServerError). The
+// messages of the chunk have already been serialized, so only their tag
+// is known. The error handler gets it from setLastError, like the other
+// errors of the connection
+func (m *minion) reportServerError(err error, tag string) {
+	if _, ok := err.(*ServerError); !ok {
+		return
+	}
+	m.sendError(PostError{Tag: tag, Err: err})
+}
+
+// sendError sends perr to the error channel, unless it is full, in which
+// case perr is dropped: the writer must never wait for the application
+func (m *minion) sendError(perr PostError) {
+	m.muErrorCh.Lock()
+	defer m.muErrorCh.Unlock()
+
+	if m.errorChClosed {
+		return
+	}
+	select {
+	case m.errorCh <- perr:
+	default:
+		m.logger.Warn("error channel is full, dropping error", "tag", perr.Tag)
+	}
+}
+
+// closeErrorCh closes the error channel, once the writer is done. The
+// reader may still report errors after that, which are then dropped
+func (m *minion) closeErrorCh() {
+	m.muErrorCh.Lock()
+	defer m.muErrorCh.Unlock()
+
+	if !m.errorChClosed {
+		m.errorChClosed = true
+		close(m.errorCh)
+	}
+}
+
+// reportDropped reports that the message described by frame, serialized
+// as data, has been dropped from the pending buffer. Only its tag and time
+// are known to the error handler, as the record is not kept
+func (m *minion) reportDropped(err error, frame pendingFrame, data []byte) {
+	m.counters.addDropped(1)
+	m.reportError(err, &Message{
+		Tag:       frame.tag,
+		Time:      EventTime{Time: frame.time},
+		subsecond: frame.subsecond,
+	})
+	m.notifyDrop(err, frame, data)
+}
+
+// notifyDrop logs the drop of the message described by frame, and passes
+// it, serialized as data, to the drop hook (see WithOnDrop), if any
+func (m *minion) notifyDrop(err error, frame pendingFrame, data []byte) {
+	m.logger.Warn("dropping message", "tag", frame.tag, "error", err)
+	if f := m.onDrop; f != nil {
+		dropped := newBufferedMessage(frame, data)
+		m.queueCallback(func() { f(err, dropped) })
+	}
+}
+
+// queueCallback queues f to be run on the callback goroutine (see
+// callbackQueue), rather than with the locks that the caller may be
+// holding
+func (m *minion) queueCallback(f func()) {
+	if m.callbacks != nil {
+		m.callbacks.push(f)
+	}
+}
+
+// closeCallbacks waits for the callbacks that have been queued to be run.
+// The ones that are queued afterwards are dropped
+func (m *minion) closeCallbacks() {
+	if m.callbacks != nil {
+		m.callbacks.close()
+	}
+}
+
+// newBufferedMessage describes the message in frame, serialized as data.
+// data is copied, as it usually points into the pending buffer
+func newBufferedMessage(frame pendingFrame, data []byte) *BufferedMessage {
+	return &BufferedMessage{
+		Tag:       frame.tag,
+		Time:      frame.time,
+		Subsecond: frame.subsecond,
+		Chunk:     frame.chunk,
+		Data:      append([]byte(nil), data...),
+	}
+}
+
+func (m *minion) getLastError() error {
+	m.muLastError.RLock()
+	defer m.muLastError.RUnlock()
+	return m.lastError
 }
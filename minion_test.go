@@ -0,0 +1,510 @@
+package fluent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// shortWriteConn accepts at most `chunk` bytes per call to Write, and
+// fails once `limit` bytes have been written, if limit is positive
+type shortWriteConn struct {
+	net.Conn
+	buf   bytes.Buffer
+	chunk int
+	limit int
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if c.limit > 0 && c.buf.Len() >= c.limit {
+		return 0, errors.New(`connection reset`)
+	}
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	return c.buf.Write(b)
+}
+
+func (c *shortWriteConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestPartialWrites(t *testing.T) {
+	var records []map[string]interface{}
+	for i := 0; i < 10; i++ {
+		records = append(records, map[string]interface{}{"count": i, "padding": "abcdefghijklmnopqrstuvwxyz"})
+	}
+
+	ts := time.Unix(1482493046, 0).UTC()
+	var expected bytes.Buffer
+	var frameSize int
+	for _, record := range records {
+		msg := makeMessage("tag_name", record, ts, TimestampSeconds, false)
+		buf, err := msgpackMarshal(msg)
+		releaseMessage(msg)
+		if !assert.NoError(t, err, "msgpackMarshal should succeed") {
+			return
+		}
+		frameSize = len(buf)
+		expected.Write(buf)
+	}
+
+	setup := func(t *testing.T) *minion {
+		m, err := newMinion()
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return nil
+		}
+		for _, record := range records {
+			m.appendMessage(makeMessage("tag_name", record, ts, TimestampSeconds, false))
+		}
+		return m
+	}
+
+	t.Run("short writes", func(t *testing.T) {
+		m := setup(t)
+		if m == nil {
+			return
+		}
+
+		conn := &shortWriteConn{chunk: 7}
+		if !assert.NoError(t, m.flushPending(conn, writeTarget{}), "flushPending should succeed") {
+			return
+		}
+		if !assert.Equal(t, expected.Bytes(), conn.buf.Bytes(), "frames should be written without corruption") {
+			return
+		}
+		if !assert.False(t, m.pendingAvailable(0), "pending buffer should be empty") {
+			return
+		}
+	})
+	t.Run("short writes followed by an error", func(t *testing.T) {
+		m := setup(t)
+		if m == nil {
+			return
+		}
+
+		// fail in the middle of the fourth frame
+		conn := &shortWriteConn{chunk: 7, limit: frameSize*3 + 1}
+		if !assert.Error(t, m.flushPending(conn, writeTarget{}), "flushPending should fail") {
+			return
+		}
+
+		// The partially written frame must be sent again from its beginning
+		if !assert.Equal(t, expected.Bytes()[frameSize*3:], m.pending, "partially written frame should remain in the buffer") {
+			return
+		}
+		if !assert.Len(t, m.pendingFrames, len(records)-3, "partially written frame should remain in the buffer") {
+			return
+		}
+
+		conn = &shortWriteConn{chunk: 7}
+		if !assert.NoError(t, m.flushPending(conn, writeTarget{}), "flushPending should succeed") {
+			return
+		}
+		if !assert.Equal(t, expected.Bytes()[frameSize*3:], conn.buf.Bytes(), "remaining frames should be written on the new connection") {
+			return
+		}
+	})
+}
+
+func TestWriteQueueSize(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		m, err := newMinion()
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return
+		}
+		if !assert.Equal(t, 64, cap(m.incoming), "queue capacity should be the default") {
+			return
+		}
+	})
+	t.Run("WithWriteQueueSize", func(t *testing.T) {
+		m, err := newMinion(WithWriteQueueSize(1024))
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return
+		}
+		if !assert.Equal(t, 1024, cap(m.incoming), "queue capacity should be honored") {
+			return
+		}
+	})
+}
+
+func TestRetryJitter(t *testing.T) {
+	for _, f := range []float64{0, 0.5, 1} {
+		_, err := newMinion(WithRetryJitter(f))
+		if !assert.NoError(t, err, "newMinion should succeed with jitter factor %f", f) {
+			return
+		}
+	}
+
+	for _, f := range []float64{-0.1, 1.1} {
+		_, err := newMinion(WithRetryJitter(f))
+		if !assert.Error(t, err, "newMinion should fail with jitter factor %f", f) {
+			return
+		}
+	}
+}
+
+func TestTrackConn(t *testing.T) {
+	m, err := newMinion()
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+
+	closed := make(chan struct{})
+	conn := &shortWriteConn{}
+	m.trackConn(conn, closed)
+	if !assert.True(t, m.isConnected(), "minion should be connected") {
+		return
+	}
+
+	close(closed)
+	if !assert.False(t, m.isConnected(), "connection closed by the server should not count") {
+		return
+	}
+
+	m.untrackConn(conn)
+	m.trackConn(conn, nil)
+	if !assert.True(t, m.isConnected(), "connection that is not watched should count") {
+		return
+	}
+	m.untrackConn(conn)
+	if !assert.False(t, m.isConnected(), "minion should not be connected") {
+		return
+	}
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	ts := time.Unix(1482493046, 0).UTC()
+	serialize := func(i int) []byte {
+		msg := makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false)
+		defer releaseMessage(msg)
+		buf, err := msgpackMarshal(msg)
+		if err != nil {
+			t.Fatalf("msgpackMarshal failed: %s", err)
+		}
+		return buf
+	}
+	frameSize := len(serialize(0))
+
+	setup := func(t *testing.T, options ...Option) *minion {
+		m, err := newMinion(append(options, WithBufferLimit(frameSize*3))...)
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return nil
+		}
+		for i := 0; i < 5; i++ {
+			m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false))
+		}
+		return m
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		m := setup(t)
+		if m == nil {
+			return
+		}
+		expected := append(append(serialize(0), serialize(1)...), serialize(2)...)
+		if !assert.Equal(t, expected, m.pending, "newest messages should be rejected") {
+			return
+		}
+	})
+	t.Run("drop_oldest", func(t *testing.T) {
+		m := setup(t, WithOverflowPolicy("drop_oldest"))
+		if m == nil {
+			return
+		}
+		expected := append(append(serialize(2), serialize(3)...), serialize(4)...)
+		if !assert.Equal(t, expected, m.pending, "oldest messages should be evicted") {
+			return
+		}
+		if !assert.Len(t, m.pendingFrames, 3, "oldest messages should be evicted") {
+			return
+		}
+	})
+	t.Run("drop_oldest while writing", func(t *testing.T) {
+		m := setup(t, WithOverflowPolicy("drop_oldest"))
+		if m == nil {
+			return
+		}
+
+		// The message at the head is being written, so the one after it
+		// is evicted instead
+		m.writing = frameSize
+		m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": 5}, ts, TimestampSeconds, false))
+		expected := append(append(serialize(2), serialize(4)...), serialize(5)...)
+		if !assert.Equal(t, expected, m.pending, "message being written should not be evicted") {
+			return
+		}
+	})
+	t.Run("block", func(t *testing.T) {
+		m, err := newMinion(WithBufferLimit(frameSize*3), WithOverflowPolicy("block"))
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return
+		}
+		for i := 0; i < 3; i++ {
+			m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false))
+		}
+
+		appended := make(chan struct{})
+		go func() {
+			defer close(appended)
+			m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": 3}, ts, TimestampSeconds, false))
+		}()
+
+		select {
+		case <-appended:
+			t.Errorf("append should block while the buffer is full")
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		m.muPending.Lock()
+		consumed := m.consumePending(frameSize)
+		m.pending = m.pending[consumed:]
+		m.muPending.Unlock()
+
+		select {
+		case <-appended:
+		case <-time.After(time.Second):
+			t.Errorf("append should proceed once there is room")
+			return
+		}
+		expected := append(append(serialize(1), serialize(2)...), serialize(3)...)
+		if !assert.Equal(t, expected, m.pending, "message should be appended") {
+			return
+		}
+	})
+	t.Run("block while closing", func(t *testing.T) {
+		m, err := newMinion(WithBufferLimit(frameSize*3), WithOverflowPolicy("block"))
+		if !assert.NoError(t, err, "newMinion should succeed") {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go m.runReader(ctx)
+		for i := 0; i < 4; i++ {
+			m.incoming <- makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false)
+		}
+
+		cancel()
+		select {
+		case <-m.readerDone:
+		case <-time.After(time.Second):
+			t.Errorf("reader should exit once canceled")
+			return
+		}
+		if !assert.Len(t, m.pendingFrames, 4, "blocked message should be accepted while closing") {
+			return
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newMinion(WithOverflowPolicy("drop_newest"))
+		if !assert.Error(t, err, "newMinion should fail") {
+			return
+		}
+	})
+}
+
+func TestOnDrop(t *testing.T) {
+	ts := time.Unix(1482493046, 0).UTC()
+	serialize := func(i int) []byte {
+		msg := makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false)
+		defer releaseMessage(msg)
+		buf, err := msgpackMarshal(msg)
+		if err != nil {
+			t.Fatalf("msgpackMarshal failed: %s", err)
+		}
+		return buf
+	}
+	frameSize := len(serialize(0))
+
+	for _, policy := range []string{"reject", "drop_oldest"} {
+		t.Run(policy, func(t *testing.T) {
+			var dropped [][]byte
+			m, err := newMinion(
+				WithBufferLimit(frameSize*3),
+				WithOverflowPolicy(policy),
+				WithOnDrop(func(err error, msg *BufferedMessage) {
+					if !assert.Error(t, err, "reason should be given") {
+						return
+					}
+					if !assert.Equal(t, "tag_name", msg.Tag, "tag should match") {
+						return
+					}
+					dropped = append(dropped, msg.Data)
+				}),
+			)
+			if !assert.NoError(t, err, "newMinion should succeed") {
+				return
+			}
+			defer m.closeCallbacks()
+
+			// The callbacks are run in the background, in order
+			waitCallbacks := func() {
+				done := make(chan struct{})
+				m.queueCallback(func() { close(done) })
+				<-done
+			}
+
+			for i := 0; i < 5; i++ {
+				m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false))
+			}
+			waitCallbacks()
+
+			expected := [][]byte{serialize(3), serialize(4)}
+			if policy == "drop_oldest" {
+				expected = [][]byte{serialize(0), serialize(1)}
+			}
+			if !assert.Equal(t, expected, dropped, "dropped messages should be passed") {
+				return
+			}
+
+			dropped = nil
+			m.discardPending(errors.New(`discarded`))
+			waitCallbacks()
+			if !assert.Len(t, dropped, 3, "discarded messages should be passed") {
+				return
+			}
+		})
+	}
+}
+
+func TestChunkResend(t *testing.T) {
+	m, err := newMinion(WithProtocolMode("forward"), WithRequireAck(true))
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+	ts := time.Unix(1482493046, 0).UTC()
+	post := func(i int) {
+		m.appendMessage(makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false))
+	}
+
+	post(0)
+	post(1)
+	buf, size, chunk, err := m.nextChunk()
+	if !assert.NoError(t, err, "nextChunk should succeed") {
+		return
+	}
+
+	// The ack does not arrive, and another message comes in before the
+	// chunk is sent again
+	post(2)
+	resent, resentSize, resentChunk, err := m.nextChunk()
+	if !assert.NoError(t, err, "nextChunk should succeed") {
+		return
+	}
+	if !assert.Equal(t, chunk, resentChunk, "chunk ID should be the same") {
+		return
+	}
+	if !assert.Equal(t, size, resentSize, "chunk should hold the same messages") {
+		return
+	}
+	if !assert.Equal(t, buf, resent, "chunk should be sent as it was") {
+		return
+	}
+
+	m.pending = m.pending[m.consumePending(size):]
+	_, _, nextChunk, err := m.nextChunk()
+	if !assert.NoError(t, err, "nextChunk should succeed") {
+		return
+	}
+	if !assert.NotEqual(t, chunk, nextChunk, "next chunk should have a new ID") {
+		return
+	}
+}
+
+func TestChunkEviction(t *testing.T) {
+	ts := time.Unix(1482493046, 0).UTC()
+	message := func(i int) *Message {
+		return makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false)
+	}
+
+	probe, err := newMinion(WithProtocolMode("forward"))
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+	probe.appendMessage(message(0))
+	frameSize := probe.pendingFrames[0].size
+
+	m, err := newMinion(
+		WithProtocolMode("forward"),
+		WithRequireAck(true),
+		WithBufferLimit(frameSize*4),
+		WithOverflowPolicy("drop_oldest"),
+	)
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		m.appendMessage(message(i))
+	}
+	_, size, chunk, err := m.nextChunk()
+	if !assert.NoError(t, err, "nextChunk should succeed") {
+		return
+	}
+	if !assert.Equal(t, frameSize*3, size, "chunk should hold all messages") {
+		return
+	}
+
+	// The ack does not arrive, and the buffer overflows before the chunk
+	// is sent again. Evicting only its first message would change what
+	// is sent under its ID
+	m.appendMessage(message(3))
+	m.appendMessage(message(4))
+	if !assert.Equal(t, uint64(3), m.stats().Dropped, "chunk should be evicted as a whole") {
+		return
+	}
+	if !assert.Len(t, m.pendingFrames, 2, "new messages should be kept") {
+		return
+	}
+
+	_, size, nextChunk, err := m.nextChunk()
+	if !assert.NoError(t, err, "nextChunk should succeed") {
+		return
+	}
+	if !assert.NotEqual(t, chunk, nextChunk, "next chunk should have a new ID") {
+		return
+	}
+	if !assert.Equal(t, frameSize*2, size, "next chunk should hold the new messages") {
+		return
+	}
+}
+
+func TestChunkSizeLimit(t *testing.T) {
+	ts := time.Unix(1482493046, 0).UTC()
+	message := func(i int) *Message {
+		return makeMessage("tag_name", map[string]interface{}{"count": i}, ts, TimestampSeconds, false)
+	}
+
+	probe, err := newMinion(WithProtocolMode("forward"))
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+	probe.appendMessage(message(0))
+	frameSize := probe.pendingFrames[0].size
+
+	m, err := newMinion(WithProtocolMode("forward"), WithChunkSizeLimit(frameSize*3+1))
+	if !assert.NoError(t, err, "newMinion should succeed") {
+		return
+	}
+	for i := 0; i < 8; i++ {
+		m.appendMessage(message(i))
+	}
+
+	var sizes []int
+	for len(m.pendingFrames) > 0 {
+		_, size, _, err := m.nextChunk()
+		if !assert.NoError(t, err, "nextChunk should succeed") {
+			return
+		}
+		sizes = append(sizes, size/frameSize)
+		m.pending = m.pending[m.consumePending(size):]
+	}
+	if !assert.Equal(t, []int{3, 3, 2}, sizes, "messages should be split into chunks under the limit") {
+		return
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package fluent
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func dialPipe(_ context.Context, _ string) (net.Conn, error) {
+	return nil, errors.New(`npipe network is only supported on Windows`)
+}
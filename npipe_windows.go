@@ -0,0 +1,63 @@
+//go:build windows
+// +build windows
+
+package fluent
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errorPipeBusy is returned when all instances of the pipe are in use
+const errorPipeBusy = syscall.Errno(231)
+
+// dialPipe opens the named pipe at address, such as \\.\pipe\fluentd.
+// If all instances of the pipe are busy, it keeps trying until ctx is
+// canceled
+func dialPipe(ctx context.Context, address string) (net.Conn, error) {
+	for {
+		f, err := os.OpenFile(address, os.O_RDWR, 0)
+		if err == nil {
+			return &pipeConn{File: f, addr: pipeAddr(address)}, nil
+		}
+
+		if perr, ok := err.(*os.PathError); !ok || perr.Err != errorPipeBusy {
+			return nil, errors.Wrap(err, `failed to open named pipe`)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(err, `failed to open named pipe`)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// pipeConn makes a named pipe usable as a net.Conn
+type pipeConn struct {
+	*os.File
+	addr pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "npipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,285 @@
+package fluent
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// proxyDialer connects to the server through a SOCKS5 or an HTTP proxy.
+// The connection to the proxy itself is established via forward, which is
+// the dial function that would otherwise have been used for the server
+type proxyDialer struct {
+	forward func(context.Context, string, string) (net.Conn, error)
+	url     *url.URL
+}
+
+func newProxyDialer(s string, forward func(context.Context, string, string) (net.Conn, error)) (*proxyDialer, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse proxy URL`)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, errors.Errorf(`unsupported proxy scheme: %s`, strconv.Quote(u.Scheme))
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, errors.Errorf(`invalid proxy URL: %s`, strconv.Quote(s))
+	}
+
+	if forward == nil {
+		var dialer net.Dialer
+		forward = dialer.DialContext
+	}
+
+	return &proxyDialer{forward: forward, url: u}, nil
+}
+
+// proxyAddress returns the address of the proxy, with the default port
+// for the scheme if none has been specified
+func (d *proxyDialer) proxyAddress() string {
+	if port := d.url.Port(); len(port) > 0 {
+		return d.url.Host
+	}
+
+	port := "1080"
+	switch d.url.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(d.url.Hostname(), port)
+}
+
+// dial connects to address through the proxy. Only TCP can be proxied
+func (d *proxyDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf(`network %s can not be used through a proxy`, network)
+	}
+
+	conn, err := d.forward(ctx, "tcp", d.proxyAddress())
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to connect to proxy`)
+	}
+
+	// The proxy negotiation must complete within the dial timeout, too
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	switch d.url.Scheme {
+	case "socks5", "socks5h":
+		err = d.socks5Connect(conn, address)
+	default:
+		if d.url.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: d.url.Hostname()})
+			if err = tlsConn.Handshake(); err != nil {
+				err = errors.Wrap(err, `failed to perform TLS handshake with proxy`)
+				break
+			}
+			conn = tlsConn
+		}
+		conn, err = d.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy to open a tunnel to address
+func (d *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := d.url.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return conn, errors.Wrap(err, `failed to send CONNECT request to proxy`)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, errors.Wrap(err, `failed to read CONNECT response from proxy`)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return conn, errors.Errorf(`proxy refused to connect to %s: %s`, address, res.Status)
+	}
+
+	// Anything that the server has sent through the tunnel may already
+	// have been read into br (the handshake starts with the server
+	// speaking first), so it has to be read from there
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: io.MultiReader(br, conn)}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn that reads from r instead of the connection
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5 protocol constants, as defined in RFC 1928 and RFC 1929
+const (
+	socks5Version           = 0x05
+	socks5AuthNone          = 0x00
+	socks5AuthPassword      = 0x02
+	socks5AuthNoAcceptable  = 0xff
+	socks5AuthVersion       = 0x01
+	socks5CommandConnect    = 0x01
+	socks5AddressIPv4       = 0x01
+	socks5AddressDomainName = 0x03
+	socks5AddressIPv6       = 0x04
+)
+
+// socks5Connect asks a SOCKS5 proxy to connect to address. Host names are
+// always sent to the proxy to be resolved there
+func (d *proxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, `failed to parse address`)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errors.Wrap(err, `failed to parse port`)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if d.url.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return errors.Wrap(err, `failed to write SOCKS5 greeting`)
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return errors.Wrap(err, `failed to read SOCKS5 greeting reply`)
+	}
+	if reply[0] != socks5Version {
+		return errors.Errorf(`unexpected SOCKS version %d`, reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if d.url.User == nil {
+			return errors.New(`SOCKS5 proxy requires authentication`)
+		}
+		if err := d.socks5Authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAcceptable:
+		return errors.New(`SOCKS5 proxy did not accept any authentication method`)
+	default:
+		return errors.Errorf(`unsupported SOCKS5 authentication method %d`, reply[1])
+	}
+
+	req := []byte{socks5Version, socks5CommandConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddressIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddressIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.Errorf(`host name too long: %s`, host)
+		}
+		req = append(req, socks5AddressDomainName, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return errors.Wrap(err, `failed to write SOCKS5 connect request`)
+	}
+
+	// VER, REP, RSV, ATYP, followed by the bound address and port, which
+	// we have no use for
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return errors.Wrap(err, `failed to read SOCKS5 connect reply`)
+	}
+	if header[1] != 0x00 {
+		return errors.Errorf(`SOCKS5 proxy refused to connect to %s (reply code %d)`, address, header[1])
+	}
+
+	var skip int
+	switch header[3] {
+	case socks5AddressIPv4:
+		skip = net.IPv4len
+	case socks5AddressIPv6:
+		skip = net.IPv6len
+	case socks5AddressDomainName:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return errors.Wrap(err, `failed to read SOCKS5 connect reply`)
+		}
+		skip = int(l[0])
+	default:
+		return errors.Errorf(`unknown SOCKS5 address type %d`, header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return errors.Wrap(err, `failed to read SOCKS5 connect reply`)
+	}
+	return nil
+}
+
+// socks5Authenticate performs the username/password authentication
+func (d *proxyDialer) socks5Authenticate(conn net.Conn) error {
+	username := d.url.User.Username()
+	password, _ := d.url.User.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New(`SOCKS5 username or password too long`)
+	}
+
+	req := []byte{socks5AuthVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return errors.Wrap(err, `failed to write SOCKS5 authentication request`)
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return errors.Wrap(err, `failed to read SOCKS5 authentication reply`)
+	}
+	if reply[1] != 0x00 {
+		return errors.New(`SOCKS5 proxy rejected username/password`)
+	}
+	return nil
+}
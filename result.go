@@ -0,0 +1,63 @@
+package fluent
+
+func newResult() *Result {
+	return &Result{
+		appended: make(chan error, 1),
+		ch:       make(chan error, 1),
+	}
+}
+
+// NewCompletedResult returns a Result whose outcome is err, both for
+// Appended and Done. It is meant for implementations of Client other
+// than the ones in this package, such as fakes used in tests
+func NewCompletedResult(err error) *Result {
+	r := newResult()
+	notifyFlush(r.appended, err)
+	notifyFlush(r.ch, err)
+	return r
+}
+
+// Appended returns a channel that is closed once the message has been
+// appended to the buffer of the client. If it could not be, e.g. because
+// the buffer is full, the error is sent before the channel is closed.
+// Receiving nil therefore means that the message was appended.
+//
+// This is the same outcome that Post reports with WithSyncAppend, without
+// having to wait for it.
+func (r *Result) Appended() <-chan error {
+	return r.appended
+}
+
+// Err waits for the outcome of the asynchronous Post operation, as sent
+// to the channel returned by Done, and returns it. Unlike receiving from
+// Done, it may be called any number of times, but the two should not be
+// mixed.
+func (r *Result) Err() error {
+	r.once.Do(func() {
+		r.err = <-r.ch
+	})
+	return r.err
+}
+
+// Done returns a channel that receives the outcome of the asynchronous
+// Post operation. A nil value is sent once the message has been written
+// to the server, and a non-nil error is sent if the message could not be
+// appended to the buffer, or could not be written before the client exited.
+// The channel is closed after the outcome has been sent.
+//
+// Note that buffered clients do not start writing until the amount of
+// pending data reaches the write threshold (see WithWriteThreshold), the
+// flush interval elapses (see WithFlushInterval), or the client is closed.
+func (r *Result) Done() <-chan error {
+	return r.ch
+}
+
+// notifyFlush sends the outcome of writing a message to the caller, if
+// the caller asked for it. Each channel is notified exactly once
+func notifyFlush(ch chan error, err error) {
+	if ch == nil {
+		return
+	}
+	ch <- err
+	close(ch)
+}
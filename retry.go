@@ -0,0 +1,111 @@
+package fluent
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	retryDrop       = "drop"
+	retryDeadLetter = "dead_letter"
+	retryBlock      = "block"
+)
+
+// RetryPolicy describes what a buffered client does when it cannot
+// connect to the server, or write to it (see WithRetryPolicy). The
+// intervals between attempts are governed by WithBackoff.
+//
+// Messages that cannot be serialized are never retried, regardless of
+// the policy: they are rejected as soon as they are posted.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts in a row that may fail before
+	// the client gives up. 0 means that the client never gives up, unless
+	// the error is not retryable
+	MaxAttempts int
+
+	// Retryable reports whether the client should try again after err. It
+	// gives up right away if it returns false. If nil, all errors are
+	// retried
+	Retryable func(err error) bool
+
+	// Exhausted is what the client does with the pending messages once it
+	// gives up:
+	//
+	//   "drop":        discard them (the default). They are still passed
+	//                  to the functions given by WithErrorHandler and
+	//                  WithOnDrop, if any
+	//   "dead_letter": pass them to DeadLetter, then discard them
+	//   "block":       keep them, and stop accepting new messages until
+	//                  the server can be reached again, so that Post
+	//                  blocks once the queue is full (see WithPostTimeout
+	//                  and WithNonBlocking)
+	Exhausted string
+
+	// DeadLetter receives the messages that are given up on, in their
+	// serialized form, if Exhausted is "dead_letter". It is called in
+	// the same way as the function given by WithOnDrop
+	DeadLetter func(error, *BufferedMessage)
+}
+
+func (p *RetryPolicy) validate() error {
+	switch p.Exhausted {
+	case "", retryDrop, retryBlock:
+	case retryDeadLetter:
+		if p.DeadLetter == nil {
+			return errors.New(`retry policy "dead_letter" requires a DeadLetter function`)
+		}
+	default:
+		return errors.Errorf(`invalid retry exhaustion policy: %s`, p.Exhausted)
+	}
+	if p.MaxAttempts < 0 {
+		return errors.Errorf(`invalid max attempts: %d`, p.MaxAttempts)
+	}
+	return nil
+}
+
+// exhausted reports whether we should give up after the given number of
+// attempts in a row have failed, the last one with err
+func (p *RetryPolicy) exhausted(err error, failures int) bool {
+	if p.Retryable != nil && !p.Retryable(err) {
+		return true
+	}
+	return p.MaxAttempts > 0 && failures >= p.MaxAttempts
+}
+
+// giveUp applies the retry policy to the pending messages, once it has
+// been exhausted (or the backoff has, see WithBackoff)
+func (m *minion) giveUp(err error) {
+	m.logger.Error("retries exhausted", "error", err)
+	switch m.retryPolicy.Exhausted {
+	case retryBlock:
+		m.setRetryBlocked(true)
+	case retryDeadLetter:
+		m.discardPendingTo(err, m.retryPolicy.DeadLetter)
+	default:
+		m.discardPending(err)
+	}
+}
+
+// setRetryBlocked records whether new messages are held off until the
+// server can be reached again (see RetryPolicy)
+func (m *minion) setRetryBlocked(b bool) {
+	m.muPending.Lock()
+	defer m.muPending.Unlock()
+
+	if m.retryBlocked == b {
+		return
+	}
+	m.retryBlocked = b
+	if b {
+		m.logger.Warn("holding off new messages until the server can be reached")
+	} else {
+		m.spaceCond.Broadcast()
+	}
+}
+
+// waitRetry waits while new messages are held off, or until the client is
+// closing. The caller must be holding muPending
+func (m *minion) waitRetry() {
+	for !m.closing && m.retryBlocked {
+		m.spaceCond.Wait()
+	}
+}
@@ -0,0 +1,348 @@
+package fluent
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	loadBalanceRoundRobin = "round_robin"
+	loadBalanceRandom     = "random"
+
+	// defaultServerWeight is the same as out_forward's
+	defaultServerWeight = 60
+)
+
+// serverList keeps track of the servers that the client may connect to.
+//
+// By default, the first server is the primary, and the rest are standbys
+// that are only used while the servers before them are unreachable. Once
+// we have failed over to a standby, the primary is tried again after the
+// fallback interval has elapsed.
+//
+// With load balancing, a server is picked for each chunk of data instead,
+// according to the weights of the servers. Servers with a weight of 0 are
+// never picked, and only serve as standbys. If the server that was picked
+// is unreachable, the following servers are tried in order.
+//
+// If an SRV record name is given instead of addresses, the record is
+// looked up every time we connect, and the targets are tried in the order
+// returned by the resolver, which sorts them by priority, and shuffles
+// those with the same priority according to their weights.
+//
+// With heartbeats, servers that are considered dead are tried after all
+// the others, and are not picked for load balancing. We also move away
+// from the server that we are using as soon as it is considered dead
+type serverList struct {
+	addresses        []string // for SRV records, the targets of the last lookup
+	balancing        string
+	fallbackInterval time.Duration
+	heartbeat        *heartbeat
+	logger           Logger
+	lookupSRV        func(context.Context, string, string, string) (string, []*net.SRV, error)
+	srv              string
+	weights          []int
+
+	mu             sync.Mutex
+	current        int       // index of the server that we last connected to
+	currentWeights []int     // for the smooth weighted round-robin
+	failedOverAt   time.Time // when we last connected to a standby
+	selected       int       // index of the server picked for load balancing
+}
+
+func newServerList(addresses []string, weights map[string]int, balancing string, fallbackInterval time.Duration, logger Logger) (*serverList, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New(`at least one address must be specified`)
+	}
+
+	l := &serverList{
+		addresses:        addresses,
+		balancing:        balancing,
+		fallbackInterval: fallbackInterval,
+		logger:           logger,
+		currentWeights:   make([]int, len(addresses)),
+		weights:          make([]int, len(addresses)),
+	}
+
+	for i := range l.weights {
+		l.weights[i] = defaultServerWeight
+	}
+	for address, weight := range weights {
+		if weight < 0 {
+			return nil, errors.Errorf(`invalid weight for %s: %d`, strconv.Quote(address), weight)
+		}
+
+		var found bool
+		for i, v := range addresses {
+			if v == address {
+				l.weights[i] = weight
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf(`weight specified for unknown address %s`, strconv.Quote(address))
+		}
+	}
+
+	if len(balancing) > 0 && l.totalWeight() == 0 {
+		return nil, errors.New(`at least one server must have a non-zero weight for load balancing`)
+	}
+	return l, nil
+}
+
+func newSRVServerList(name string, logger Logger) *serverList {
+	return &serverList{
+		logger:    logger,
+		lookupSRV: net.DefaultResolver.LookupSRV,
+		srv:       name,
+	}
+}
+
+// dial connects to the first server that accepts the connection, starting
+// with the one that has been picked for load balancing, the one that we
+// are currently using, or the primary if it is time to fall back to it.
+// dialFunc is called for each server in turn, and the error for the last
+// one is returned if none of them can be reached
+func (l *serverList) dial(ctx context.Context, dialFunc func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	if len(l.srv) > 0 {
+		return l.dialSRV(ctx, dialFunc)
+	}
+
+	var lastErr error
+	for _, idx := range l.order(l.next()) {
+		conn, err := dialFunc(ctx, l.addresses[idx])
+		if err == nil {
+			l.connected(idx)
+			return conn, nil
+		}
+
+		l.logger.Warn("failed to connect", "address", l.addresses[idx], "error", err)
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialSRV is the equivalent of dial for SRV records. If the lookup fails,
+// the targets from the last successful lookup are used, so that a flaky
+// DNS server does not stop us from reconnecting to a known server
+func (l *serverList) dialSRV(ctx context.Context, dialFunc func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	_, records, err := l.lookupSRV(ctx, "", "", l.srv)
+	if err == nil && len(records) == 0 {
+		err = errors.New(`no targets found`)
+	}
+
+	l.mu.Lock()
+	if err == nil {
+		l.addresses = l.addresses[:0]
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			l.addresses = append(l.addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		l.current = 0
+	}
+	addresses := append([]string(nil), l.addresses...)
+	l.mu.Unlock()
+
+	if err != nil {
+		if len(addresses) == 0 {
+			return nil, errors.Wrapf(err, `failed to look up SRV record %s`, l.srv)
+		}
+		l.logger.Warn("failed to look up SRV record, using previous targets", "name", l.srv, "error", err)
+	}
+
+	var lastErr error
+	for _, idx := range l.order(0) {
+		address := addresses[idx]
+		conn, err := dialFunc(ctx, address)
+		if err == nil {
+			l.mu.Lock()
+			if idx < len(l.addresses) && l.addresses[idx] == address {
+				l.current = idx
+			}
+			l.mu.Unlock()
+			return conn, nil
+		}
+
+		l.logger.Warn("failed to connect", "address", address, "error", err)
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// order returns the indices of the servers in the order in which they
+// should be tried, starting with start, with the servers that are
+// considered dead moved to the end
+func (l *serverList) order(start int) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(l.addresses)
+	alive := make([]int, 0, n)
+	var dead []int
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		if l.alive(idx) {
+			alive = append(alive, idx)
+		} else {
+			dead = append(dead, idx)
+		}
+	}
+	return append(alive, dead...)
+}
+
+// targets returns the addresses of the servers, for the heartbeats
+func (l *serverList) targets() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.addresses...)
+}
+
+// next returns the index of the server to try first
+func (l *serverList) next() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.balancing) > 0 {
+		return l.selected
+	}
+	if l.fallbackDue() {
+		return 0
+	}
+	return l.current
+}
+
+func (l *serverList) connected(idx int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if idx != l.current {
+		l.logger.Info("switching servers", "from", l.addresses[l.current], "to", l.addresses[idx])
+	}
+	l.current = idx
+	if idx != 0 {
+		l.failedOverAt = time.Now()
+	}
+}
+
+// rotate is called before each chunk of data is written. With load
+// balancing, it picks the server for the chunk. It reports whether the
+// current connection should be closed, so that the next connection goes
+// to the server that has been picked, or to the primary server if it is
+// time to fall back to it
+func (l *serverList) rotate() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch l.balancing {
+	case loadBalanceRoundRobin:
+		l.selected = l.pickRoundRobin(l.liveWeights())
+	case loadBalanceRandom:
+		l.selected = l.pickRandom(l.liveWeights())
+	default:
+		if l.fallbackDue() && l.alive(0) {
+			return true
+		}
+		return !l.alive(l.current) && l.anyAlive()
+	}
+	return l.selected != l.current
+}
+
+// alive reports whether the server at idx is not known to be dead. Must
+// be called while holding mu
+func (l *serverList) alive(idx int) bool {
+	if l.heartbeat == nil || idx >= len(l.addresses) {
+		return true
+	}
+	return l.heartbeat.alive(l.addresses[idx])
+}
+
+// anyAlive must be called while holding mu
+func (l *serverList) anyAlive() bool {
+	for i := range l.addresses {
+		if l.alive(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// liveWeights returns the weights of the servers, with those of the
+// servers that are considered dead set to 0. If that leaves nothing to
+// pick from, all servers are picked as usual. Must be called while
+// holding mu
+func (l *serverList) liveWeights() []int {
+	weights := make([]int, len(l.weights))
+	var total int
+	for i, weight := range l.weights {
+		if l.alive(i) {
+			weights[i] = weight
+			total += weight
+		}
+	}
+	if total == 0 {
+		return l.weights
+	}
+	return weights
+}
+
+// pickRoundRobin implements the smooth weighted round-robin, which
+// spreads the picks of each server evenly, instead of picking the same
+// server as many times in a row as its weight. Must be called while
+// holding mu
+func (l *serverList) pickRoundRobin(weights []int) int {
+	total := sumWeights(weights)
+	best := -1
+	for i, weight := range weights {
+		l.currentWeights[i] += weight
+		if best < 0 || l.currentWeights[i] > l.currentWeights[best] {
+			best = i
+		}
+	}
+	l.currentWeights[best] -= total
+	return best
+}
+
+// pickRandom picks a server at random, with probabilities proportional
+// to the weights. Must be called while holding mu
+func (l *serverList) pickRandom(weights []int) int {
+	n := rand.Intn(sumWeights(weights))
+	for i, weight := range weights {
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	return 0 // not reached
+}
+
+func (l *serverList) totalWeight() int {
+	return sumWeights(l.weights)
+}
+
+func sumWeights(weights []int) int {
+	var total int
+	for _, weight := range weights {
+		total += weight
+	}
+	return total
+}
+
+// fallbackDue must be called while holding mu
+func (l *serverList) fallbackDue() bool {
+	return l.current != 0 && l.fallbackInterval > 0 && time.Since(l.failedOverAt) >= l.fallbackInterval
+}
@@ -0,0 +1,114 @@
+package fluent
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerListRoundRobin(t *testing.T) {
+	l, err := newServerList([]string{"a", "b", "c"}, map[string]int{"a": 2, "b": 1, "c": 0}, loadBalanceRoundRobin, 0, nopLogger{})
+	if !assert.NoError(t, err, "newServerList should succeed") {
+		return
+	}
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		l.rotate()
+		picked = append(picked, l.addresses[l.next()])
+	}
+	if !assert.Equal(t, []string{"a", "b", "a", "a", "b", "a"}, picked, "servers should be picked according to their weights") {
+		return
+	}
+}
+
+func TestServerListRandom(t *testing.T) {
+	l, err := newServerList([]string{"a", "b", "c"}, map[string]int{"c": 0}, loadBalanceRandom, 0, nopLogger{})
+	if !assert.NoError(t, err, "newServerList should succeed") {
+		return
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		l.rotate()
+		counts[l.addresses[l.next()]]++
+	}
+	if !assert.Zero(t, counts["c"], "servers with no weight should never be picked") {
+		return
+	}
+	if !assert.True(t, counts["a"] > 300 && counts["b"] > 300, "servers with the same weight should be picked about as often (%v)", counts) {
+		return
+	}
+}
+
+func TestServerListErrors(t *testing.T) {
+	var testcases = []struct {
+		name      string
+		addresses []string
+		weights   map[string]int
+		balancing string
+	}{
+		{name: "no addresses"},
+		{name: "unknown address", addresses: []string{"a"}, weights: map[string]int{"b": 1}},
+		{name: "negative weight", addresses: []string{"a"}, weights: map[string]int{"a": -1}},
+		{name: "no weight", addresses: []string{"a"}, weights: map[string]int{"a": 0}, balancing: loadBalanceRandom},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newServerList(tc.addresses, tc.weights, tc.balancing, 0, nopLogger{})
+			if !assert.Error(t, err, "newServerList should fail") {
+				return
+			}
+		})
+	}
+}
+
+func TestServerListSRV(t *testing.T) {
+	l := newSRVServerList("_fluentd._tcp.example.com", nopLogger{})
+
+	var lookupErr error
+	l.lookupSRV = func(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if lookupErr != nil {
+			return "", nil, lookupErr
+		}
+		return name, []*net.SRV{
+			{Target: "fluent1.example.com.", Port: 24224},
+			{Target: "fluent2.example.com.", Port: 24225},
+		}, nil
+	}
+
+	var dialed []string
+	dialFunc := func(_ context.Context, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errors.New("connection refused")
+	}
+
+	_, err := l.dial(context.Background(), dialFunc)
+	if !assert.Error(t, err, "dial should fail") {
+		return
+	}
+	if !assert.Equal(t, []string{"fluent1.example.com:24224", "fluent2.example.com:24225"}, dialed, "targets should be tried in order") {
+		return
+	}
+
+	// The previous targets are used if the lookup fails
+	dialed = nil
+	lookupErr = errors.New("no such host")
+	l.dial(context.Background(), dialFunc)
+	if !assert.Equal(t, []string{"fluent1.example.com:24224", "fluent2.example.com:24225"}, dialed, "previous targets should be used") {
+		return
+	}
+
+	l = newSRVServerList("_fluentd._tcp.example.com", nopLogger{})
+	l.lookupSRV = func(context.Context, string, string, string) (string, []*net.SRV, error) {
+		return "", nil, lookupErr
+	}
+	_, err = l.dial(context.Background(), dialFunc)
+	if !assert.Error(t, err, "dial should fail without any targets") {
+		return
+	}
+}
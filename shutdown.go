@@ -0,0 +1,51 @@
+package fluent
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// shutdownErrors is returned by ShutdownAll when one or more clients
+// failed to shutdown
+type shutdownErrors []error
+
+func (e shutdownErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return `failed to shutdown ` + strconv.Itoa(len(e)) + ` client(s): ` + strings.Join(msgs, `; `)
+}
+
+// ShutdownAll calls Shutdown on all of the given clients concurrently,
+// and waits for them to complete. The same context is shared among all
+// clients, so a deadline applies to the whole operation, not to each
+// client.
+//
+// If any of the clients fail to shutdown, an error describing all
+// of the failures is returned.
+func ShutdownAll(ctx context.Context, clients ...Client) error {
+	var mu sync.Mutex
+	var errs shutdownErrors
+	var wg sync.WaitGroup
+
+	wg.Add(len(clients))
+	for _, client := range clients {
+		go func(client Client) {
+			defer wg.Done()
+			if err := client.Shutdown(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+//go:build go1.21
+// +build go1.21
+
+package fluent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const defaultSlogTag = "slog"
+
+// SlogHandler is a slog.Handler that posts each log record to fluentd
+// using a Client. The record is of the form
+//
+//	{"level": "INFO", "message": "...", <attributes>...}
+//
+// and its timestamp is the time of the log record. Groups become nested
+// maps, and attributes whose values are errors, times, or durations are
+// converted to strings. See NewSlogHandler
+type SlogHandler struct {
+	attrs   []groupedAttr
+	client  Client
+	groups  []string
+	level   slog.Leveler
+	name    string
+	nameKey string
+	options []Option
+	tag     string
+}
+
+// groupedAttr is an attribute that was given to WithAttrs, along with
+// the groups that were open at the time
+type groupedAttr struct {
+	attr   slog.Attr
+	groups []string
+}
+
+// NewSlogHandler creates a slog.Handler that posts log records using
+// client. The following options are understood:
+//
+//   - fluent.WithSlogLevel
+//   - fluent.WithSlogNameKey
+//   - fluent.WithSlogTag
+//
+// All other options are passed to client.Post for every log record.
+func NewSlogHandler(client Client, options ...Option) *SlogHandler {
+	h := &SlogHandler{
+		client: client,
+		level:  slog.LevelInfo,
+		tag:    defaultSlogTag,
+	}
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeySlogLevel:
+			h.level = opt.Value().(slog.Leveler)
+		case optkeySlogNameKey:
+			h.nameKey = opt.Value().(string)
+		case optkeySlogTag:
+			h.tag = opt.Value().(string)
+		default:
+			h.options = append(h.options, opt)
+		}
+	}
+	return h
+}
+
+// WithSlogLevel specifies the minimum level of the log records that are
+// posted by a SlogHandler. The default is slog.LevelInfo
+func WithSlogLevel(l slog.Leveler) Option {
+	return &option{
+		name:  optkeySlogLevel,
+		value: l,
+	}
+}
+
+// WithSlogNameKey specifies the attribute that holds the name of the
+// logger, e.g. `logger.With("logger", "db")`. When a log record has a
+// top-level string attribute with that key, it is removed from the
+// record, and the tag becomes "<tag>.<name>", e.g. "slog.db"
+func WithSlogNameKey(key string) Option {
+	return &option{
+		name:  optkeySlogNameKey,
+		value: key,
+	}
+}
+
+// WithSlogTag specifies the tag of the log records posted by a
+// SlogHandler. The default is "slog"
+func WithSlogTag(tag string) Option {
+	return &option{
+		name:  optkeySlogTag,
+		value: tag,
+	}
+}
+
+// Enabled reports whether records of the given level are posted
+func (h *SlogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+// Handle posts r. The error from the client is returned as it is. The
+// record is posted even if ctx has been canceled, e.g. because the
+// request that is being logged has completed, but the values of ctx are
+// still available to the client.
+//
+// The level and the message of r take precedence over top-level
+// attributes named "level" or "message", which are dropped
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	record := make(map[string]interface{})
+
+	name := h.name
+	for _, ga := range h.attrs {
+		addSlogAttr(record, ga.groups, ga.attr)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		if h.isName(a) {
+			name = a.Value.String()
+			return true
+		}
+		addSlogAttr(record, h.groups, a)
+		return true
+	})
+	record["level"] = r.Level.String()
+	record["message"] = r.Message
+
+	tag := h.tag
+	if name != "" {
+		tag += "." + name
+	}
+
+	options := append(h.options[:len(h.options):len(h.options)], WithContext(context.WithoutCancel(ctx)))
+	if !r.Time.IsZero() {
+		options = append(options, WithTimestamp(r.Time))
+	}
+	return h.client.Post(tag, record, options...)
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]groupedAttr(nil), h.attrs...)
+	for _, a := range attrs {
+		if h.isName(a) {
+			h2.name = a.Value.String()
+			continue
+		}
+		h2.attrs = append(h2.attrs, groupedAttr{attr: a, groups: h.groups})
+	}
+	return &h2
+}
+
+// WithGroup returns a handler that puts the attributes that follow in
+// a group of the given name
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.groups = append(h.groups[:len(h.groups):len(h.groups)], name)
+	return &h2
+}
+
+// isName reports whether a holds the name of the logger (see
+// WithSlogNameKey)
+func (h *SlogHandler) isName(a slog.Attr) bool {
+	return h.nameKey != "" && len(h.groups) == 0 && a.Key == h.nameKey && a.Value.Kind() == slog.KindString
+}
+
+// addSlogAttr adds a to record, in the map of the innermost of groups,
+// which are created as necessary
+func addSlogAttr(record map[string]interface{}, groups []string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return
+		}
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range attrs {
+			addSlogAttr(record, groups, ga)
+		}
+		return
+	}
+
+	for _, g := range groups {
+		m, ok := record[g].(map[string]interface{})
+		if !ok {
+			m = make(map[string]interface{})
+			record[g] = m
+		}
+		record = m
+	}
+	record[a.Key] = slogValue(a.Value)
+}
+
+// slogValue converts v to a value that both marshalers can serialize
+func slogValue(v slog.Value) interface{} {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+	}
+	return v.Any()
+}
@@ -0,0 +1,110 @@
+//go:build go1.21
+// +build go1.21
+
+package fluent_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	fluent "github.com/lestrrat/go-fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// A *slog.Logger can be passed to WithLogger as is
+var _ fluent.Logger = (*slog.Logger)(nil)
+
+func TestSlogHandler(t *testing.T) {
+	s, err := newServer(t, true)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	// This is just to stop the server
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+
+	go s.Run(sctx)
+
+	<-s.Ready()
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithBuffered(false),
+		fluent.WithJSONMarshaler(),
+	)
+	if !assert.NoError(t, err, "fluent.New should succeed") {
+		return
+	}
+
+	logger := slog.New(fluent.NewSlogHandler(client,
+		fluent.WithSlogTag("app"),
+		fluent.WithSlogNameKey("logger"),
+	))
+	logger.Debug("not posted")
+	logger.Info("started", "port", 8080)
+	logger.With("logger", "db").WithGroup("query").Warn("slow query",
+		"table", "users",
+		slog.Group("stats", "rows", 10),
+		"err", errors.New("timeout"),
+	)
+
+	// The level and the message are not overwritten by attributes, and
+	// the record is posted even though the context has been canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	logger.InfoContext(ctx, "done", "level", "bogus", "message", "bogus")
+
+	client.Shutdown(nil)
+
+	// timing sensitive :/ we need to give the server enough time to receive
+	// the message before canceling it via scancel
+	time.Sleep(100 * time.Millisecond)
+	scancel()
+	<-s.Done()
+
+	if !assert.Len(t, s.Payload, 3, "expected 3 messages") {
+		return
+	}
+
+	if !assert.Equal(t, "app", s.Payload[0].Tag, "tag should match") {
+		return
+	}
+	expected := map[string]interface{}{
+		"level":   "INFO",
+		"message": "started",
+		"port":    float64(8080),
+	}
+	if !assert.Equal(t, expected, s.Payload[0].Record, "record should match") {
+		return
+	}
+
+	if !assert.Equal(t, "app.db", s.Payload[1].Tag, "tag should include the logger name") {
+		return
+	}
+	expected = map[string]interface{}{
+		"level":   "WARN",
+		"message": "slow query",
+		"query": map[string]interface{}{
+			"table": "users",
+			"stats": map[string]interface{}{"rows": float64(10)},
+			"err":   "timeout",
+		},
+	}
+	if !assert.Equal(t, expected, s.Payload[1].Record, "record should match") {
+		return
+	}
+
+	expected = map[string]interface{}{
+		"level":   "INFO",
+		"message": "done",
+	}
+	if !assert.Equal(t, expected, s.Payload[2].Record, "record should match") {
+		return
+	}
+}
@@ -0,0 +1,376 @@
+package fluent
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The format of the buffer file is versioned, so that the messages that
+// were left in it can still be salvaged by a later version of the client
+// (see OpenBufferFile). Version 1 starts with a header:
+//
+//	[4]byte "FBUF"
+//	uint8   format version
+//	[3]byte reserved, always zero
+//	int64   offset of the first message that has not been written to
+//	        the server yet
+//
+// It is followed by the messages, each of which is stored as a record:
+//
+//	uint32  length of the rest of the record
+//	uint8   1 if the message has subsecond resolution
+//	int64   timestamp, in nanoseconds (only used by the HTTP transport)
+//	uint16  length of the tag, followed by the tag
+//	uint8   length of the chunk ID, followed by the chunk ID
+//	...     the serialized message, as it is held in the pending buffer
+//
+// All integers are big endian.
+const (
+	spoolMagic            = "FBUF"
+	spoolVersion          = 1
+	spoolHeaderSize       = 16
+	spoolRecordHeaderSize = 4
+	spoolMaxRecordSize    = 1 << 30
+	spoolCompactSize      = 1 << 20 // see compact
+)
+
+// spool is the Buffer that persists the pending messages to a file (see
+// NewFileBuffer).
+//
+// The records between head and next have been read, and the ones between
+// next and size have not. Once the messages that were read have been
+// written to the server, head moves past them, and the file is truncated
+// when there is nothing left in it, or compacted when enough space can be
+// reclaimed before head
+type spool struct {
+	file   *os.File
+	limit  int64 // max size of the messages between head and size, 0 for none
+	size   int64
+	head   int64
+	next   int64
+	count  int   // number of messages between head and size
+	loaded []int // sizes of the records between head and next
+}
+
+// NewFileBuffer returns a Buffer that stores the messages in the file at
+// path, which is created if necessary. The messages that a previous
+// process left in the file are kept, and come first. If limit is
+// positive, the messages that have not been written to the server yet
+// take up no more than limit bytes in the file. The space taken by the
+// ones that have been written is reclaimed as the file grows, so that the
+// file stays under twice that size.
+//
+// The format of the file is documented, and its contents can be read
+// with OpenBufferFile. See also WithBufferFile.
+func NewFileBuffer(path string, limit int) (Buffer, error) {
+	if limit < 0 {
+		return nil, errors.Errorf(`invalid buffer file limit: %d`, limit)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to open buffer file`)
+	}
+
+	s := &spool{
+		file:  f,
+		limit: int64(limit),
+	}
+	if err := s.scan(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, `failed to read buffer file %s`, path)
+	}
+	return s, nil
+}
+
+// scan finds the messages that have not been written to the server
+// yet. A record that was only partially written, e.g. because the process
+// crashed, is discarded along with anything after it
+func (s *spool) scan() error {
+	fi, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = fi.Size()
+
+	// The file is either new, or the process crashed while resetting it
+	if s.size < spoolHeaderSize {
+		return s.reset()
+	}
+
+	s.head, err = readSpoolHeader(s.file, s.size)
+	if err != nil {
+		return err
+	}
+
+	s.count = 0
+	for offset := s.head; offset < s.size; s.count++ {
+		_, n, err := s.readAt(offset)
+		if err != nil {
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			s.size = offset
+			break
+		}
+		offset += int64(n)
+	}
+
+	s.next = s.head
+	if s.head == s.size {
+		return s.reset()
+	}
+	return nil
+}
+
+// reset empties the file
+func (s *spool) reset() error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.size = spoolHeaderSize
+	s.head = spoolHeaderSize
+	s.next = spoolHeaderSize
+	s.count = 0
+	s.loaded = s.loaded[:0]
+	return s.writeHeader()
+}
+
+func (s *spool) writeHeader() error {
+	var header [spoolHeaderSize]byte
+	copy(header[:], spoolMagic)
+	header[4] = spoolVersion
+	binary.BigEndian.PutUint64(header[8:], uint64(s.head))
+	_, err := s.file.WriteAt(header[:], 0)
+	return err
+}
+
+// readSpoolHeader checks the header of a buffer file of the given size,
+// and returns the offset of the first message that has not been written
+func readSpoolHeader(f *os.File, size int64) (int64, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != spoolMagic {
+		return 0, errors.New(`not a buffer file`)
+	}
+	if header[4] != spoolVersion {
+		return 0, errors.Errorf(`unsupported buffer file version %d`, header[4])
+	}
+
+	head := int64(binary.BigEndian.Uint64(header[8:]))
+	if head < spoolHeaderSize || head > size {
+		return 0, errors.Errorf(`invalid offset %d in header`, head)
+	}
+	return head, nil
+}
+
+// Write appends a message to the end of the file
+func (s *spool) Write(msg *BufferedMessage) error {
+	if len(msg.Tag) > 0xffff {
+		return errors.Errorf(`tag is too long for the buffer file (%d bytes)`, len(msg.Tag))
+	}
+	if len(msg.Chunk) > 0xff {
+		return errors.Errorf(`chunk ID is too long for the buffer file (%d bytes)`, len(msg.Chunk))
+	}
+	rec := encodeSpoolRecord(msg)
+	if len(rec) > spoolMaxRecordSize {
+		return errors.Errorf(`message is too large for the buffer file (%d bytes)`, len(msg.Data))
+	}
+	// The messages that have been written to the server, but are still
+	// in the file, do not count
+	used := spoolHeaderSize + s.size - s.head
+	if s.limit > 0 && used+int64(len(rec)) > s.limit {
+		return &BufferFullError{
+			Size:        int(used),
+			Limit:       int(s.limit),
+			MessageSize: len(rec),
+		}
+	}
+	if s.limit > 0 && s.size+int64(len(rec)) > s.limit && s.canCompact() {
+		if err := s.compact(); err != nil {
+			return errors.Wrap(err, `failed to compact buffer file`)
+		}
+	}
+
+	if _, err := s.file.WriteAt(rec, s.size); err != nil {
+		// Whatever made it to the file is overwritten by the next record
+		return errors.Wrap(err, `failed to write to buffer file`)
+	}
+	s.size += int64(len(rec))
+	s.count++
+	return nil
+}
+
+// Read returns the message that follows the last one that was read
+func (s *spool) Read() (*BufferedMessage, error) {
+	if s.next >= s.size {
+		return nil, io.EOF
+	}
+
+	msg, n, err := s.readAt(s.next)
+	if err != nil {
+		return nil, err
+	}
+	s.next += int64(n)
+	s.loaded = append(s.loaded, n)
+	return msg, nil
+}
+
+// Len returns the number of messages in the file
+func (s *spool) Len() int {
+	return s.count
+}
+
+// Truncate discards the n oldest messages, which have been written to
+// the server, or given up on
+func (s *spool) Truncate(n int) error {
+	if n > len(s.loaded) {
+		return errors.Errorf(`cannot truncate %d messages, only %d have been read`, n, len(s.loaded))
+	}
+	if n == 0 {
+		return nil
+	}
+
+	for _, size := range s.loaded[:n] {
+		s.head += int64(size)
+	}
+	s.loaded = s.loaded[n:]
+	s.count -= n
+	if s.head >= s.size {
+		return s.reset()
+	}
+	if s.head-spoolHeaderSize >= spoolCompactSize && s.canCompact() {
+		return s.compact()
+	}
+	return s.writeHeader()
+}
+
+// canCompact reports whether the messages that have been written to the
+// server take up more space than the ones that have not (see compact)
+func (s *spool) canCompact() bool {
+	return s.head-spoolHeaderSize >= s.size-s.head+spoolRecordHeaderSize
+}
+
+// compact moves the messages that have not been written to the server to
+// the start of the file, and truncates it, to reclaim the space taken by
+// the ones before them. This is only done if canCompact, so that nothing
+// is overwritten before the header points to the new location of the
+// messages, should the process crash in the middle of it
+func (s *spool) compact() error {
+	live := s.size - s.head
+	shift := s.head - spoolHeaderSize
+
+	buf := make([]byte, 32*1024)
+	for offset := int64(0); offset < live; {
+		n := int64(len(buf))
+		if live-offset < n {
+			n = live - offset
+		}
+		if _, err := s.file.ReadAt(buf[:n], s.head+offset); err != nil {
+			return err
+		}
+		if _, err := s.file.WriteAt(buf[:n], spoolHeaderSize+offset); err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	// A record of length zero ends the messages, in case we crash before
+	// the file is truncated (see scan)
+	var end [spoolRecordHeaderSize]byte
+	if _, err := s.file.WriteAt(end[:], spoolHeaderSize+live); err != nil {
+		return err
+	}
+
+	s.head = spoolHeaderSize
+	if err := s.writeHeader(); err != nil {
+		s.head += shift
+		return err
+	}
+	s.next -= shift
+	s.size = spoolHeaderSize + live
+	return s.file.Truncate(s.size)
+}
+
+// Close closes the file. The messages that are still in it are left for
+// the next process
+func (s *spool) Close() error {
+	return s.file.Close()
+}
+
+// readAt reads the record at offset, and returns the size of the record
+func (s *spool) readAt(offset int64) (*BufferedMessage, int, error) {
+	var header [spoolRecordHeaderSize]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length > spoolMaxRecordSize || offset+spoolRecordHeaderSize+length > s.size {
+		return nil, 0, errors.New(`truncated record`)
+	}
+
+	rec := make([]byte, length)
+	if _, err := s.file.ReadAt(rec, offset+spoolRecordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+
+	msg, err := decodeSpoolRecord(rec)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msg, spoolRecordHeaderSize + len(rec), nil
+}
+
+func encodeSpoolRecord(msg *BufferedMessage) []byte {
+	length := 1 + 8 + 2 + len(msg.Tag) + 1 + len(msg.Chunk) + len(msg.Data)
+	rec := make([]byte, spoolRecordHeaderSize, spoolRecordHeaderSize+length)
+	binary.BigEndian.PutUint32(rec, uint32(length))
+
+	if msg.Subsecond {
+		rec = append(rec, 1)
+	} else {
+		rec = append(rec, 0)
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(msg.Time.UnixNano()))
+	rec = append(rec, buf[:]...)
+	binary.BigEndian.PutUint16(buf[:], uint16(len(msg.Tag)))
+	rec = append(rec, buf[:2]...)
+	rec = append(rec, msg.Tag...)
+	rec = append(rec, byte(len(msg.Chunk)))
+	rec = append(rec, msg.Chunk...)
+	return append(rec, msg.Data...)
+}
+
+func decodeSpoolRecord(rec []byte) (*BufferedMessage, error) {
+	if len(rec) < 1+8+2 {
+		return nil, errors.New(`record is too short`)
+	}
+	var msg BufferedMessage
+	msg.Subsecond = rec[0] == 1
+	msg.Time = time.Unix(0, int64(binary.BigEndian.Uint64(rec[1:9])))
+	rec = rec[9:]
+
+	l := int(binary.BigEndian.Uint16(rec))
+	rec = rec[2:]
+	if len(rec) < l+1 {
+		return nil, errors.New(`record is too short`)
+	}
+	msg.Tag = string(rec[:l])
+	rec = rec[l:]
+
+	l = int(rec[0])
+	rec = rec[1:]
+	if len(rec) < l {
+		return nil, errors.New(`record is too short`)
+	}
+	msg.Chunk = string(rec[:l])
+	msg.Data = rec[l:]
+	return &msg, nil
+}
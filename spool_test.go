@@ -0,0 +1,194 @@
+package fluent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+
+	// Files in an unknown format are left alone
+	if !assert.NoError(t, ioutil.WriteFile(path, []byte("0123456789abcdef"), 0600), "WriteFile should succeed") {
+		return
+	}
+	if _, err := NewFileBuffer(path, 0); !assert.Error(t, err, "NewFileBuffer should fail") {
+		return
+	}
+	os.Remove(path)
+
+	b, err := NewFileBuffer(path, 0)
+	if !assert.NoError(t, err, "NewFileBuffer should succeed") {
+		return
+	}
+
+	msg := BufferedMessage{Tag: "tag", Chunk: "chunk", Time: time.Unix(1482493046, 0), Subsecond: true}
+	for _, data := range []string{"first", "second"} {
+		msg.Data = []byte(data)
+		if !assert.NoError(t, b.Write(&msg), "Write should succeed") {
+			return
+		}
+	}
+	if !assert.Equal(t, 2, b.Len(), "buffer should hold both messages") {
+		return
+	}
+
+	if _, err := b.Read(); !assert.NoError(t, err, "Read should succeed") {
+		return
+	}
+	if !assert.Error(t, b.Truncate(2), "unread messages should not be truncated") {
+		return
+	}
+
+	// Once the first message has been written, only the second one is
+	// left for the next process. A partial record at the end is dropped
+	if !assert.NoError(t, b.Truncate(1), "Truncate should succeed") {
+		return
+	}
+	s := b.(*spool)
+	if _, err := s.file.WriteAt([]byte{0, 0, 1, 0, 1}, s.size); !assert.NoError(t, err, "WriteAt should succeed") {
+		return
+	}
+	b.Close()
+
+	b, err = NewFileBuffer(path, 0)
+	if !assert.NoError(t, err, "NewFileBuffer should succeed") {
+		return
+	}
+	defer b.Close()
+	if !assert.Equal(t, 1, b.Len(), "partial record should be dropped") {
+		return
+	}
+
+	read, err := b.Read()
+	if !assert.NoError(t, err, "Read should succeed") {
+		return
+	}
+	if !assert.Equal(t, "second", string(read.Data), "second message should be recovered") ||
+		!assert.Equal(t, "tag", read.Tag, "tag should be restored") ||
+		!assert.Equal(t, "chunk", read.Chunk, "chunk should be restored") ||
+		!assert.True(t, read.Time.Equal(msg.Time), "time should be restored") ||
+		!assert.True(t, read.Subsecond, "subsecond should be restored") {
+		return
+	}
+	if _, err := b.Read(); !assert.Equal(t, io.EOF, err, "Read should return io.EOF") {
+		return
+	}
+
+	if !assert.NoError(t, b.Truncate(1), "Truncate should succeed") {
+		return
+	}
+	fi, err := os.Stat(path)
+	if !assert.NoError(t, err, "os.Stat should succeed") {
+		return
+	}
+	if !assert.Equal(t, int64(spoolHeaderSize), fi.Size(), "file should be truncated") {
+		return
+	}
+
+	t.Run("limit", func(t *testing.T) {
+		s := b.(*spool)
+		s.limit = s.size + int64(len(encodeSpoolRecord(&msg)))
+		if !assert.NoError(t, b.Write(&msg), "Write should succeed") {
+			return
+		}
+		if !assert.True(t, IsBufferFull(b.Write(&msg)), "Write should fail with a buffer full error") {
+			return
+		}
+	})
+}
+
+func TestFileBufferCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-")
+	if !assert.NoError(t, err, "ioutil.TempDir should succeed") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buffer")
+
+	msg := BufferedMessage{Tag: "tag", Time: time.Unix(1482493046, 0)}
+	message := func(i int) *BufferedMessage {
+		msg := msg
+		msg.Data = []byte(fmt.Sprintf("message %04d", i))
+		return &msg
+	}
+	recordSize := len(encodeSpoolRecord(message(0)))
+	limit := spoolHeaderSize + 4*recordSize
+
+	b, err := NewFileBuffer(path, limit)
+	if !assert.NoError(t, err, "NewFileBuffer should succeed") {
+		return
+	}
+
+	// The buffer never drains, but far more than limit bytes go through it
+	var written, read int
+	for ; written < 2; written++ {
+		if !assert.NoError(t, b.Write(message(written)), "Write should succeed") {
+			return
+		}
+	}
+	for round := 0; round < 50; round++ {
+		for i := 0; i < 2; i++ {
+			if !assert.NoError(t, b.Write(message(written)), "Write should succeed") {
+				return
+			}
+			written++
+		}
+		for i := 0; i < 2; i++ {
+			got, err := b.Read()
+			if !assert.NoError(t, err, "Read should succeed") {
+				return
+			}
+			if !assert.Equal(t, message(read).Data, got.Data, "messages should be read in order") {
+				return
+			}
+			read++
+		}
+		if !assert.NoError(t, b.Truncate(2), "Truncate should succeed") {
+			return
+		}
+
+		fi, err := os.Stat(path)
+		if !assert.NoError(t, err, "os.Stat should succeed") {
+			return
+		}
+		if !assert.True(t, fi.Size() < int64(2*limit), "file should be compacted") {
+			return
+		}
+	}
+	if !assert.Equal(t, 2, b.Len(), "unread messages should be left") {
+		return
+	}
+	b.Close()
+
+	// The messages that are left survive compaction
+	b, err = NewFileBuffer(path, limit)
+	if !assert.NoError(t, err, "NewFileBuffer should succeed") {
+		return
+	}
+	defer b.Close()
+	if !assert.Equal(t, 2, b.Len(), "unread messages should be recovered") {
+		return
+	}
+	for ; read < written; read++ {
+		got, err := b.Read()
+		if !assert.NoError(t, err, "Read should succeed") {
+			return
+		}
+		if !assert.Equal(t, message(read).Data, got.Data, "messages should be recovered in order") {
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package fluent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the activity of a client, meant to be exported
+// to monitoring systems. The totals are counted from the creation of the
+// client.
+type Stats struct {
+	Queued       int    // messages posted, but not appended to the buffer yet
+	PendingBytes int    // bytes in the buffer that have not been written yet
+	Posted       uint64 // messages that the client accepted
+	Flushed      uint64 // messages written to the server (and acknowledged, if acks are required)
+	Dropped      uint64 // messages that were accepted, but will never be written
+	Reconnects   uint64 // times a connection was established again after it was lost to an error
+	Retries      uint64 // attempts to connect or write to the server that failed, and were tried again
+	WriteLatency Histogram
+	LastError    error // see LastError
+
+	// DroppedAfterRetry is the number of messages that were dropped
+	// because their chunk failed too many times (see WithMaxRetries).
+	// They are also counted in Dropped
+	DroppedAfterRetry uint64
+
+	// DroppedCallbacks is the number of calls to the callbacks of the
+	// client (see WithErrorHandler) that were dropped, because too many
+	// were already waiting to be made
+	DroppedCallbacks uint64
+
+	// InflightBytes is the number of bytes of PendingBytes that are being
+	// written to the server, or waiting for their ack (see WithRequireAck)
+	InflightBytes int
+
+	// ServerDisconnects is the number of connections that the server
+	// closed while the client was using them. Only the buffered client
+	// watches its connections, so this is always 0 for the unbuffered one
+	ServerDisconnects uint64
+}
+
+// Histogram is the distribution of the time taken by the writes that
+// succeeded, from the time the oldest message of the write was handed
+// over to the buffer until the write completed (or was acknowledged, if
+// acks are required). This includes the time that the message waited in
+// the buffer, and any failed attempts to write it. The unbuffered client
+// has no buffer, so it measures from the start of the write. Counts[i] is
+// the number of writes that took at most Buckets[i], so the counts are
+// cumulative, as in a Prometheus histogram
+type Histogram struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []time.Duration
+	Counts  []uint64
+}
+
+// latencyBuckets are the upper bounds of the buckets of the write latency
+// histogram
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// counters holds the totals of Stats. It is always allocated on its own,
+// so that the counters are aligned for atomic access on 32 bit platforms
+type counters struct {
+	posted       uint64
+	flushed      uint64
+	dropped      uint64
+	reconnects   uint64
+	retries      uint64
+	callbacks    uint64 // dropped, see callbackQueue
+	retryDrops   uint64 // see failChunk
+	disconnects  uint64 // see countServerDisconnect
+	writes       uint64
+	writeNanos   uint64
+	writeBuckets [len(latencyBuckets)]uint64
+}
+
+func (c *counters) addPosted(n int) {
+	atomic.AddUint64(&c.posted, uint64(n))
+}
+
+func (c *counters) addFlushed(n int) {
+	atomic.AddUint64(&c.flushed, uint64(n))
+}
+
+func (c *counters) addDropped(n int) {
+	atomic.AddUint64(&c.dropped, uint64(n))
+}
+
+func (c *counters) addReconnect() {
+	atomic.AddUint64(&c.reconnects, 1)
+}
+
+func (c *counters) addRetry() {
+	atomic.AddUint64(&c.retries, 1)
+}
+
+func (c *counters) addDroppedAfterRetry(n int) {
+	atomic.AddUint64(&c.retryDrops, uint64(n))
+}
+
+func (c *counters) addServerDisconnect() {
+	atomic.AddUint64(&c.disconnects, 1)
+}
+
+func (c *counters) addDroppedCallback() {
+	atomic.AddUint64(&c.callbacks, 1)
+}
+
+// observeWrite records a write that succeeded after d
+func (c *counters) observeWrite(d time.Duration) {
+	atomic.AddUint64(&c.writes, 1)
+	atomic.AddUint64(&c.writeNanos, uint64(d))
+	for i, b := range latencyBuckets {
+		if d <= b {
+			atomic.AddUint64(&c.writeBuckets[i], 1)
+		}
+	}
+}
+
+// snapshot returns the totals in a Stats, for the caller to fill in the
+// rest
+func (c *counters) snapshot() Stats {
+	s := Stats{
+		Posted:            atomic.LoadUint64(&c.posted),
+		Flushed:           atomic.LoadUint64(&c.flushed),
+		Dropped:           atomic.LoadUint64(&c.dropped),
+		Reconnects:        atomic.LoadUint64(&c.reconnects),
+		Retries:           atomic.LoadUint64(&c.retries),
+		DroppedAfterRetry: atomic.LoadUint64(&c.retryDrops),
+		DroppedCallbacks:  atomic.LoadUint64(&c.callbacks),
+		ServerDisconnects: atomic.LoadUint64(&c.disconnects),
+		WriteLatency: Histogram{
+			Count:   atomic.LoadUint64(&c.writes),
+			Sum:     time.Duration(atomic.LoadUint64(&c.writeNanos)),
+			Buckets: append([]time.Duration(nil), latencyBuckets[:]...),
+			Counts:  make([]uint64, len(latencyBuckets)),
+		},
+	}
+	for i := range c.writeBuckets {
+		s.WriteLatency.Counts[i] = atomic.LoadUint64(&c.writeBuckets[i])
+	}
+	return s
+}
+
+// stats returns a snapshot of the activity of the minion
+func (m *minion) stats() Stats {
+	s := m.counters.snapshot()
+	s.Queued = len(m.incoming)
+	m.muPending.RLock()
+	s.PendingBytes = len(m.pending) + m.inflight
+	s.InflightBytes = m.writing + m.inflight
+	m.muPending.RUnlock()
+	s.LastError = m.getLastError()
+	return s
+}
@@ -7,10 +7,52 @@ import (
 	"github.com/pkg/errors"
 )
 
+// TimestampResolution specifies the granularity of the timestamps that
+// are sent to the server
+type TimestampResolution int
+
+const (
+	// TimestampSeconds sends timestamps as integers (the default)
+	TimestampSeconds TimestampResolution = iota
+	// TimestampMilliseconds sends timestamps as EventTime, truncated to
+	// milliseconds
+	TimestampMilliseconds
+	// TimestampNanoseconds sends timestamps as EventTime
+	TimestampNanoseconds
+)
+
+// resolutionFromSubsecond converts the value given to WithSubsecond
+func resolutionFromSubsecond(b bool) TimestampResolution {
+	if b {
+		return TimestampNanoseconds
+	}
+	return TimestampSeconds
+}
+
+// eventTimeErr is non-nil if EventTime could not be registered as a
+// msgpack extension type, in which case subsecond timestamps can't be
+// encoded, and we fall back to integer timestamps
+var eventTimeErr error
+
 func init() {
 	if err := msgpack.RegisterExt(0, EventTime{}); err != nil {
-		panic(err)
+		eventTimeErr = errors.Wrap(err, `failed to register EventTime as msgpack extension`)
+	}
+}
+
+// subsecondAvailable returns true if subsecond timestamps can be encoded
+func subsecondAvailable() bool {
+	return eventTimeErr == nil
+}
+
+// warnSubsecondFallback warns through the logger of a client that was
+// asked for subsecond timestamps that they can't be encoded, and that
+// integer timestamps are sent instead
+func warnSubsecondFallback(logger Logger, resolution TimestampResolution) {
+	if resolution == TimestampSeconds || subsecondAvailable() {
+		return
 	}
+	logger.Warn("subsecond timestamps are not available, falling back to integer timestamps", "error", eventTimeErr)
 }
 
 // DecodeMsgpack decodes from a msgpack stream and materializes
@@ -0,0 +1,121 @@
+package fluent
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	msgpack "github.com/lestrrat/go-msgpack"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubsecondFallback(t *testing.T) {
+	// Simulate a msgpack library that does not support EventTime
+	eventTimeErr = errors.New(`unsupported`)
+	defer func() { eventTimeErr = nil }()
+
+	t.Run("fallback", func(t *testing.T) {
+		ts := time.Unix(1482493046, 123456789).UTC()
+		msg := makeMessage("tag_name", "hello", ts, TimestampNanoseconds, false)
+		defer releaseMessage(msg)
+
+		buf, err := msgpackMarshal(msg)
+		if !assert.NoError(t, err, "msgpackMarshal should succeed") {
+			return
+		}
+
+		var decoded Message
+		if !assert.NoError(t, msgpack.Unmarshal(buf, &decoded), "msgpack.Unmarshal should succeed") {
+			return
+		}
+
+		if !assert.Equal(t, time.Unix(1482493046, 0).UTC(), decoded.Time.Time, "time should be truncated to seconds") {
+			return
+		}
+	})
+
+	t.Run("warning", func(t *testing.T) {
+		for _, buffered := range []bool{true, false} {
+			logger := &warnLogger{}
+			client, err := New(
+				WithBuffered(buffered),
+				WithSubsecond(true),
+				WithLogger(logger),
+			)
+			if !assert.NoError(t, err, "New should succeed") {
+				return
+			}
+			client.Close()
+
+			if !assert.Equal(t, []string{"subsecond timestamps are not available, falling back to integer timestamps"}, logger.warnings, "the fallback should be logged through the client logger") {
+				return
+			}
+		}
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		for _, buffered := range []bool{true, false} {
+			client, err := New(
+				WithBuffered(buffered),
+				WithSubsecond(true),
+				WithSubsecondStrict(true),
+			)
+			if !assert.Error(t, err, "New should fail") {
+				client.Close()
+				return
+			}
+		}
+	})
+}
+
+// warnLogger records the warnings that are logged
+type warnLogger struct {
+	nopLogger
+	warnings []string
+}
+
+func (l *warnLogger) Warn(msg string, args ...interface{}) {
+	l.warnings = append(l.warnings, msg)
+}
+
+func TestTimestampResolution(t *testing.T) {
+	ts := time.Unix(1482493046, 123456789).UTC()
+
+	var testcases = []struct {
+		resolution TimestampResolution
+		eventTime  bool
+		expected   time.Time
+	}{
+		{resolution: TimestampSeconds, eventTime: false, expected: time.Unix(1482493046, 0).UTC()},
+		{resolution: TimestampMilliseconds, eventTime: true, expected: time.Unix(1482493046, 123000000).UTC()},
+		{resolution: TimestampNanoseconds, eventTime: true, expected: ts},
+	}
+
+	for _, tc := range testcases {
+		t.Run(strconv.Itoa(int(tc.resolution)), func(t *testing.T) {
+			msg := makeMessage("tag_name", "hello", ts, tc.resolution, false)
+			defer releaseMessage(msg)
+
+			buf, err := msgpackMarshal(msg)
+			if !assert.NoError(t, err, "msgpackMarshal should succeed") {
+				return
+			}
+
+			// fixarray(4), fixstr(8) "tag_name", then the time field
+			code := msgpack.Code(buf[1+1+len("tag_name")])
+			if !assert.Equal(t, tc.eventTime, msgpack.IsExtFamily(code), "time field should be encoded as EventTime: %t", tc.eventTime) {
+				return
+			}
+
+			var decoded Message
+			if !assert.NoError(t, msgpack.Unmarshal(buf, &decoded), "msgpack.Unmarshal should succeed") {
+				return
+			}
+
+			if !assert.Equal(t, tc.expected, decoded.Time.Time, "time should match") {
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package fluent
+
+// WriteTracer is notified of each write that the background writer of a
+// buffered client makes to the server (see WithWriteTracer). It allows
+// the writes to be traced and measured without this package depending on
+// a particular instrumentation library. The fluentotel subpackage
+// provides an implementation for OpenTelemetry.
+type WriteTracer interface {
+	// StartWrite is called right before the write described by info. The
+	// returned function is called once the write has completed (and has
+	// been acknowledged, if acks are required), with the error if it
+	// failed. Both are called from the background writer, so they
+	// should not block
+	StartWrite(info WriteInfo) func(error)
+}
+
+// WriteInfo describes a write to the server
+type WriteInfo struct {
+	Network  string // network of the server, as given by WithNetwork
+	Address  string // address of the server being written to
+	Chunk    string // chunk ID of the messages, if any (see WithRequireAck)
+	Messages int    // number of messages being written
+	Bytes    int    // number of bytes being written
+	Attempt  int    // 1, plus the number of attempts that failed in a row before this one
+}
+
+// writeTarget identifies where the background writer is writing to, and
+// how many attempts to write there failed in a row, for the write tracer
+type writeTarget struct {
+	address string
+	attempt int
+}
+
+func noopWriteDone(error) {}
+
+// traceWrite notifies the write tracer, if any, that messages of the given
+// size are about to be written to target, and returns the function to call
+// once the write has completed
+func (m *minion) traceWrite(target writeTarget, chunk string, messages, size int) func(error) {
+	if m.writeTracer == nil {
+		return noopWriteDone
+	}
+	done := m.writeTracer.StartWrite(WriteInfo{
+		Network:  m.network,
+		Address:  target.address,
+		Chunk:    chunk,
+		Messages: messages,
+		Bytes:    size,
+		Attempt:  target.attempt,
+	})
+	if done == nil {
+		return noopWriteDone
+	}
+	return done
+}
@@ -2,11 +2,11 @@ package fluent
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"time"
 
-	pdebug "github.com/lestrrat/go-pdebug"
 	"github.com/pkg/errors"
 )
 
@@ -15,63 +15,238 @@ import (
 // synchronously, and does not attempt to buffer the payload.
 //
 //    * fluent.WithAddress
+//    * fluent.WithAddresses
+//    * fluent.WithCircuitBreaker
+//    * fluent.WithClock
+//    * fluent.WithClientCertificate
+//    * fluent.WithConn
+//    * fluent.WithConnFactory
+//    * fluent.WithConnectHook
+//    * fluent.WithDialFunc
 //    * fluent.WithDialTimeout
+//    * fluent.WithExpvar
+//    * fluent.WithFallbackInterval
+//    * fluent.WithLengthPrefix
+//    * fluent.WithLogger
 //    * fluent.WithMarshaler
 //    * fluent.WithMaxConnAttempts
+//    * fluent.WithMaxConnLifetime
 //    * fluent.WithNetwork
+//    * fluent.WithOnConnect
+//    * fluent.WithOnDisconnect
+//    * fluent.WithOnReconnect
+//    * fluent.WithPassword
+//    * fluent.WithPostTimeout
+//    * fluent.WithProxy
+//    * fluent.WithRecordModifier
+//    * fluent.WithSelfHostname
+//    * fluent.WithSendBufferSize
+//    * fluent.WithSharedKey
+//    * fluent.WithSRV
 //    * fluent.WithSubSecond
 //    * fluent.WithTagPrefix
+//    * fluent.WithTCPKeepAlive
+//    * fluent.WithTCPNoDelay
+//    * fluent.WithTimestampExtractor
+//    * fluent.WithTimestampResolution
+//    * fluent.WithTLSConfig
+//    * fluent.WithUsername
+//    * fluent.WithWriteDeadline
 //
 // Please see their respective documentation for details.
 func NewUnbuffered(options ...Option) (client *Unbuffered, err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("fluent.NewUnbuffered").BindError(&err)
-		defer g.End()
-	}
-
 	var c = &Unbuffered{
-		address:         "127.0.0.1:24224",
-		dialTimeout:     3 * time.Second,
-		maxConnAttempts: 64,
-		marshaler:       marshalFunc(msgpackMarshal),
-		network:         "tcp",
-		writeTimeout:    3 * time.Second,
+		address:          "127.0.0.1:24224",
+		clock:            time.Now,
+		counters:         &counters{},
+		dialTimeout:      3 * time.Second,
+		fallbackInterval: time.Minute,
+		logger:           nopLogger{},
+		maxConnAttempts:  64,
+		marshaler:        msgpackMarshaler{},
+		network:          "tcp",
+		tcp:              defaultTCPOptions(),
+		writeTimeout:     3 * time.Second,
 	}
 
 	var connectOnStart bool
+	var clientCert *clientCertificate
+	var proxyURL string
+	var addresses []string
+	var srvName string
+	var breakerConfig *circuitBreakerConfig
+	var expvarName string
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyAddress:
 			c.address = opt.Value().(string)
+			addresses = nil
+			srvName = ""
+		case optkeyAddresses:
+			addresses = opt.Value().([]string)
+			srvName = ""
+		case optkeySRV:
+			srvName = opt.Value().(string)
+		case optkeyFallbackInterval:
+			c.fallbackInterval = opt.Value().(time.Duration)
+		case optkeyCircuitBreaker:
+			breakerConfig = opt.Value().(*circuitBreakerConfig)
+		case optkeyClientCertificate:
+			clientCert = opt.Value().(*clientCertificate)
+		case optkeyConnectHook:
+			c.connectHook = opt.Value().(func(net.Conn) error)
+		case optkeyOnConnect:
+			c.events.onConnect = opt.Value().(func(string))
+		case optkeyOnDisconnect:
+			c.events.onDisconnect = opt.Value().(func(string, error))
+		case optkeyOnReconnect:
+			c.events.onReconnect = opt.Value().(func(string, time.Duration))
+		case optkeyDialFunc:
+			c.dialFunc = opt.Value().(func(context.Context, string, string) (net.Conn, error))
 		case optkeyDialTimeout:
 			c.dialTimeout = opt.Value().(time.Duration)
+		case optkeyWriteDeadline:
+			c.writeTimeout = opt.Value().(time.Duration)
+		case optkeyLengthPrefix:
+			c.lengthPrefix = opt.Value().(bool)
+		case optkeyLogger:
+			c.logger = opt.Value().(Logger)
 		case optkeyMarshaler:
 			c.marshaler = opt.Value().(marshaler)
 		case optkeyMaxConnAttempts:
 			c.maxConnAttempts = opt.Value().(uint64)
+		case optkeyMaxConnLifetime:
+			c.maxConnLifetime = opt.Value().(time.Duration)
+		case optkeyRecordModifier:
+			c.recordModifier = opt.Value().(func(string, interface{}) interface{})
 		case optkeyNetwork:
 			v := opt.Value().(string)
 			switch v {
-			case "tcp", "unix":
+			case "tcp", "unix", "http", "udp", "unixgram", "npipe":
 			default:
 				return nil, errors.Errorf(`invalid network type: %s`, v)
 			}
 			c.network = v
 		case optkeySubSecond:
-			c.subsecond = opt.Value().(bool)
+			c.resolution = resolutionFromSubsecond(opt.Value().(bool))
+		case optkeyTimestampResolution:
+			c.resolution = opt.Value().(TimestampResolution)
+		case optkeyPassword:
+			c.handshake.password = opt.Value().(string)
+		case optkeyPostTimeout:
+			c.postTimeout = opt.Value().(time.Duration)
+		case optkeySelfHostname:
+			c.handshake.selfHostname = opt.Value().(string)
+		case optkeySharedKey:
+			c.handshake.sharedKey = opt.Value().(string)
+		case optkeyUsername:
+			c.handshake.username = opt.Value().(string)
 		case optkeyTagPrefix:
 			c.tagPrefix = opt.Value().(string)
+		case optkeyTCPKeepAlive:
+			c.tcp.keepAlive = opt.Value().(time.Duration)
+		case optkeyTCPNoDelay:
+			c.tcp.noDelay = opt.Value().(bool)
+		case optkeySendBufferSize:
+			c.tcp.sendBufferSize = opt.Value().(int)
+		case optkeyTLSConfig:
+			c.tlsConfig = opt.Value().(*tls.Config)
+		case optkeyTimestampExtractor:
+			c.timeExtractor = opt.Value().(func(interface{}) (time.Time, bool))
+		case optkeyClock:
+			c.clock = opt.Value().(func() time.Time)
+		case optkeyExpvar:
+			expvarName = opt.Value().(string)
 		case optkeyConnectOnStart:
 			connectOnStart = opt.Value().(bool)
+		case optkeyProxy:
+			proxyURL = opt.Value().(string)
+		}
+	}
+
+	// This is done after all options have been processed, so that it
+	// does not matter whether WithTLSConfig comes before or after
+	if clientCert != nil {
+		c.tlsConfig = clientCert.apply(c.tlsConfig)
+	}
+
+	if err := c.handshake.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	c.events.logger = c.logger
+	warnSubsecondFallback(c.logger, c.resolution)
+
+	c.breaker, err = newCircuitBreaker(breakerConfig, c.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// The proxy dialer wraps whatever dial function has been specified,
+	// so this is also done after all options have been processed
+	if len(proxyURL) > 0 {
+		if c.network != "tcp" && c.network != "http" {
+			return nil, errors.Errorf(`network %s can not be used through a proxy`, c.network)
+		}
+		d, err := newProxyDialer(proxyURL, c.dialFunc)
+		if err != nil {
+			return nil, err
 		}
+		c.dialFunc = d.dial
 	}
 
-	if connectOnStart {
-		if _, err := c.connect(true); err != nil {
+	if len(srvName) > 0 {
+		c.servers = newSRVServerList(srvName, c.logger)
+	} else {
+		if addresses == nil {
+			addresses = []string{c.address}
+		} else if len(addresses) > 0 {
+			c.address = addresses[0]
+		}
+		c.servers, err = newServerList(addresses, nil, "", c.fallbackInterval, c.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.network == "http" {
+		if len(addresses) > 1 || len(srvName) > 0 {
+			return nil, errors.New(`multiple addresses are not supported over http`)
+		}
+		if c.handshake.enabled() {
+			return nil, errors.New(`handshake is not supported over http`)
+		}
+
+		c.http, err = newHTTPTransport(c.address, c.marshaler, c.dialFunc, c.tlsConfig, c.dialTimeout, c.writeTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.events.enabled() && (c.network == "http" || isDatagramNetwork(c.network)) {
+		return nil, errors.Errorf(`connection callbacks are not supported over %s`, c.network)
+	}
+
+	if isDatagramNetwork(c.network) {
+		if err := checkDatagramOptions(c.network, c.marshaler, c.tlsConfig, &c.handshake, c.tagPrefix); err != nil {
+			return nil, err
+		}
+	}
+
+	// There is no connection to establish upfront for HTTP
+	if connectOnStart && c.http == nil {
+		if _, err := c.connect(context.Background(), nil); err != nil {
 			return nil, errors.Wrap(err, `failed to connect on start`)
 		}
 	}
 
+	if expvarName != "" {
+		if err := publishExpvar(expvarName, c.Stats); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
 	return c, nil
 }
 
@@ -80,11 +255,13 @@ func (c *Unbuffered) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if c.http != nil {
+		c.http.close()
+	}
 	if c.conn == nil {
 		return nil
 	}
-	c.conn.Close()
-	c.conn = nil
+	c.closeConn(nil)
 	return nil
 }
 
@@ -95,23 +272,71 @@ func (c *Unbuffered) Shutdown(_ context.Context) error {
 	return c.Close()
 }
 
-func (c *Unbuffered) connect(force bool) (net.Conn, error) {
+// connect returns the cached connection, or establishes a new one. If
+// lost is non-nil, the cached connection is known to be broken, and it
+// is replaced regardless
+func (c *Unbuffered) connect(ctx context.Context, lost error) (net.Conn, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.conn != nil {
-		if !force {
+		expired := c.maxConnLifetime > 0 && time.Since(c.connectedAt) > c.maxConnLifetime
+		if lost == nil && !expired && !c.servers.rotate() {
 			return c.conn, nil
 		}
-		c.conn.Close()
+		c.closeConn(lost)
 	}
 
-	conn, err := dial(context.Background(), c.network, c.address, c.dialTimeout)
+	var address string
+	conn, err := c.servers.dial(ctx, func(ctx context.Context, a string) (net.Conn, error) {
+		address = a
+		return c.dialServer(ctx, a)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	c.conn = conn
+	c.connectedAt = time.Now()
+	c.lastAddress = address
+	if !c.lostAt.IsZero() {
+		c.counters.addReconnect()
+	}
+	c.events.connected(address, c.lostAt)
+	c.lostAt = time.Time{}
+	return conn, nil
+}
+
+// closeConn closes the cached connection. err is the reason why it is
+// being closed, or nil if we are simply done with it. c.mu must be held
+func (c *Unbuffered) closeConn(err error) {
+	c.conn.Close()
+	c.conn = nil
+	c.events.disconnected(c.lastAddress, err)
+	if err != nil {
+		c.lostAt = time.Now()
+	}
+}
+
+// dialServer connects to the server at address, and prepares the
+// connection for writing
+func (c *Unbuffered) dialServer(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := dial(ctx, c.dialFunc, c.tlsConfig, c.network, address, c.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setupConn(conn, &c.tcp, c.connectHook); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if c.handshake.enabled() {
+		if err := handshake(conn, &c.handshake, c.dialTimeout); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, `handshake failed`)
+		}
+	}
 	return conn, nil
 }
 
@@ -120,83 +345,296 @@ func (c *Unbuffered) connect(force bool) (net.Conn, error) {
 // If you would like to specify options to `Post()`, you may pass them at the
 // end of the method. Currently you can use the following:
 //
-//   fluent.WithTimestamp: allows you to set arbitrary timestamp values
+//	fluent.WithContext: specify context.Context to use
+//	fluent.WithPostTimeout: bounds the time that Post may block
+//	fluent.WithTimestamp: allows you to set arbitrary timestamp values
+//	fluent.WithForwardOption: adds an entry to the message option map
 //
+// The context bounds the time spent connecting to and writing to the
+// server.
 func (c *Unbuffered) Post(tag string, v interface{}, options ...Option) (err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("fluent.Unbuffered.Post").BindError(&err)
-		defer g.End()
-	}
+	c.counters.addPosted(1)
+	defer func() {
+		if err != nil {
+			c.counters.addDropped(1)
+		} else {
+			c.counters.addFlushed(1)
+		}
+	}()
 
 	var t time.Time
+	var ctx = context.Background()
+	var postTimeout = c.postTimeout
+	var fwdOptions map[string]interface{}
 	for _, opt := range options {
 		switch opt.Name() {
+		case optkeyContext:
+			ctx = opt.Value().(context.Context)
+		case optkeyForwardOption:
+			fwdOptions, err = addForwardOption(fwdOptions, opt.Value().(*forwardOption))
+			if err != nil {
+				return errors.Wrap(err, `invalid option`)
+			}
+		case optkeyPostTimeout:
+			postTimeout = opt.Value().(time.Duration)
 		case optkeyTimestamp:
 			t = opt.Value().(time.Time)
 		}
 	}
 
+	if postTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, postTimeout)
+		defer cancel()
+	}
+
+	if f := c.timeExtractor; f != nil {
+		if extracted, ok := f(v); ok {
+			t = extracted
+		}
+	}
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock()
 	}
 
-	msg := makeMessage(tag, v, t, c.subsecond, false)
+	msg := makeMessage(tag, v, t, c.resolution, false)
 	defer releaseMessage(msg)
+	if fwdOptions != nil {
+		msg.Option = fwdOptions
+	}
+	if f := c.recordModifier; f != nil {
+		msg.Record = f(msg.Tag, msg.Record)
+	}
+	if p := c.tagPrefix; len(p) > 0 {
+		msg.Tag = p + "." + msg.Tag
+	}
 
-	serialized, err := c.marshaler.Marshal(msg)
+	if c.http != nil {
+		var body []byte
+		body, err = c.http.marshaler.MarshalRecord(msg.Record)
+		if err != nil {
+			return errors.Wrap(err, `failed to serialize payload`)
+		}
+		if !c.breaker.allow() {
+			return &circuitOpenErrInstance
+		}
+		start := time.Now()
+		err = c.http.post(ctx, msg.Tag, msg.Time.Time, msg.subsecond, body)
+		if err == nil {
+			c.counters.observeWrite(time.Since(start))
+		}
+		c.setLastError(err)
+		c.breaker.record(err)
+		return err
+	}
+
+	datagram := isDatagramNetwork(c.network)
+	var serialized []byte
+	if datagram {
+		serialized, err = c.marshaler.(recordMarshaler).MarshalRecord(msg.Record)
+	} else {
+		serialized, err = c.marshaler.Marshal(msg)
+	}
 	if err != nil {
 		return errors.Wrap(err, `failed to serialize payload`)
 	}
+	if c.lengthPrefix && !datagram {
+		serialized, err = addLengthPrefix(serialized)
+		if err != nil {
+			return errors.Wrap(err, `failed to serialize payload`)
+		}
+	}
+
+	if !c.breaker.allow() {
+		return &circuitOpenErrInstance
+	}
+
+	// From here on, the outcome reflects the health of the connection
+	defer func() {
+		c.setLastError(err)
+		c.breaker.record(err)
+	}()
 
 	var attempt uint64
 WRITE:
 	attempt++
-	if pdebug.Enabled {
-		pdebug.Printf("Attempt %d/%d", attempt, c.maxConnAttempts)
-	}
 	payload := serialized
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
 	if attempt > c.maxConnAttempts {
+		if err != nil {
+			// err holds the reason why the last attempt to connect failed
+			return errors.Wrap(err, `exceeded max connection attempts`)
+		}
 		return errors.New(`exceeded max connection attempts`)
 	}
+	if attempt > 1 {
+		c.counters.addRetry()
+		c.logger.Warn("failed to write, trying again", "attempt", attempt, "error", err)
+	}
 
-	conn, err := c.connect(attempt > 1)
+	// err holds the reason why the last attempt failed, if any
+	conn, err := c.connect(ctx, err)
 	if err != nil {
 		goto WRITE
 	}
-	if pdebug.Enabled {
-		pdebug.Printf("Successfully connected to server")
-	}
 
-	if pdebug.Enabled {
-		pdebug.Printf("Going to write %d bytes", len(payload))
+	start := time.Now()
+	setWriteDeadline(conn, contextTimeout(ctx, c.writeTimeout))
+
+	// A datagram that cannot be sent is not worth sending again
+	if datagram {
+		if err := writeDatagram(conn, payload); err != nil {
+			return err
+		}
+		c.counters.observeWrite(time.Since(start))
+		return nil
 	}
 
 	for len(payload) > 0 {
-		n, err := conn.Write(payload)
-		if err != nil {
-			if err == io.EOF {
+		n, werr := conn.Write(payload)
+		if werr != nil {
+			if werr == io.EOF {
+				err = werr
 				goto WRITE // Try again
 			}
 
-			return errors.Wrap(err, `failed to write serialized payload`)
-		}
-		if pdebug.Enabled {
-			pdebug.Printf("Wrote %d bytes", n)
+			return errors.Wrap(werr, `failed to write serialized payload`)
 		}
 		payload = payload[n:]
 	}
 
 	// All done!
+	c.counters.observeWrite(time.Since(start))
 	return nil
 }
 
+// PostAll posts each of the entries in turn, as the unbuffered client
+// has no buffer to append them to as a unit. The entries that cannot be
+// written do not stop the others; they are described by the *BatchError
+// that is returned, which maps their indices to their errors.
+func (c *Unbuffered) PostAll(entries []Entry, options ...Option) error {
+	var batchErr *BatchError
+	for i, entry := range entries {
+		opts := options
+		if !entry.Time.IsZero() {
+			opts = append(opts[:len(opts):len(opts)], WithTimestamp(entry.Time))
+		}
+		if err := c.Post(entry.Tag, entry.Record, opts...); err != nil {
+			if batchErr == nil {
+				batchErr = &BatchError{Errors: make(map[int]error)}
+			}
+			batchErr.Errors[i] = err
+		}
+	}
+	if batchErr != nil {
+		return batchErr
+	}
+	return nil
+}
+
+// PostWithContext is the same as Post with WithContext(ctx)
+func (c *Unbuffered) PostWithContext(ctx context.Context, tag string, v interface{}, options ...Option) error {
+	return c.Post(tag, v, append(options[:len(options):len(options)], WithContext(ctx))...)
+}
+
+// PostRaw posts a record that has already been serialized (see
+// RawRecord), skipping the marshaling step. It is the same as Post with
+// RawRecord(raw) and WithTimestamp(t). If t is the zero value, the
+// current time is used.
+func (c *Unbuffered) PostRaw(tag string, t time.Time, raw []byte, options ...Option) error {
+	if len(raw) == 0 {
+		return errors.New(`empty raw record`)
+	}
+	return c.Post(tag, RawRecord(raw), append(options[:len(options):len(options)], WithTimestamp(t))...)
+}
+
+// Writer returns an io.WriteCloser that posts each line that is written
+// to it as a record of the form {"message": line}, using the given tag
+// and options. fluent.WithWriterFields adds fields to every record. The
+// writer can be given to log.SetOutput, for example. Closing it posts the
+// last line, if it was not terminated by a newline, but does not close
+// the client.
+func (c *Unbuffered) Writer(tag string, options ...Option) io.WriteCloser {
+	return newLineWriter(c, tag, options)
+}
+
+// LastError returns the error from the most recent attempt to write a
+// message to the server via Post, or nil if it succeeded. Errors that
+// occur while serializing the message are not recorded.
+func (c *Unbuffered) LastError() error {
+	c.muLastError.RLock()
+	defer c.muLastError.RUnlock()
+	return c.lastError
+}
+
+// closedErrors is returned by Unbuffered.Errors
+var closedErrors = func() chan PostError {
+	ch := make(chan PostError)
+	close(ch)
+	return ch
+}()
+
+// Errors returns a closed channel. The unbuffered client returns all
+// errors from the method that posts the message, so there is nothing to
+// receive; it is provided to satisfy the Client interface.
+func (c *Unbuffered) Errors() <-chan PostError {
+	return closedErrors
+}
+
+// Stats returns a snapshot of the activity of the client. Every message
+// that is posted is either flushed or dropped by the time Post returns,
+// so Queued, PendingBytes and InflightBytes are always 0.
+func (c *Unbuffered) Stats() Stats {
+	s := c.counters.snapshot()
+	s.LastError = c.LastError()
+	return s
+}
+
+func (c *Unbuffered) setLastError(err error) {
+	c.muLastError.Lock()
+	c.lastError = err
+	c.muLastError.Unlock()
+}
+
+// PostAsync is provided for compatibility with the buffered client.
+// Because an unbuffered client writes the message synchronously, the
+// returned Result has already been notified of the outcome by the time
+// this method returns.
+func (c *Unbuffered) PostAsync(tag string, v interface{}, options ...Option) (result *Result, err error) {
+	result = newResult()
+	perr := c.Post(tag, v, options...)
+	notifyFlush(result.appended, perr)
+	notifyFlush(result.ch, perr)
+	return result, nil
+}
+
+// Flush does nothing, as the messages are written to the server by Post
+// itself. It only exists to satisfy the Client interface
+func (c *Unbuffered) Flush(ctx context.Context) error {
+	return nil
+}
+
+// IsConnected reports whether the client has a cached connection to the
+// server. A connection is only established by Post (or on start, see
+// WithConnectOnStart), and if the server closes it, this is noticed the
+// next time a message is written. For an active check, use Ping.
+//
+// Over http and datagram networks, there is no connection to speak of,
+// and false is always returned. Use LastError instead.
+func (c *Unbuffered) IsConnected() bool {
+	if isDatagramNetwork(c.network) {
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn != nil
+}
+
 // Ping sends a ping message. A ping for an unbuffered client is completely
 // analogous to sending a message with Post
 func (c *Unbuffered) Ping(tag string, v interface{}, options ...Option) (err error) {
-	if pdebug.Enabled {
-		g := pdebug.Marker("fluent.Unbuffered.Ping").BindError(&err)
-		defer g.End()
-	}
-
 	return c.Post(tag, v, options...)
 }
@@ -0,0 +1,116 @@
+package fluent
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxLineSize is the size beyond which a line that has not been
+// terminated yet is posted anyway, so that a writer that never emits a
+// newline does not make the line buffer grow without bounds
+const maxLineSize = 64 * 1024
+
+// lineWriter is the io.WriteCloser returned by Writer. It posts each
+// line that is written to it as a record of its own
+type lineWriter struct {
+	client  Client
+	closed  bool
+	fields  map[string]interface{}
+	line    []byte
+	mu      sync.Mutex
+	options []Option
+	tag     string
+}
+
+// NewWriter returns the io.WriteCloser that Client.Writer returns, for
+// implementations of Client other than the ones in this package
+func NewWriter(client Client, tag string, options ...Option) io.WriteCloser {
+	return newLineWriter(client, tag, options)
+}
+
+func newLineWriter(client Client, tag string, options []Option) *lineWriter {
+	w := &lineWriter{
+		client: client,
+		tag:    tag,
+	}
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyWriterFields:
+			w.fields = opt.Value().(map[string]interface{})
+		default:
+			w.options = append(w.options, opt)
+		}
+	}
+	return w
+}
+
+// Write splits p into lines, and posts each of them as a record of the
+// form {"message": line}, along with the fields given by
+// WithWriterFields, if any. An incomplete line is kept until the rest of
+// it is written, or until Close is called.
+//
+// If the client fails to post a line, the error is returned, and the line
+// is discarded
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errors.New(`writer has been closed`)
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			if len(w.line) < maxLineSize {
+				break
+			}
+			p = nil
+		} else {
+			w.line = append(w.line, p[:i]...)
+			p = p[i+1:]
+		}
+
+		if err := w.postLine(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// postLine posts the line that has been accumulated so far. Empty lines
+// are skipped
+func (w *lineWriter) postLine() error {
+	line := bytes.TrimSuffix(w.line, []byte{'\r'})
+	w.line = w.line[:0]
+	if len(line) == 0 {
+		return nil
+	}
+
+	record := make(map[string]interface{}, len(w.fields)+1)
+	for k, v := range w.fields {
+		record[k] = v
+	}
+	record["message"] = string(line)
+	if err := w.client.Post(w.tag, record, w.options...); err != nil {
+		return errors.Wrap(err, `failed to post line`)
+	}
+	return nil
+}
+
+// Close posts the incomplete line, if any. It does not close the client
+func (w *lineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.postLine()
+}